@@ -0,0 +1,490 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cachefs caches the file content of a slow file system,
+// such as a network file system, in a local directory.
+//
+// Content is cached in blocks as it is read, and kept across
+// restarts. Cached files are identified by path, and the cache is
+// validated against the attributes of the backing file when a file
+// is opened, and when its attributes are read. Writes go to the
+// backing file, and update the blocks that are cached.
+//
+// The cache is an interceptor for the backing file system:
+//
+//	c, err := cachefs.New(&cachefs.Options{Dir: cacheDir})
+//	...
+//	server, err := fs.Mount(mnt, root, &fs.Options{
+//		Interceptors: []fs.Interceptor{c.Intercept},
+//	})
+package cachefs
+
+import (
+	"container/list"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Options holds the parameters for New.
+type Options struct {
+	// Dir is the directory to store the cache in. It is created
+	// if it does not exist.
+	Dir string
+
+	// BlockSize is the size of cached blocks. If zero, 128 kb is
+	// used. Changing the block size discards the content that
+	// is cached.
+	BlockSize int
+
+	// MaxSize is the maximum number of bytes of content to
+	// cache. If zero, 1 Gb is used. When the cache is full, the
+	// least recently used blocks are evicted.
+	MaxSize int64
+
+	// Validate reports whether the content cached for the file
+	// at `path`, cached when it had attributes `cached`, can be
+	// used now that it has attributes `current`. If nil, the
+	// content is used if the size and modification time are
+	// unchanged.
+	Validate func(path string, cached, current *fuse.Attr) bool
+}
+
+// Cache caches the content of the file system it intercepts.
+type Cache struct {
+	dir       string
+	blockSize int
+	maxSize   int64
+	validate  func(path string, cached, current *fuse.Attr) bool
+
+	// mu protects the bookkeeping. Block content is read and
+	// written without holding it.
+	mu      sync.Mutex
+	entries map[string]*entry
+	lru     *list.List
+	size    int64
+}
+
+// New returns a Cache. Mount the file system to cache with
+// Cache.Intercept as an interceptor. The content that was cached by
+// an earlier Cache with the same directory is reused. A Cache should
+// be used for a single mount.
+func New(opts *Options) (*Cache, error) {
+	c := &Cache{
+		dir:       opts.Dir,
+		blockSize: opts.BlockSize,
+		maxSize:   opts.MaxSize,
+		validate:  opts.Validate,
+		entries:   map[string]*entry{},
+		lru:       list.New(),
+	}
+	if c.blockSize == 0 {
+		c.blockSize = 128 << 10
+	}
+	if c.maxSize == 0 {
+		c.maxSize = 1 << 30
+	}
+	if c.validate == nil {
+		c.validate = sameSizeAndMtime
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func sameSizeAndMtime(path string, cached, current *fuse.Attr) bool {
+	return cached.Size == current.Size &&
+		cached.Mtime == current.Mtime &&
+		cached.Mtimensec == current.Mtimensec
+}
+
+// Size returns the number of bytes of content that is cached.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Invalidate discards the content cached for `path`, and for the
+// files below it if it is a directory.
+func (c *Cache) Invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropPath(path)
+}
+
+// dropPath discards the content cached for `path` and the files
+// below it. It must be called with c.mu held.
+func (c *Cache) dropPath(path string) {
+	path = filepath.Clean(path)
+	for p, e := range c.entries {
+		if p == path || path == "." || strings.HasPrefix(p, path+"/") {
+			c.dropEntry(e)
+		}
+	}
+}
+
+// bypassKey marks the context of calls made by the cache itself,
+// which go straight to the backing file system.
+type bypassKey struct{}
+
+func bypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassKey{}, true)
+}
+
+// nodePath returns the path that identifies the content of `n`. It
+// returns false for files that are no longer in the tree.
+func nodePath(n *fs.Inode) (string, bool) {
+	p := n.Path(nil)
+	if p == "" && !n.IsRoot() {
+		return "", false
+	}
+	return p, true
+}
+
+// Intercept is the fs.Interceptor that does the caching.
+func (c *Cache) Intercept(ctx context.Context, op *fs.InterceptedOp, next func(ctx context.Context) syscall.Errno) syscall.Errno {
+	if ctx.Value(bypassKey{}) != nil {
+		return next(ctx)
+	}
+
+	switch op.Name {
+	case "Read":
+		return c.read(ctx, op, next)
+	case "Getattr":
+		errno := next(ctx)
+		if errno == 0 {
+			out := op.Args[1].(*fuse.AttrOut)
+			c.check(op.Node, &out.Attr, false)
+		}
+		return errno
+	case "Open":
+		errno := next(ctx)
+		if errno == 0 {
+			flags := op.Args[0].(uint32)
+			f, _ := op.Results[0].(fs.FileHandle)
+			c.opened(ctx, op, f, flags)
+		}
+		return errno
+	case "Write", "Setattr", "Allocate":
+		return c.modify(ctx, op, next)
+	case "CopyFileRange":
+		errno := next(ctx)
+		if errno == 0 {
+			c.invalidate(op.Args[2].(*fs.Inode))
+		}
+		return errno
+	case "Create", "Unlink", "Rmdir":
+		errno := next(ctx)
+		if p, ok := nodePath(op.Node); ok && errno == 0 {
+			c.Invalidate(filepath.Join(p, op.Args[0].(string)))
+		}
+		return errno
+	case "Rename":
+		errno := next(ctx)
+		if p, ok := nodePath(op.Node); ok && errno == 0 {
+			c.Invalidate(filepath.Join(p, op.Args[0].(string)))
+		}
+		newParent := op.Args[1].(fs.InodeEmbedder).EmbeddedInode()
+		if p, ok := nodePath(newParent); ok && errno == 0 {
+			c.Invalidate(filepath.Join(p, op.Args[2].(string)))
+		}
+		return errno
+	}
+	return next(ctx)
+}
+
+// check validates the cached content of `n` against its current
+// attributes. It adds an entry for `n` if `create` is set.
+func (c *Cache) check(n *fs.Inode, attr *fuse.Attr, create bool) *entry {
+	if attr.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil
+	}
+	p, ok := nodePath(n)
+	if !ok {
+		return nil
+	}
+
+	c.mu.Lock()
+	e := c.entries[p]
+	c.mu.Unlock()
+	if e == nil && !create {
+		return nil
+	}
+	if e != nil {
+		// Do not mistake the changes of an ongoing write for
+		// changes to the backing file.
+		e.writeMu.Lock()
+		defer e.writeMu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e = c.lookup(p, attr)
+	if !c.validate(p, &e.attr, attr) {
+		c.dropBlocks(e, 0)
+	}
+	if e.attr != *attr {
+		e.attr = *attr
+		if len(e.blocks) > 0 {
+			c.writeMeta(e)
+		}
+	}
+	e.checked = true
+	return e
+}
+
+// getattr fetches the attributes of the node of `op` from the
+// backing file system.
+func getattr(ctx context.Context, op *fs.InterceptedOp, f fs.FileHandle) (*fuse.Attr, syscall.Errno) {
+	var out fuse.AttrOut
+	if errno := op.Handler.(fs.NodeGetattrer).Getattr(bypass(ctx), f, &out); errno != 0 {
+		return nil, errno
+	}
+	return &out.Attr, 0
+}
+
+// opened validates the cache when a file is opened.
+func (c *Cache) opened(ctx context.Context, op *fs.InterceptedOp, f fs.FileHandle, flags uint32) {
+	if flags&syscall.O_TRUNC != 0 {
+		c.invalidate(op.Node)
+	}
+	if attr, errno := getattr(ctx, op, f); errno == 0 {
+		c.check(op.Node, attr, true)
+	}
+}
+
+// invalidate discards the content cached for `n`.
+func (c *Cache) invalidate(n *fs.Inode) {
+	if p, ok := nodePath(n); ok {
+		c.Invalidate(p)
+	}
+}
+
+// entry returns the validated entry for the node of `op`.
+func (c *Cache) entry(ctx context.Context, op *fs.InterceptedOp, f fs.FileHandle) *entry {
+	p, ok := nodePath(op.Node)
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	e := c.entries[p]
+	checked := e != nil && e.checked
+	c.mu.Unlock()
+	if checked {
+		return e
+	}
+	attr, errno := getattr(ctx, op, f)
+	if errno != 0 {
+		return nil
+	}
+	return c.check(op.Node, attr, true)
+}
+
+func (c *Cache) read(ctx context.Context, op *fs.InterceptedOp, next func(ctx context.Context) syscall.Errno) syscall.Errno {
+	f, _ := op.Args[0].(fs.FileHandle)
+	dest := op.Args[1].([]byte)
+	off := op.Args[2].(int64)
+
+	e := c.entry(ctx, op, f)
+	if e == nil {
+		return next(ctx)
+	}
+	c.mu.Lock()
+	size := int64(e.attr.Size)
+	c.mu.Unlock()
+
+	end := off + int64(len(dest))
+	if end > size {
+		end = size
+	}
+	if off >= end {
+		op.Results = []interface{}{fuse.ReadResultData(nil)}
+		return 0
+	}
+
+	bs := int64(c.blockSize)
+	for idx := off / bs; idx*bs < end; idx++ {
+		data, errno := c.block(ctx, op, f, e, idx, size)
+		if errno != 0 {
+			return errno
+		}
+		start := idx * bs
+		lo, hi := int64(0), int64(len(data))
+		if off > start {
+			lo = off - start
+		}
+		if end < start+hi {
+			hi = end - start
+		}
+		if lo >= hi {
+			// The backing file is shorter than it was.
+			end = start + lo
+			break
+		}
+		copy(dest[start+lo-off:], data[lo:hi])
+	}
+	op.Results = []interface{}{fuse.ReadResultData(dest[:end-off])}
+	return 0
+}
+
+// block returns block `idx` of the file, which has size `size`,
+// from the cache or from the backing file.
+func (c *Cache) block(ctx context.Context, op *fs.InterceptedOp, f fs.FileHandle, e *entry, idx, size int64) ([]byte, syscall.Errno) {
+	bs := int64(c.blockSize)
+	complete := func(data []byte) bool {
+		return int64(len(data)) == bs || idx*bs+int64(len(data)) == size
+	}
+	if data, ok := c.cachedBlock(e, idx); ok && complete(data) {
+		return data, 0
+	}
+
+	c.mu.Lock()
+	gen := e.gen
+	c.mu.Unlock()
+
+	buf := make([]byte, bs)
+	res, errno := op.Handler.(fs.NodeReader).Read(bypass(ctx), f, buf, idx*bs)
+	if errno != 0 {
+		return nil, errno
+	}
+	data, status := res.Bytes(buf)
+	res.Done()
+	if !status.Ok() {
+		return nil, syscall.Errno(status)
+	}
+	if complete(data) {
+		c.storeBlock(e, gen, idx, data)
+	}
+	return data, 0
+}
+
+// modify runs an operation that changes the content of a file, and
+// updates the cache accordingly.
+func (c *Cache) modify(ctx context.Context, op *fs.InterceptedOp, next func(ctx context.Context) syscall.Errno) syscall.Errno {
+	p, ok := nodePath(op.Node)
+	if !ok {
+		return next(ctx)
+	}
+	c.mu.Lock()
+	e := c.entries[p]
+	c.mu.Unlock()
+	if e == nil {
+		return next(ctx)
+	}
+
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	// Blocks fetched while the operation runs may or may not
+	// have its changes.
+	c.mu.Lock()
+	e.gen++
+	c.mu.Unlock()
+	errno := next(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.gen++
+	if c.entries[p] != e {
+		return errno
+	}
+	if errno != 0 {
+		c.dropEntry(e)
+		return errno
+	}
+
+	f, _ := op.Args[0].(fs.FileHandle)
+	wantSize := e.attr.Size
+	switch op.Name {
+	case "Write":
+		data := op.Args[1].([]byte)
+		off := op.Args[2].(int64)
+		written, _ := op.Results[0].(uint32)
+		gen := e.gen
+		c.mu.Unlock()
+		c.patch(e, gen, off, data[:written])
+		c.mu.Lock()
+		if c.entries[p] != e {
+			return errno
+		}
+		if end := uint64(off) + uint64(written); end > wantSize {
+			wantSize = end
+		}
+	case "Setattr":
+		in := op.Args[1].(*fuse.SetAttrIn)
+		if sz, ok := in.GetSize(); ok {
+			c.dropBlocks(e, int64(sz)/int64(c.blockSize))
+			wantSize = sz
+		}
+	default:
+		c.dropEntry(e)
+		return errno
+	}
+
+	// Our own changes are not a reason to discard the cache.
+	c.mu.Unlock()
+	attr, aerr := getattr(ctx, op, f)
+	c.mu.Lock()
+	if c.entries[p] != e {
+		return errno
+	}
+	if aerr != 0 || attr.Size != wantSize {
+		// Someone else changed the file too, or the write
+		// went elsewhere, eg. because of O_APPEND.
+		c.dropEntry(e)
+		return errno
+	}
+	e.attr = *attr
+	if len(e.blocks) > 0 {
+		c.writeMeta(e)
+	}
+	return errno
+}
+
+// patch applies a write to the cached blocks, if the file has not
+// changed since generation `gen`. It must be called with e.writeMu
+// held, and c.mu not held.
+func (c *Cache) patch(e *entry, gen uint64, off int64, data []byte) {
+	bs := int64(c.blockSize)
+	end := off + int64(len(data))
+	for idx := off / bs; idx*bs < end; idx++ {
+		c.mu.Lock()
+		_, ok := e.blocks[idx]
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+		old, err := ioutil.ReadFile(e.blockPath(idx))
+		if err != nil {
+			c.mu.Lock()
+			c.dropBlock(e, idx)
+			c.mu.Unlock()
+			continue
+		}
+		start := idx * bs
+		lo, hi := int64(0), bs
+		if off > start {
+			lo = off - start
+		}
+		if end < start+hi {
+			hi = end - start
+		}
+		blk := old
+		if int64(len(blk)) < hi {
+			// Past the end of file, which reads as zeros.
+			blk = make([]byte, hi)
+			copy(blk, old)
+		}
+		copy(blk[lo:hi], data[start+lo-off:])
+		c.putBlock(e, gen, idx, blk)
+	}
+}
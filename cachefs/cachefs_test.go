@@ -0,0 +1,271 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cachefs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+const testBlockSize = 64 << 10
+
+type testCase struct {
+	*testing.T
+
+	dir   string
+	orig  string
+	mnt   string
+	cache string
+
+	// reads counts the reads of the backing file system.
+	reads int64
+}
+
+func newTestCase(t *testing.T) (*testCase, func()) {
+	tc := &testCase{T: t, dir: testutil.TempDir()}
+	tc.orig = tc.dir + "/orig"
+	tc.mnt = tc.dir + "/mnt"
+	tc.cache = tc.dir + "/cache"
+	for _, d := range []string{tc.orig, tc.mnt} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tc, func() {
+		os.RemoveAll(tc.dir)
+	}
+}
+
+// mount mounts the backing directory with a new Cache, as if the
+// file system were restarted.
+func (tc *testCase) mount(opts Options) (*Cache, func()) {
+	loopback, err := fs.NewLoopbackRoot(tc.orig)
+	if err != nil {
+		tc.Fatal(err)
+	}
+	count := func(ctx context.Context, op *fs.InterceptedOp, next func(ctx context.Context) syscall.Errno) syscall.Errno {
+		if op.Name == "Read" {
+			atomic.AddInt64(&tc.reads, 1)
+		}
+		return next(ctx)
+	}
+
+	opts.Dir = tc.cache
+	if opts.BlockSize == 0 {
+		opts.BlockSize = testBlockSize
+	}
+	c, err := New(&opts)
+	if err != nil {
+		tc.Fatal(err)
+	}
+	// The counting interceptor runs after the cache, so it only
+	// sees the reads of the backing file system.
+	mountOpts := &fs.Options{
+		Interceptors: []fs.Interceptor{c.Intercept, count},
+	}
+	mountOpts.Debug = testutil.VerboseTest()
+	server, err := fs.Mount(tc.mnt, loopback, mountOpts)
+	if err != nil {
+		tc.Fatal(err)
+	}
+	atomic.StoreInt64(&tc.reads, 0)
+	return c, func() {
+		if err := server.Unmount(); err != nil {
+			tc.Fatal(err)
+		}
+	}
+}
+
+func (tc *testCase) backingReads() int64 {
+	return atomic.LoadInt64(&tc.reads)
+}
+
+func (tc *testCase) readFile(name string, want []byte) {
+	tc.Helper()
+	got, err := ioutil.ReadFile(filepath.Join(tc.mnt, name))
+	if err != nil {
+		tc.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		tc.Fatalf("%s: got %d bytes, want %d bytes, contents differ", name, len(got), len(want))
+	}
+}
+
+func testData(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7) + seed
+	}
+	return data
+}
+
+func TestPersist(t *testing.T) {
+	tc, clean := newTestCase(t)
+	defer clean()
+
+	data := testData(5*testBlockSize/2, 1)
+	if err := ioutil.WriteFile(tc.orig+"/file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, unmount := tc.mount(Options{})
+	tc.readFile("file", data)
+	if tc.backingReads() == 0 {
+		t.Errorf("first read was not passed through")
+	}
+	if got := c.Size(); got != int64(len(data)) {
+		t.Errorf("got cache size %d, want %d", got, len(data))
+	}
+	unmount()
+
+	c, unmount = tc.mount(Options{})
+	defer unmount()
+	if got := c.Size(); got != int64(len(data)) {
+		t.Errorf("after restart: got cache size %d, want %d", got, len(data))
+	}
+	tc.readFile("file", data)
+	if got := tc.backingReads(); got != 0 {
+		t.Errorf("got %d backing reads, want 0", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tc, clean := newTestCase(t)
+	defer clean()
+
+	data := testData(testBlockSize, 1)
+	if err := ioutil.WriteFile(tc.orig+"/file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, unmount := tc.mount(Options{})
+	tc.readFile("file", data)
+	unmount()
+
+	// Changed behind the back of the cache.
+	data = testData(testBlockSize+10, 2)
+	if err := ioutil.WriteFile(tc.orig+"/file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, unmount = tc.mount(Options{})
+	tc.readFile("file", data)
+	if tc.backingReads() == 0 {
+		t.Errorf("stale content was not refetched")
+	}
+	unmount()
+
+	// A hook that accepts anything returns stale content.
+	if err := ioutil.WriteFile(tc.orig+"/file", testData(100, 3), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	_, unmount = tc.mount(Options{
+		Validate: func(path string, cached, current *fuse.Attr) bool {
+			paths = append(paths, path)
+			return true
+		},
+	})
+	defer unmount()
+	f, err := os.Open(tc.mnt + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 100)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data[:100]) {
+		t.Errorf("Validate hook was ignored")
+	}
+	if len(paths) == 0 || paths[0] != "file" {
+		t.Errorf("got Validate calls for %q, want \"file\"", paths)
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	tc, clean := newTestCase(t)
+	defer clean()
+
+	data := testData(2*testBlockSize, 1)
+	if err := ioutil.WriteFile(tc.orig+"/file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, unmount := tc.mount(Options{})
+	tc.readFile("file", data)
+
+	f, err := os.OpenFile(tc.mnt+"/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Straddles the blocks, and extends the file.
+	for _, off := range []int{testBlockSize - 2, 2*testBlockSize - 1} {
+		if _, err := f.WriteAt([]byte("hello"), int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if end := off + 5; end > len(data) {
+			data = append(data, make([]byte, end-len(data))...)
+		}
+		copy(data[off:], "hello")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(tc.orig + "/file"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Errorf("write did not reach the backing file")
+	}
+	unmount()
+
+	_, unmount = tc.mount(Options{})
+	defer unmount()
+	tc.readFile("file", data)
+	if got := tc.backingReads(); got != 1 {
+		// The last block now has more data.
+		t.Errorf("got %d backing reads, want 1", got)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	tc, clean := newTestCase(t)
+	defer clean()
+
+	files := map[string][]byte{}
+	for i, name := range []string{"a", "b", "c"} {
+		files[name] = testData(testBlockSize, byte(i))
+		if err := ioutil.WriteFile(tc.orig+"/"+name, files[name], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, unmount := tc.mount(Options{MaxSize: 2 * testBlockSize})
+	for _, name := range []string{"a", "b", "c"} {
+		tc.readFile(name, files[name])
+	}
+	if got, want := c.Size(), int64(2*testBlockSize); got != want {
+		t.Errorf("got cache size %d, want %d", got, want)
+	}
+	unmount()
+
+	_, unmount = tc.mount(Options{MaxSize: 2 * testBlockSize})
+	defer unmount()
+	for _, name := range []string{"b", "c", "a"} {
+		atomic.StoreInt64(&tc.reads, 0)
+		tc.readFile(name, files[name])
+		if got, want := tc.backingReads() > 0, name == "a"; got != want {
+			t.Errorf("%s: got backing reads %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cachefs
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// The cache directory holds a directory for every cached file, named
+// by the SHA-256 of its path and fanned out over subdirectories by
+// the first two hex digits. It contains a metadata file and a file
+// for every cached block, named by the block index.
+const metaName = "meta"
+
+// meta is the metadata of a cached file, as stored on disk.
+type meta struct {
+	Path      string
+	BlockSize int
+	Attr      fuse.Attr
+}
+
+// entry is a cached file. Its fields are protected by Cache.mu,
+// except for writeMu.
+type entry struct {
+	path string
+	dir  string
+	attr fuse.Attr
+
+	// checked is set once the attributes have been validated
+	// against the backing file by this process.
+	checked bool
+
+	// gen is incremented when the content may have changed, so
+	// blocks that were fetched before are not stored.
+	gen uint64
+
+	// blocks has an LRU element for every cached block.
+	blocks map[int64]*list.Element
+
+	// writeMu serializes writes and validations.
+	writeMu sync.Mutex
+}
+
+// block is the value of the elements of the LRU list.
+type block struct {
+	e    *entry
+	idx  int64
+	size int64
+}
+
+func (e *entry) blockPath(idx int64) string {
+	return filepath.Join(e.dir, strconv.FormatInt(idx, 10))
+}
+
+func (c *Cache) newEntry(path string, attr *fuse.Attr) *entry {
+	sum := sha256.Sum256([]byte(path))
+	key := hex.EncodeToString(sum[:])
+	return &entry{
+		path:   path,
+		dir:    filepath.Join(c.dir, key[:2], key),
+		attr:   *attr,
+		blocks: map[int64]*list.Element{},
+	}
+}
+
+// writeMeta stores the metadata of `e`. It must be called with c.mu
+// held.
+func (c *Cache) writeMeta(e *entry) error {
+	data, err := json.Marshal(&meta{
+		Path:      e.path,
+		BlockSize: c.blockSize,
+		Attr:      e.attr,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(e.dir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(e.dir, metaName), data)
+}
+
+// writeTemp writes `data` to a new temporary file in `dir`, and
+// returns its name.
+func writeTemp(dir string, data []byte) (string, error) {
+	f, err := ioutil.TempFile(dir, ".tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// writeFileAtomic writes a file, so it is either completely written,
+// or not at all.
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := writeTemp(filepath.Dir(name), data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// load reads the cache directory. Blocks are put in the LRU list in
+// order of modification time.
+func (c *Cache) load() error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	fanout, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	type loaded struct {
+		block
+		mtime time.Time
+	}
+	var blocks []loaded
+	for _, fo := range fanout {
+		if !fo.IsDir() {
+			continue
+		}
+		dirs, err := ioutil.ReadDir(filepath.Join(c.dir, fo.Name()))
+		if err != nil {
+			return err
+		}
+		for _, d := range dirs {
+			dir := filepath.Join(c.dir, fo.Name(), d.Name())
+			e := c.loadEntry(dir)
+			if e == nil {
+				os.RemoveAll(dir)
+				continue
+			}
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				return err
+			}
+			for _, f := range files {
+				idx, err := strconv.ParseInt(f.Name(), 10, 64)
+				if err != nil {
+					if f.Name() != metaName {
+						// Left over from a crash.
+						os.Remove(filepath.Join(dir, f.Name()))
+					}
+					continue
+				}
+				blocks = append(blocks, loaded{block{e, idx, f.Size()}, f.ModTime()})
+			}
+			c.entries[e.path] = e
+		}
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].mtime.After(blocks[j].mtime)
+	})
+	for i := range blocks {
+		b := blocks[i].block
+		b.e.blocks[b.idx] = c.lru.PushBack(&b)
+		c.size += b.size
+	}
+	for _, e := range c.entries {
+		if len(e.blocks) == 0 {
+			c.dropEntry(e)
+		}
+	}
+	c.evict()
+	return nil
+}
+
+// loadEntry reads the metadata in `dir`. It returns nil if the
+// metadata is unusable.
+func (c *Cache) loadEntry(dir string) *entry {
+	data, err := ioutil.ReadFile(filepath.Join(dir, metaName))
+	if err != nil {
+		return nil
+	}
+	var m meta
+	if err := json.Unmarshal(data, &m); err != nil || m.BlockSize != c.blockSize {
+		return nil
+	}
+	e := c.newEntry(m.Path, &m.Attr)
+	if e.dir != dir {
+		return nil
+	}
+	return e
+}
+
+// lookup returns the entry for `path`, creating it with attributes
+// `attr` if needed. It must be called with c.mu held.
+func (c *Cache) lookup(path string, attr *fuse.Attr) *entry {
+	e := c.entries[path]
+	if e == nil {
+		e = c.newEntry(path, attr)
+		e.checked = true
+		c.entries[path] = e
+	}
+	return e
+}
+
+// dropBlock removes a cached block. It must be called with c.mu held.
+func (c *Cache) dropBlock(e *entry, idx int64) {
+	el, ok := e.blocks[idx]
+	if !ok {
+		return
+	}
+	c.lru.Remove(el)
+	c.size -= el.Value.(*block).size
+	delete(e.blocks, idx)
+	os.Remove(e.blockPath(idx))
+}
+
+// dropBlocks removes the blocks from index `from` onwards, and
+// invalidates blocks that are being fetched. It must be called with
+// c.mu held.
+func (c *Cache) dropBlocks(e *entry, from int64) {
+	for idx := range e.blocks {
+		if idx >= from {
+			c.dropBlock(e, idx)
+		}
+	}
+	e.gen++
+}
+
+// dropEntry removes a file from the cache. It must be called with
+// c.mu held.
+func (c *Cache) dropEntry(e *entry) {
+	c.dropBlocks(e, 0)
+	if c.entries[e.path] == e {
+		delete(c.entries, e.path)
+	}
+	os.RemoveAll(e.dir)
+}
+
+// storeBlock adds a block fetched from the backing file, if the file
+// has not changed since generation `gen`.
+func (c *Cache) storeBlock(e *entry, gen uint64, idx int64, data []byte) {
+	c.mu.Lock()
+	ok := c.entries[e.path] == e && e.gen == gen
+	if ok && len(e.blocks) == 0 {
+		ok = c.writeMeta(e) == nil
+	}
+	c.mu.Unlock()
+	if ok {
+		c.putBlock(e, gen, idx, data)
+	}
+}
+
+// putBlock writes a block, if the file has not changed since
+// generation `gen`, and evicts blocks if the cache is over its size
+// limit. The content is written without holding c.mu, so that I/O
+// for different blocks runs in parallel; with c.mu held, the block
+// is only renamed into place.
+func (c *Cache) putBlock(e *entry, gen uint64, idx int64, data []byte) {
+	tmp, err := writeTemp(e.dir, data)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil && (c.entries[e.path] != e || e.gen != gen) {
+		os.Remove(tmp)
+		return
+	}
+	if err == nil {
+		if err = os.Rename(tmp, e.blockPath(idx)); err != nil {
+			os.Remove(tmp)
+		}
+	}
+	if err != nil {
+		// The cached block, if any, may be out of date.
+		c.dropBlock(e, idx)
+		return
+	}
+	b := &block{e, idx, int64(len(data))}
+	if el, ok := e.blocks[idx]; ok {
+		c.size -= el.Value.(*block).size
+		el.Value = b
+		c.lru.MoveToFront(el)
+	} else {
+		e.blocks[idx] = c.lru.PushFront(b)
+	}
+	c.size += b.size
+	c.evict()
+}
+
+// evict drops the least recently used blocks until the cache fits
+// its size limit. It must be called with c.mu held.
+func (c *Cache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		b := c.lru.Back().Value.(*block)
+		c.dropBlock(b.e, b.idx)
+		if len(b.e.blocks) == 0 {
+			c.dropEntry(b.e)
+		}
+	}
+}
+
+// cachedBlock returns the content of a cached block.
+func (c *Cache) cachedBlock(e *entry, idx int64) ([]byte, bool) {
+	c.mu.Lock()
+	el, ok := e.blocks[idx]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	// Blocks are replaced atomically, so this reads either the
+	// old or the new content. A block that was evicted in the
+	// meantime is fetched again.
+	data, err := ioutil.ReadFile(e.blockPath(idx))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package compressfs provides a view of a directory in which file
+// content is compressed at rest. The directory holds the compressed
+// files, and the mounted file system shows them uncompressed.
+//
+// Files are compressed with DEFLATE in chunks that are compressed
+// independently, and an index of the chunks is stored after them, so
+// reads and writes at any offset only touch the chunks involved.
+// Chunks that do not compress are stored as they are, and runs of
+// zeros are stored as holes.
+//
+// Changes are written without overwriting the content that is in
+// use, and take effect when the file is flushed, that is, closed or
+// synced. After a crash, a file has the content it had when it was
+// last flushed, or flushed the time before, if it was not synced
+// since.
+//
+// Whether a file is compressed is decided when it first reaches the
+// size of a chunk: if its first chunk does not compress well, the
+// file is stored unchanged, and is passed through from then on. Files
+// in the directory that were not written through compressfs are
+// passed through as well, unless they are smaller than a chunk.
+//
+// Attributes other than the size, and the names, are those of the
+// files in the directory.
+package compressfs
+
+import (
+	"compress/flate"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/internal/passthrough"
+)
+
+// Options sets options for the file system.
+type Options struct {
+	// ChunkSize is the size of the uncompressed chunks. The
+	// default is 64 kb. It only applies to new files.
+	ChunkSize int
+
+	// Level is the compression level, from 1 (fastest) to 9
+	// (best). The default is that of compress/flate.
+	Level int
+
+	// MaxRatio is the largest compressed to uncompressed size
+	// ratio of the first chunk for which a file is compressed.
+	// The default is 0.9.
+	MaxRatio float64
+
+	// Exclude holds patterns, as for filepath.Match, for names
+	// of files that are not compressed, like "*.gz". Files whose
+	// content starts like that of a compressed file are
+	// compressed regardless.
+	Exclude []string
+}
+
+// compressRoot holds the parameters of the file system.
+type compressRoot struct {
+	// path is the directory with the compressed files.
+	path string
+
+	// dev is the device of path.
+	dev uint64
+
+	opts Options
+}
+
+// NewRoot returns the root of the uncompressed view of `dir`. `opts`
+// may be nil.
+func NewRoot(dir string, opts *Options) (fs.InodeEmbedder, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return nil, err
+	}
+	r := &compressRoot{
+		path: dir,
+		dev:  uint64(st.Dev),
+	}
+	if opts != nil {
+		r.opts = *opts
+	}
+	if r.opts.Level == 0 {
+		r.opts.Level = flate.DefaultCompression
+	}
+	if r.opts.ChunkSize <= 0 {
+		r.opts.ChunkSize = 64 << 10
+	}
+	if r.opts.MaxRatio <= 0 {
+		r.opts.MaxRatio = 0.9
+	}
+	if _, err := flate.NewWriter(nil, r.opts.Level); err != nil {
+		return nil, err
+	}
+	return r.newNode(), nil
+}
+
+func (r *compressRoot) newNode() *compressNode {
+	return &compressNode{root: r}
+}
+
+func (r *compressRoot) idFromStat(st *syscall.Stat_t) fs.StableAttr {
+	return fs.StableAttr{
+		Mode: uint32(st.Mode),
+		Gen:  1,
+		Ino:  passthrough.Ino(st, r.dev),
+	}
+}
+
+// excluded reports whether the file `name` must not be compressed.
+func (r *compressRoot) excluded(name string) bool {
+	for _, pat := range r.opts.Exclude {
+		if ok, _ := filepath.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,460 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compressfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"github.com/hanwen/go-fuse/v2/posixtest"
+)
+
+type testCase struct {
+	*testing.T
+
+	orig   string
+	mnt    string
+	opts   *Options
+	server interface{ Unmount() error }
+}
+
+func newTestCase(t *testing.T, opts *Options) (*testCase, func()) {
+	dir := testutil.TempDir()
+	tc := &testCase{
+		T:    t,
+		orig: dir + "/orig",
+		mnt:  dir + "/mnt",
+		opts: opts,
+	}
+	for _, d := range []string{tc.orig, tc.mnt} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tc.mount()
+	return tc, func() {
+		tc.server.Unmount()
+		os.RemoveAll(dir)
+	}
+}
+
+func (tc *testCase) mount() {
+	root, err := NewRoot(tc.orig, tc.opts)
+	if err != nil {
+		tc.Fatal(err)
+	}
+	opts := &fs.Options{}
+	opts.Debug = testutil.VerboseTest()
+	server, err := fs.Mount(tc.mnt, root, opts)
+	if err != nil {
+		tc.Fatal(err)
+	}
+	tc.server = server
+}
+
+// remount mounts again, so content is not served from the kernel
+// cache.
+func (tc *testCase) remount() {
+	if err := tc.server.Unmount(); err != nil {
+		tc.Fatal(err)
+	}
+	tc.mount()
+}
+
+// check verifies that the file `name` has content `want`, in the
+// mount and when reading at random offsets.
+func (tc *testCase) check(what, name string, want []byte) {
+	tc.Helper()
+	got, err := ioutil.ReadFile(tc.mnt + "/" + name)
+	if err != nil {
+		tc.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		tc.Fatalf("%s: content mismatch: got %d bytes, want %d", what, len(got), len(want))
+	}
+	fi, err := os.Stat(tc.mnt + "/" + name)
+	if err != nil {
+		tc.Fatal(err)
+	}
+	if fi.Size() != int64(len(want)) {
+		tc.Errorf("%s: got size %d, want %d", what, fi.Size(), len(want))
+	}
+
+	f, err := os.Open(tc.mnt + "/" + name)
+	if err != nil {
+		tc.Fatal(err)
+	}
+	defer f.Close()
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20 && len(want) > 0; i++ {
+		off := rnd.Intn(len(want))
+		buf := make([]byte, rnd.Intn(5000))
+		n, _ := f.ReadAt(buf, int64(off))
+		end := off + len(buf)
+		if end > len(want) {
+			end = len(want)
+		}
+		if !bytes.Equal(buf[:n], want[off:end]) {
+			tc.Fatalf("%s: ReadAt(%d, %d) mismatch", what, off, len(buf))
+		}
+	}
+}
+
+func logData(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, "2019-03-01 12:00:%02d INFO request %d served in %dms\n", i%60, i, i%97)
+	}
+	return buf.Bytes()[:n]
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func TestPosix(t *testing.T) {
+	for nm, fn := range posixtest.All {
+		t.Run(nm, func(t *testing.T) {
+			tc, clean := newTestCase(t, &Options{ChunkSize: 512})
+			defer clean()
+			fn(t, tc.mnt)
+		})
+	}
+}
+
+func TestCompress(t *testing.T) {
+	tc, clean := newTestCase(t, &Options{ChunkSize: 4096})
+	defer clean()
+
+	want := logData(100000)
+	if err := ioutil.WriteFile(tc.mnt+"/log", want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ioutil.ReadFile(tc.orig + "/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasMagic(stored) {
+		t.Fatalf("file not compressed")
+	}
+	if len(stored) > len(want)/2 {
+		t.Errorf("compressed to %d bytes, want at most %d", len(stored), len(want)/2)
+	}
+	tc.check("write", "log", want)
+
+	tc.remount()
+	tc.check("remount", "log", want)
+
+	// Overwrite chunks in the middle with data that does not
+	// compress, so they must move.
+	f, err := os.OpenFile(tc.mnt+"/log", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noise := randomData(10000)
+	if _, err := f.WriteAt(noise, 30000); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[30000:], noise)
+	tc.check("overwrite", "log", want)
+
+	// Append across the end, and truncate in the middle of a
+	// chunk.
+	more := logData(7000)
+	if _, err := f.WriteAt(more, int64(len(want))-1000); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want[:len(want)-1000], more...)
+	tc.check("append", "log", want)
+
+	if err := f.Truncate(50001); err != nil {
+		t.Fatal(err)
+	}
+	want = want[:50001]
+	tc.check("truncate down", "log", want)
+
+	if err := f.Truncate(70000); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, make([]byte, 70000-len(want))...)
+	tc.check("truncate up", "log", want)
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tc.remount()
+	tc.check("reopen", "log", want)
+}
+
+func TestCompact(t *testing.T) {
+	tc, clean := newTestCase(t, &Options{ChunkSize: 4096})
+	defer clean()
+
+	want := logData(64 * 1024)
+	if err := ioutil.WriteFile(tc.mnt+"/log", want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(tc.orig + "/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := fi.Size()
+
+	// Replace all chunks twice, with data that does not
+	// compress and then with the original data.
+	f, err := os.OpenFile(tc.mnt+"/log", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(randomData(len(want)), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(want, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is compacted on release, which the kernel sends
+	// asynchronously.
+	var size int64
+	for i := 0; i < 100; i++ {
+		fi, err := os.Stat(tc.orig + "/log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size = fi.Size(); size <= before {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if size > before {
+		t.Errorf("got size %d after compacting, want at most %d", size, before)
+	}
+	tc.remount()
+	tc.check("compact", "log", want)
+}
+
+// TestUnflushed checks that changes that were not flushed, as after
+// a crash, leave the file as it was when it was last flushed.
+func TestUnflushed(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	root, err := NewRoot(dir, &Options{ChunkSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := root.(*compressNode).root
+
+	open := func() (int, *content) {
+		fd, err := syscall.Open(dir+"/log", syscall.O_RDWR|syscall.O_CREAT, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, errno := r.loadContent(fd, "log")
+		if errno != 0 {
+			t.Fatalf("loadContent: %v", errno)
+		}
+		return fd, c
+	}
+
+	want := logData(64 * 1024)
+	fd, c := open()
+	defer syscall.Close(fd)
+	if errno := c.writeAt(fd, want, 0); errno != 0 {
+		t.Fatalf("writeAt: %v", errno)
+	}
+	if errno := c.flush(fd); errno != 0 {
+		t.Fatalf("flush: %v", errno)
+	}
+	if c.l == nil {
+		t.Fatal("file was not compressed")
+	}
+
+	// Replace all chunks, some in place, and grow the file.
+	if errno := c.writeAt(fd, randomData(len(want)), 0); errno != 0 {
+		t.Fatalf("writeAt: %v", errno)
+	}
+	if errno := c.writeAt(fd, logData(1000), 0); errno != 0 {
+		t.Fatalf("writeAt: %v", errno)
+	}
+	if errno := c.writeAt(fd, want, int64(len(want))); errno != 0 {
+		t.Fatalf("writeAt: %v", errno)
+	}
+
+	fd2, c2 := open()
+	defer syscall.Close(fd2)
+	got, errno := c2.readAt(fd2, make([]byte, 2*len(want)), 0)
+	if errno != 0 {
+		t.Fatalf("readAt: %v", errno)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes, want the %d bytes of the last flush", len(got), len(want))
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	tc, clean := newTestCase(t, &Options{ChunkSize: 4096, Exclude: []string{"*.gz"}})
+	defer clean()
+
+	for name, want := range map[string][]byte{
+		"random":  randomData(20000),
+		"log.gz":  logData(20000),
+		"small":   logData(100),
+		"grown":   randomData(6000),
+		"growlog": logData(6000),
+	} {
+		// Write in small pieces, so files are decided when
+		// they reach the chunk size.
+		f, err := os.Create(tc.mnt + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for off := 0; off < len(want); off += 1000 {
+			end := off + 1000
+			if end > len(want) {
+				end = len(want)
+			}
+			if _, err := f.Write(want[off:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := ioutil.ReadFile(tc.orig + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "growlog" {
+			if !hasMagic(stored) {
+				t.Errorf("%s: not compressed", name)
+			}
+		} else if !bytes.Equal(stored, want) {
+			t.Errorf("%s: not passed through", name)
+		}
+		tc.check(name, name, want)
+	}
+
+	// Files that were not written through us are shown as they
+	// are.
+	want := logData(30000)
+	if err := ioutil.WriteFile(tc.orig+"/existing", want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tc.check("existing", "existing", want)
+	f, err := os.OpenFile(tc.mnt+"/existing", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("tail\n")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	want = append(want, "tail\n"...)
+	if stored, err := ioutil.ReadFile(tc.orig + "/existing"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(stored, want) {
+		t.Errorf("existing: not passed through")
+	}
+}
+
+// TestMagic checks that files whose content starts with the magic are
+// not taken for compressed files.
+func TestMagic(t *testing.T) {
+	tc, clean := newTestCase(t, &Options{ChunkSize: 4096, Exclude: []string{"*.gz"}})
+	defer clean()
+
+	for _, name := range []string{"random", "small", "excluded.gz"} {
+		want := append([]byte(magic), randomData(20000)...)
+		if name == "small" {
+			want = want[:200]
+		}
+		if err := ioutil.WriteFile(tc.mnt+"/"+name, want, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if stored, err := ioutil.ReadFile(tc.orig + "/" + name); err != nil {
+			t.Fatal(err)
+		} else if bytes.Equal(stored, want) {
+			t.Errorf("%s: stored uncompressed", name)
+		}
+		tc.check(name, name, want)
+	}
+
+	// A file that starts with the magic, but was not written
+	// through us, is shown as it is.
+	want := append([]byte(magic), logData(20000)...)
+	if err := ioutil.WriteFile(tc.orig+"/existing", want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tc.check("existing", "existing", want)
+	tc.remount()
+	tc.check("remount", "existing", want)
+}
+
+// TestTornSlot checks that a file whose newest slot did not reach the
+// disk has the content of the flush before.
+func TestTornSlot(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	root, err := NewRoot(dir, &Options{ChunkSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := root.(*compressNode).root
+
+	fd, err := syscall.Open(dir+"/log", syscall.O_RDWR|syscall.O_CREAT, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	c, errno := r.loadContent(fd, "log")
+	if errno != 0 {
+		t.Fatalf("loadContent: %v", errno)
+	}
+	want := logData(64 * 1024)
+	if errno := c.writeAt(fd, want, 0); errno != 0 {
+		t.Fatalf("writeAt: %v", errno)
+	}
+	if errno := c.flush(fd); errno != 0 {
+		t.Fatalf("flush: %v", errno)
+	}
+	if errno := c.writeAt(fd, randomData(len(want)), 0); errno != 0 {
+		t.Fatalf("writeAt: %v", errno)
+	}
+	if errno := c.flush(fd); errno != 0 {
+		t.Fatalf("flush: %v", errno)
+	}
+
+	// Tear the slot of the last flush.
+	off := int64(len(magic) + c.l.slot*slotLen + 20)
+	if _, err := syscall.Pwrite(fd, []byte{0xff}, off); err != nil {
+		t.Fatal(err)
+	}
+
+	c, errno = r.loadContent(fd, "log")
+	if errno != 0 {
+		t.Fatalf("loadContent: %v", errno)
+	}
+	got, errno := c.readAt(fd, make([]byte, len(want)), 0)
+	if errno != 0 {
+		t.Fatalf("readAt: %v", errno)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes, want the %d bytes of the first flush", len(got), len(want))
+	}
+}
@@ -0,0 +1,579 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compressfs
+
+import (
+	"context"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// compressFile is an open compressed file. Content is accessed with
+// the lock of the node held, as the handles of a file share its
+// layout.
+type compressFile struct {
+	node     *compressNode
+	fd       int
+	writable bool
+}
+
+var _ = (fs.FileReader)((*compressFile)(nil))
+var _ = (fs.FileWriter)((*compressFile)(nil))
+var _ = (fs.FileFlusher)((*compressFile)(nil))
+var _ = (fs.FileFsyncer)((*compressFile)(nil))
+var _ = (fs.FileReleaser)((*compressFile)(nil))
+var _ = (fs.FileAllocater)((*compressFile)(nil))
+
+func (f *compressFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	data, errno := f.node.content.readAt(f.fd, dest, off)
+	if errno != 0 {
+		return nil, errno
+	}
+	return fuse.ReadResultData(data), 0
+}
+
+func (f *compressFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if errno := f.node.content.writeAt(f.fd, data, off); errno != 0 {
+		return 0, errno
+	}
+	return uint32(len(data)), 0
+}
+
+func (f *compressFile) Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno {
+	if mode != 0 {
+		return syscall.EOPNOTSUPP
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.fd, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	cur, errno := f.node.content.size(&st)
+	if errno != 0 {
+		return errno
+	}
+	if int64(off+size) <= cur {
+		return 0
+	}
+	return f.node.content.truncate(f.fd, int64(off+size))
+}
+
+func (f *compressFile) Flush(ctx context.Context) syscall.Errno {
+	f.node.mu.Lock()
+	errno := f.node.content.flush(f.fd)
+	f.node.mu.Unlock()
+	if errno != 0 {
+		return errno
+	}
+
+	// As for the loopback file, closing a dup'd descriptor
+	// flushes without closing the file.
+	newFd, err := syscall.Dup(f.fd)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	return fs.ToErrno(syscall.Close(newFd))
+}
+
+func (f *compressFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	f.node.mu.Lock()
+	errno := f.node.content.flush(f.fd)
+	f.node.mu.Unlock()
+	if errno != 0 {
+		return errno
+	}
+	return fs.ToErrno(syscall.Fsync(f.fd))
+}
+
+func (f *compressFile) Release(ctx context.Context) syscall.Errno {
+	n := f.node
+	n.mu.Lock()
+	errno := n.content.flush(f.fd)
+	n.opens--
+	if n.opens == 0 {
+		if errno == 0 && f.writable {
+			errno = n.content.compact(f.fd)
+		}
+		n.content = nil
+	}
+	n.mu.Unlock()
+
+	if err := syscall.Close(f.fd); errno == 0 {
+		errno = fs.ToErrno(err)
+	}
+	return errno
+}
+
+// content is the state of the content of an open file.
+type content struct {
+	root *compressRoot
+
+	// l is the layout of the file, or nil if it is stored
+	// uncompressed.
+	l *layout
+
+	// decided is set for an uncompressed file if it must stay
+	// uncompressed. Otherwise, it is compressed once it has
+	// the size of a chunk, if the first chunk compresses well.
+	decided bool
+
+	// excluded is set if the file is never compressed.
+	excluded bool
+
+	// The last chunk read or written, uncompressed and without
+	// trailing zeros.
+	cacheIdx int
+	cache    []byte
+}
+
+// loadContent reads the layout of the file `fd`, which is named
+// `name`.
+func (r *compressRoot) loadContent(fd int, name string) (*content, syscall.Errno) {
+	excluded := r.excluded(name)
+	c := &content{root: r, cacheIdx: -1, excluded: excluded}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	if st.Size < int64(headerLen) {
+		c.decided = excluded
+		return c, 0
+	}
+
+	header := make([]byte, headerLen)
+	if _, err := syscall.Pread(fd, header, 0); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	h, slot, err := decodeHeader(header)
+	if err != nil {
+		c.decided = excluded || st.Size >= int64(r.opts.ChunkSize)
+		return c, 0
+	}
+
+	if h.indexOff+int64(h.count*indexEntryLen) > st.Size {
+		return nil, syscall.EIO
+	}
+	index := make([]byte, h.count*indexEntryLen)
+	if n, err := syscall.Pread(fd, index, h.indexOff); err != nil {
+		return nil, fs.ToErrno(err)
+	} else if n != len(index) {
+		return nil, syscall.EIO
+	}
+	if c.l, err = decodeLayout(h, slot, index); err != nil {
+		return nil, syscall.EIO
+	}
+	return c, 0
+}
+
+// size returns the uncompressed size of the file, which has
+// attributes `st`.
+func (c *content) size(st *syscall.Stat_t) (int64, syscall.Errno) {
+	if c.l == nil {
+		return st.Size, 0
+	}
+	return c.l.size, 0
+}
+
+// chunkLen returns the uncompressed length of chunk `idx`.
+func (c *content) chunkLen(idx int) int64 {
+	cs := c.l.chunkSize
+	if rest := c.l.size - int64(idx)*cs; rest < cs {
+		return rest
+	}
+	return cs
+}
+
+// readChunk returns a copy of the uncompressed content of chunk
+// `idx`.
+func (c *content) readChunk(fd int, idx int) ([]byte, syscall.Errno) {
+	buf := make([]byte, c.chunkLen(idx))
+	if c.cacheIdx != idx {
+		ch := c.l.chunks[idx]
+		var data []byte
+		if ch.length > 0 {
+			data = make([]byte, ch.length)
+			if n, err := syscall.Pread(fd, data, int64(ch.off)); err != nil {
+				return nil, fs.ToErrno(err)
+			} else if n != len(data) {
+				return nil, syscall.EIO
+			}
+			var err error
+			if data, err = decompress(data, ch.stored, ch.plain); err != nil {
+				return nil, syscall.EIO
+			}
+		}
+		c.cacheIdx = idx
+		c.cache = data
+	}
+	copy(buf, c.cache)
+	return buf, 0
+}
+
+// storeChunk writes `data` as the content of chunk `idx`.
+func (c *content) storeChunk(fd int, idx int, data []byte) syscall.Errno {
+	l := c.l
+	for len(data) > 0 && data[len(data)-1] == 0 {
+		data = data[:len(data)-1]
+	}
+
+	old := l.chunks[idx]
+	var ch chunk
+	if len(data) > 0 {
+		stored, raw := compress(data, c.root.opts.Level)
+		ch = chunk{
+			length: uint32(len(stored)),
+			plain:  uint32(len(data)),
+			stored: raw,
+		}
+		if ch.length <= old.length && int64(old.off) >= l.committed {
+			// The index in the file does not use the old
+			// chunk, so it can be overwritten.
+			ch.off = old.off
+		} else {
+			ch.off = uint64(l.end)
+			l.end += int64(ch.length)
+		}
+		if _, err := syscall.Pwrite(fd, stored, int64(ch.off)); err != nil {
+			c.cacheIdx = -1
+			return fs.ToErrno(err)
+		}
+	}
+	l.chunks[idx] = ch
+	l.dirty = true
+
+	c.cacheIdx = idx
+	c.cache = append([]byte{}, data...)
+	return 0
+}
+
+// grow extends the file with zeros to `size`.
+func (c *content) grow(size int64) {
+	l := c.l
+	l.size = size
+	for n := int((size + l.chunkSize - 1) / l.chunkSize); len(l.chunks) < n; {
+		l.chunks = append(l.chunks, chunk{})
+	}
+	l.dirty = true
+}
+
+func (c *content) readAt(fd int, dest []byte, off int64) ([]byte, syscall.Errno) {
+	if c.l == nil {
+		n, err := syscall.Pread(fd, dest, off)
+		if err != nil {
+			return nil, fs.ToErrno(err)
+		}
+		return dest[:n], 0
+	}
+
+	end := off + int64(len(dest))
+	if end > c.l.size {
+		end = c.l.size
+	}
+	out := dest[:0]
+	cs := c.l.chunkSize
+	for pos := off; pos < end; {
+		idx := int(pos / cs)
+		start := int64(idx) * cs
+		data, errno := c.readChunk(fd, idx)
+		if errno != 0 {
+			return nil, errno
+		}
+		if end-start < int64(len(data)) {
+			data = data[:end-start]
+		}
+		out = append(out, data[pos-start:]...)
+		pos = start + int64(len(data))
+	}
+	return out, 0
+}
+
+func (c *content) writeAt(fd int, data []byte, off int64) syscall.Errno {
+	if c.l == nil {
+		if errno := c.decide(fd, data, off); errno != 0 {
+			return errno
+		}
+		if c.l == nil && off < int64(len(magic)) {
+			if errno := c.escape(fd, data, off); errno != 0 {
+				return errno
+			}
+		}
+		if c.l == nil {
+			_, err := syscall.Pwrite(fd, data, off)
+			return fs.ToErrno(err)
+		}
+	}
+	return c.writeChunks(fd, data, off)
+}
+
+// escape compresses an uncompressed file if writing `data` at `off`
+// makes it start with the magic, so it is not taken for a compressed
+// file.
+func (c *content) escape(fd int, data []byte, off int64) syscall.Errno {
+	h := make([]byte, len(magic))
+	if _, err := syscall.Pread(fd, h, 0); err != nil {
+		return fs.ToErrno(err)
+	}
+	copy(h[off:], data)
+	if !hasMagic(h) {
+		return 0
+	}
+	old, errno := readAll(fd)
+	if errno != 0 {
+		return errno
+	}
+	c.decided = true
+	return c.convert(fd, old)
+}
+
+// readAll returns the content of the uncompressed file `fd`.
+func readAll(fd int) ([]byte, syscall.Errno) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	old := make([]byte, st.Size)
+	if n, err := syscall.Pread(fd, old, 0); err != nil {
+		return nil, fs.ToErrno(err)
+	} else if n != len(old) {
+		return nil, syscall.EIO
+	}
+	return old, 0
+}
+
+// writeChunks writes `data` at `off` to a compressed file.
+func (c *content) writeChunks(fd int, data []byte, off int64) syscall.Errno {
+	end := off + int64(len(data))
+	if end > c.l.size {
+		c.grow(end)
+	}
+	cs := c.l.chunkSize
+	for pos := off; pos < end; {
+		idx := int(pos / cs)
+		start := int64(idx) * cs
+		n := c.chunkLen(idx)
+
+		var buf []byte
+		if pos == start && end >= start+n {
+			buf = data[pos-off : pos-off+n]
+		} else {
+			var errno syscall.Errno
+			if buf, errno = c.readChunk(fd, idx); errno != 0 {
+				return errno
+			}
+			copy(buf[pos-start:], data[pos-off:])
+		}
+		if errno := c.storeChunk(fd, idx, buf); errno != 0 {
+			return errno
+		}
+		pos = start + n
+	}
+	return 0
+}
+
+// decide compresses an uncompressed file that is not decided yet, if
+// writing `data` at `off` gives it the size of a chunk, and its first
+// chunk compresses well.
+func (c *content) decide(fd int, data []byte, off int64) syscall.Errno {
+	if c.decided {
+		return 0
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	cs := int64(c.root.opts.ChunkSize)
+	if st.Size < cs && off+int64(len(data)) < cs {
+		return 0
+	}
+
+	c.decided = true
+	old, errno := readAll(fd)
+	if errno != 0 {
+		return errno
+	}
+	first := make([]byte, cs)
+	copy(first, old)
+	if off < cs {
+		copy(first[off:], data)
+	}
+	stored, raw := compress(first, c.root.opts.Level)
+	if raw || float64(len(stored)) > c.root.opts.MaxRatio*float64(cs) {
+		return 0
+	}
+	return c.convert(fd, old)
+}
+
+// convert compresses the uncompressed file `fd`, which has content
+// `old`. The uncompressed content stays in place until the file is
+// flushed, and the header is written.
+func (c *content) convert(fd int, old []byte) syscall.Errno {
+	end := int64(len(old))
+	if end < int64(headerLen) {
+		end = int64(headerLen)
+	}
+	cs := int64(c.root.opts.ChunkSize)
+	c.l = &layout{
+		chunkSize: cs,
+		end:       end,
+		committed: end,
+		dirty:     true,
+	}
+	return c.writeChunks(fd, old, 0)
+}
+
+func (c *content) truncate(fd int, size int64) syscall.Errno {
+	if c.l == nil && size > 0 {
+		// Decide now, so an undecided file never has more than a
+		// chunk of content to convert.
+		if errno := c.decide(fd, nil, size); errno != 0 {
+			return errno
+		}
+	}
+	if c.l == nil || size == 0 {
+		if err := syscall.Ftruncate(fd, size); err != nil {
+			return fs.ToErrno(err)
+		}
+		if c.l != nil {
+			c.l = nil
+			c.decided = c.excluded
+			c.cacheIdx = -1
+		}
+		return 0
+	}
+
+	l := c.l
+	if size >= l.size {
+		c.grow(size)
+		return c.flush(fd)
+	}
+
+	n := int((size + l.chunkSize - 1) / l.chunkSize)
+	l.chunks = l.chunks[:n]
+	l.size = size
+	l.dirty = true
+	if c.cacheIdx >= n {
+		c.cacheIdx = -1
+	}
+	if last := n - 1; int64(l.chunks[last].plain) > c.chunkLen(last) {
+		data, errno := c.readChunk(fd, last)
+		if errno != 0 {
+			return errno
+		}
+		if errno := c.storeChunk(fd, last, data); errno != 0 {
+			return errno
+		}
+	}
+	return c.flush(fd)
+}
+
+// flush commits the changes, if there are any.
+func (c *content) flush(fd int) syscall.Errno {
+	l := c.l
+	if l == nil || !l.dirty {
+		return 0
+	}
+	return c.commit(fd)
+}
+
+// commit writes the index after the chunks, and points the older
+// slot of the header to it once it is on disk. The sync also puts
+// the slot written by the previous commit on disk, so the newer slot
+// on disk always points to a complete index.
+func (c *content) commit(fd int) syscall.Errno {
+	l := c.l
+	index := l.encodeIndex()
+	indexOff := l.end
+	if _, err := syscall.Pwrite(fd, index, indexOff); err != nil {
+		return fs.ToErrno(err)
+	}
+	if err := syscall.Fsync(fd); err != nil {
+		return fs.ToErrno(err)
+	}
+
+	seq := l.seq + 1
+	slot := 1 - l.slot
+	buf := l.encodeSlot(seq, indexOff)
+	off := int64(len(magic) + slot*slotLen)
+	if l.seq == 0 {
+		// The file has no header yet.
+		slot = 0
+		buf = append(append([]byte(magic), buf...), make([]byte, slotLen)...)
+		off = 0
+	}
+	if _, err := syscall.Pwrite(fd, buf, off); err != nil {
+		return fs.ToErrno(err)
+	}
+	l.seq = seq
+	l.slot = slot
+	l.end = indexOff + int64(len(index))
+	l.committed = l.end
+	l.garbage = indexOff - int64(headerLen) - l.used()
+	l.dirty = false
+	return 0
+}
+
+// compact moves the chunks together, if more than half of the space
+// before the index is unused. To keep the file usable throughout, the
+// chunks are first copied to the end of the file and committed
+// there, and then copied to the start of the file, which no chunk in
+// use occupies any longer. Both commits are synced, so that neither
+// slot on disk points to chunks that are overwritten or truncated.
+func (c *content) compact(fd int) syscall.Errno {
+	l := c.l
+	if l == nil || 2*l.garbage <= l.end-int64(headerLen) {
+		return 0
+	}
+
+	var order []int
+	for i, ch := range l.chunks {
+		if ch.length > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return l.chunks[order[i]].off < l.chunks[order[j]].off
+	})
+
+	// As more than half of the space is unused, the compacted
+	// chunks and their index fit before the chunks at the end.
+	if int64(headerLen)+l.used()+int64(len(l.chunks)*indexEntryLen) > l.end {
+		return 0
+	}
+
+	move := func(pos int64) syscall.Errno {
+		for _, i := range order {
+			ch := &l.chunks[i]
+			data := make([]byte, ch.length)
+			if _, err := syscall.Pread(fd, data, int64(ch.off)); err != nil {
+				return fs.ToErrno(err)
+			}
+			if _, err := syscall.Pwrite(fd, data, pos); err != nil {
+				return fs.ToErrno(err)
+			}
+			ch.off = uint64(pos)
+			pos += int64(ch.length)
+		}
+		l.end = pos
+		if errno := c.commit(fd); errno != 0 {
+			return errno
+		}
+		return fs.ToErrno(syscall.Fsync(fd))
+	}
+	if errno := move(l.end); errno != 0 {
+		return errno
+	}
+	if errno := move(int64(headerLen)); errno != 0 {
+		return errno
+	}
+	return fs.ToErrno(syscall.Ftruncate(fd, l.end))
+}
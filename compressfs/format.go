@@ -0,0 +1,263 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compressfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+)
+
+// A compressed file starts with a header, followed by the chunks and
+// the index:
+//
+//	header:  magic[8] slot[2]
+//	slot:    seq:u64 version:u32 chunkSize:u32 indexOffset:u64 chunkCount:u32 reserved:u32 size:u64 crc:u32 reserved:u32
+//	chunks:  deflated, or stored, chunk data
+//	index:   (offset:u64 length:u32 plainLength:u32 flags:u8) per chunk
+//
+// Integers are big-endian, and the crc of a slot is the CRC-32C of
+// the bytes before it. A chunk of length 0 is a hole. Chunks
+// decompress to at most the chunk size, and are extended with zeros
+// up to the chunk size, or the file size for the last chunk.
+//
+// The index is a footer: it is written after the chunks, and it is
+// the last thing in the file. It is found through the header rather
+// than from the end of the file, because after a crash the end of the
+// file may hold an index that was only partly written, and the header
+// still points to the last complete one.
+//
+// The file is changed copy-on-write. Chunks that the indexes the
+// slots point to use are never overwritten: new chunks are written
+// after the index, and when the file is flushed, a new index is
+// written after them, and the file is synced. Only then is the slot
+// with the lower sequence number pointed to the new index, with a
+// higher sequence number. That write is not synced: it reaches the
+// disk with the next flush, or before. The slot with the highest
+// sequence number and a valid crc is the one in use, so after a crash,
+// a file has the content it had when it was last or next-to-last
+// flushed, and possibly unused bytes after the index. A file that was
+// still being converted from uncompressed storage keeps its
+// uncompressed content, followed by unused bytes. Syncing the file
+// syncs the header too.
+//
+// Uncompressed files have no header. So that a file is never taken
+// for a compressed one because of its content, a file whose content
+// starts with the magic is always compressed. A file in the directory
+// that starts with the magic but has no valid slot was not written by
+// compressfs, and is passed through.
+//
+// Replaced chunks and indexes leave unused space, which is reclaimed
+// by compacting the file.
+const (
+	magic         = "\x89GFZ\r\n\x1a\n"
+	formatVersion = 1
+	slotLen       = 48
+	headerLen     = len(magic) + 2*slotLen
+	indexEntryLen = 17
+
+	flagStored = 1
+)
+
+var errCorrupt = errors.New("compressfs: corrupt file")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type chunk struct {
+	off    uint64
+	length uint32
+	plain  uint32
+	stored bool
+}
+
+// layout is the structure of a compressed file.
+type layout struct {
+	chunkSize int64
+
+	// size is the uncompressed size of the file.
+	size int64
+
+	chunks []chunk
+
+	// end is where the next chunk or the index is written.
+	end int64
+
+	// committed is the end of the newest index that a slot
+	// points to. The chunks before it may be in use by the
+	// indexes of both slots, so they are not overwritten.
+	committed int64
+
+	// garbage is the number of unused bytes before the index, as
+	// of the last commit.
+	garbage int64
+
+	// seq is the sequence number of the newest slot, or 0 if the
+	// file has no header yet, and slot is its position.
+	seq  uint64
+	slot int
+
+	// dirty is set if the index must be written.
+	dirty bool
+}
+
+// hasMagic reports whether `h` starts with the magic, which
+// compressed files, and only those, written by compressfs start with.
+func hasMagic(h []byte) bool {
+	return len(h) >= len(magic) && string(h[:len(magic)]) == magic
+}
+
+// slotHeader describes the index that a slot points to.
+type slotHeader struct {
+	seq       uint64
+	chunkSize int64
+	indexOff  int64
+	count     int
+	size      int64
+}
+
+// encodeSlot returns the slot for `l`, with the index at offset
+// `indexOff`, and sequence number `seq`.
+func (l *layout) encodeSlot(seq uint64, indexOff int64) []byte {
+	s := make([]byte, slotLen)
+	binary.BigEndian.PutUint64(s, seq)
+	binary.BigEndian.PutUint32(s[8:], formatVersion)
+	binary.BigEndian.PutUint32(s[12:], uint32(l.chunkSize))
+	binary.BigEndian.PutUint64(s[16:], uint64(indexOff))
+	binary.BigEndian.PutUint32(s[24:], uint32(len(l.chunks)))
+	binary.BigEndian.PutUint64(s[32:], uint64(l.size))
+	binary.BigEndian.PutUint32(s[40:], crc32.Checksum(s[:40], castagnoli))
+	return s
+}
+
+// decodeSlot parses a slot. It fails for slots that were never
+// written, or only partly.
+func decodeSlot(s []byte) (slotHeader, error) {
+	var h slotHeader
+	if len(s) != slotLen || binary.BigEndian.Uint32(s[40:]) != crc32.Checksum(s[:40], castagnoli) ||
+		binary.BigEndian.Uint32(s[8:]) != formatVersion {
+		return h, errCorrupt
+	}
+	h = slotHeader{
+		seq:       binary.BigEndian.Uint64(s),
+		chunkSize: int64(binary.BigEndian.Uint32(s[12:])),
+		indexOff:  int64(binary.BigEndian.Uint64(s[16:])),
+		count:     int(binary.BigEndian.Uint32(s[24:])),
+		size:      int64(binary.BigEndian.Uint64(s[32:])),
+	}
+	if h.seq == 0 || h.chunkSize == 0 || h.indexOff < int64(headerLen) || (h.size+h.chunkSize-1)/h.chunkSize != int64(h.count) {
+		return slotHeader{}, errCorrupt
+	}
+	return h, nil
+}
+
+// decodeHeader returns the slot in use from the header of a
+// compressed file, and its position.
+func decodeHeader(h []byte) (slotHeader, int, error) {
+	if len(h) != headerLen || !hasMagic(h) {
+		return slotHeader{}, 0, errCorrupt
+	}
+	var best slotHeader
+	slot := -1
+	for i := 0; i < 2; i++ {
+		off := len(magic) + i*slotLen
+		s, err := decodeSlot(h[off : off+slotLen])
+		if err == nil && s.seq > best.seq {
+			best, slot = s, i
+		}
+	}
+	if slot < 0 {
+		return slotHeader{}, 0, errCorrupt
+	}
+	return best, slot, nil
+}
+
+// encodeIndex returns the index for `l`.
+func (l *layout) encodeIndex() []byte {
+	buf := make([]byte, len(l.chunks)*indexEntryLen)
+	p := buf
+	for _, c := range l.chunks {
+		binary.BigEndian.PutUint64(p, c.off)
+		binary.BigEndian.PutUint32(p[8:], c.length)
+		binary.BigEndian.PutUint32(p[12:], c.plain)
+		if c.stored {
+			p[16] = flagStored
+		}
+		p = p[indexEntryLen:]
+	}
+	return buf
+}
+
+// used returns the number of bytes the chunks take.
+func (l *layout) used() int64 {
+	var n int64
+	for _, c := range l.chunks {
+		n += int64(c.length)
+	}
+	return n
+}
+
+// decodeLayout parses the index of a compressed file, which slot
+// `slot` with header `h` points to.
+func decodeLayout(h slotHeader, slot int, index []byte) (*layout, error) {
+	if len(index) != h.count*indexEntryLen {
+		return nil, errCorrupt
+	}
+	l := &layout{
+		chunkSize: h.chunkSize,
+		size:      h.size,
+		chunks:    make([]chunk, h.count),
+		end:       h.indexOff + int64(len(index)),
+		seq:       h.seq,
+		slot:      slot,
+	}
+	l.committed = l.end
+	for i := range l.chunks {
+		p := index[i*indexEntryLen:]
+		c := chunk{
+			off:    binary.BigEndian.Uint64(p),
+			length: binary.BigEndian.Uint32(p[8:]),
+			plain:  binary.BigEndian.Uint32(p[12:]),
+			stored: p[16]&flagStored != 0,
+		}
+		if (c.length > 0 && int64(c.off) < int64(headerLen)) || int64(c.off)+int64(c.length) > h.indexOff || int64(c.plain) > h.chunkSize {
+			return nil, errCorrupt
+		}
+		l.chunks[i] = c
+	}
+	l.garbage = h.indexOff - int64(headerLen) - l.used()
+	return l, nil
+}
+
+// compress returns the data to store for a chunk, and whether it is
+// stored uncompressed.
+func compress(data []byte, level int) ([]byte, bool) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level)
+	if err == nil {
+		w.Write(data)
+		err = w.Close()
+	}
+	if err != nil || buf.Len() >= len(data) {
+		return data, true
+	}
+	return buf.Bytes(), false
+}
+
+func decompress(data []byte, stored bool, plain uint32) ([]byte, error) {
+	if stored {
+		if len(data) != int(plain) {
+			return nil, errCorrupt
+		}
+		return data, nil
+	}
+	out, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil || len(out) != int(plain) {
+		return nil, errCorrupt
+	}
+	return out, nil
+}
@@ -0,0 +1,364 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compressfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/passthrough"
+)
+
+// compressNode is a file or directory in the uncompressed view.
+type compressNode struct {
+	fs.Inode
+
+	root *compressRoot
+
+	// mu protects the fields below, and serializes access to the
+	// content.
+	mu sync.Mutex
+
+	// opens is the number of open handles.
+	opens int
+
+	// content is the state of the content while the file is
+	// open.
+	content *content
+
+	// size is the uncompressed size of the closed file, and
+	// sizeKey the attributes of the compressed file it was
+	// computed for.
+	size    int64
+	sizeKey sizeKey
+}
+
+type sizeKey struct {
+	mtime, ctime     uint64
+	mtimens, ctimens uint32
+	len              int64
+}
+
+var _ = (fs.NodeStatfser)((*compressNode)(nil))
+var _ = (fs.NodeLookuper)((*compressNode)(nil))
+var _ = (fs.NodeGetattrer)((*compressNode)(nil))
+var _ = (fs.NodeSetattrer)((*compressNode)(nil))
+var _ = (fs.NodeReaddirer)((*compressNode)(nil))
+var _ = (fs.NodeOpener)((*compressNode)(nil))
+var _ = (fs.NodeCreater)((*compressNode)(nil))
+var _ = (fs.NodeMkdirer)((*compressNode)(nil))
+var _ = (fs.NodeRmdirer)((*compressNode)(nil))
+var _ = (fs.NodeUnlinker)((*compressNode)(nil))
+var _ = (fs.NodeRenamer)((*compressNode)(nil))
+var _ = (fs.NodeLinker)((*compressNode)(nil))
+var _ = (fs.NodeSymlinker)((*compressNode)(nil))
+var _ = (fs.NodeReadlinker)((*compressNode)(nil))
+
+// path returns the path of the compressed file or directory.
+func (n *compressNode) path() string {
+	return filepath.Join(n.root.path, n.Path(n.Root()))
+}
+
+func (n *compressNode) childPath(name string) string {
+	return filepath.Join(n.path(), name)
+}
+
+// fromStat fills `out` with the attributes of the compressed file at
+// `p`, with the uncompressed size.
+func (n *compressNode) fromStat(out *fuse.Attr, st *syscall.Stat_t, p string) {
+	out.FromStat(st)
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.content != nil {
+		if sz, errno := n.content.size(st); errno == 0 {
+			out.Size = uint64(sz)
+		}
+		return
+	}
+	key := sizeKey{out.Mtime, out.Ctime, out.Mtimensec, out.Ctimensec, st.Size}
+	if key != n.sizeKey {
+		n.sizeKey = key
+		n.size = readSize(p, st.Size)
+	}
+	out.Size = uint64(n.size)
+}
+
+// readSize returns the uncompressed size of the file `p`, which is
+// `len` bytes long.
+func readSize(p string, len int64) int64 {
+	if len < int64(headerLen) {
+		return len
+	}
+	fd, err := syscall.Open(p, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return len
+	}
+	defer syscall.Close(fd)
+	h := make([]byte, headerLen)
+	if n, _ := syscall.Pread(fd, h, 0); n != headerLen {
+		return len
+	}
+	hdr, _, err := decodeHeader(h)
+	if err != nil {
+		return len
+	}
+	return hdr.size
+}
+
+// newChild returns the Inode for the compressed file `p`, which was
+// just created or looked up.
+func (n *compressNode) newChild(ctx context.Context, p string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(p, &st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	ch := n.NewInode(ctx, n.root.newNode(), n.root.idFromStat(&st))
+	ch.Operations().(*compressNode).fromStat(&out.Attr, &st, p)
+	return ch, 0
+}
+
+func (n *compressNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	var s syscall.Statfs_t
+	if err := syscall.Statfs(n.root.path, &s); err != nil {
+		return fs.ToErrno(err)
+	}
+	out.FromStatfsT(&s)
+	return 0
+}
+
+func (n *compressNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return n.newChild(ctx, n.childPath(name), out)
+}
+
+func (n *compressNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	var st syscall.Stat_t
+	if cf, ok := f.(*compressFile); ok {
+		if err := syscall.Fstat(cf.fd, &st); err != nil {
+			return fs.ToErrno(err)
+		}
+		n.fromStat(&out.Attr, &st, "")
+		return 0
+	}
+
+	p := n.path()
+	if err := syscall.Lstat(p, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	n.fromStat(&out.Attr, &st, p)
+	return 0
+}
+
+func (n *compressNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	p := n.path()
+	if m, ok := in.GetMode(); ok {
+		if err := syscall.Chmod(p, m); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok || gok {
+		suid := -1
+		sgid := -1
+		if uok {
+			suid = int(uid)
+		}
+		if gok {
+			sgid = int(gid)
+		}
+		if err := syscall.Lchown(p, suid, sgid); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+
+	mtime, mok := in.GetMTime()
+	atime, aok := in.GetATime()
+	if mok || aok {
+		ap := &atime
+		mp := &mtime
+		if !aok {
+			ap = nil
+		}
+		if !mok {
+			mp = nil
+		}
+		ts := []syscall.Timespec{fuse.UtimeToTimespec(ap), fuse.UtimeToTimespec(mp)}
+		if err := syscall.UtimesNano(p, ts); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+
+	if sz, ok := in.GetSize(); ok {
+		fd := -1
+		if cf, ok := f.(*compressFile); ok {
+			fd = cf.fd
+		} else {
+			var err error
+			fd, err = syscall.Open(p, syscall.O_RDWR, 0)
+			if err != nil {
+				return fs.ToErrno(err)
+			}
+			defer syscall.Close(fd)
+		}
+		if errno := n.truncate(fd, int64(sz)); errno != 0 {
+			return errno
+		}
+	}
+
+	return n.Getattr(ctx, f, out)
+}
+
+// truncate sets the uncompressed size of the file `fd`.
+func (n *compressNode) truncate(fd int, sz int64) syscall.Errno {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c := n.content
+	if c == nil {
+		var errno syscall.Errno
+		name, _ := n.Parent()
+		if c, errno = n.root.loadContent(fd, name); errno != 0 {
+			return errno
+		}
+	}
+	return c.truncate(fd, sz)
+}
+
+func (n *compressNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return fs.NewLoopbackDirStream(n.path())
+}
+
+// openFlags returns the flags for opening the compressed file.
+// Writing may need to read a chunk, offsets are computed by us, and
+// truncation must go through the content state.
+func openFlags(flags uint32) int {
+	f := int(flags) &^ (syscall.O_ACCMODE | syscall.O_APPEND | syscall.O_TRUNC | oDirect)
+	return f | syscall.O_RDWR
+}
+
+func (n *compressNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	p := n.path()
+	writable := true
+	fd, err := syscall.Open(p, openFlags(flags), 0)
+	if err == syscall.EACCES && flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		writable = false
+		fd, err = syscall.Open(p, int(flags)&^(oDirect|syscall.O_TRUNC), 0)
+	}
+	if err != nil {
+		return nil, 0, fs.ToErrno(err)
+	}
+	name, _ := n.Parent()
+	f, errno := n.open(fd, name, writable, flags&syscall.O_TRUNC != 0)
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	return f, 0, 0
+}
+
+// open returns the handle for the compressed file `fd`, which it
+// owns, and which is named `name`.
+func (n *compressNode) open(fd int, name string, writable, trunc bool) (*compressFile, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.content == nil {
+		c, errno := n.root.loadContent(fd, name)
+		if errno != 0 {
+			syscall.Close(fd)
+			return nil, errno
+		}
+		n.content = c
+	}
+	if trunc {
+		if errno := n.content.truncate(fd, 0); errno != 0 {
+			if n.opens == 0 {
+				n.content = nil
+			}
+			syscall.Close(fd)
+			return nil, errno
+		}
+	}
+	n.opens++
+	return &compressFile{node: n, fd: fd, writable: writable}, 0
+}
+
+func (n *compressNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	p := n.childPath(name)
+	fd, err := syscall.Open(p, openFlags(flags)|syscall.O_CREAT, mode)
+	if err != nil {
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+	passthrough.PreserveOwner(ctx, p)
+	ch, errno := n.newChild(ctx, p, out)
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, nil, 0, errno
+	}
+	cn := ch.Operations().(*compressNode)
+	f, errno := cn.open(fd, name, true, flags&syscall.O_TRUNC != 0)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	return ch, f, 0, 0
+}
+
+func (n *compressNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	p := n.childPath(name)
+	if err := os.Mkdir(p, os.FileMode(mode)); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	passthrough.PreserveOwner(ctx, p)
+	return n.newChild(ctx, p, out)
+}
+
+func (n *compressNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return fs.ToErrno(syscall.Rmdir(n.childPath(name)))
+}
+
+func (n *compressNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	return fs.ToErrno(syscall.Unlink(n.childPath(name)))
+}
+
+func (n *compressNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags != 0 {
+		return syscall.ENOTSUP
+	}
+	np := newParent.EmbeddedInode().Operations().(*compressNode).childPath(newName)
+	return fs.ToErrno(syscall.Rename(n.childPath(name), np))
+}
+
+func (n *compressNode) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	tp := target.EmbeddedInode().Operations().(*compressNode).path()
+	p := n.childPath(name)
+	if err := syscall.Link(tp, p); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return n.newChild(ctx, p, out)
+}
+
+func (n *compressNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	p := n.childPath(name)
+	if err := syscall.Symlink(target, p); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	passthrough.PreserveOwner(ctx, p)
+	return n.newChild(ctx, p, out)
+}
+
+func (n *compressNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	target, err := os.Readlink(n.path())
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return []byte(target), 0
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ConfigName is the name of the configuration file in the root of
+// the encrypted directory.
+const ConfigName = "cryptfs.conf"
+
+// ErrWrongPassphrase is returned when the passphrase does not
+// decrypt the key.
+var ErrWrongPassphrase = errors.New("cryptfs: wrong passphrase")
+
+const configVersion = 1
+
+// config is the content of the configuration file. The master key is
+// stored encrypted with a key derived from the passphrase, so the
+// passphrase can be changed without reencrypting the files.
+type config struct {
+	Version int
+
+	// BlockSize is the size of the plaintext blocks of files.
+	BlockSize int
+
+	// Salt and Iterations are the parameters for deriving the
+	// key that encrypts the master key from the passphrase,
+	// with PBKDF2-HMAC-SHA256.
+	Salt       []byte
+	Iterations int
+
+	// EncryptedKey is the master key, encrypted with AES-GCM.
+	// It starts with the nonce.
+	EncryptedKey []byte
+}
+
+// InitOptions holds the parameters for Init.
+type InitOptions struct {
+	// BlockSize is the size of the plaintext blocks that file
+	// content is encrypted in. If zero, 4096 is used.
+	BlockSize int
+
+	// Iterations is the number of PBKDF2 iterations for deriving
+	// a key from the passphrase. If zero, 600000 is used.
+	Iterations int
+}
+
+// Init prepares the empty directory `dir` for storing encrypted
+// files, by writing a configuration file with a new random key,
+// protected by `passphrase`.
+func Init(dir string, passphrase []byte, opts *InitOptions) error {
+	if opts == nil {
+		opts = &InitOptions{}
+	}
+	cfg := config{
+		Version:    configVersion,
+		BlockSize:  opts.BlockSize,
+		Iterations: opts.Iterations,
+		Salt:       make([]byte, 32),
+	}
+	if cfg.BlockSize == 0 {
+		cfg.BlockSize = 4096
+	}
+	if cfg.Iterations == 0 {
+		cfg.Iterations = 600000
+	}
+	if cfg.BlockSize < 16 {
+		return fmt.Errorf("cryptfs: block size %d too small", cfg.BlockSize)
+	}
+
+	masterKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, masterKey); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rand.Reader, cfg.Salt); err != nil {
+		return err
+	}
+	aead, err := newGCM(pbkdf2.Key(passphrase, cfg.Salt, cfg.Iterations, 32, sha256.New))
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	cfg.EncryptedKey = aead.Seal(nonce, nonce, masterKey, []byte(ConfigName))
+
+	data, err := json.MarshalIndent(&cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, ConfigName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return writeDirIV(dir)
+}
+
+// readConfig reads the configuration file of `dir`, and decrypts
+// the master key.
+func readConfig(dir string, passphrase []byte) (*config, []byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ConfigName))
+	if err != nil {
+		return nil, nil, err
+	}
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, nil, fmt.Errorf("cryptfs: %s: %v", ConfigName, err)
+	}
+	if cfg.Version != configVersion {
+		return nil, nil, fmt.Errorf("cryptfs: unsupported version %d", cfg.Version)
+	}
+	if cfg.BlockSize < 16 || cfg.Iterations <= 0 {
+		return nil, nil, fmt.Errorf("cryptfs: %s: invalid parameters", ConfigName)
+	}
+
+	aead, err := newGCM(pbkdf2.Key(passphrase, cfg.Salt, cfg.Iterations, 32, sha256.New))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(cfg.EncryptedKey) < aead.NonceSize() {
+		return nil, nil, fmt.Errorf("cryptfs: %s: invalid key", ConfigName)
+	}
+	nonce := cfg.EncryptedKey[:aead.NonceSize()]
+	masterKey, err := aead.Open(nil, nonce, cfg.EncryptedKey[len(nonce):], []byte(ConfigName))
+	if err != nil {
+		return nil, nil, ErrWrongPassphrase
+	}
+	return &cfg, masterKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	bc, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(bc)
+}
+
+// subKey derives a key for the purpose `label` from the master key,
+// so content and names are not encrypted with the same key.
+func subKey(masterKey []byte, label string) []byte {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptfs
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// An encrypted file is empty, or consists of a header followed by
+// the encrypted blocks. The header holds a version and a random file
+// ID. A block holds a random nonce, the ciphertext and the GCM tag.
+// The block number and the file ID are authenticated along with the
+// block, so blocks cannot be moved around within or between files
+// unnoticed.
+//
+// A block of only zero bytes decrypts to zeros, so holes in the
+// encrypted file read as holes in the plaintext file.
+const (
+	headerVersion = 1
+	fileIDLen     = 16
+	headerLen     = 2 + fileIDLen
+	nonceLen      = 12
+	tagLen        = 16
+	blockOverhead = nonceLen + tagLen
+)
+
+var errCorrupt = errors.New("cryptfs: corrupt block")
+
+// contentCrypt encrypts and decrypts file content.
+type contentCrypt struct {
+	aead cipher.AEAD
+
+	// plainBS is the size of a plaintext block
+	plainBS int64
+}
+
+func newContentCrypt(key []byte, blockSize int) (*contentCrypt, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &contentCrypt{aead: aead, plainBS: int64(blockSize)}, nil
+}
+
+// cipherBS returns the size of an encrypted block.
+func (c *contentCrypt) cipherBS() int64 {
+	return c.plainBS + blockOverhead
+}
+
+// blockOffset returns the offset of block `idx` in the encrypted file.
+func (c *contentCrypt) blockOffset(idx int64) int64 {
+	return headerLen + idx*c.cipherBS()
+}
+
+// cipherSize returns the size of the encrypted file for a plaintext
+// size.
+func (c *contentCrypt) cipherSize(plain uint64) uint64 {
+	if plain == 0 {
+		return 0
+	}
+	bs := uint64(c.plainBS)
+	sz := headerLen + plain/bs*uint64(c.cipherBS())
+	if rem := plain % bs; rem > 0 {
+		sz += rem + blockOverhead
+	}
+	return sz
+}
+
+// plainSize returns the size of the plaintext for the size of an
+// encrypted file. A trailing block that is too short is ignored.
+func (c *contentCrypt) plainSize(cipher uint64) uint64 {
+	if cipher <= headerLen {
+		return 0
+	}
+	cipher -= headerLen
+	cbs := uint64(c.cipherBS())
+	sz := cipher / cbs * uint64(c.plainBS)
+	if rem := cipher % cbs; rem > blockOverhead {
+		sz += rem - blockOverhead
+	}
+	return sz
+}
+
+// newHeader returns a header with a new random file ID.
+func newHeader() ([]byte, error) {
+	h := make([]byte, headerLen)
+	binary.BigEndian.PutUint16(h, headerVersion)
+	if _, err := io.ReadFull(rand.Reader, h[2:]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// parseHeader returns the file ID of a header.
+func parseHeader(h []byte) ([]byte, error) {
+	if len(h) != headerLen || binary.BigEndian.Uint16(h) != headerVersion {
+		return nil, errCorrupt
+	}
+	return h[2:], nil
+}
+
+func blockAD(idx int64, fileID []byte) []byte {
+	ad := make([]byte, 8, 8+len(fileID))
+	binary.BigEndian.PutUint64(ad, uint64(idx))
+	return append(ad, fileID...)
+}
+
+// encryptBlock encrypts block `idx` of the file with ID `fileID`.
+func (c *contentCrypt) encryptBlock(plain []byte, idx int64, fileID []byte) ([]byte, error) {
+	nonce := make([]byte, nonceLen, nonceLen+len(plain)+tagLen)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plain, blockAD(idx, fileID)), nil
+}
+
+// decryptBlock decrypts block `idx` of the file with ID `fileID`.
+func (c *contentCrypt) decryptBlock(ciphertext []byte, idx int64, fileID []byte) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, nil
+	}
+	if len(ciphertext) <= blockOverhead {
+		return nil, errCorrupt
+	}
+	if allZero(ciphertext) {
+		return make([]byte, len(ciphertext)-blockOverhead), nil
+	}
+	nonce := ciphertext[:nonceLen]
+	plain, err := c.aead.Open(nil, nonce, ciphertext[nonceLen:], blockAD(idx, fileID))
+	if err != nil {
+		return nil, errCorrupt
+	}
+	return plain, nil
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
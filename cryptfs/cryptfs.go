@@ -0,0 +1,86 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cryptfs provides an encrypted view of a directory, in the
+// style of gocryptfs. The directory holds the encrypted files, and
+// the mounted file system shows them decrypted.
+//
+// File content is encrypted with AES-256-GCM in fixed-size blocks,
+// which are authenticated along with their position and a random
+// ID of the file, so files support random access, and tampering is
+// detected. Names are encrypted with AES-256 in EME mode, tweaked
+// with a random IV per directory, and symlink targets are encrypted
+// like file content. File sizes, the directory structure, the
+// number of files, and the other attributes are not hidden.
+//
+// The key is random, and stored in a configuration file, encrypted
+// with a key derived from a passphrase. Use Init to create it.
+//
+// Encrypted names are longer than plaintext names. If an encrypted
+// name is too long for the directory, which happens for plaintext
+// names over about 175 bytes, the entry is stored under a hash of
+// the encrypted name, and the encrypted name is stored in a file
+// next to it.
+//
+// The file system is a loopback file system, whose nodes encrypt
+// names and content on the way to the directory.
+package cryptfs
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// cryptRoot holds the parameters of the file system.
+type cryptRoot struct {
+	content *contentCrypt
+	names   *nameCrypt
+}
+
+// NewRoot returns the root of the decrypted view of `dir`, which
+// must have been initialized with Init. If `passphrase` is wrong,
+// ErrWrongPassphrase is returned.
+func NewRoot(dir string, passphrase []byte) (fs.InodeEmbedder, error) {
+	cfg, masterKey, err := readConfig(dir, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	r := &cryptRoot{}
+	if r.content, err = newContentCrypt(subKey(masterKey, "cryptfs content"), cfg.BlockSize); err != nil {
+		return nil, err
+	}
+	if r.names, err = newNameCrypt(subKey(masterKey, "cryptfs names")); err != nil {
+		return nil, err
+	}
+	return fs.NewLoopbackRootWithOptions(dir, &fs.LoopbackOptions{
+		NewNode:    r.newNode,
+		EncodeName: r.encodeName,
+	})
+}
+
+func (r *cryptRoot) newNode(rootData *fs.LoopbackRoot) fs.InodeEmbedder {
+	return &cryptNode{
+		LoopbackNode: fs.LoopbackNode{RootData: rootData},
+		root:         r,
+	}
+}
+
+// encodeName returns the name in the directory with the encrypted
+// files of the entry `name` in `dir`.
+func (r *cryptRoot) encodeName(dir *fs.Inode, name string) (string, syscall.Errno) {
+	stored, _, errno := dir.Operations().(*cryptNode).encryptName(name)
+	return stored, errno
+}
+
+// writeDirIV creates the IV file in the new directory `dir`.
+func writeDirIV(dir string) error {
+	iv, err := newDirIV()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, DirIVName), iv, 0444)
+}
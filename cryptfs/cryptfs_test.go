@@ -0,0 +1,380 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"github.com/hanwen/go-fuse/v2/posixtest"
+)
+
+var testPassphrase = []byte("correct horse battery staple")
+
+func TestEME(t *testing.T) {
+	bc, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tweak := make([]byte, emeBlockSize)
+	in := bytes.Repeat([]byte("0123456789abcdef"), 4)
+	enc := emeTransform(bc, tweak, in, true)
+	if dec := emeTransform(bc, tweak, enc, false); !bytes.Equal(dec, in) {
+		t.Fatalf("round trip: got %q, want %q", dec, in)
+	}
+
+	// A change anywhere changes all blocks.
+	in[len(in)-1] ^= 1
+	enc2 := emeTransform(bc, tweak, in, true)
+	for j := 0; j < len(in); j += emeBlockSize {
+		if bytes.Equal(enc[j:j+emeBlockSize], enc2[j:j+emeBlockSize]) {
+			t.Errorf("block %d unchanged", j/emeBlockSize)
+		}
+	}
+
+	tweak[0] = 1
+	if bytes.Equal(emeTransform(bc, tweak, in, true), enc2) {
+		t.Errorf("tweak ignored")
+	}
+}
+
+func TestSizes(t *testing.T) {
+	c, err := newContentCrypt(make([]byte, 32), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sz := range []uint64{0, 1, 4095, 4096, 4097, 3*4096 + 17} {
+		if got := c.plainSize(c.cipherSize(sz)); got != sz {
+			t.Errorf("size %d: got %d after round trip", sz, got)
+		}
+	}
+	if got, want := c.cipherSize(4097), uint64(headerLen+4096+1+2*blockOverhead); got != want {
+		t.Errorf("cipherSize(4097): got %d, want %d", got, want)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	if err := Init(dir, testPassphrase, &InitOptions{Iterations: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Init(dir, testPassphrase, &InitOptions{Iterations: 10}); err == nil {
+		t.Errorf("Init succeeded twice")
+	}
+	if _, err := NewRoot(dir, []byte("wrong")); err != ErrWrongPassphrase {
+		t.Errorf("got %v, want ErrWrongPassphrase", err)
+	}
+	if _, err := NewRoot(dir, testPassphrase); err != nil {
+		t.Errorf("NewRoot: %v", err)
+	}
+}
+
+type testCase struct {
+	orig string
+	mnt  string
+}
+
+func newTestCase(t *testing.T) (*testCase, func()) {
+	dir := testutil.TempDir()
+	tc := &testCase{
+		orig: dir + "/orig",
+		mnt:  dir + "/mnt",
+	}
+	for _, d := range []string{tc.orig, tc.mnt} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Init(tc.orig, testPassphrase, &InitOptions{Iterations: 10, BlockSize: 512}); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewRoot(tc.orig, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &fs.Options{}
+	opts.Debug = testutil.VerboseTest()
+	server, err := fs.Mount(tc.mnt, root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tc, func() {
+		server.Unmount()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPosix(t *testing.T) {
+	for nm, fn := range posixtest.All {
+		t.Run(nm, func(t *testing.T) {
+			tc, clean := newTestCase(t)
+			defer clean()
+			fn(t, tc.mnt)
+		})
+	}
+}
+
+func TestCiphertext(t *testing.T) {
+	tc, clean := newTestCase(t)
+	defer clean()
+
+	if err := os.Mkdir(tc.mnt+"/secretdir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("secret content "), 100)
+	if err := ioutil.WriteFile(tc.mnt+"/secretdir/secretfile", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("secrettarget", tc.mnt+"/secretdir/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := filepath.Walk(tc.orig, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.Contains(p, "secret") {
+			t.Errorf("plaintext name %q", p)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if strings.Contains(target, "secret") {
+				t.Errorf("plaintext target %q", target)
+			}
+		} else if fi.Mode().IsRegular() {
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			if bytes.Contains(data, []byte("secret")) {
+				t.Errorf("plaintext content in %q", p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := ioutil.ReadFile(tc.mnt + "/secretdir/secretfile"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, content) {
+		t.Errorf("content mismatch")
+	}
+	if got, err := os.Readlink(tc.mnt + "/secretdir/link"); err != nil {
+		t.Fatal(err)
+	} else if got != "secrettarget" {
+		t.Errorf("got target %q", got)
+	}
+	if fi, err := os.Lstat(tc.mnt + "/secretdir/link"); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != int64(len("secrettarget")) {
+		t.Errorf("got symlink size %d", fi.Size())
+	}
+	entries, err := ioutil.ReadDir(tc.mnt + "/secretdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, ",") != "link,secretfile" {
+		t.Errorf("got entries %v", names)
+	}
+}
+
+func TestSparse(t *testing.T) {
+	tc, clean := newTestCase(t)
+	defer clean()
+
+	f, err := os.Create(tc.mnt + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	want := []byte("abc")
+	if _, err := f.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	// Write past the end, leaving a hole of several blocks.
+	if _, err := f.WriteAt([]byte("xyz"), 2000); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, make([]byte, 2000-len(want))...)
+	want = append(want, "xyz"...)
+
+	check := func(what string) {
+		t.Helper()
+		got, err := ioutil.ReadFile(tc.mnt + "/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", what, got, want)
+		}
+		var st syscall.Stat_t
+		if err := syscall.Stat(tc.mnt+"/file", &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Size != int64(len(want)) {
+			t.Errorf("%s: got size %d, want %d", what, st.Size, len(want))
+		}
+	}
+	check("write past end")
+
+	if err := f.Truncate(3000); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, make([]byte, 3000-len(want))...)
+	check("truncate up")
+
+	if err := f.Truncate(700); err != nil {
+		t.Fatal(err)
+	}
+	want = want[:700]
+	check("truncate down")
+
+	if _, err := f.WriteAt([]byte("123"), 510); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[510:], "123")
+	check("write across blocks")
+}
+
+func TestLongNames(t *testing.T) {
+	tc, clean := newTestCase(t)
+	defer clean()
+
+	long := strings.Repeat("x", 200)
+	long2 := strings.Repeat("y", 250)
+	if err := ioutil.WriteFile(tc.mnt+"/"+long, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(tc.mnt+"/"+long2, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tc.mnt+"/"+long, tc.mnt+"/"+long2+"/"+long2); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(tc.mnt + "/" + long2 + "/" + long2); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "content" {
+		t.Errorf("got %q, want %q", got, "content")
+	}
+
+	for _, dir := range []string{tc.mnt, tc.mnt + "/" + long2} {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name() != long2 {
+			t.Errorf("%s: got %d entries, want %q", dir, len(entries), long2)
+		}
+	}
+
+	// The encrypted names are hashed, with one name file per
+	// entry.
+	count := func() (names int) {
+		err := filepath.Walk(tc.orig, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if len(fi.Name()) > maxNameLen {
+				t.Errorf("name too long: %q", fi.Name())
+			}
+			if strings.HasSuffix(fi.Name(), longNameSuffix) {
+				names++
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+	if got := count(); got != 2 {
+		t.Errorf("got %d name files, want 2", got)
+	}
+
+	if err := os.Remove(tc.mnt + "/" + long2 + "/" + long2); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(tc.mnt + "/" + long2); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(); got != 0 {
+		t.Errorf("got %d name files after removal, want 0", got)
+	}
+}
+
+func TestReadDuringWrite(t *testing.T) {
+	tc, clean := newTestCase(t)
+	defer clean()
+
+	a := bytes.Repeat([]byte("a"), 2000)
+	b := bytes.Repeat([]byte("b"), 2000)
+	if err := ioutil.WriteFile(tc.mnt+"/file", a, 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := os.OpenFile(tc.mnt+"/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	// With O_DIRECT, reads are not served from the page cache.
+	r, err := os.OpenFile(tc.mnt+"/file", os.O_RDONLY|syscall.O_DIRECT, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			data := a
+			if i%2 == 1 {
+				data = b
+			}
+			// Rewriting the file also rewrites its header.
+			if err := w.Truncate(0); err != nil {
+				t.Errorf("Truncate: %v", err)
+				return
+			}
+			if _, err := w.WriteAt(data, 0); err != nil {
+				t.Errorf("WriteAt: %v", err)
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 2000)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if _, err := r.ReadAt(buf, 0); err != nil && err != io.EOF {
+			t.Fatalf("ReadAt: %v", err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptfs
+
+import (
+	"crypto/cipher"
+)
+
+// This file implements EME (ECB-Mix-ECB), the wide-block tweakable
+// encryption mode of Halevi and Rogaway, as described in "A Parallelizable
+// Enciphering Mode" (2003). Every bit of the output depends on every
+// bit of the input, so equal file names only encrypt to equal names
+// if they are in the same directory, and a change of the name cannot
+// be localized to a block.
+
+const emeBlockSize = 16
+
+// emeMaxBlocks is the maximum input size, in cipher blocks.
+const emeMaxBlocks = 128
+
+// emeDouble multiplies `in` by 2 in GF(2^128), little-endian.
+func emeDouble(out, in []byte) {
+	carry := in[emeBlockSize-1] >> 7
+	for j := emeBlockSize - 1; j > 0; j-- {
+		out[j] = in[j]<<1 | in[j-1]>>7
+	}
+	out[0] = in[0] << 1
+	if carry != 0 {
+		out[0] ^= 0x87
+	}
+}
+
+func emeXor(out, a, b []byte) {
+	for i := 0; i < emeBlockSize; i++ {
+		out[i] = a[i] ^ b[i]
+	}
+}
+
+// emeTransform encrypts (or decrypts, if `encrypt` is false) `in`,
+// which must be a multiple of the block size, with tweak `tweak`.
+func emeTransform(bc cipher.Block, tweak, in []byte, encrypt bool) []byte {
+	m := len(in) / emeBlockSize
+	if m == 0 || m > emeMaxBlocks || len(in)%emeBlockSize != 0 || len(tweak) != emeBlockSize {
+		panic("cryptfs: invalid EME input length")
+	}
+	crypt := bc.Decrypt
+	if encrypt {
+		crypt = bc.Encrypt
+	}
+
+	// L_j = 2^j * E(0)
+	l := make([][]byte, m)
+	li := make([]byte, emeBlockSize)
+	bc.Encrypt(li, li)
+	for j := range l {
+		emeDouble(li, li)
+		l[j] = append([]byte(nil), li...)
+	}
+
+	out := make([]byte, len(in))
+	block := func(j int) []byte {
+		return out[j*emeBlockSize : (j+1)*emeBlockSize]
+	}
+
+	// PPP_j = E(P_j xor L_j)
+	for j := 0; j < m; j++ {
+		emeXor(block(j), in[j*emeBlockSize:], l[j])
+		crypt(block(j), block(j))
+	}
+
+	// MP = (xor of PPP_j) xor T, MC = E(MP), M = MP xor MC
+	mp := make([]byte, emeBlockSize)
+	emeXor(mp, block(0), tweak)
+	for j := 1; j < m; j++ {
+		emeXor(mp, mp, block(j))
+	}
+	mc := make([]byte, emeBlockSize)
+	crypt(mc, mp)
+	mm := make([]byte, emeBlockSize)
+	emeXor(mm, mp, mc)
+
+	// CCC_j = PPP_j xor 2^(j-1) * M
+	for j := 1; j < m; j++ {
+		emeDouble(mm, mm)
+		emeXor(block(j), block(j), mm)
+	}
+
+	// CCC_1 = (xor of CCC_j) xor T xor MC
+	emeXor(block(0), mc, tweak)
+	for j := 1; j < m; j++ {
+		emeXor(block(0), block(0), block(j))
+	}
+
+	// C_j = E(CCC_j) xor L_j
+	for j := 0; j < m; j++ {
+		crypt(block(j), block(j))
+		emeXor(block(j), block(j), l[j])
+	}
+	return out
+}
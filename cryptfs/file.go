@@ -0,0 +1,318 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptfs
+
+import (
+	"context"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// cryptFile is an open encrypted file. Changes to the content are
+// made with the lock of the node held, so concurrent writes to a
+// block through different handles do not overwrite each other.
+type cryptFile struct {
+	node *cryptNode
+	fd   int
+}
+
+var _ = (fs.FileReader)((*cryptFile)(nil))
+var _ = (fs.FileWriter)((*cryptFile)(nil))
+var _ = (fs.FileGetattrer)((*cryptFile)(nil))
+var _ = (fs.FileFlusher)((*cryptFile)(nil))
+var _ = (fs.FileFsyncer)((*cryptFile)(nil))
+var _ = (fs.FileReleaser)((*cryptFile)(nil))
+var _ = (fs.FileAllocater)((*cryptFile)(nil))
+
+// Read does not take the lock of the node, so reads run in parallel
+// with each other and with writes. Each block is authenticated, so a
+// read that overlaps a write sees either the old or the new content
+// of a block, or fails to decrypt it. In the latter case, it waits
+// for the write to finish, and tries again.
+func (f *cryptFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	for {
+		seq := atomic.LoadUint32(&f.node.writes)
+		data, errno := f.node.root.readAt(f.fd, dest, off)
+		if errno == 0 {
+			return fuse.ReadResultData(data), 0
+		}
+		if seq%2 == 0 && atomic.LoadUint32(&f.node.writes) == seq {
+			return nil, errno
+		}
+		f.node.mu.Lock()
+		f.node.mu.Unlock()
+	}
+}
+
+func (f *cryptFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	f.node.beginWrite()
+	defer f.node.endWrite()
+	if errno := f.node.root.writeAt(f.fd, data, off); errno != 0 {
+		return 0, errno
+	}
+	return uint32(len(data)), 0
+}
+
+// Getattr returns the attributes of the encrypted file, which
+// cryptNode.Getattr translates.
+func (f *cryptFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.fd, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	out.FromStat(&st)
+	return 0
+}
+
+func (f *cryptFile) Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno {
+	if mode != 0 {
+		return syscall.EOPNOTSUPP
+	}
+	f.node.beginWrite()
+	defer f.node.endWrite()
+	cur, errno := f.node.root.size(f.fd)
+	if errno != 0 {
+		return errno
+	}
+	if off+size <= cur {
+		return 0
+	}
+	return f.node.root.truncate(f.fd, off+size)
+}
+
+func (f *cryptFile) Flush(ctx context.Context) syscall.Errno {
+	// As for the loopback file, closing a dup'd descriptor
+	// flushes without closing the file.
+	newFd, err := syscall.Dup(f.fd)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	return fs.ToErrno(syscall.Close(newFd))
+}
+
+func (f *cryptFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return fs.ToErrno(syscall.Fsync(f.fd))
+}
+
+func (f *cryptFile) Release(ctx context.Context) syscall.Errno {
+	return fs.ToErrno(syscall.Close(f.fd))
+}
+
+// size returns the plaintext size of the file `fd`.
+func (r *cryptRoot) size(fd int) (uint64, syscall.Errno) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return 0, fs.ToErrno(err)
+	}
+	return r.content.plainSize(uint64(st.Size)), 0
+}
+
+// fileID returns the ID of the file `fd`. For an empty file, it
+// returns nil, or writes a new header if `create` is set.
+func (r *cryptRoot) fileID(fd int, create bool) ([]byte, syscall.Errno) {
+	h := make([]byte, headerLen)
+	n, err := syscall.Pread(fd, h, 0)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	if n == 0 {
+		if !create {
+			return nil, 0
+		}
+		if h, err = newHeader(); err != nil {
+			return nil, fs.ToErrno(err)
+		}
+		if _, err := syscall.Pwrite(fd, h, 0); err != nil {
+			return nil, fs.ToErrno(err)
+		}
+	} else if n < headerLen {
+		return nil, syscall.EIO
+	}
+	id, err := parseHeader(h)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	return id, 0
+}
+
+// readBlock returns the plaintext of block `idx`, which is shorter
+// than the block size for the last block, and empty past the end of
+// the file.
+func (r *cryptRoot) readBlock(fd int, id []byte, idx int64) ([]byte, syscall.Errno) {
+	buf := make([]byte, r.content.cipherBS())
+	n, err := syscall.Pread(fd, buf, r.content.blockOffset(idx))
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	plain, err := r.content.decryptBlock(buf[:n], idx, id)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	return plain, 0
+}
+
+// writeBlock encrypts and writes block `idx`.
+func (r *cryptRoot) writeBlock(fd int, id []byte, idx int64, plain []byte) syscall.Errno {
+	enc, err := r.content.encryptBlock(plain, idx, id)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	_, err = syscall.Pwrite(fd, enc, r.content.blockOffset(idx))
+	return fs.ToErrno(err)
+}
+
+// readAt reads plaintext at offset `off`.
+func (r *cryptRoot) readAt(fd int, dest []byte, off int64) ([]byte, syscall.Errno) {
+	if len(dest) == 0 {
+		return nil, 0
+	}
+	id, errno := r.fileID(fd, false)
+	if errno != 0 || id == nil {
+		return nil, errno
+	}
+
+	bs := r.content.plainBS
+	cbs := r.content.cipherBS()
+	first := off / bs
+	last := (off + int64(len(dest)) - 1) / bs
+	buf := make([]byte, (last-first+1)*cbs)
+	n, err := syscall.Pread(fd, buf, r.content.blockOffset(first))
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	buf = buf[:n]
+
+	plain := make([]byte, 0, (last-first+1)*bs)
+	for idx := first; len(buf) > 0; idx++ {
+		c := buf
+		if int64(len(c)) > cbs {
+			c = c[:cbs]
+		}
+		p, err := r.content.decryptBlock(c, idx, id)
+		if err != nil {
+			return nil, syscall.EIO
+		}
+		plain = append(plain, p...)
+		buf = buf[len(c):]
+	}
+
+	skip := off - first*bs
+	if skip >= int64(len(plain)) {
+		return nil, 0
+	}
+	plain = plain[skip:]
+	if len(plain) > len(dest) {
+		plain = plain[:len(dest)]
+	}
+	return plain, 0
+}
+
+// writeAt writes plaintext at offset `off`.
+func (r *cryptRoot) writeAt(fd int, data []byte, off int64) syscall.Errno {
+	if len(data) == 0 {
+		return 0
+	}
+	id, errno := r.fileID(fd, true)
+	if errno != 0 {
+		return errno
+	}
+	sz, errno := r.size(fd)
+	if errno != 0 {
+		return errno
+	}
+	size := int64(sz)
+	if off > size {
+		if errno := r.grow(fd, id, size, off); errno != 0 {
+			return errno
+		}
+	}
+
+	bs := r.content.plainBS
+	end := off + int64(len(data))
+	for idx := off / bs; idx*bs < end; idx++ {
+		start := idx * bs
+		lo, hi := int64(0), bs
+		if off > start {
+			lo = off - start
+		}
+		if end < start+hi {
+			hi = end - start
+		}
+
+		var blk []byte
+		if (lo > 0 || hi < bs) && start < size {
+			if blk, errno = r.readBlock(fd, id, idx); errno != 0 {
+				return errno
+			}
+		}
+		if int64(len(blk)) < hi {
+			blk = append(blk, make([]byte, hi-int64(len(blk)))...)
+		}
+		copy(blk[lo:hi], data[start+lo-off:])
+		if errno := r.writeBlock(fd, id, idx, blk); errno != 0 {
+			return errno
+		}
+	}
+	return 0
+}
+
+// grow pads the last block of a file of size `size` with zeros, so
+// it can be extended to `newSize`. The blocks after it are holes, or
+// written by the caller.
+func (r *cryptRoot) grow(fd int, id []byte, size, newSize int64) syscall.Errno {
+	bs := r.content.plainBS
+	if size%bs == 0 {
+		return 0
+	}
+	idx := size / bs
+	blk, errno := r.readBlock(fd, id, idx)
+	if errno != 0 {
+		return errno
+	}
+	n := newSize - idx*bs
+	if n > bs {
+		n = bs
+	}
+	blk = append(blk, make([]byte, n-int64(len(blk)))...)
+	return r.writeBlock(fd, id, idx, blk)
+}
+
+// truncate sets the plaintext size of the file.
+func (r *cryptRoot) truncate(fd int, newSize uint64) syscall.Errno {
+	sz, errno := r.size(fd)
+	if errno != 0 {
+		return errno
+	}
+	if newSize == 0 {
+		return fs.ToErrno(syscall.Ftruncate(fd, 0))
+	}
+	id, errno := r.fileID(fd, true)
+	if errno != 0 {
+		return errno
+	}
+
+	size, bs := int64(sz), r.content.plainBS
+	if int64(newSize) > size {
+		if errno := r.grow(fd, id, size, int64(newSize)); errno != 0 {
+			return errno
+		}
+	} else if rem := int64(newSize) % bs; rem != 0 {
+		idx := int64(newSize) / bs
+		blk, errno := r.readBlock(fd, id, idx)
+		if errno != 0 {
+			return errno
+		}
+		if int64(len(blk)) > rem {
+			blk = blk[:rem]
+		}
+		if errno := r.writeBlock(fd, id, idx, blk); errno != 0 {
+			return errno
+		}
+	}
+	return fs.ToErrno(syscall.Ftruncate(fd, int64(r.content.cipherSize(newSize))))
+}
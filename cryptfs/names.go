@@ -0,0 +1,110 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"strings"
+	"syscall"
+)
+
+// DirIVName is the name of the file holding the random IV of a
+// directory, which is the tweak for encrypting the names in it.
+// Names that are equal in different directories thus encrypt
+// differently.
+const DirIVName = "cryptfs.diriv"
+
+const dirIVLen = emeBlockSize
+
+// maxNameLen is the maximum length of a name in the directory with
+// the encrypted files. Longer encrypted names are hashed.
+const maxNameLen = 255
+
+// longNamePrefix starts the names of entries whose encrypted name is
+// hashed. The encrypted name is stored in a file with the same name
+// and longNameSuffix.
+const (
+	longNamePrefix = "cryptfs.longname."
+	longNameSuffix = ".name"
+)
+
+var nameEncoding = base64.RawURLEncoding
+
+// nameCrypt encrypts file names with EME. Names are padded to the
+// block size as in PKCS#7, and stored in URL-safe base64.
+type nameCrypt struct {
+	bc cipher.Block
+}
+
+func newNameCrypt(key []byte) (*nameCrypt, error) {
+	bc, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &nameCrypt{bc}, nil
+}
+
+func newDirIV() ([]byte, error) {
+	iv := make([]byte, dirIVLen)
+	_, err := io.ReadFull(rand.Reader, iv)
+	return iv, err
+}
+
+// encrypt returns the encrypted form of `name`, in a directory with
+// IV `iv`.
+func (nc *nameCrypt) encrypt(name string, iv []byte) (string, syscall.Errno) {
+	pad := emeBlockSize - len(name)%emeBlockSize
+	if len(name)+pad > emeMaxBlocks*emeBlockSize {
+		return "", syscall.ENAMETOOLONG
+	}
+	plain := append([]byte(name), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	return nameEncoding.EncodeToString(emeTransform(nc.bc, iv, plain, true)), 0
+}
+
+// storedName returns the name under which the entry with encrypted
+// name `enc` is stored.
+func storedName(enc string) string {
+	if len(enc) <= maxNameLen {
+		return enc
+	}
+	sum := sha256.Sum256([]byte(enc))
+	return longNamePrefix + nameEncoding.EncodeToString(sum[:])
+}
+
+// isLongName reports whether `stored` is the hashed name of an entry.
+func isLongName(stored string) bool {
+	return strings.HasPrefix(stored, longNamePrefix) && !strings.HasSuffix(stored, longNameSuffix)
+}
+
+// decrypt returns the plaintext of the encrypted name `enc`, in a
+// directory with IV `iv`. It returns false for names that were not
+// encrypted with the key.
+func (nc *nameCrypt) decrypt(enc string, iv []byte) (string, bool) {
+	data, err := nameEncoding.DecodeString(enc)
+	if err != nil || len(data) == 0 || len(data)%emeBlockSize != 0 || len(data) > emeMaxBlocks*emeBlockSize {
+		return "", false
+	}
+	plain := emeTransform(nc.bc, iv, data, false)
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > emeBlockSize {
+		return "", false
+	}
+	for _, c := range plain[len(plain)-pad:] {
+		if int(c) != pad {
+			return "", false
+		}
+	}
+	name := string(plain[:len(plain)-pad])
+	if name == "" || name == "." || name == ".." || bytes.IndexByte([]byte(name), '/') >= 0 || bytes.IndexByte([]byte(name), 0) >= 0 {
+		return "", false
+	}
+	return name, true
+}
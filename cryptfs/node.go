@@ -0,0 +1,509 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptfs
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// cryptNode is a file or directory in the decrypted view. It is a
+// loopback node for the encrypted file, which translates names and
+// content. The loopback node finds the encrypted file through
+// cryptRoot.encodeName.
+type cryptNode struct {
+	fs.LoopbackNode
+
+	root *cryptRoot
+
+	// mu serializes changes to the content, as writes may have
+	// to read, modify and write back a block.
+	mu sync.Mutex
+
+	// writes is incremented when a change to the content starts,
+	// and when it ends, so it is odd while the content changes.
+	// Reads do not take mu, and use it to detect that they
+	// overlapped a change.
+	writes uint32
+
+	// iv is the IV of the directory, once it has been read.
+	ivMu sync.Mutex
+	iv   []byte
+}
+
+var _ = (fs.NodeLookuper)((*cryptNode)(nil))
+var _ = (fs.NodeGetattrer)((*cryptNode)(nil))
+var _ = (fs.NodeSetattrer)((*cryptNode)(nil))
+var _ = (fs.NodeReaddirer)((*cryptNode)(nil))
+var _ = (fs.NodeOpener)((*cryptNode)(nil))
+var _ = (fs.NodeCreater)((*cryptNode)(nil))
+var _ = (fs.NodeMknoder)((*cryptNode)(nil))
+var _ = (fs.NodeMkdirer)((*cryptNode)(nil))
+var _ = (fs.NodeRmdirer)((*cryptNode)(nil))
+var _ = (fs.NodeUnlinker)((*cryptNode)(nil))
+var _ = (fs.NodeRenamer)((*cryptNode)(nil))
+var _ = (fs.NodeLinker)((*cryptNode)(nil))
+var _ = (fs.NodeSymlinker)((*cryptNode)(nil))
+var _ = (fs.NodeReadlinker)((*cryptNode)(nil))
+
+// beginWrite locks the content of the file for a change.
+func (n *cryptNode) beginWrite() {
+	n.mu.Lock()
+	atomic.AddUint32(&n.writes, 1)
+}
+
+func (n *cryptNode) endWrite() {
+	atomic.AddUint32(&n.writes, 1)
+	n.mu.Unlock()
+}
+
+// dirIV returns the IV of the directory n.
+func (n *cryptNode) dirIV() ([]byte, syscall.Errno) {
+	n.ivMu.Lock()
+	defer n.ivMu.Unlock()
+	if n.iv != nil {
+		return n.iv, 0
+	}
+	p, errno := n.BackingPath()
+	if errno != 0 {
+		return nil, errno
+	}
+	iv, err := ioutil.ReadFile(filepath.Join(p, DirIVName))
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	if len(iv) != dirIVLen {
+		return nil, syscall.EIO
+	}
+	n.iv = iv
+	return iv, 0
+}
+
+// encryptName returns the name under which the entry `name` in the
+// directory n is stored, and its full encrypted name.
+func (n *cryptNode) encryptName(name string) (stored, enc string, errno syscall.Errno) {
+	iv, errno := n.dirIV()
+	if errno != 0 {
+		return "", "", errno
+	}
+	if enc, errno = n.root.names.encrypt(name, iv); errno != 0 {
+		return "", "", errno
+	}
+	return storedName(enc), enc, 0
+}
+
+// addLongName writes the file holding the encrypted name of the
+// entry `name`, if its name is hashed. It returns a function that
+// removes the file again, for when creating the entry fails.
+func (n *cryptNode) addLongName(name string) (undo func(), errno syscall.Errno) {
+	undo = func() {}
+	stored, enc, errno := n.encryptName(name)
+	if errno != 0 || stored == enc {
+		return undo, errno
+	}
+	dir, errno := n.BackingPath()
+	if errno != 0 {
+		return undo, errno
+	}
+	p := filepath.Join(dir, stored+longNameSuffix)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if os.IsExist(err) {
+		// The entry is being replaced.
+		return undo, 0
+	} else if err != nil {
+		return undo, fs.ToErrno(err)
+	}
+	_, err = f.WriteString(enc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(p)
+		return undo, fs.ToErrno(err)
+	}
+	return func() { os.Remove(p) }, 0
+}
+
+// removeLongName removes the file holding the encrypted name of the
+// removed entry `name`, if its name is hashed.
+func (n *cryptNode) removeLongName(name string) {
+	stored, enc, errno := n.encryptName(name)
+	if errno != 0 || stored == enc {
+		return
+	}
+	if dir, errno := n.BackingPath(); errno == 0 {
+		os.Remove(filepath.Join(dir, stored+longNameSuffix))
+	}
+}
+
+// plainAttr translates the attributes in `out` of an encrypted file
+// to the plaintext. For symlinks, the target is read from the path
+// returned by `p`.
+func (r *cryptRoot) plainAttr(out *fuse.Attr, p func() (string, syscall.Errno)) {
+	switch out.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		out.Size = r.content.plainSize(out.Size)
+	case syscall.S_IFLNK:
+		path, errno := p()
+		if errno != 0 {
+			return
+		}
+		if enc, err := os.Readlink(path); err == nil {
+			if target, errno := r.decryptTarget([]byte(enc)); errno == 0 {
+				out.Size = uint64(len(target))
+			}
+		}
+	}
+}
+
+// childAttr translates the attributes of the entry `name`. The new
+// Inode of the entry is only added to the tree once the operation
+// returns, so its path is found through n.
+func (n *cryptNode) childAttr(name string, out *fuse.EntryOut) {
+	n.root.plainAttr(&out.Attr, func() (string, syscall.Errno) {
+		return n.childBackingPath(name)
+	})
+}
+
+func (n *cryptNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ch, errno := n.LoopbackNode.Lookup(ctx, name, out)
+	if errno != 0 {
+		return nil, errno
+	}
+	n.childAttr(name, out)
+	return ch, 0
+}
+
+func (n *cryptNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if errno := n.LoopbackNode.Getattr(ctx, f, out); errno != 0 {
+		return errno
+	}
+	n.root.plainAttr(&out.Attr, n.BackingPath)
+	return 0
+}
+
+func (n *cryptNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if sz, ok := in.GetSize(); ok {
+		if errno := n.truncate(f, sz); errno != 0 {
+			return errno
+		}
+		rest := *in
+		rest.Valid &^= fuse.FATTR_SIZE
+		if rest.Valid&^(fuse.FATTR_FH|fuse.FATTR_LOCKOWNER) == 0 {
+			// Only the size was set, which also works for
+			// files that are open but unlinked.
+			return n.Getattr(ctx, f, out)
+		}
+		in = &rest
+	}
+	if errno := n.LoopbackNode.Setattr(ctx, f, in, out); errno != 0 {
+		return errno
+	}
+	n.root.plainAttr(&out.Attr, n.BackingPath)
+	return 0
+}
+
+// truncate sets the plaintext size of the file, through `f` if it is
+// open.
+func (n *cryptNode) truncate(f fs.FileHandle, sz uint64) syscall.Errno {
+	fd := -1
+	if cf, ok := f.(*cryptFile); ok {
+		fd = cf.fd
+	} else {
+		p, errno := n.BackingPath()
+		if errno != 0 {
+			return errno
+		}
+		var err error
+		fd, err = syscall.Open(p, syscall.O_RDWR, 0)
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+		defer syscall.Close(fd)
+	}
+	n.beginWrite()
+	defer n.endWrite()
+	return n.root.truncate(fd, sz)
+}
+
+func (n *cryptNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	iv, errno := n.dirIV()
+	if errno != 0 {
+		return nil, errno
+	}
+	dir, errno := n.BackingPath()
+	if errno != 0 {
+		return nil, errno
+	}
+	ds, errno := n.LoopbackNode.Readdir(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer ds.Close()
+
+	var entries []fuse.DirEntry
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			return nil, errno
+		}
+		enc := e.Name
+		if isLongName(enc) {
+			data, err := ioutil.ReadFile(filepath.Join(dir, enc+longNameSuffix))
+			if err != nil || storedName(string(data)) != enc {
+				continue
+			}
+			enc = string(data)
+		}
+		name, ok := n.root.names.decrypt(enc, iv)
+		if !ok {
+			// The IV file, the configuration file, the
+			// file for a hashed name, or something that
+			// was not written by us.
+			continue
+		}
+		e.Name = name
+		entries = append(entries, e)
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+// openFlags returns the flags for opening the encrypted file. Writing
+// may need to read a block, and offsets are computed by us.
+func openFlags(flags uint32) int {
+	f := int(flags) &^ (syscall.O_ACCMODE | syscall.O_APPEND | oDirect)
+	return f | syscall.O_RDWR
+}
+
+func (n *cryptNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	p, errno := n.BackingPath()
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	fd, err := syscall.Open(p, openFlags(flags), 0)
+	if err == syscall.EACCES && flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		fd, err = syscall.Open(p, int(flags)&^oDirect, 0)
+	}
+	if err != nil {
+		return nil, 0, fs.ToErrno(err)
+	}
+	return &cryptFile{node: n, fd: fd}, 0, 0
+}
+
+func (n *cryptNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	ch, errno := n.Mknod(ctx, name, mode|syscall.S_IFREG, 0, out)
+	if errno == syscall.EEXIST && flags&syscall.O_EXCL == 0 {
+		ch, errno = n.Lookup(ctx, name, out)
+	}
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	p, errno := n.childBackingPath(name)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	fd, err := syscall.Open(p, openFlags(flags&^(syscall.O_CREAT|syscall.O_EXCL)), 0)
+	if err != nil {
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+	return ch, &cryptFile{node: ch.Operations().(*cryptNode), fd: fd}, 0, 0
+}
+
+func (n *cryptNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	undo, errno := n.addLongName(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	ch, errno := n.LoopbackNode.Mknod(ctx, name, mode, rdev, out)
+	if errno != 0 {
+		undo()
+		return nil, errno
+	}
+	n.childAttr(name, out)
+	return ch, 0
+}
+
+func (n *cryptNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	undo, errno := n.addLongName(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	ch, errno := n.LoopbackNode.Mkdir(ctx, name, mode, out)
+	if errno != 0 {
+		undo()
+		return nil, errno
+	}
+	p, errno := n.childBackingPath(name)
+	if errno == 0 {
+		errno = fs.ToErrno(writeDirIV(p))
+	}
+	if errno != 0 {
+		n.LoopbackNode.Rmdir(ctx, name)
+		undo()
+		return nil, errno
+	}
+	return ch, 0
+}
+
+// removeDir removes the empty encrypted directory `p` with `remove`,
+// which fails if the directory is not empty. The IV file is moved
+// out of the way first, and put back if `remove` fails.
+func removeDir(p string, remove func() syscall.Errno) syscall.Errno {
+	d, err := os.Open(p)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	for _, nm := range names {
+		if nm != DirIVName {
+			return syscall.ENOTEMPTY
+		}
+	}
+	// The name cannot be mistaken for an encrypted name.
+	tmp := filepath.Join(filepath.Dir(p), ".rmdir-"+filepath.Base(p))
+	if err := os.Rename(filepath.Join(p, DirIVName), tmp); err != nil && !os.IsNotExist(err) {
+		return fs.ToErrno(err)
+	}
+	if errno := remove(); errno != 0 {
+		os.Rename(tmp, filepath.Join(p, DirIVName))
+		return errno
+	}
+	os.Remove(tmp)
+	return 0
+}
+
+// childBackingPath returns the path of the encrypted entry `name`.
+func (n *cryptNode) childBackingPath(name string) (string, syscall.Errno) {
+	dir, errno := n.BackingPath()
+	if errno != 0 {
+		return "", errno
+	}
+	stored, _, errno := n.encryptName(name)
+	if errno != 0 {
+		return "", errno
+	}
+	return filepath.Join(dir, stored), 0
+}
+
+func (n *cryptNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	p, errno := n.childBackingPath(name)
+	if errno != 0 {
+		return errno
+	}
+	errno = removeDir(p, func() syscall.Errno {
+		return n.LoopbackNode.Rmdir(ctx, name)
+	})
+	if errno == 0 {
+		n.removeLongName(name)
+	}
+	return errno
+}
+
+func (n *cryptNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	errno := n.LoopbackNode.Unlink(ctx, name)
+	if errno == 0 {
+		n.removeLongName(name)
+	}
+	return errno
+}
+
+func (n *cryptNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	np := newParent.EmbeddedInode().Operations().(*cryptNode)
+	undo, errno := np.addLongName(newName)
+	if errno != 0 {
+		return errno
+	}
+	rename := func() syscall.Errno {
+		return n.LoopbackNode.Rename(ctx, name, newParent, newName, flags)
+	}
+
+	if flags == 0 {
+		p, errno := np.childBackingPath(newName)
+		if errno != 0 {
+			undo()
+			return errno
+		}
+		var st syscall.Stat_t
+		if err := syscall.Lstat(p, &st); err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			// Replacing an empty directory.
+			inner := rename
+			rename = func() syscall.Errno { return removeDir(p, inner) }
+		}
+	}
+	if errno := rename(); errno != 0 {
+		undo()
+		return errno
+	}
+	if flags&fs.RENAME_EXCHANGE == 0 {
+		n.removeLongName(name)
+	}
+	return 0
+}
+
+func (n *cryptNode) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	undo, errno := n.addLongName(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	ch, errno := n.LoopbackNode.Link(ctx, target, name, out)
+	if errno != 0 {
+		undo()
+		return nil, errno
+	}
+	n.childAttr(name, out)
+	return ch, 0
+}
+
+func (n *cryptNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	enc, err := n.root.content.encryptBlock([]byte(target), 0, nil)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	undo, errno := n.addLongName(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	ch, errno := n.LoopbackNode.Symlink(ctx, base64.RawURLEncoding.EncodeToString(enc), name, out)
+	if errno != 0 {
+		undo()
+		return nil, errno
+	}
+	out.Attr.Size = uint64(len(target))
+	return ch, 0
+}
+
+func (n *cryptNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	enc, errno := n.LoopbackNode.Readlink(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	return n.root.decryptTarget(enc)
+}
+
+// decryptTarget decrypts the target of a symlink.
+func (r *cryptRoot) decryptTarget(enc []byte) ([]byte, syscall.Errno) {
+	data, err := base64.RawURLEncoding.DecodeString(string(enc))
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	target, err := r.content.decryptBlock(data, 0, nil)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	return target, 0
+}
@@ -7,7 +7,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -28,6 +31,8 @@ func main() {
 			"Enabled by default.")
 	portableInodes := flag.Bool("portable-inodes", false,
 		"Use sequential 32-bit inode numbers.")
+	config := flag.String("config", "",
+		"JSON file declaring unions. It is reloaded when it changes, or on SIGHUP.")
 
 	flag.Parse()
 
@@ -54,6 +59,7 @@ func main() {
 			ClientInodes: *hardlinks,
 		},
 		HideReadonly: *hide_readonly_link,
+		ConfigFile:   *config,
 	}
 	fsOpts := nodefs.Options{
 		PortableInodes: *portableInodes,
@@ -69,6 +75,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *config != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := unionfs.ReloadAutoUnionConfig(gofs); err != nil {
+					log.Printf("reload %s: %v", *config, err)
+				}
+			}
+		}()
+	}
+
 	state.Serve()
 	time.Sleep(1 * time.Second)
 }
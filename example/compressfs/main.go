@@ -0,0 +1,52 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This is main program driver for github.com/hanwen/go-fuse/compressfs,
+// a filesystem that stores the files of a directory compressed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/compressfs"
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+func main() {
+	debug := flag.Bool("debug", false, "print debugging messages.")
+	chunk := flag.Int("chunk", 64<<10, "size of the compressed chunks.")
+	level := flag.Int("level", 0, "compression level, from 1 to 9.")
+	exclude := flag.String("exclude", "*.gz,*.bz2,*.xz,*.zst,*.zip,*.jpg,*.png",
+		"comma separated patterns of names of files not to compress.")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s MOUNTPOINT DIR\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	copts := &compressfs.Options{
+		ChunkSize: *chunk,
+		Level:     *level,
+	}
+	if *exclude != "" {
+		copts.Exclude = strings.Split(*exclude, ",")
+	}
+	root, err := compressfs.NewRoot(flag.Arg(1), copts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NewRoot failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	opts := &fs.Options{}
+	opts.Debug = *debug
+	server, err := fs.Mount(flag.Arg(0), root, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Mount fail: %v\n", err)
+		os.Exit(1)
+	}
+	server.Wait()
+}
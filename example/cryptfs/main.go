@@ -0,0 +1,67 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This is main program driver for github.com/hanwen/go-fuse/cryptfs,
+// a filesystem that shows the files of an encrypted directory
+// decrypted.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/cryptfs"
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// readPassphrase reads the passphrase from $CRYPTFS_PASSPHRASE, or
+// from the first line of stdin.
+func readPassphrase() []byte {
+	if p := os.Getenv("CRYPTFS_PASSPHRASE"); p != "" {
+		return []byte(p)
+	}
+	fmt.Fprintf(os.Stderr, "Passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintf(os.Stderr, "reading passphrase: %v\n", err)
+		os.Exit(1)
+	}
+	return []byte(strings.TrimRight(line, "\r\n"))
+}
+
+func main() {
+	debug := flag.Bool("debug", false, "print debugging messages.")
+	initDir := flag.Bool("init", false, "initialize CIPHERDIR instead of mounting it.")
+	flag.Parse()
+	if *initDir && flag.NArg() == 1 {
+		if err := cryptfs.Init(flag.Arg(0), readPassphrase(), nil); err != nil {
+			fmt.Fprintf(os.Stderr, "Init failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.NArg() < 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s MOUNTPOINT CIPHERDIR\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -init CIPHERDIR\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	root, err := cryptfs.NewRoot(flag.Arg(1), readPassphrase())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NewRoot failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	opts := &fs.Options{}
+	opts.Debug = *debug
+	server, err := fs.Mount(flag.Arg(0), root, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Mount fail: %v\n", err)
+		os.Exit(1)
+	}
+	server.Wait()
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This is main program driver for github.com/hanwen/go-fuse/poolfs,
+// a filesystem that pools directories on several disks.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/poolfs"
+)
+
+func main() {
+	debug := flag.Bool("debug", false, "print debugging messages.")
+	other := flag.Bool("allow-other", false, "mount with -o allowother.")
+	create := flag.String("create", "epmfs", "policy for creating entries.")
+	search := flag.String("search", "ff", "policy for looking up entries.")
+	action := flag.String("action", "epall", "policy for changing entries.")
+	minFree := flag.Uint64("minfreespace", 4<<30, "bytes that must be free on a branch to create entries in it.")
+	control := flag.String("control", ".poolfs", "name of the control file, or \"-\" for none.")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s MOUNTPOINT BRANCH[=RW|NC|RO][:BRANCH...]\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	popts := &poolfs.Options{
+		MinFreeSpace: *minFree,
+		ControlName:  *control,
+	}
+	for _, p := range []struct {
+		name string
+		dst  *poolfs.Policy
+	}{{*create, &popts.Create}, {*search, &popts.Search}, {*action, &popts.Action}} {
+		policy, err := poolfs.ParsePolicy(p.name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		*p.dst = policy
+	}
+
+	var branches []poolfs.Branch
+	for _, s := range strings.Split(flag.Arg(1), ":") {
+		b, err := poolfs.ParseBranch(s)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		branches = append(branches, b)
+	}
+	pool, err := poolfs.New(branches, popts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "New failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	opts := &fs.Options{}
+	opts.Debug = *debug
+	opts.AllowOther = *other
+	server, err := fs.Mount(flag.Arg(0), pool.Root(), opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Mount fail: %v\n", err)
+		os.Exit(1)
+	}
+	server.Wait()
+}
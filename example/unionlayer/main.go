@@ -0,0 +1,65 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This program captures the changes in the writable branch of a
+// union from github.com/hanwen/go-fuse/newunionfs or
+// github.com/hanwen/go-fuse/unionfs, either as an OCI image layer, or
+// as a new read-only branch. The union must be unmounted, or quiesced
+// for export.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	unionfs "github.com/hanwen/go-fuse/v2/newunionfs"
+)
+
+func main() {
+	format := flag.String("whiteouts", "deletions", "whiteout format: deletions, overlay, user-overlay or aufs.")
+	deldirname := flag.String("deletion_dirname", "DELETIONS", "directory of the deletions format; GOUNIONFS_DELETIONS for the unionfs command.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage:\n  %s [options] export RW-DIRECTORY RO-DIRECTORY ... > LAYER.tar\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [options] commit NEW-DIRECTORY RW-DIRECTORY RO-DIRECTORY ...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\noptions:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var wh unionfs.Whiteouts
+	switch *format {
+	case "deletions":
+		wh = unionfs.NewDeletionsWhiteoutsIn(*deldirname)
+	case "overlay":
+		wh = unionfs.NewOverlayWhiteouts(false)
+	case "user-overlay":
+		wh = unionfs.NewOverlayWhiteouts(true)
+	case "aufs":
+		wh = unionfs.NewAUFSWhiteouts()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown whiteout format %q\n", *format)
+		os.Exit(2)
+	}
+
+	args := flag.Args()
+	var err error
+	switch {
+	case len(args) >= 2 && args[0] == "export":
+		w := bufio.NewWriter(os.Stdout)
+		if err = unionfs.ExportLayer(args[1:], wh, w); err == nil {
+			err = w.Flush()
+		}
+	case len(args) >= 3 && args[0] == "commit":
+		err = unionfs.CommitLayer(args[2:], wh, args[1])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
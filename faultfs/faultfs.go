@@ -0,0 +1,374 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package faultfs injects faults, such as I/O errors, delays and
+// short reads, into a file system, for testing how applications cope
+// with them.
+//
+// An Injector is an fs.Interceptor; mount the file system with it to
+// inject faults:
+//
+//	inj := faultfs.New(&faultfs.Options{Rules: rules})
+//	server, err := fs.Mount(dir, root, &fs.Options{
+//		Interceptors: []fs.Interceptor{inj.Intercept},
+//	})
+package faultfs
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Options holds the parameters for New.
+type Options struct {
+	// Rules are the rules to start with.
+	Rules []Rule
+
+	// ControlName is the name of the control file in the root
+	// directory. Reading it returns the current rules, and
+	// writing rules to it replaces them when the file is
+	// closed. If empty, ".faultfs" is used. Set it to "-" to
+	// disable the control file.
+	ControlName string
+
+	// Logger receives a line for every injected fault. If nil,
+	// the standard logger is used.
+	Logger *log.Logger
+
+	// Seed seeds the random generator used for probabilities.
+	Seed int64
+}
+
+// Injector injects faults into the operations of a file system.
+type Injector struct {
+	controlName string
+	logger      *log.Logger
+
+	mu     sync.Mutex
+	rules  []Rule
+	counts []int
+	rand   *rand.Rand
+
+	control *fs.Inode
+}
+
+// New returns an Injector. Its faults apply to the file systems
+// mounted with Intercept among their interceptors.
+func New(opts *Options) *Injector {
+	if opts == nil {
+		opts = &Options{}
+	}
+	inj := &Injector{
+		controlName: opts.ControlName,
+		logger:      opts.Logger,
+		rand:        rand.New(rand.NewSource(opts.Seed)),
+	}
+	if inj.controlName == "" {
+		inj.controlName = ".faultfs"
+	}
+	inj.SetRules(opts.Rules)
+	return inj
+}
+
+// SetRules replaces the rules, and resets the call counts.
+func (inj *Injector) SetRules(rules []Rule) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.rules = append([]Rule(nil), rules...)
+	inj.counts = make([]int, len(rules))
+}
+
+// Rules returns the current rules.
+func (inj *Injector) Rules() []Rule {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return append([]Rule(nil), inj.rules...)
+}
+
+func (inj *Injector) logf(format string, args ...interface{}) {
+	if inj.logger != nil {
+		inj.logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// nameArg has the position of the entry name in the arguments of
+// operations that operate on a directory entry.
+var nameArg = map[string]int{
+	"Lookup":  0,
+	"Mkdir":   0,
+	"Mknod":   0,
+	"Create":  0,
+	"Unlink":  0,
+	"Rmdir":   0,
+	"Rename":  0,
+	"Symlink": 1,
+	"Link":    1,
+}
+
+// opPath returns the path that rules are matched against.
+func opPath(op *fs.InterceptedOp) string {
+	p := op.Node.Path(nil)
+	if i, ok := nameArg[op.Name]; ok {
+		if name, ok := op.Args[i].(string); ok {
+			p = filepath.Join(p, name)
+		}
+	}
+	return p
+}
+
+// match returns the rule to apply to `op`, if any.
+func (inj *Injector) match(op *fs.InterceptedOp, p string) (Rule, bool) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	for i := range inj.rules {
+		r := &inj.rules[i]
+		if !r.matches(op.Name, p) {
+			continue
+		}
+		inj.counts[i]++
+		switch {
+		case r.Nth > 0:
+			if inj.counts[i] != r.Nth {
+				continue
+			}
+		case r.Probability > 0:
+			if inj.rand.Float64() >= r.Probability {
+				continue
+			}
+		}
+		return *r, true
+	}
+	return Rule{}, false
+}
+
+// Intercept is the fs.Interceptor that injects the faults.
+func (inj *Injector) Intercept(ctx context.Context, op *fs.InterceptedOp, next func(ctx context.Context) syscall.Errno) syscall.Errno {
+	if inj.isControl(op.Node) {
+		return next(ctx)
+	}
+	if op.Name == "Lookup" && op.Node.IsRoot() &&
+		inj.controlName != "-" && op.Args[0] == inj.controlName {
+		return inj.lookupControl(ctx, op)
+	}
+
+	p := opPath(op)
+	r, ok := inj.match(op, p)
+	if !ok {
+		return next(ctx)
+	}
+
+	if r.Delay > 0 {
+		inj.logf("faultfs: %s %q: delay %v", op.Name, p, r.Delay)
+		select {
+		case <-time.After(r.Delay):
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+	}
+	if r.Errno != 0 {
+		inj.logf("faultfs: %s %q: %v", op.Name, p, r.Errno)
+		return r.Errno
+	}
+
+	errno := next(ctx)
+	if errno == 0 && r.Truncate > 0 && truncateResult(op, r.Truncate) {
+		inj.logf("faultfs: %s %q: truncate to %d bytes", op.Name, p, r.Truncate)
+	}
+	return errno
+}
+
+// truncateResult shortens the result of `op` to `n` bytes. It
+// returns false if there was nothing to truncate.
+func truncateResult(op *fs.InterceptedOp, n int) bool {
+	switch op.Name {
+	case "Read":
+		res, ok := op.Results[0].(fuse.ReadResult)
+		if !ok || res.Size() <= n {
+			return false
+		}
+		dest, _ := op.Args[1].([]byte)
+		data, status := res.Bytes(dest)
+		res.Done()
+		if !status.Ok() {
+			return false
+		}
+		if len(data) > n {
+			data = data[:n]
+		}
+		op.Results[0] = fuse.ReadResultData(data)
+	case "Readlink":
+		target, _ := op.Results[0].([]byte)
+		if len(target) <= n {
+			return false
+		}
+		op.Results[0] = target[:n]
+	case "Write":
+		written, _ := op.Results[0].(uint32)
+		if int(written) <= n {
+			return false
+		}
+		op.Results[0] = uint32(n)
+	default:
+		return false
+	}
+	return true
+}
+
+func (inj *Injector) isControl(n *fs.Inode) bool {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return inj.control == n
+}
+
+// lookupControl returns the control file for a lookup of its name in
+// the root.
+func (inj *Injector) lookupControl(ctx context.Context, op *fs.InterceptedOp) syscall.Errno {
+	inj.mu.Lock()
+	if inj.control == nil {
+		inj.control = op.Node.NewPersistentInode(ctx, &controlNode{inj: inj},
+			fs.StableAttr{Mode: syscall.S_IFREG})
+	}
+	ch := inj.control
+	inj.mu.Unlock()
+
+	out := op.Args[1].(*fuse.EntryOut)
+	var attr fuse.AttrOut
+	ch.Operations().(*controlNode).Getattr(ctx, nil, &attr)
+	out.Attr = attr.Attr
+	op.Results = []interface{}{ch}
+	return 0
+}
+
+func formatRules(rules []Rule) []byte {
+	var lines []string
+	for _, r := range rules {
+		lines = append(lines, r.String()+"\n")
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+// controlNode is the control file. Reads return the current rules.
+// Data written is parsed as rules when the file is flushed.
+type controlNode struct {
+	fs.Inode
+
+	inj *Injector
+
+	mu        sync.Mutex
+	truncated bool
+}
+
+var _ = (fs.NodeOpener)((*controlNode)(nil))
+var _ = (fs.NodeGetattrer)((*controlNode)(nil))
+var _ = (fs.NodeSetattrer)((*controlNode)(nil))
+
+type controlHandle struct {
+	inj *Injector
+
+	mu    sync.Mutex
+	data  []byte
+	dirty bool
+}
+
+var _ = (fs.FileReader)((*controlHandle)(nil))
+var _ = (fs.FileWriter)((*controlHandle)(nil))
+var _ = (fs.FileFlusher)((*controlHandle)(nil))
+
+func (n *controlNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	h := &controlHandle{inj: n.inj}
+	if flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		h.data = formatRules(n.inj.Rules())
+		return h, fuse.FOPEN_DIRECT_IO, 0
+	}
+
+	n.mu.Lock()
+	truncated := n.truncated
+	n.truncated = false
+	n.mu.Unlock()
+	if flags&syscall.O_APPEND != 0 {
+		h.data = formatRules(n.inj.Rules())
+	} else if truncated || flags&syscall.O_TRUNC != 0 {
+		// Writing an empty file clears the rules.
+		h.dirty = true
+	}
+	return h, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (n *controlNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0644
+	out.Size = uint64(len(formatRules(n.inj.Rules())))
+	return 0
+}
+
+func (n *controlNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if sz, ok := in.GetSize(); ok {
+		if h, ok := f.(*controlHandle); ok {
+			h.mu.Lock()
+			if int(sz) < len(h.data) {
+				h.data = h.data[:sz]
+			}
+			h.dirty = true
+			h.mu.Unlock()
+		} else if sz == 0 {
+			// Without ATOMIC_O_TRUNC, the kernel truncates
+			// before opening with O_TRUNC.
+			n.mu.Lock()
+			n.truncated = true
+			n.mu.Unlock()
+		}
+	}
+	return n.Getattr(ctx, f, out)
+}
+
+func (h *controlHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if off >= int64(len(h.data)) {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(h.data)) {
+		end = int64(len(h.data))
+	}
+	return fuse.ReadResultData(h.data[off:end]), 0
+}
+
+func (h *controlHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if end := int(off) + len(data); end > len(h.data) {
+		h.data = append(h.data, make([]byte, end-len(h.data))...)
+	}
+	copy(h.data[off:], data)
+	h.dirty = true
+	return uint32(len(data)), 0
+}
+
+func (h *controlHandle) Flush(ctx context.Context) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dirty {
+		return 0
+	}
+	h.dirty = false
+	rules, err := ParseRules(string(h.data))
+	if err != nil {
+		h.inj.logf("faultfs: %v", err)
+		return syscall.EINVAL
+	}
+	h.inj.SetRules(rules)
+	h.inj.logf("faultfs: installed %d rules", len(rules))
+	return 0
+}
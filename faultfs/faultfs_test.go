@@ -0,0 +1,201 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package faultfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+type testCase struct {
+	dir string
+	mnt string
+	inj *Injector
+	log bytes.Buffer
+}
+
+func newTestCase(t *testing.T, rules []Rule) (*testCase, func()) {
+	t.Helper()
+	tc := &testCase{dir: testutil.TempDir()}
+	tc.mnt = tc.dir + "/mnt"
+	for _, d := range []string{"/orig", "/mnt", "/orig/sub"} {
+		if err := os.Mkdir(tc.dir+d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"/orig/file.dat", "/orig/sub/file.txt"} {
+		if err := ioutil.WriteFile(tc.dir+f, []byte("hello world"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loopback, err := fs.NewLoopbackRoot(tc.dir + "/orig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.inj = New(&Options{
+		Rules:  rules,
+		Logger: log.New(&tc.log, "", 0),
+	})
+	opts := &fs.Options{
+		Interceptors: []fs.Interceptor{tc.inj.Intercept},
+	}
+	opts.Debug = testutil.VerboseTest()
+	server, err := fs.Mount(tc.mnt, loopback, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tc, func() {
+		server.Unmount()
+		os.RemoveAll(tc.dir)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	in := `# comment
+path=*.db op=Write errno=ENOSPC
+
+op=Fsync delay=2s
+path=data/* op=Lookup nth=3 errno=2
+op=Read probability=0.5 truncate=100
+`
+	got, err := ParseRules(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{Path: "*.db", Op: "Write", Errno: syscall.ENOSPC},
+		{Op: "Fsync", Delay: 2 * time.Second},
+		{Path: "data/*", Op: "Lookup", Nth: 3, Errno: syscall.ENOENT},
+		{Op: "Read", Probability: 0.5, Truncate: 100},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	again, err := ParseRules(string(formatRules(got)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, want) {
+		t.Errorf("round trip: got %v, want %v", again, want)
+	}
+
+	for _, bad := range []string{"op", "foo=bar", "errno=EWHATEVER", "probability=2", "path=["} {
+		if _, err := ParseRules(bad); err == nil {
+			t.Errorf("ParseRules(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestReadError(t *testing.T) {
+	tc, clean := newTestCase(t, []Rule{{Path: "*.dat", Op: "Read", Errno: syscall.EIO}})
+	defer clean()
+
+	if _, err := ioutil.ReadFile(tc.mnt + "/file.dat"); err == nil || !strings.Contains(err.Error(), "input/output error") {
+		t.Errorf("got %v, want EIO", err)
+	}
+	if _, err := ioutil.ReadFile(tc.mnt + "/sub/file.txt"); err != nil {
+		t.Errorf("ReadFile: %v", err)
+	}
+	if !strings.Contains(tc.log.String(), `Read "file.dat": input/output error`) {
+		t.Errorf("fault not logged: %q", tc.log.String())
+	}
+}
+
+func TestNthOpen(t *testing.T) {
+	tc, clean := newTestCase(t, []Rule{{Path: "sub/file.txt", Op: "Open", Nth: 2, Errno: syscall.EIO}})
+	defer clean()
+
+	for i, want := range []error{nil, syscall.EIO, nil} {
+		fd, err := syscall.Open(tc.mnt+"/sub/file.txt", syscall.O_RDONLY, 0)
+		if err == nil {
+			syscall.Close(fd)
+		}
+		if err != want {
+			t.Errorf("%d: got %v, want %v", i, err, want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tc, clean := newTestCase(t, []Rule{{Op: "Read", Truncate: 5}})
+	defer clean()
+
+	f, err := os.Open(tc.mnt + "/file.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 100)
+	n, err := f.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestControlFile(t *testing.T) {
+	tc, clean := newTestCase(t, nil)
+	defer clean()
+
+	ctl := tc.mnt + "/.faultfs"
+	if err := ioutil.WriteFile(ctl, []byte("op=Fsync delay=50ms\npath=*.txt op=Open errno=EACCES\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(tc.inj.Rules()); got != 2 {
+		t.Fatalf("got %d rules, want 2", got)
+	}
+	content, err := ioutil.ReadFile(ctl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(content), "op=Fsync delay=50ms\npath=*.txt op=Open errno=EACCES\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := os.Open(tc.mnt + "/sub/file.txt"); !os.IsPermission(err) {
+		t.Errorf("got %v, want EACCES", err)
+	}
+
+	f, err := os.OpenFile(tc.mnt+"/file.dat", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	start := time.Now()
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if dt := time.Since(start); dt < 50*time.Millisecond {
+		t.Errorf("Fsync took %v, want delay", dt)
+	}
+
+	if err := ioutil.WriteFile(ctl, []byte("bogus\n"), 0644); err == nil {
+		t.Errorf("writing invalid rules succeeded")
+	}
+	if got := len(tc.inj.Rules()); got != 2 {
+		t.Errorf("invalid rules changed rules to %v", tc.inj.Rules())
+	}
+
+	if err := ioutil.WriteFile(ctl, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := tc.inj.Rules(); len(got) != 0 {
+		t.Errorf("got rules %v, want none", got)
+	}
+}
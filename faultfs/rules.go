@@ -0,0 +1,210 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package faultfs
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Rule describes a fault to inject. A rule matches an operation if
+// both Path and Op match. Of the matching operations, it fails the
+// Nth, or each one with the given Probability, or all of them if
+// neither is set.
+type Rule struct {
+	// Path is a pattern in path.Match syntax. Patterns containing
+	// a "/" are matched against the path relative to the root,
+	// others against the last path component. Operations that
+	// take a name, such as Lookup or Create, match on the path of
+	// the named entry. Empty matches everything.
+	Path string
+
+	// Op is the name of the operation, as in
+	// fs.InterceptedOp.Name, eg. "Read" or "Fsync". Empty
+	// matches all operations.
+	Op string
+
+	// Probability is the chance that a matching operation is
+	// failed, between 0 and 1.
+	Probability float64
+
+	// Nth makes the rule fail only the Nth matching operation,
+	// counting from 1.
+	Nth int
+
+	// Delay is waited before running the operation, or before
+	// returning Errno.
+	Delay time.Duration
+
+	// Errno is returned instead of running the operation.
+	Errno syscall.Errno
+
+	// Truncate limits the result of a successful Read, Readlink
+	// or Write to the given number of bytes, producing short
+	// reads and writes.
+	Truncate int
+}
+
+// matches returns if the rule applies to operation `op` on the
+// entry `p`.
+func (r *Rule) matches(op, p string) bool {
+	if r.Op != "" && r.Op != op {
+		return false
+	}
+	if r.Path == "" {
+		return true
+	}
+	if !strings.Contains(r.Path, "/") {
+		p = path.Base(p)
+	}
+	ok, _ := path.Match(r.Path, p)
+	return ok
+}
+
+// String formats the rule in the syntax accepted by ParseRules.
+func (r Rule) String() string {
+	var fields []string
+	if r.Path != "" {
+		fields = append(fields, "path="+r.Path)
+	}
+	if r.Op != "" {
+		fields = append(fields, "op="+r.Op)
+	}
+	if r.Probability != 0 {
+		fields = append(fields, "probability="+strconv.FormatFloat(r.Probability, 'g', -1, 64))
+	}
+	if r.Nth != 0 {
+		fields = append(fields, fmt.Sprintf("nth=%d", r.Nth))
+	}
+	if r.Delay != 0 {
+		fields = append(fields, "delay="+r.Delay.String())
+	}
+	if r.Errno != 0 {
+		fields = append(fields, "errno="+errnoName(r.Errno))
+	}
+	if r.Truncate != 0 {
+		fields = append(fields, fmt.Sprintf("truncate=%d", r.Truncate))
+	}
+	return strings.Join(fields, " ")
+}
+
+// ParseRules parses rules, one per line. Each rule is a list of
+// key=value pairs separated by white space, with the keys path, op,
+// probability, nth, delay (a time.Duration), errno (a name such as
+// EIO, or a number) and truncate. Empty lines and lines starting
+// with "#" are ignored. For example,
+//
+//	path=*.db op=Write errno=ENOSPC
+//	op=Fsync delay=2s
+//	path=data/* op=Lookup nth=3 errno=ENOENT
+//	op=Read probability=0.1 truncate=100
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		r, err := parseRule(l)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", l, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func parseRule(l string) (Rule, error) {
+	var r Rule
+	for _, f := range strings.Fields(l) {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return r, fmt.Errorf("missing '=' in %q", f)
+		}
+		var err error
+		switch k, v := kv[0], kv[1]; k {
+		case "path":
+			_, err = path.Match(v, "")
+			r.Path = v
+		case "op":
+			r.Op = v
+		case "probability":
+			r.Probability, err = strconv.ParseFloat(v, 64)
+			if err == nil && (r.Probability < 0 || r.Probability > 1) {
+				err = fmt.Errorf("probability %v out of range", r.Probability)
+			}
+		case "nth":
+			r.Nth, err = strconv.Atoi(v)
+		case "delay":
+			r.Delay, err = time.ParseDuration(v)
+		case "errno":
+			r.Errno, err = parseErrno(v)
+		case "truncate":
+			r.Truncate, err = strconv.Atoi(v)
+		default:
+			err = fmt.Errorf("unknown key %q", k)
+		}
+		if err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+var errnoNames = map[string]syscall.Errno{
+	"EACCES":       syscall.EACCES,
+	"EAGAIN":       syscall.EAGAIN,
+	"EBADF":        syscall.EBADF,
+	"EBUSY":        syscall.EBUSY,
+	"EDQUOT":       syscall.EDQUOT,
+	"EEXIST":       syscall.EEXIST,
+	"EFBIG":        syscall.EFBIG,
+	"EINTR":        syscall.EINTR,
+	"EINVAL":       syscall.EINVAL,
+	"EIO":          syscall.EIO,
+	"EISDIR":       syscall.EISDIR,
+	"ELOOP":        syscall.ELOOP,
+	"EMFILE":       syscall.EMFILE,
+	"ENAMETOOLONG": syscall.ENAMETOOLONG,
+	"ENFILE":       syscall.ENFILE,
+	"ENODATA":      syscall.ENODATA,
+	"ENOENT":       syscall.ENOENT,
+	"ENOMEM":       syscall.ENOMEM,
+	"ENOSPC":       syscall.ENOSPC,
+	"ENOSYS":       syscall.ENOSYS,
+	"ENOTDIR":      syscall.ENOTDIR,
+	"ENOTEMPTY":    syscall.ENOTEMPTY,
+	"ENOTSUP":      syscall.ENOTSUP,
+	"ENXIO":        syscall.ENXIO,
+	"EPERM":        syscall.EPERM,
+	"EROFS":        syscall.EROFS,
+	"ESTALE":       syscall.ESTALE,
+	"ETIMEDOUT":    syscall.ETIMEDOUT,
+	"EXDEV":        syscall.EXDEV,
+}
+
+func parseErrno(s string) (syscall.Errno, error) {
+	if e, ok := errnoNames[s]; ok {
+		return e, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("unknown errno %q", s)
+	}
+	return syscall.Errno(n), nil
+}
+
+func errnoName(e syscall.Errno) string {
+	for k, v := range errnoNames {
+		if v == e {
+			return k
+		}
+	}
+	return strconv.Itoa(int(e))
+}
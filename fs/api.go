@@ -239,6 +239,15 @@ type NodeOnAdder interface {
 	OnAdd(ctx context.Context)
 }
 
+// NodeOnForgetter is implemented by nodes that hold resources, such
+// as file descriptors. OnForget is called once the node is dropped
+// from the tree: because the kernel forgot it, because it was removed
+// from its last parent and is no longer referenced by the kernel, or
+// because the file system was unmounted.
+type NodeOnForgetter interface {
+	OnForget()
+}
+
 // Getxattr should read data for the given attribute into
 // `dest` and return the number of bytes. If `dest` is too
 // small, it should return ERANGE and the size of the attribute.
@@ -610,4 +619,11 @@ type Options struct {
 	// return error, but want to signal something seems off
 	// anyway. If unset, no messages are printed.
 	Logger *log.Logger
+
+	// Interceptors are called for every operation on the nodes
+	// of the file system, the first interceptor being
+	// outermost. They can inspect and change the arguments and
+	// results of operations, or fail them. Inode.Operations
+	// still returns the node itself.
+	Interceptors []Interceptor
 }
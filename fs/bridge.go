@@ -123,6 +123,16 @@ func (b *rawBridge) newInodeUnlocked(ops InodeEmbedder, id StableAttr, persisten
 	return ops.embed()
 }
 
+// reserveIno makes sure that automatic inode numbers handed out in
+// the future do not clash with `ino`.
+func (b *rawBridge) reserveIno(ino uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ino >= b.automaticIno {
+		b.automaticIno = ino + 1
+	}
+}
+
 func (b *rawBridge) logf(format string, args ...interface{}) {
 	if b.options.Logger != nil {
 		b.options.Logger.Printf(format, args...)
@@ -336,16 +346,21 @@ func (b *rawBridge) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name s
 }
 
 func (b *rawBridge) lookup(ctx *fuse.Context, parent *Inode, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
-	if lu, ok := parent.ops.(NodeLookuper); ok {
+	if lu, ok := parent.handler.(NodeLookuper); ok {
 		return lu.Lookup(ctx, name, out)
 	}
+	return b.lookupChild(ctx, parent, name, out)
+}
 
+// lookupChild looks up `name` among the children of `parent` already
+// in the tree.
+func (b *rawBridge) lookupChild(ctx context.Context, parent *Inode, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
 	child := parent.GetChild(name)
 	if child == nil {
 		return nil, syscall.ENOENT
 	}
 
-	if ga, ok := child.ops.(NodeGetattrer); ok {
+	if ga, ok := child.handler.(NodeGetattrer); ok {
 		var a fuse.AttrOut
 		errno := ga.Getattr(ctx, nil, &a)
 		if errno == 0 {
@@ -359,7 +374,7 @@ func (b *rawBridge) lookup(ctx *fuse.Context, parent *Inode, name string, out *f
 func (b *rawBridge) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
 	parent, _ := b.inode(header.NodeId, 0)
 	var errno syscall.Errno
-	if mops, ok := parent.ops.(NodeRmdirer); ok {
+	if mops, ok := parent.handler.(NodeRmdirer); ok {
 		errno = mops.Rmdir(&fuse.Context{Caller: header.Caller, Cancel: cancel}, name)
 	}
 
@@ -372,7 +387,7 @@ func (b *rawBridge) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name st
 func (b *rawBridge) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
 	parent, _ := b.inode(header.NodeId, 0)
 	var errno syscall.Errno
-	if mops, ok := parent.ops.(NodeUnlinker); ok {
+	if mops, ok := parent.handler.(NodeUnlinker); ok {
 		errno = mops.Unlink(&fuse.Context{Caller: header.Caller, Cancel: cancel}, name)
 	}
 
@@ -387,7 +402,7 @@ func (b *rawBridge) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name stri
 
 	var child *Inode
 	var errno syscall.Errno
-	if mops, ok := parent.ops.(NodeMkdirer); ok {
+	if mops, ok := parent.handler.(NodeMkdirer); ok {
 		child, errno = mops.Mkdir(&fuse.Context{Caller: input.Caller, Cancel: cancel}, name, input.Mode, out)
 	} else {
 		return fuse.ENOTSUP
@@ -416,7 +431,7 @@ func (b *rawBridge) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name stri
 
 	var child *Inode
 	var errno syscall.Errno
-	if mops, ok := parent.ops.(NodeMknoder); ok {
+	if mops, ok := parent.handler.(NodeMknoder); ok {
 		child, errno = mops.Mknod(&fuse.Context{Caller: input.Caller, Cancel: cancel}, name, input.Mode, input.Rdev, out)
 	}
 
@@ -438,7 +453,7 @@ func (b *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name st
 	var errno syscall.Errno
 	var f FileHandle
 	var flags uint32
-	if mops, ok := parent.ops.(NodeCreater); ok {
+	if mops, ok := parent.handler.(NodeCreater); ok {
 		child, f, flags, errno = mops.Create(ctx, name, input.Flags, input.Mode, &out.EntryOut)
 	} else {
 		return fuse.EROFS
@@ -496,7 +511,7 @@ func (b *rawBridge) getattr(ctx context.Context, n *Inode, f FileHandle, out *fu
 		fg, _ = f.(FileGetattrer)
 	}
 
-	if fops, ok := n.ops.(NodeGetattrer); ok {
+	if fops, ok := n.handler.(NodeGetattrer); ok {
 		errno = fops.Getattr(ctx, f, out)
 	} else if fg != nil {
 		errno = fg.Getattr(ctx, out)
@@ -525,7 +540,7 @@ func (b *rawBridge) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fus
 	f := fEntry.file
 
 	var errno = syscall.ENOTSUP
-	if fops, ok := n.ops.(NodeSetattrer); ok {
+	if fops, ok := n.handler.(NodeSetattrer); ok {
 		errno = fops.Setattr(ctx, f, in, out)
 	} else if fops, ok := f.(FileSetattrer); ok {
 		errno = fops.Setattr(ctx, in, out)
@@ -539,7 +554,7 @@ func (b *rawBridge) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName
 	p1, _ := b.inode(input.NodeId, 0)
 	p2, _ := b.inode(input.Newdir, 0)
 
-	if mops, ok := p1.ops.(NodeRenamer); ok {
+	if mops, ok := p1.handler.(NodeRenamer); ok {
 		errno := mops.Rename(&fuse.Context{Caller: input.Caller, Cancel: cancel}, oldName, p2.ops, newName, input.Flags)
 		if errno == 0 {
 			if input.Flags&RENAME_EXCHANGE != 0 {
@@ -558,7 +573,7 @@ func (b *rawBridge) Link(cancel <-chan struct{}, input *fuse.LinkIn, name string
 	parent, _ := b.inode(input.NodeId, 0)
 	target, _ := b.inode(input.Oldnodeid, 0)
 
-	if mops, ok := parent.ops.(NodeLinker); ok {
+	if mops, ok := parent.handler.(NodeLinker); ok {
 		child, errno := mops.Link(&fuse.Context{Caller: input.Caller, Cancel: cancel}, target.ops, name, out)
 		if errno != 0 {
 			return errnoToStatus(errno)
@@ -575,7 +590,7 @@ func (b *rawBridge) Link(cancel <-chan struct{}, input *fuse.LinkIn, name string
 func (b *rawBridge) Symlink(cancel <-chan struct{}, header *fuse.InHeader, target string, name string, out *fuse.EntryOut) fuse.Status {
 	parent, _ := b.inode(header.NodeId, 0)
 
-	if mops, ok := parent.ops.(NodeSymlinker); ok {
+	if mops, ok := parent.handler.(NodeSymlinker); ok {
 		child, status := mops.Symlink(&fuse.Context{Caller: header.Caller, Cancel: cancel}, target, name, out)
 		if status != 0 {
 			return errnoToStatus(status)
@@ -592,7 +607,7 @@ func (b *rawBridge) Symlink(cancel <-chan struct{}, header *fuse.InHeader, targe
 func (b *rawBridge) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out []byte, status fuse.Status) {
 	n, _ := b.inode(header.NodeId, 0)
 
-	if linker, ok := n.ops.(NodeReadlinker); ok {
+	if linker, ok := n.handler.(NodeReadlinker); ok {
 		result, errno := linker.Readlink(&fuse.Context{Caller: header.Caller, Cancel: cancel})
 		if errno != 0 {
 			return nil, errnoToStatus(errno)
@@ -609,22 +624,29 @@ func (b *rawBridge) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.St
 	n, _ := b.inode(input.NodeId, 0)
 
 	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
-	if a, ok := n.ops.(NodeAccesser); ok {
+	if a, ok := n.handler.(NodeAccesser); ok {
 		return errnoToStatus(a.Access(ctx, input.Mask))
 	}
 
-	// default: check attributes.
-	caller := input.Caller
+	return errnoToStatus(b.checkAccess(ctx, n, input.Mask))
+}
+
+// checkAccess checks the attributes of `n` for access by the caller.
+func (b *rawBridge) checkAccess(ctx context.Context, n *Inode, mask uint32) syscall.Errno {
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return syscall.EACCES
+	}
 
 	var out fuse.AttrOut
 	if s := b.getattr(ctx, n, nil, &out); s != 0 {
-		return errnoToStatus(s)
+		return s
 	}
 
-	if !internal.HasAccess(caller.Uid, caller.Gid, out.Uid, out.Gid, out.Mode, input.Mask) {
-		return fuse.EACCES
+	if !internal.HasAccess(caller.Uid, caller.Gid, out.Uid, out.Gid, out.Mode, mask) {
+		return syscall.EACCES
 	}
-	return fuse.OK
+	return OK
 }
 
 // Extended attributes.
@@ -632,7 +654,7 @@ func (b *rawBridge) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.St
 func (b *rawBridge) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, data []byte) (uint32, fuse.Status) {
 	n, _ := b.inode(header.NodeId, 0)
 
-	if xops, ok := n.ops.(NodeGetxattrer); ok {
+	if xops, ok := n.handler.(NodeGetxattrer); ok {
 		nb, errno := xops.Getxattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, attr, data)
 		return nb, errnoToStatus(errno)
 	}
@@ -642,7 +664,7 @@ func (b *rawBridge) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr
 
 func (b *rawBridge) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (sz uint32, status fuse.Status) {
 	n, _ := b.inode(header.NodeId, 0)
-	if xops, ok := n.ops.(NodeListxattrer); ok {
+	if xops, ok := n.handler.(NodeListxattrer); ok {
 		sz, errno := xops.Listxattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, dest)
 		return sz, errnoToStatus(errno)
 	}
@@ -651,7 +673,7 @@ func (b *rawBridge) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, des
 
 func (b *rawBridge) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
-	if xops, ok := n.ops.(NodeSetxattrer); ok {
+	if xops, ok := n.handler.(NodeSetxattrer); ok {
 		return errnoToStatus(xops.Setxattr(&fuse.Context{Caller: input.Caller, Cancel: cancel}, attr, data, input.Flags))
 	}
 	return fuse.ENOATTR
@@ -659,7 +681,7 @@ func (b *rawBridge) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, att
 
 func (b *rawBridge) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
 	n, _ := b.inode(header.NodeId, 0)
-	if xops, ok := n.ops.(NodeRemovexattrer); ok {
+	if xops, ok := n.handler.(NodeRemovexattrer); ok {
 		return errnoToStatus(xops.Removexattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, attr))
 	}
 	return fuse.ENOATTR
@@ -668,7 +690,7 @@ func (b *rawBridge) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, a
 func (b *rawBridge) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
 
-	if op, ok := n.ops.(NodeOpener); ok {
+	if op, ok := n.handler.(NodeOpener); ok {
 		f, flags, errno := op.Open(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Flags)
 		if errno != 0 {
 			return errnoToStatus(errno)
@@ -709,7 +731,7 @@ func (b *rawBridge) registerFile(n *Inode, f FileHandle, flags uint32) uint32 {
 func (b *rawBridge) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
 	n, f := b.inode(input.NodeId, input.Fh)
 
-	if fops, ok := n.ops.(NodeReader); ok {
+	if fops, ok := n.handler.(NodeReader); ok {
 		res, errno := fops.Read(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, buf, int64(input.Offset))
 		return res, errnoToStatus(errno)
 	}
@@ -724,7 +746,7 @@ func (b *rawBridge) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte)
 func (b *rawBridge) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
 
-	if lops, ok := n.ops.(NodeGetlker); ok {
+	if lops, ok := n.handler.(NodeGetlker); ok {
 		return errnoToStatus(lops.Getlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags, &out.Lk))
 	}
 	if gl, ok := f.file.(FileGetlker); ok {
@@ -735,20 +757,20 @@ func (b *rawBridge) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.Lk
 
 func (b *rawBridge) SetLk(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	if lops, ok := n.ops.(NodeSetlker); ok {
+	if lops, ok := n.handler.(NodeSetlker); ok {
 		return errnoToStatus(lops.Setlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags))
 	}
-	if sl, ok := n.ops.(FileSetlker); ok {
+	if sl, ok := n.handler.(FileSetlker); ok {
 		return errnoToStatus(sl.Setlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Owner, &input.Lk, input.LkFlags))
 	}
 	return fuse.ENOTSUP
 }
 func (b *rawBridge) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	if lops, ok := n.ops.(NodeSetlkwer); ok {
+	if lops, ok := n.handler.(NodeSetlkwer); ok {
 		return errnoToStatus(lops.Setlkw(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags))
 	}
-	if sl, ok := n.ops.(FileSetlkwer); ok {
+	if sl, ok := n.handler.(FileSetlkwer); ok {
 		return errnoToStatus(sl.Setlkw(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Owner, &input.Lk, input.LkFlags))
 	}
 	return fuse.ENOTSUP
@@ -762,7 +784,7 @@ func (b *rawBridge) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
 
 	f.wg.Wait()
 
-	if r, ok := n.ops.(NodeReleaser); ok {
+	if r, ok := n.handler.(NodeReleaser); ok {
 		r.Release(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file)
 	} else if r, ok := f.file.(FileReleaser); ok {
 		r.Release(&fuse.Context{Caller: input.Caller, Cancel: cancel})
@@ -811,7 +833,7 @@ func (b *rawBridge) releaseFileEntry(nid uint64, fh uint64) (*Inode, *fileEntry)
 func (b *rawBridge) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (written uint32, status fuse.Status) {
 	n, f := b.inode(input.NodeId, input.Fh)
 
-	if wr, ok := n.ops.(NodeWriter); ok {
+	if wr, ok := n.handler.(NodeWriter); ok {
 		w, errno := wr.Write(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, data, int64(input.Offset))
 		return w, errnoToStatus(errno)
 	}
@@ -825,7 +847,7 @@ func (b *rawBridge) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []by
 
 func (b *rawBridge) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	if fl, ok := n.ops.(NodeFlusher); ok {
+	if fl, ok := n.handler.(NodeFlusher); ok {
 		return errnoToStatus(fl.Flush(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file))
 	}
 	if fl, ok := f.file.(FileFlusher); ok {
@@ -836,7 +858,7 @@ func (b *rawBridge) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Stat
 
 func (b *rawBridge) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	if fs, ok := n.ops.(NodeFsyncer); ok {
+	if fs, ok := n.handler.(NodeFsyncer); ok {
 		return errnoToStatus(fs.Fsync(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.FsyncFlags))
 	}
 	if fs, ok := f.file.(FileFsyncer); ok {
@@ -847,7 +869,7 @@ func (b *rawBridge) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Stat
 
 func (b *rawBridge) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	if a, ok := n.ops.(NodeAllocater); ok {
+	if a, ok := n.handler.(NodeAllocater); ok {
 		return errnoToStatus(a.Allocate(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Offset, input.Length, input.Mode))
 	}
 	if a, ok := f.file.(FileAllocater); ok {
@@ -859,7 +881,7 @@ func (b *rawBridge) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) f
 func (b *rawBridge) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
 
-	if od, ok := n.ops.(NodeOpendirer); ok {
+	if od, ok := n.handler.(NodeOpendirer); ok {
 		errno := od.Opendir(&fuse.Context{Caller: input.Caller, Cancel: cancel})
 		if errno != 0 {
 			return errnoToStatus(errno)
@@ -916,17 +938,21 @@ func (b *rawBridge) setStream(cancel <-chan struct{}, input *fuse.ReadIn, inode
 }
 
 func (b *rawBridge) getStream(ctx context.Context, inode *Inode) (DirStream, syscall.Errno) {
-	if rd, ok := inode.ops.(NodeReaddirer); ok {
+	if rd, ok := inode.handler.(NodeReaddirer); ok {
 		return rd.Readdir(ctx)
 	}
+	return childrenStream(inode), 0
+}
 
+// childrenStream lists the children of `inode` already in the tree.
+func childrenStream(inode *Inode) DirStream {
 	r := []fuse.DirEntry{}
 	for k, ch := range inode.Children() {
 		r = append(r, fuse.DirEntry{Mode: ch.Mode(),
 			Name: k,
 			Ino:  ch.StableAttr().Ino})
 	}
-	return NewListDirStream(r), 0
+	return NewListDirStream(r)
 }
 
 func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
@@ -1034,7 +1060,7 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 
 func (b *rawBridge) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
 	n, _ := b.inode(input.NodeId, input.Fh)
-	if fs, ok := n.ops.(NodeFsyncer); ok {
+	if fs, ok := n.handler.(NodeFsyncer); ok {
 		return errnoToStatus(fs.Fsync(&fuse.Context{Caller: input.Caller, Cancel: cancel}, nil, input.FsyncFlags))
 	}
 
@@ -1043,7 +1069,7 @@ func (b *rawBridge) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.S
 
 func (b *rawBridge) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
-	if sf, ok := n.ops.(NodeStatfser); ok {
+	if sf, ok := n.handler.(NodeStatfser); ok {
 		return errnoToStatus(sf.Statfs(&fuse.Context{Caller: input.Caller, Cancel: cancel}, out))
 	}
 
@@ -1055,9 +1081,41 @@ func (b *rawBridge) Init(s *fuse.Server) {
 	b.server = s
 }
 
+// OnUnmount calls OnForget on all nodes that are still in the tree,
+// because the kernel does not forget them on unmount.
+func (b *rawBridge) OnUnmount() {
+	seen := map[*Inode]bool{}
+	var walk func(n *Inode)
+	walk = func(n *Inode) {
+		if seen[n] {
+			return
+		}
+		seen[n] = true
+		for _, ch := range n.Children() {
+			walk(ch)
+		}
+		if of, ok := n.ops.(NodeOnForgetter); ok {
+			of.OnForget()
+		}
+	}
+
+	b.mu.Lock()
+	nodes := make([]*Inode, 0, len(b.kernelNodeIds))
+	for _, n := range b.kernelNodeIds {
+		nodes = append(nodes, n)
+	}
+	b.mu.Unlock()
+
+	// Unlinked files may only be referenced by the kernel.
+	walk(b.root)
+	for _, n := range nodes {
+		walk(n)
+	}
+}
+
 func (b *rawBridge) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRangeIn) (size uint32, status fuse.Status) {
 	n1, f1 := b.inode(in.NodeId, in.FhIn)
-	cfr, ok := n1.ops.(NodeCopyFileRanger)
+	cfr, ok := n1.handler.(NodeCopyFileRanger)
 	if !ok {
 		return 0, fuse.ENOTSUP
 	}
@@ -1072,7 +1130,7 @@ func (b *rawBridge) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRange
 func (b *rawBridge) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
 	n, f := b.inode(in.NodeId, in.Fh)
 
-	ls, ok := n.ops.(NodeLseeker)
+	ls, ok := n.handler.(NodeLseeker)
 	if ok {
 		off, errno := ls.Lseek(&fuse.Context{Caller: in.Caller, Cancel: cancel},
 			f.file, in.Offset, in.Whence)
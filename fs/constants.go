@@ -27,3 +27,19 @@ const _SEEK_DATA = 3
 
 // seek to the next hole
 const _SEEK_HOLE = 4
+
+// RENAME_NOREPLACE is a flag argument for renameat2()
+const RENAME_NOREPLACE = 0x1
+
+// flags for fallocate(2)
+const (
+	_FALLOC_FL_KEEP_SIZE  = 0x1
+	_FALLOC_FL_PUNCH_HOLE = 0x2
+	_FALLOC_FL_ZERO_RANGE = 0x10
+)
+
+// flags for setxattr(2)
+const (
+	_XATTR_CREATE  = 0x1
+	_XATTR_REPLACE = 0x2
+)
@@ -8,3 +8,11 @@ import "syscall"
 
 // ENOATTR indicates that an extended attribute was not present.
 var ENOATTR = syscall.ENODATA
+
+// flags for the *at family of system calls
+const (
+	_AT_EMPTY_PATH = 0x1000
+)
+
+// MAX_HANDLE_SZ from <fcntl.h>
+const _MAX_HANDLE_SZ = 128
@@ -0,0 +1,483 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// DedupDigestXattr is the extended attribute that holds the hex
+// SHA-256 digest of the content of a file in a file system returned
+// by NewDedupFS. It cannot be set or removed.
+const DedupDigestXattr = "user.sha256"
+
+// BlobStore stores file content by its SHA-256 digest, for
+// NewDedupFS. Blobs are never modified once stored.
+type BlobStore interface {
+	// Put stores `data`, which has the hex SHA-256 digest
+	// `digest`. Storing a blob that is already present must
+	// succeed.
+	Put(digest string, data []byte) error
+
+	// Open returns a reader for the blob `digest`.
+	Open(digest string) (BlobReader, error)
+
+	// Delete removes the blob `digest`. It is called once no file
+	// uses the blob anymore.
+	Delete(digest string) error
+}
+
+// BlobReader reads the content of a blob.
+type BlobReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// DedupFSOptions holds the parameters for NewDedupFS.
+type DedupFSOptions struct {
+	// MaxBytes and MaxInodes limit the file system as for
+	// NewMemFS. Content shared by several files is counted once.
+	MemFSOptions
+
+	// Store holds the content of the files. If nil, the content
+	// is kept in memory.
+	Store BlobStore
+}
+
+// NewDedupFS returns the root of an in-memory file system, like
+// NewMemFS, that stores each distinct file content only once. The
+// content of files that are not open for writing is kept in a
+// BlobStore, so files with the same content, as well as hard links,
+// share a blob. A file is copied out of its blob when it is opened
+// for writing, and stored again once the last writable handle is
+// released. The digest of a file can be read from its
+// DedupDigestXattr extended attribute. The opts argument may be nil.
+func NewDedupFS(opts *DedupFSOptions) InodeEmbedder {
+	var o DedupFSOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Store == nil {
+		o.Store = NewMemBlobStore()
+	}
+	fs := &memFS{
+		opts:  o.MemFSOptions,
+		store: o.Store,
+		blobs: map[string]*dedupBlob{},
+	}
+	return fs.newRoot()
+}
+
+// dedupBlob is a blob that is used by files of a dedup file system.
+type dedupBlob struct {
+	digest string
+	size   int64
+
+	// stored is closed once the blob was put in the store. Then,
+	// r is set, or err if it could not be stored.
+	stored chan struct{}
+	r      BlobReader
+	err    error
+
+	// refs is the number of memNodes using the blob. It is
+	// protected by memFS.blobMu.
+	refs int
+}
+
+// dedupHandle is the FileHandle for files of a dedup file system, so
+// the release of writable handles can be recognized.
+type dedupHandle struct {
+	write bool
+}
+
+// putBlob stores `data`, and returns a reference to its blob. The
+// blob is stored without holding fs.blobMu, so different blobs are
+// stored in parallel.
+func (fs *memFS) putBlob(data []byte) (*dedupBlob, syscall.Errno) {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	fs.blobMu.Lock()
+	b := fs.blobs[digest]
+	if b != nil {
+		b.refs++
+		fs.blobMu.Unlock()
+	} else {
+		if !fs.allocBytes(uint64(len(data))) {
+			fs.blobMu.Unlock()
+			return nil, syscall.ENOSPC
+		}
+		b = &dedupBlob{
+			digest: digest,
+			size:   int64(len(data)),
+			stored: make(chan struct{}),
+			refs:   1,
+		}
+		fs.blobs[digest] = b
+		fs.blobMu.Unlock()
+
+		b.err = fs.store.Put(digest, data)
+		if b.err == nil {
+			b.r, b.err = fs.store.Open(digest)
+		}
+		close(b.stored)
+	}
+
+	<-b.stored
+	if b.err != nil {
+		fs.dropBlob(b)
+		return nil, ToErrno(b.err)
+	}
+	return b, OK
+}
+
+// dropBlob drops a reference to `b`, and deletes it from the store
+// if it was the last one.
+func (fs *memFS) dropBlob(b *dedupBlob) {
+	fs.blobMu.Lock()
+	b.refs--
+	last := b.refs == 0
+	if last {
+		delete(fs.blobs, b.digest)
+	}
+	fs.blobMu.Unlock()
+	if !last {
+		return
+	}
+	if b.err == nil {
+		b.r.Close()
+		fs.store.Delete(b.digest)
+	}
+	fs.freeBytes(uint64(b.size))
+}
+
+// openDedup opens a file of a dedup file system. Must hold n.mu.
+func (n *memNode) openDedup(flags uint32) (FileHandle, syscall.Errno) {
+	h := &dedupHandle{
+		write: flags&syscall.O_ACCMODE != syscall.O_RDONLY && n.Mode() == syscall.S_IFREG,
+	}
+	if h.write {
+		if errno := n.unshare(); errno != 0 {
+			return nil, errno
+		}
+		n.writers++
+	}
+	n.opens++
+	return h, OK
+}
+
+// releaseDedup releases a handle returned by openDedup. Must hold
+// n.mu.
+func (n *memNode) releaseDedup(h *dedupHandle) syscall.Errno {
+	n.opens--
+	if h.write {
+		n.writers--
+	}
+	if n.attr.Nlink == 0 {
+		// The last link was dropped while the file was open.
+		if n.opens == 0 && n.blob != nil {
+			n.fs.dropBlob(n.blob)
+			n.blob = nil
+		}
+		return OK
+	}
+	return n.settle()
+}
+
+// unshare copies the content out of its blob, so it can be
+// modified. Must hold n.mu.
+func (n *memNode) unshare() syscall.Errno {
+	b := n.blob
+	if b == nil {
+		return OK
+	}
+	data := make([]byte, b.size)
+	if _, err := b.r.ReadAt(data, 0); err != nil && err != io.EOF {
+		return ToErrno(err)
+	}
+	if errno := n.reserve(n.content.unallocated(0, b.size)); errno != 0 {
+		return errno
+	}
+	n.content.writeAt(data, 0)
+	n.content.truncate(b.size)
+	n.blob = nil
+	n.fs.dropBlob(b)
+	return OK
+}
+
+// settle stores the content in a blob if the file is not open for
+// writing. Must hold n.mu.
+func (n *memNode) settle() syscall.Errno {
+	if n.fs.store == nil || n.writers > 0 || n.blob != nil ||
+		n.Mode() != syscall.S_IFREG || n.attr.Nlink == 0 {
+		return OK
+	}
+	data := make([]byte, n.content.size)
+	n.content.readAt(data, 0)
+	b, errno := n.fs.putBlob(data)
+	if errno != 0 {
+		// Keep the content private.
+		return errno
+	}
+	before := n.content.allocated()
+	n.content = sparseData{}
+	n.release(before)
+	n.blob = b
+	return OK
+}
+
+// digest returns the digest of the content. Must hold n.mu.
+func (n *memNode) digest() string {
+	if n.blob != nil {
+		return n.blob.digest
+	}
+	h := sha256.New()
+	buf := make([]byte, sparseChunkSize)
+	for off := int64(0); off < n.content.size; {
+		k := n.content.readAt(buf, off)
+		h.Write(buf[:k])
+		off += int64(k)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hasDigest reports whether n has the DedupDigestXattr attribute.
+func (n *memNode) hasDigest() bool {
+	return n.fs.store != nil && n.Mode() == syscall.S_IFREG
+}
+
+// readBlob reads from the blob of the file. Must hold n.mu.
+func (n *memNode) readBlob(dest []byte, off int64) (int, syscall.Errno) {
+	if off >= n.blob.size {
+		return 0, OK
+	}
+	k, err := n.blob.r.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return 0, ToErrno(err)
+	}
+	return k, OK
+}
+
+// NewMemBlobStore returns a BlobStore that keeps blobs in memory.
+func NewMemBlobStore() BlobStore {
+	return &memBlobStore{blobs: map[string][]byte{}}
+}
+
+type memBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+type memBlobReader struct {
+	*bytes.Reader
+}
+
+func (r memBlobReader) Close() error {
+	return nil
+}
+
+func (s *memBlobStore) Put(digest string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[digest]; !ok {
+		s.blobs[digest] = append([]byte{}, data...)
+	}
+	return nil
+}
+
+func (s *memBlobStore) Open(digest string) (BlobReader, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.blobs[digest]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return memBlobReader{bytes.NewReader(data)}, nil
+}
+
+func (s *memBlobStore) Delete(digest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, digest)
+	return nil
+}
+
+// maxOpenBlobs is the number of blob files a dirBlobStore keeps
+// open.
+const maxOpenBlobs = 64
+
+// NewDirBlobStore returns a BlobStore that keeps blobs as files in
+// `dir`, named by their digest, in subdirectories named by the first
+// two characters of the digest. The directory is created if needed.
+// Blobs that are already in the directory are reused. Blob files are
+// opened when they are read, and only the ones that were read most
+// recently are kept open.
+func NewDirBlobStore(dir string) (BlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &dirBlobStore{
+		dir:   dir,
+		files: map[string]*list.Element{},
+		lru:   list.New(),
+	}, nil
+}
+
+type dirBlobStore struct {
+	dir string
+
+	// mu protects files and lru, which hold the open blob files,
+	// most recently used first.
+	mu    sync.Mutex
+	files map[string]*list.Element
+	lru   *list.List
+}
+
+// blobFile is an open blob file of a dirBlobStore.
+type blobFile struct {
+	digest string
+	f      *os.File
+
+	// users is the number of reads in progress. The file is
+	// closed once it is dropped from the cache and unused.
+	users   int
+	dropped bool
+}
+
+func (s *dirBlobStore) path(digest string) string {
+	return filepath.Join(s.dir, digest[:2], digest)
+}
+
+func (s *dirBlobStore) Put(digest string, data []byte) error {
+	p := s.path(digest)
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *dirBlobStore) Open(digest string) (BlobReader, error) {
+	if _, err := os.Stat(s.path(digest)); err != nil {
+		return nil, err
+	}
+	return &dirBlobReader{s, digest}, nil
+}
+
+func (s *dirBlobStore) Delete(digest string) error {
+	s.forget(digest)
+	return os.Remove(s.path(digest))
+}
+
+// acquire returns the open file for blob `digest`, opening it if
+// needed. It must be released with release.
+func (s *dirBlobStore) acquire(digest string) (*blobFile, error) {
+	s.mu.Lock()
+	if el, ok := s.files[digest]; ok {
+		bf := el.Value.(*blobFile)
+		bf.users++
+		s.lru.MoveToFront(el)
+		s.mu.Unlock()
+		return bf, nil
+	}
+	s.mu.Unlock()
+
+	f, err := os.Open(s.path(digest))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.files[digest]; ok {
+		// Opened concurrently.
+		f.Close()
+		bf := el.Value.(*blobFile)
+		bf.users++
+		s.lru.MoveToFront(el)
+		return bf, nil
+	}
+	bf := &blobFile{digest: digest, f: f, users: 1}
+	s.files[digest] = s.lru.PushFront(bf)
+	for s.lru.Len() > maxOpenBlobs {
+		s.drop(s.lru.Back())
+	}
+	return bf, nil
+}
+
+func (s *dirBlobStore) release(bf *blobFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bf.users--
+	if bf.dropped && bf.users == 0 {
+		bf.f.Close()
+	}
+}
+
+// forget closes the file of blob `digest`, if it is open.
+func (s *dirBlobStore) forget(digest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.files[digest]; ok {
+		s.drop(el)
+	}
+}
+
+// drop removes a file from the cache. It must be called with s.mu
+// held.
+func (s *dirBlobStore) drop(el *list.Element) {
+	bf := el.Value.(*blobFile)
+	s.lru.Remove(el)
+	delete(s.files, bf.digest)
+	bf.dropped = true
+	if bf.users == 0 {
+		bf.f.Close()
+	}
+}
+
+// dirBlobReader reads a blob of a dirBlobStore.
+type dirBlobReader struct {
+	s      *dirBlobStore
+	digest string
+}
+
+func (r *dirBlobReader) ReadAt(dest []byte, off int64) (int, error) {
+	bf, err := r.s.acquire(r.digest)
+	if err != nil {
+		return 0, err
+	}
+	defer r.s.release(bf)
+	return bf.f.ReadAt(dest, off)
+}
+
+func (r *dirBlobReader) Close() error {
+	r.s.forget(r.digest)
+	return nil
+}
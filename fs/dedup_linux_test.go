@@ -0,0 +1,117 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"golang.org/x/sys/unix"
+)
+
+func TestDedupFS(t *testing.T) {
+	storeDir := testutil.TempDir()
+	defer os.RemoveAll(storeDir)
+	store, err := NewDirBlobStore(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mntDir, _, clean := testMount(t, NewDedupFS(&DedupFSOptions{Store: store}), nil)
+	defer clean()
+
+	blobs := func() []string {
+		names, err := filepath.Glob(storeDir + "/*/*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+	digest := func(name string) string {
+		buf := make([]byte, 100)
+		sz, err := unix.Getxattr(mntDir+"/"+name, DedupDigestXattr, buf)
+		if err != nil {
+			t.Fatalf("Getxattr(%s): %v", name, err)
+		}
+		return string(buf[:sz])
+	}
+	sum := func(data []byte) string {
+		s := sha256.Sum256(data)
+		return hex.EncodeToString(s[:])
+	}
+	check := func(name string, want []byte) {
+		t.Helper()
+		if got, err := ioutil.ReadFile(mntDir + "/" + name); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+		if got := digest(name); got != sum(want) {
+			t.Errorf("%s: got digest %s, want %s", name, got, sum(want))
+		}
+	}
+
+	artifact := bytes.Repeat([]byte("object code "), 1000)
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(mntDir+"/"+name, artifact, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(mntDir+"/a", mntDir+"/c"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "one blob", func() bool {
+		b := blobs()
+		return len(b) == 1 && filepath.Base(b[0]) == sum(artifact)
+	})
+	for _, name := range []string{"a", "b", "c"} {
+		check(name, artifact)
+	}
+
+	// Writing copies the file out of the shared blob.
+	f, err := os.OpenFile(mntDir+"/b", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("patched"), 100); err != nil {
+		t.Fatal(err)
+	}
+	patched := append([]byte{}, artifact...)
+	copy(patched[100:], "patched")
+	check("b", patched)
+	f.Close()
+
+	waitFor(t, "two blobs", func() bool { return len(blobs()) == 2 })
+	check("a", artifact)
+	check("b", patched)
+	check("c", artifact)
+
+	if err := unix.Setxattr(mntDir+"/a", DedupDigestXattr, []byte("x"), 0); err != syscall.EPERM {
+		t.Errorf("Setxattr: got %v, want EPERM", err)
+	}
+
+	// Blobs are deleted when their last file is gone.
+	for _, name := range []string{"a", "b"} {
+		if err := os.Remove(mntDir + "/" + name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b := blobs(); len(b) != 1 || filepath.Base(b[0]) != sum(artifact) {
+		t.Errorf("got blobs %v, want only the one for c", b)
+	}
+	if err := os.Truncate(mntDir+"/c", 3); err != nil {
+		t.Fatal(err)
+	}
+	check("c", artifact[:3])
+	if b := blobs(); len(b) != 1 || filepath.Base(b[0]) != sum(artifact[:3]) {
+		t.Errorf("got blobs %v after truncate", b)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"github.com/hanwen/go-fuse/v2/posixtest"
+)
+
+func TestDedupFSPosix(t *testing.T) {
+	for nm, fn := range posixtest.All {
+		t.Run(nm, func(t *testing.T) {
+			mntDir, _, clean := testMount(t, NewDedupFS(nil), nil)
+			defer clean()
+
+			fn(t, mntDir)
+		})
+	}
+}
+
+func TestDirBlobStoreOpenFiles(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	store, err := NewDirBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var readers []BlobReader
+	for i := 0; i < 2*maxOpenBlobs; i++ {
+		data := []byte(fmt.Sprintf("blob %d", i))
+		sum := sha256.Sum256(data)
+		digest := hex.EncodeToString(sum[:])
+		if err := store.Put(digest, data); err != nil {
+			t.Fatal(err)
+		}
+		r, err := store.Open(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, r)
+	}
+	// Read everything twice, so evicted blobs are opened again.
+	for k := 0; k < 2; k++ {
+		for i, r := range readers {
+			buf := make([]byte, 100)
+			n, err := r.ReadAt(buf, 0)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if got, want := string(buf[:n]), fmt.Sprintf("blob %d", i); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		}
+	}
+	if n := len(store.(*dirBlobStore).files); n > maxOpenBlobs {
+		t.Errorf("got %d open blob files, want at most %d", n, maxOpenBlobs)
+	}
+	for _, r := range readers {
+		r.Close()
+	}
+	if n := len(store.(*dirBlobStore).files); n != 0 {
+		t.Errorf("got %d open blob files after Close, want 0", n)
+	}
+}
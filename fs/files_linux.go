@@ -31,6 +31,13 @@ func (f *loopbackFile) utimens(a *time.Time, m *time.Time) syscall.Errno {
 	return ToErrno(err)
 }
 
+// setBlksize sets the block size, unless it was set already.
+func setBlksize(out *fuse.Attr, sz uint32) {
+	if out.Blksize == 0 {
+		out.Blksize = sz
+	}
+}
+
 func setBlocks(out *fuse.Attr) {
 	if out.Blksize > 0 {
 		return
@@ -0,0 +1,132 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// OverflowID is the user or group ID reported for IDs that have no
+// mapping, like /proc/sys/kernel/overflowuid.
+const OverflowID = 65534
+
+// IDMapping maps a range of Count IDs starting at Inside, as seen
+// through the file system, to the range starting at Outside, as
+// stored in the backing file system.
+type IDMapping struct {
+	Inside  uint32
+	Outside uint32
+	Count   uint32
+}
+
+// IDMap translates user or group IDs between the file system and its
+// backing storage, like /proc/PID/uid_map does for user namespaces.
+// An empty IDMap maps every ID to itself.
+type IDMap []IDMapping
+
+// ParseIDMap parses a map in the format of /proc/PID/uid_map: one
+// range per line, each having the inside ID, the outside ID and the
+// length of the range, separated by white space.
+func ParseIDMap(s string) (IDMap, error) {
+	var m IDMap
+	for _, l := range strings.Split(s, "\n") {
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("idmap: line %q: want 3 fields", l)
+		}
+		var vals [3]uint32
+		for i, f := range fields {
+			v, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("idmap: line %q: %v", l, err)
+			}
+			vals[i] = uint32(v)
+		}
+		e := IDMapping{Inside: vals[0], Outside: vals[1], Count: vals[2]}
+		if e.Count == 0 ||
+			uint64(e.Inside)+uint64(e.Count) > 1<<32 ||
+			uint64(e.Outside)+uint64(e.Count) > 1<<32 {
+			return nil, fmt.Errorf("idmap: line %q: invalid range", l)
+		}
+		m = append(m, e)
+	}
+	return m, nil
+}
+
+// ToInside translates an ID from the backing file system. IDs that
+// are not mapped are returned as OverflowID.
+func (m IDMap) ToInside(id uint32) uint32 {
+	if len(m) == 0 {
+		return id
+	}
+	for _, e := range m {
+		if id >= e.Outside && id-e.Outside < e.Count {
+			return e.Inside + (id - e.Outside)
+		}
+	}
+	return OverflowID
+}
+
+// ToOutside translates an ID as seen through the file system to the
+// backing file system. It returns false if the ID is not mapped.
+func (m IDMap) ToOutside(id uint32) (uint32, bool) {
+	if len(m) == 0 {
+		return id, true
+	}
+	for _, e := range m {
+		if id >= e.Inside && id-e.Inside < e.Count {
+			return e.Outside + (id - e.Inside), true
+		}
+	}
+	return 0, false
+}
+
+// MapAttrOwner translates the owner of `out` from the backing file
+// system.
+func MapAttrOwner(uidMap, gidMap IDMap, out *fuse.Attr) {
+	out.Uid = uidMap.ToInside(out.Uid)
+	out.Gid = gidMap.ToInside(out.Gid)
+}
+
+// MapSetAttrIn returns a copy of `in` with the owner translated to
+// the backing file system. Changing ownership to an unmapped ID
+// fails with EINVAL.
+func MapSetAttrIn(uidMap, gidMap IDMap, in *fuse.SetAttrIn) (*fuse.SetAttrIn, syscall.Errno) {
+	out := *in
+	var ok bool
+	if _, set := in.GetUID(); set {
+		if out.Uid, ok = uidMap.ToOutside(in.Uid); !ok {
+			return nil, syscall.EINVAL
+		}
+	}
+	if _, set := in.GetGID(); set {
+		if out.Gid, ok = gidMap.ToOutside(in.Gid); !ok {
+			return nil, syscall.EINVAL
+		}
+	}
+	return &out, OK
+}
+
+// MapCaller translates the credentials of the caller to the backing
+// file system, so they can be used as the owner of new files. IDs
+// that are not mapped become OverflowID.
+func MapCaller(uidMap, gidMap IDMap, caller *fuse.Caller) (uid, gid uint32) {
+	var ok bool
+	if uid, ok = uidMap.ToOutside(caller.Uid); !ok {
+		uid = OverflowID
+	}
+	if gid, ok = gidMap.ToOutside(caller.Gid); !ok {
+		gid = OverflowID
+	}
+	return uid, gid
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIDMap(t *testing.T) {
+	m, err := ParseIDMap("         0     100000      65536\n 65536 1000 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := IDMap{{0, 100000, 65536}, {65536, 1000, 1}}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+
+	for _, in := range []string{"1 2", "1 2 0", "a 2 3", "4294967295 0 2"} {
+		if _, err := ParseIDMap(in); err == nil {
+			t.Errorf("ParseIDMap(%q) succeeded", in)
+		}
+	}
+}
+
+func TestIDMapTranslate(t *testing.T) {
+	m := IDMap{{0, 100000, 65536}, {65536, 1000, 1}}
+	for _, c := range []struct {
+		outside, inside uint32
+	}{
+		{100000, 0},
+		{100005, 5},
+		{165535, 65535},
+		{1000, 65536},
+	} {
+		if got := m.ToInside(c.outside); got != c.inside {
+			t.Errorf("ToInside(%d): got %d, want %d", c.outside, got, c.inside)
+		}
+		if got, ok := m.ToOutside(c.inside); !ok || got != c.outside {
+			t.Errorf("ToOutside(%d): got %d, %v, want %d", c.inside, got, ok, c.outside)
+		}
+	}
+
+	if got := m.ToInside(5); got != OverflowID {
+		t.Errorf("ToInside(5): got %d, want overflow", got)
+	}
+	if _, ok := m.ToOutside(65537); ok {
+		t.Errorf("ToOutside(65537) succeeded")
+	}
+	if got := IDMap(nil).ToInside(5); got != 5 {
+		t.Errorf("empty map: got %d, want 5", got)
+	}
+}
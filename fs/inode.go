@@ -63,6 +63,11 @@ type Inode struct {
 	ops    InodeEmbedder
 	bridge *rawBridge
 
+	// handler receives the operations for this node from the
+	// bridge. It is ops, or a wrapper that passes the operations
+	// through Options.Interceptors.
+	handler InodeEmbedder
+
 	// The *Node ID* is an arbitrary uint64 identifier chosen by the FUSE library.
 	// It is used the identify *nodes* (files/directories/symlinks/...) in the
 	// communication between the FUSE library and the Linux kernel.
@@ -122,6 +127,13 @@ func (n *Inode) EmbeddedInode() *Inode {
 
 func initInode(n *Inode, ops InodeEmbedder, attr StableAttr, bridge *rawBridge, persistent bool, nodeId uint64) {
 	n.ops = ops
+	n.handler = ops
+	if is := bridge.options.Interceptors; len(is) > 0 {
+		n.handler = &wrapperNode{
+			inner:        ops,
+			interceptors: is,
+		}
+	}
 	n.stableAttr = attr
 	n.bridge = bridge
 	n.persistent = persistent
@@ -458,6 +470,14 @@ retry:
 		break
 	}
 
+	// We dropped the node, either because the kernel forgot it,
+	// or because it was removed from its last parent.
+	if nlookup > 0 || len(parents) > 0 {
+		if of, ok := n.ops.(NodeOnForgetter); ok {
+			of.OnForget()
+		}
+	}
+
 	for _, p := range lockme {
 		if p != n {
 			p.removeRef(0, false)
@@ -720,7 +740,7 @@ retry:
 		}
 
 		if destChild != nil {
-			oldParent.children[oldName] = oldChild
+			oldParent.children[oldName] = destChild
 			oldParent.changeCounter++
 
 			destChild.parents[parentData{oldName, oldParent}] = struct{}{}
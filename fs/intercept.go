@@ -0,0 +1,529 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// InterceptedOp describes an operation passed to an Interceptor.
+type InterceptedOp struct {
+	// Name is the name of the method, eg. "Lookup" or "Read".
+	Name string
+
+	// Node is the inode the operation is called on.
+	Node *Inode
+
+	// Handler receives the operations for Node, and passes them
+	// through the interceptors. Interceptors can call its methods
+	// to run further operations on Node through the same chain of
+	// interceptors.
+	Handler InodeEmbedder
+
+	// Args holds the arguments of the method, excluding the
+	// context. Output arguments, such as *fuse.EntryOut, are
+	// filled in once the operation has run. Replacing the
+	// elements has no effect.
+	Args []interface{}
+
+	// Results holds the return values of the method, excluding
+	// the error code. It is set once the operation has run, and
+	// may be modified by interceptors. An interceptor that
+	// returns OK without calling next must set it.
+	Results []interface{}
+}
+
+func (op *InterceptedOp) result(i int) interface{} {
+	if i >= len(op.Results) {
+		return nil
+	}
+	return op.Results[i]
+}
+
+// Interceptor is called for every operation on the nodes of a file
+// system mounted with Options.Interceptors. It runs the operation by
+// calling `next`, and can inspect the arguments and results, change
+// the results, or fail the operation without running it.
+type Interceptor func(ctx context.Context, op *InterceptedOp, next func(ctx context.Context) syscall.Errno) syscall.Errno
+
+// wrapperNode receives the operations for a node of a file system
+// with interceptors, and passes them through the interceptors to the
+// node. It implements every operation; if the node does not, it
+// behaves as the bridge does for such nodes.
+type wrapperNode struct {
+	inner        InodeEmbedder
+	interceptors []Interceptor
+}
+
+var _ = (NodeStatfser)((*wrapperNode)(nil))
+var _ = (NodeAccesser)((*wrapperNode)(nil))
+var _ = (NodeGetattrer)((*wrapperNode)(nil))
+var _ = (NodeSetattrer)((*wrapperNode)(nil))
+var _ = (NodeGetxattrer)((*wrapperNode)(nil))
+var _ = (NodeSetxattrer)((*wrapperNode)(nil))
+var _ = (NodeRemovexattrer)((*wrapperNode)(nil))
+var _ = (NodeListxattrer)((*wrapperNode)(nil))
+var _ = (NodeReadlinker)((*wrapperNode)(nil))
+var _ = (NodeOpener)((*wrapperNode)(nil))
+var _ = (NodeReader)((*wrapperNode)(nil))
+var _ = (NodeWriter)((*wrapperNode)(nil))
+var _ = (NodeFsyncer)((*wrapperNode)(nil))
+var _ = (NodeFlusher)((*wrapperNode)(nil))
+var _ = (NodeReleaser)((*wrapperNode)(nil))
+var _ = (NodeAllocater)((*wrapperNode)(nil))
+var _ = (NodeCopyFileRanger)((*wrapperNode)(nil))
+var _ = (NodeLseeker)((*wrapperNode)(nil))
+var _ = (NodeGetlker)((*wrapperNode)(nil))
+var _ = (NodeSetlker)((*wrapperNode)(nil))
+var _ = (NodeSetlkwer)((*wrapperNode)(nil))
+var _ = (NodeLookuper)((*wrapperNode)(nil))
+var _ = (NodeOpendirer)((*wrapperNode)(nil))
+var _ = (NodeReaddirer)((*wrapperNode)(nil))
+var _ = (NodeMkdirer)((*wrapperNode)(nil))
+var _ = (NodeMknoder)((*wrapperNode)(nil))
+var _ = (NodeLinker)((*wrapperNode)(nil))
+var _ = (NodeSymlinker)((*wrapperNode)(nil))
+var _ = (NodeCreater)((*wrapperNode)(nil))
+var _ = (NodeUnlinker)((*wrapperNode)(nil))
+var _ = (NodeRmdirer)((*wrapperNode)(nil))
+var _ = (NodeRenamer)((*wrapperNode)(nil))
+
+func (w *wrapperNode) embed() *Inode {
+	return w.inner.embed()
+}
+
+func (w *wrapperNode) EmbeddedInode() *Inode {
+	return w.inner.EmbeddedInode()
+}
+
+func (w *wrapperNode) newOp(name string, args ...interface{}) *InterceptedOp {
+	return &InterceptedOp{
+		Name:    name,
+		Node:    w.inner.EmbeddedInode(),
+		Handler: w,
+		Args:    args,
+	}
+}
+
+// run calls `call` through the chain of interceptors.
+func (w *wrapperNode) run(ctx context.Context, op *InterceptedOp, call func(ctx context.Context) syscall.Errno) syscall.Errno {
+	return runInterceptors(ctx, w.interceptors, op, call)
+}
+
+func runInterceptors(ctx context.Context, is []Interceptor, op *InterceptedOp, call func(ctx context.Context) syscall.Errno) syscall.Errno {
+	if len(is) == 0 {
+		return call(ctx)
+	}
+	return is[0](ctx, op, func(ctx context.Context) syscall.Errno {
+		return runInterceptors(ctx, is[1:], op, call)
+	})
+}
+
+func (w *wrapperNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return w.run(ctx, w.newOp("Statfs", out), func(ctx context.Context) syscall.Errno {
+		if sf, ok := w.inner.(NodeStatfser); ok {
+			return sf.Statfs(ctx, out)
+		}
+		return OK
+	})
+}
+
+func (w *wrapperNode) Access(ctx context.Context, mask uint32) syscall.Errno {
+	return w.run(ctx, w.newOp("Access", mask), func(ctx context.Context) syscall.Errno {
+		if a, ok := w.inner.(NodeAccesser); ok {
+			return a.Access(ctx, mask)
+		}
+		return w.EmbeddedInode().bridge.checkAccess(ctx, w.EmbeddedInode(), mask)
+	})
+}
+
+func (w *wrapperNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	return w.run(ctx, w.newOp("Getattr", f, out), func(ctx context.Context) syscall.Errno {
+		if ga, ok := w.inner.(NodeGetattrer); ok {
+			return ga.Getattr(ctx, f, out)
+		}
+		if fga, ok := f.(FileGetattrer); ok {
+			return fga.Getattr(ctx, out)
+		}
+		return OK
+	})
+}
+
+func (w *wrapperNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return w.run(ctx, w.newOp("Setattr", f, in, out), func(ctx context.Context) syscall.Errno {
+		if sa, ok := w.inner.(NodeSetattrer); ok {
+			return sa.Setattr(ctx, f, in, out)
+		}
+		if fsa, ok := f.(FileSetattrer); ok {
+			return fsa.Setattr(ctx, in, out)
+		}
+		return syscall.ENOTSUP
+	})
+}
+
+func (w *wrapperNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	op := w.newOp("Getxattr", attr, dest)
+	errno := w.run(ctx, op, func(ctx context.Context) syscall.Errno {
+		var sz uint32
+		errno := ENOATTR
+		if xa, ok := w.inner.(NodeGetxattrer); ok {
+			sz, errno = xa.Getxattr(ctx, attr, dest)
+		}
+		op.Results = []interface{}{sz}
+		return errno
+	})
+	sz, _ := op.result(0).(uint32)
+	return sz, errno
+}
+
+func (w *wrapperNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return w.run(ctx, w.newOp("Setxattr", attr, data, flags), func(ctx context.Context) syscall.Errno {
+		if xa, ok := w.inner.(NodeSetxattrer); ok {
+			return xa.Setxattr(ctx, attr, data, flags)
+		}
+		return ENOATTR
+	})
+}
+
+func (w *wrapperNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return w.run(ctx, w.newOp("Removexattr", attr), func(ctx context.Context) syscall.Errno {
+		if xa, ok := w.inner.(NodeRemovexattrer); ok {
+			return xa.Removexattr(ctx, attr)
+		}
+		return ENOATTR
+	})
+}
+
+func (w *wrapperNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	op := w.newOp("Listxattr", dest)
+	errno := w.run(ctx, op, func(ctx context.Context) syscall.Errno {
+		var sz uint32
+		var errno syscall.Errno
+		if xa, ok := w.inner.(NodeListxattrer); ok {
+			sz, errno = xa.Listxattr(ctx, dest)
+		}
+		op.Results = []interface{}{sz}
+		return errno
+	})
+	sz, _ := op.result(0).(uint32)
+	return sz, errno
+}
+
+func (w *wrapperNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	op := w.newOp("Readlink")
+	errno := w.run(ctx, op, func(ctx context.Context) syscall.Errno {
+		var target []byte
+		errno := syscall.ENOTSUP
+		if rl, ok := w.inner.(NodeReadlinker); ok {
+			target, errno = rl.Readlink(ctx)
+		}
+		op.Results = []interface{}{target}
+		return errno
+	})
+	target, _ := op.result(0).([]byte)
+	return target, errno
+}
+
+func (w *wrapperNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	op := w.newOp("Open", flags)
+	errno := w.run(ctx, op, func(ctx context.Context) syscall.Errno {
+		var fh FileHandle
+		var fuseFlags uint32
+		errno := syscall.ENOTSUP
+		if o, ok := w.inner.(NodeOpener); ok {
+			fh, fuseFlags, errno = o.Open(ctx, flags)
+		}
+		op.Results = []interface{}{fh, fuseFlags}
+		return errno
+	})
+	fh, _ := op.result(0).(FileHandle)
+	fuseFlags, _ := op.result(1).(uint32)
+	return fh, fuseFlags, errno
+}
+
+func (w *wrapperNode) Read(ctx context.Context, f FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	op := w.newOp("Read", f, dest, off)
+	errno := w.run(ctx, op, func(ctx context.Context) syscall.Errno {
+		var res fuse.ReadResult
+		errno := syscall.ENOTSUP
+		if r, ok := w.inner.(NodeReader); ok {
+			res, errno = r.Read(ctx, f, dest, off)
+		} else if fr, ok := f.(FileReader); ok {
+			res, errno = fr.Read(ctx, dest, off)
+		}
+		op.Results = []interface{}{res}
+		return errno
+	})
+	res, _ := op.result(0).(fuse.ReadResult)
+	return res, errno
+}
+
+func (w *wrapperNode) Write(ctx context.Context, f FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	op := w.newOp("Write", f, data, off)
+	errno := w.run(ctx, op, func(ctx context.Context) syscall.Errno {
+		var written uint32
+		errno := syscall.ENOTSUP
+		if wr, ok := w.inner.(NodeWriter); ok {
+			written, errno = wr.Write(ctx, f, data, off)
+		} else if fw, ok := f.(FileWriter); ok {
+			written, errno = fw.Write(ctx, data, off)
+		}
+		op.Results = []interface{}{written}
+		return errno
+	})
+	written, _ := op.result(0).(uint32)
+	return written, errno
+}
+
+func (w *wrapperNode) Fsync(ctx context.Context, f FileHandle, flags uint32) syscall.Errno {
+	return w.run(ctx, w.newOp("Fsync", f, flags), func(ctx context.Context) syscall.Errno {
+		if fs, ok := w.inner.(NodeFsyncer); ok {
+			return fs.Fsync(ctx, f, flags)
+		}
+		if fs, ok := f.(FileFsyncer); ok {
+			return fs.Fsync(ctx, flags)
+		}
+		return syscall.ENOTSUP
+	})
+}
+
+func (w *wrapperNode) Flush(ctx context.Context, f FileHandle) syscall.Errno {
+	return w.run(ctx, w.newOp("Flush", f), func(ctx context.Context) syscall.Errno {
+		if fl, ok := w.inner.(NodeFlusher); ok {
+			return fl.Flush(ctx, f)
+		}
+		if fl, ok := f.(FileFlusher); ok {
+			return fl.Flush(ctx)
+		}
+		return OK
+	})
+}
+
+func (w *wrapperNode) Release(ctx context.Context, f FileHandle) syscall.Errno {
+	return w.run(ctx, w.newOp("Release", f), func(ctx context.Context) syscall.Errno {
+		if r, ok := w.inner.(NodeReleaser); ok {
+			return r.Release(ctx, f)
+		}
+		if r, ok := f.(FileReleaser); ok {
+			return r.Release(ctx)
+		}
+		return OK
+	})
+}
+
+func (w *wrapperNode) Allocate(ctx context.Context, f FileHandle, off uint64, size uint64, mode uint32) syscall.Errno {
+	return w.run(ctx, w.newOp("Allocate", f, off, size, mode), func(ctx context.Context) syscall.Errno {
+		if a, ok := w.inner.(NodeAllocater); ok {
+			return a.Allocate(ctx, f, off, size, mode)
+		}
+		if a, ok := f.(FileAllocater); ok {
+			return a.Allocate(ctx, off, size, mode)
+		}
+		return syscall.ENOTSUP
+	})
+}
+
+func (w *wrapperNode) CopyFileRange(ctx context.Context, fhIn FileHandle,
+	offIn uint64, out *Inode, fhOut FileHandle, offOut uint64,
+	len uint64, flags uint64) (uint32, syscall.Errno) {
+	op := w.newOp("CopyFileRange", fhIn, offIn, out, fhOut, offOut, len, flags)
+	errno := w.run(ctx, op, func(ctx context.Context) syscall.Errno {
+		var sz uint32
+		errno := syscall.ENOTSUP
+		if cfr, ok := w.inner.(NodeCopyFileRanger); ok {
+			sz, errno = cfr.CopyFileRange(ctx, fhIn, offIn, out, fhOut, offOut, len, flags)
+		}
+		op.Results = []interface{}{sz}
+		return errno
+	})
+	sz, _ := op.result(0).(uint32)
+	return sz, errno
+}
+
+func (w *wrapperNode) Lseek(ctx context.Context, f FileHandle, off uint64, whence uint32) (uint64, syscall.Errno) {
+	op := w.newOp("Lseek", f, off, whence)
+	errno := w.run(ctx, op, func(ctx context.Context) syscall.Errno {
+		var res uint64
+		errno := syscall.ENOTSUP
+		if ls, ok := w.inner.(NodeLseeker); ok {
+			res, errno = ls.Lseek(ctx, f, off, whence)
+		} else if ls, ok := f.(FileLseeker); ok {
+			res, errno = ls.Lseek(ctx, off, whence)
+		} else if whence == _SEEK_DATA || whence == _SEEK_HOLE {
+			res, errno = off, OK
+		}
+		op.Results = []interface{}{res}
+		return errno
+	})
+	res, _ := op.result(0).(uint64)
+	return res, errno
+}
+
+func (w *wrapperNode) Getlk(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	return w.run(ctx, w.newOp("Getlk", f, owner, lk, flags, out), func(ctx context.Context) syscall.Errno {
+		if l, ok := w.inner.(NodeGetlker); ok {
+			return l.Getlk(ctx, f, owner, lk, flags, out)
+		}
+		if l, ok := f.(FileGetlker); ok {
+			return l.Getlk(ctx, owner, lk, flags, out)
+		}
+		return syscall.ENOTSUP
+	})
+}
+
+func (w *wrapperNode) Setlk(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	return w.run(ctx, w.newOp("Setlk", f, owner, lk, flags), func(ctx context.Context) syscall.Errno {
+		if l, ok := w.inner.(NodeSetlker); ok {
+			return l.Setlk(ctx, f, owner, lk, flags)
+		}
+		if l, ok := f.(FileSetlker); ok {
+			return l.Setlk(ctx, owner, lk, flags)
+		}
+		return syscall.ENOTSUP
+	})
+}
+
+func (w *wrapperNode) Setlkw(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	return w.run(ctx, w.newOp("Setlkw", f, owner, lk, flags), func(ctx context.Context) syscall.Errno {
+		if l, ok := w.inner.(NodeSetlkwer); ok {
+			return l.Setlkw(ctx, f, owner, lk, flags)
+		}
+		if l, ok := f.(FileSetlkwer); ok {
+			return l.Setlkw(ctx, owner, lk, flags)
+		}
+		return syscall.ENOTSUP
+	})
+}
+
+// entryOp runs an operation that results in a new child node.
+func (w *wrapperNode) entryOp(ctx context.Context, op *InterceptedOp, call func(ctx context.Context) (*Inode, syscall.Errno)) (*Inode, syscall.Errno) {
+	errno := w.run(ctx, op, func(ctx context.Context) syscall.Errno {
+		ch, errno := call(ctx)
+		op.Results = []interface{}{ch}
+		return errno
+	})
+	ch, _ := op.result(0).(*Inode)
+	return ch, errno
+}
+
+func (w *wrapperNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return w.entryOp(ctx, w.newOp("Lookup", name, out), func(ctx context.Context) (*Inode, syscall.Errno) {
+		if lu, ok := w.inner.(NodeLookuper); ok {
+			return lu.Lookup(ctx, name, out)
+		}
+		return w.EmbeddedInode().bridge.lookupChild(ctx, w.EmbeddedInode(), name, out)
+	})
+}
+
+func (w *wrapperNode) Opendir(ctx context.Context) syscall.Errno {
+	return w.run(ctx, w.newOp("Opendir"), func(ctx context.Context) syscall.Errno {
+		if od, ok := w.inner.(NodeOpendirer); ok {
+			return od.Opendir(ctx)
+		}
+		return OK
+	})
+}
+
+func (w *wrapperNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	op := w.newOp("Readdir")
+	errno := w.run(ctx, op, func(ctx context.Context) syscall.Errno {
+		var ds DirStream
+		var errno syscall.Errno
+		if rd, ok := w.inner.(NodeReaddirer); ok {
+			ds, errno = rd.Readdir(ctx)
+		} else {
+			ds = childrenStream(w.EmbeddedInode())
+		}
+		op.Results = []interface{}{ds}
+		return errno
+	})
+	ds, _ := op.result(0).(DirStream)
+	return ds, errno
+}
+
+func (w *wrapperNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return w.entryOp(ctx, w.newOp("Mkdir", name, mode, out), func(ctx context.Context) (*Inode, syscall.Errno) {
+		if m, ok := w.inner.(NodeMkdirer); ok {
+			return m.Mkdir(ctx, name, mode, out)
+		}
+		return nil, syscall.ENOTSUP
+	})
+}
+
+func (w *wrapperNode) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return w.entryOp(ctx, w.newOp("Mknod", name, mode, dev, out), func(ctx context.Context) (*Inode, syscall.Errno) {
+		if m, ok := w.inner.(NodeMknoder); ok {
+			return m.Mknod(ctx, name, mode, dev, out)
+		}
+		return nil, syscall.ENOTSUP
+	})
+}
+
+func (w *wrapperNode) Link(ctx context.Context, target InodeEmbedder, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return w.entryOp(ctx, w.newOp("Link", target, name, out), func(ctx context.Context) (*Inode, syscall.Errno) {
+		if l, ok := w.inner.(NodeLinker); ok {
+			return l.Link(ctx, target, name, out)
+		}
+		return nil, syscall.ENOTSUP
+	})
+}
+
+func (w *wrapperNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return w.entryOp(ctx, w.newOp("Symlink", target, name, out), func(ctx context.Context) (*Inode, syscall.Errno) {
+		if s, ok := w.inner.(NodeSymlinker); ok {
+			return s.Symlink(ctx, target, name, out)
+		}
+		return nil, syscall.ENOTSUP
+	})
+}
+
+func (w *wrapperNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	op := w.newOp("Create", name, flags, mode, out)
+	errno := w.run(ctx, op, func(ctx context.Context) syscall.Errno {
+		var ch *Inode
+		var fh FileHandle
+		var fuseFlags uint32
+		errno := syscall.EROFS
+		if c, ok := w.inner.(NodeCreater); ok {
+			ch, fh, fuseFlags, errno = c.Create(ctx, name, flags, mode, out)
+		}
+		op.Results = []interface{}{ch, fh, fuseFlags}
+		return errno
+	})
+	ch, _ := op.result(0).(*Inode)
+	fh, _ := op.result(1).(FileHandle)
+	fuseFlags, _ := op.result(2).(uint32)
+	return ch, fh, fuseFlags, errno
+}
+
+func (w *wrapperNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	return w.run(ctx, w.newOp("Unlink", name), func(ctx context.Context) syscall.Errno {
+		if u, ok := w.inner.(NodeUnlinker); ok {
+			return u.Unlink(ctx, name)
+		}
+		return OK
+	})
+}
+
+func (w *wrapperNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return w.run(ctx, w.newOp("Rmdir", name), func(ctx context.Context) syscall.Errno {
+		if r, ok := w.inner.(NodeRmdirer); ok {
+			return r.Rmdir(ctx, name)
+		}
+		return OK
+	})
+}
+
+func (w *wrapperNode) Rename(ctx context.Context, name string, newParent InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	return w.run(ctx, w.newOp("Rename", name, newParent, newName, flags), func(ctx context.Context) syscall.Errno {
+		if r, ok := w.inner.(NodeRenamer); ok {
+			return r.Rename(ctx, name, newParent, newName, flags)
+		}
+		return syscall.ENOTSUP
+	})
+}
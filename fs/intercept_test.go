@@ -0,0 +1,127 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"github.com/hanwen/go-fuse/v2/posixtest"
+)
+
+// opRecorder is an Interceptor that records the names of the
+// operations it sees.
+type opRecorder struct {
+	mu  sync.Mutex
+	ops map[string]int
+}
+
+func (r *opRecorder) intercept(ctx context.Context, op *InterceptedOp, next func(context.Context) syscall.Errno) syscall.Errno {
+	r.mu.Lock()
+	if r.ops == nil {
+		r.ops = map[string]int{}
+	}
+	r.ops[op.Name]++
+	r.mu.Unlock()
+	return next(ctx)
+}
+
+func (r *opRecorder) count(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ops[name]
+}
+
+func TestInterceptPosix(t *testing.T) {
+	for nm, fn := range posixtest.All {
+		t.Run(nm, func(t *testing.T) {
+			var rec opRecorder
+			dir := testutil.TempDir()
+			defer os.RemoveAll(dir)
+			loopback, err := NewLoopbackRoot(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mnt, _, clean := testMount(t, loopback, &Options{
+				Interceptors: []Interceptor{rec.intercept},
+			})
+			defer clean()
+
+			fn(t, mnt)
+		})
+	}
+}
+
+func TestInterceptMemFSPosix(t *testing.T) {
+	for nm, fn := range posixtest.All {
+		t.Run(nm, func(t *testing.T) {
+			var rec opRecorder
+			mnt, _, clean := testMount(t, NewMemFS(nil), &Options{
+				Interceptors: []Interceptor{rec.intercept},
+			})
+			defer clean()
+
+			fn(t, mnt)
+		})
+	}
+}
+
+func TestIntercept(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(dir+"/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/sub/file", []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loopback, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var outer, inner opRecorder
+	truncate := func(ctx context.Context, op *InterceptedOp, next func(context.Context) syscall.Errno) syscall.Errno {
+		errno := next(ctx)
+		if op.Name == "Read" && errno == 0 {
+			op.Results[0] = fuse.ReadResultData([]byte("hello"))
+		}
+		return errno
+	}
+	mnt, _, clean := testMount(t, loopback, &Options{
+		Interceptors: []Interceptor{outer.intercept, truncate, inner.intercept},
+	})
+	defer clean()
+
+	content, err := ioutil.ReadFile(mnt + "/sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(content), "hello"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, rec := range []*opRecorder{&outer, &inner} {
+		for _, op := range []string{"Lookup", "Open", "Read"} {
+			if rec.count(op) == 0 {
+				t.Errorf("no %s intercepted", op)
+			}
+		}
+	}
+
+	sub := loopback.EmbeddedInode().GetChild("sub")
+	if sub == nil {
+		t.Fatal("sub not found")
+	}
+	if _, ok := sub.Operations().(*LoopbackNode); !ok {
+		t.Errorf("Operations returned %T, want *LoopbackNode", sub.Operations())
+	}
+}
@@ -11,12 +11,13 @@ import (
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/passthrough"
 )
 
-// loopbackRoot holds the parameters for creating a new loopback
+// LoopbackRoot holds the parameters for creating a new loopback
 // filesystem. Loopback filesystem delegate their operations to an
 // underlying POSIX file system.
-type loopbackRoot struct {
+type LoopbackRoot struct {
 	// The path to the root of the underlying file system.
 	Path string
 
@@ -26,69 +27,205 @@ type loopbackRoot struct {
 
 	// NewNode returns a new InodeEmbedder to be used to respond
 	// to a LOOKUP/CREATE/MKDIR/MKNOD opcode. If not set, use a
-	// LoopbackNode.
-	NewNode func(rootData *loopbackRoot) InodeEmbedder
+	// LoopbackNode. The returned node must embed a LoopbackNode
+	// with RootData set to `rootData`.
+	NewNode func(rootData *LoopbackRoot) InodeEmbedder
+
+	// EncodeName returns the name in the backing directory for
+	// the entry `name` in the directory `dir`. If not set, names
+	// are the same in both file systems.
+	EncodeName func(dir *Inode, name string) (string, syscall.Errno)
+
+	// rootFd is an O_PATH descriptor for Path, or -1. If set,
+	// LoopbackNode resolves all paths beneath it.
+	rootFd int
+
+	// creds holds the credentials of the daemon, if operations
+	// run with the credentials of the caller.
+	creds *loopbackCreds
+
+	// uidMap and gidMap translate owners between the file system
+	// and the backing file system.
+	uidMap, gidMap IDMap
+
+	// watcher invalidates the kernel cache for changes to the
+	// backing directories, if set.
+	watcher *loopbackWatcher
 }
 
-func (r *loopbackRoot) newNode() InodeEmbedder {
+// LoopbackOptions holds options for NewLoopbackRootWithOptions.
+type LoopbackOptions struct {
+	// Confine makes the file system resolve all paths relative
+	// to a descriptor for the root with
+	// openat2(RESOLVE_BENEATH|RESOLVE_NO_MAGICLINKS), so symlinks
+	// swapped into the backing tree by other users cannot
+	// redirect operations to files outside the root. On kernels
+	// without openat2, paths are walked one component at a time,
+	// without following symlinks. Only supported on Linux.
+	Confine bool
+
+	// CallerCredentials runs the system calls for each operation
+	// with the file system uid, gid and supplementary groups of
+	// the caller, so the backing file system enforces
+	// permissions and sets ownership of new files itself. This
+	// requires the daemon to run as root. Only supported on
+	// Linux.
+	CallerCredentials bool
+
+	// UIDMap and GIDMap translate user and group IDs between the
+	// file system and the backing file system, like an idmapped
+	// mount. They apply to attributes, changes of ownership, and
+	// to the caller's credentials used for new files. IDs without
+	// mapping are reported as OverflowID.
+	UIDMap IDMap
+	GIDMap IDMap
+
+	// Watch watches the backing directories with inotify for
+	// changes made outside the mount, and invalidates the
+	// kernel's entry, attribute and data caches accordingly, so
+	// long cache timeouts can be used safely. A directory is
+	// watched once it has been looked up. Only supported on
+	// Linux.
+	Watch bool
+
+	// NewNode and EncodeName set the fields of the same name in
+	// the LoopbackRoot, for file systems that build on the
+	// loopback file system by embedding LoopbackNode. Nodes
+	// returned by NewNode do not run operations with the
+	// caller's credentials.
+	NewNode    func(rootData *LoopbackRoot) InodeEmbedder
+	EncodeName func(dir *Inode, name string) (string, syscall.Errno)
+}
+
+func (r *LoopbackRoot) newNode() InodeEmbedder {
 	if r.NewNode != nil {
 		return r.NewNode(r)
 	}
-	return &loopbackNode{
+	if r.creds != nil {
+		return &loopbackCallerNode{
+			LoopbackNode{RootData: r},
+		}
+	}
+	return &LoopbackNode{
 		RootData: r,
 	}
 }
 
-func (r *loopbackRoot) idFromStat(st *syscall.Stat_t) StableAttr {
-	// We compose an inode number by the underlying inode, and
-	// mixing in the device number. In traditional filesystems,
-	// the inode numbers are small. The device numbers are also
-	// small (typically 16 bit). Finally, we mask out the root
-	// device number of the root, so a loopback FS that does not
-	// encompass multiple mounts will reflect the inode numbers of
-	// the underlying filesystem
-	swapped := (uint64(st.Dev) << 32) | (uint64(st.Dev) >> 32)
-	swappedRootDev := (r.Dev << 32) | (r.Dev >> 32)
+// mapAttr translates the owner in `out` from the backing file system.
+func (r *LoopbackRoot) mapAttr(out *fuse.Attr) {
+	MapAttrOwner(r.uidMap, r.gidMap, out)
+}
+
+func (r *LoopbackRoot) idFromStat(st *syscall.Stat_t) StableAttr {
 	return StableAttr{
 		Mode: uint32(st.Mode),
 		Gen:  1,
 		// This should work well for traditional backing FSes,
 		// not so much for other go-fuse FS-es
-		Ino: (swapped ^ swappedRootDev) ^ st.Ino,
+		Ino: passthrough.Ino(st, r.Dev),
+	}
+}
+
+// relPath returns the path of `n` in the backing file system,
+// relative to the root.
+func (r *LoopbackRoot) relPath(n *Inode) (string, syscall.Errno) {
+	if r.EncodeName == nil {
+		return n.Path(n.Root()), OK
+	}
+	var segments []string
+	for !n.IsRoot() {
+		name, parent := n.Parent()
+		if parent == nil {
+			// Unlinked.
+			return "", syscall.ENOENT
+		}
+		enc, errno := r.EncodeName(parent, name)
+		if errno != 0 {
+			return "", errno
+		}
+		segments = append(segments, enc)
+		n = parent
+	}
+	for i, j := 0, len(segments)-1; i < j; i, j = i+1, j-1 {
+		segments[i], segments[j] = segments[j], segments[i]
 	}
+	return filepath.Join(segments...), OK
 }
 
 // LoopbackNode is a filesystem node in a loopback file system.
-type loopbackNode struct {
+type LoopbackNode struct {
 	Inode
 
-	RootData *loopbackRoot
-}
-
-var _ = (NodeStatfser)((*loopbackNode)(nil))
-var _ = (NodeStatfser)((*loopbackNode)(nil))
-var _ = (NodeGetattrer)((*loopbackNode)(nil))
-var _ = (NodeGetxattrer)((*loopbackNode)(nil))
-var _ = (NodeSetxattrer)((*loopbackNode)(nil))
-var _ = (NodeRemovexattrer)((*loopbackNode)(nil))
-var _ = (NodeListxattrer)((*loopbackNode)(nil))
-var _ = (NodeReadlinker)((*loopbackNode)(nil))
-var _ = (NodeOpener)((*loopbackNode)(nil))
-var _ = (NodeCopyFileRanger)((*loopbackNode)(nil))
-var _ = (NodeLookuper)((*loopbackNode)(nil))
-var _ = (NodeOpendirer)((*loopbackNode)(nil))
-var _ = (NodeReaddirer)((*loopbackNode)(nil))
-var _ = (NodeMkdirer)((*loopbackNode)(nil))
-var _ = (NodeMknoder)((*loopbackNode)(nil))
-var _ = (NodeLinker)((*loopbackNode)(nil))
-var _ = (NodeSymlinker)((*loopbackNode)(nil))
-var _ = (NodeUnlinker)((*loopbackNode)(nil))
-var _ = (NodeRmdirer)((*loopbackNode)(nil))
-var _ = (NodeRenamer)((*loopbackNode)(nil))
-
-func (n *loopbackNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	RootData *LoopbackRoot
+}
+
+// loopbackNodeEmbedder is implemented by the nodes of loopback file
+// systems, which embed LoopbackNode.
+type loopbackNodeEmbedder interface {
+	loopbackNode() *LoopbackNode
+}
+
+func (n *LoopbackNode) loopbackNode() *LoopbackNode {
+	return n
+}
+
+// toLoopbackNode returns the LoopbackNode of a node in a loopback
+// file system.
+func toLoopbackNode(ops InodeEmbedder) *LoopbackNode {
+	return ops.(loopbackNodeEmbedder).loopbackNode()
+}
+
+var _ = (NodeStatfser)((*LoopbackNode)(nil))
+var _ = (NodeStatfser)((*LoopbackNode)(nil))
+var _ = (NodeGetattrer)((*LoopbackNode)(nil))
+var _ = (NodeGetxattrer)((*LoopbackNode)(nil))
+var _ = (NodeSetxattrer)((*LoopbackNode)(nil))
+var _ = (NodeRemovexattrer)((*LoopbackNode)(nil))
+var _ = (NodeListxattrer)((*LoopbackNode)(nil))
+var _ = (NodeReadlinker)((*LoopbackNode)(nil))
+var _ = (NodeOpener)((*LoopbackNode)(nil))
+var _ = (NodeCopyFileRanger)((*LoopbackNode)(nil))
+var _ = (NodeLookuper)((*LoopbackNode)(nil))
+var _ = (NodeOpendirer)((*LoopbackNode)(nil))
+var _ = (NodeReaddirer)((*LoopbackNode)(nil))
+var _ = (NodeMkdirer)((*LoopbackNode)(nil))
+var _ = (NodeMknoder)((*LoopbackNode)(nil))
+var _ = (NodeLinker)((*LoopbackNode)(nil))
+var _ = (NodeSymlinker)((*LoopbackNode)(nil))
+var _ = (NodeUnlinker)((*LoopbackNode)(nil))
+var _ = (NodeRmdirer)((*LoopbackNode)(nil))
+var _ = (NodeRenamer)((*LoopbackNode)(nil))
+var _ = (NodeOnForgetter)((*LoopbackNode)(nil))
+
+// OnForget stops watching a forgotten directory. For the root, which
+// is only forgotten on unmount once all requests have been served, it
+// stops the watcher and releases the root descriptor of a confined
+// file system.
+func (n *LoopbackNode) OnForget() {
+	r := n.RootData
+	if !n.IsRoot() {
+		r.unwatch(&n.Inode)
+		return
+	}
+	if r.watcher != nil {
+		r.watcher.close()
+		r.watcher = nil
+	}
+	if r.rootFd >= 0 {
+		syscall.Close(r.rootFd)
+		r.rootFd = -1
+	}
+}
+
+func (n *LoopbackNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	p, done, errno := n.nodePath()
+	if errno != 0 {
+		return errno
+	}
+	defer done()
+
 	s := syscall.Statfs_t{}
-	err := syscall.Statfs(n.path(), &s)
+	err := syscall.Statfs(p, &s)
 	if err != nil {
 		return ToErrno(err)
 	}
@@ -96,13 +233,78 @@ func (n *loopbackNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.
 	return OK
 }
 
-func (n *loopbackNode) path() string {
-	path := n.Path(n.Root())
-	return filepath.Join(n.RootData.Path, path)
+// BackingPath returns the path of the node in the backing file
+// system.
+func (n *LoopbackNode) BackingPath() (string, syscall.Errno) {
+	rel, errno := n.RootData.relPath(&n.Inode)
+	if errno != 0 {
+		return "", errno
+	}
+	return filepath.Join(n.RootData.Path, rel), OK
+}
+
+// nodePath returns a path for operating on n itself, and a function
+// to call when done with it. If the file system is confined, the path
+// refers to a descriptor opened beneath the root, so system calls
+// that follow symlinks cannot be redirected outside it.
+func (n *LoopbackNode) nodePath() (string, func(), syscall.Errno) {
+	if n.RootData.rootFd < 0 {
+		p, errno := n.BackingPath()
+		return p, func() {}, errno
+	}
+	rel, errno := n.RootData.relPath(&n.Inode)
+	if errno != 0 {
+		return "", nil, errno
+	}
+	return n.RootData.nodePathBeneath(rel)
+}
+
+// entryPath is like nodePath, but the path names n in its parent
+// directory, so system calls that do not follow symlinks, such as
+// lstat and readlink, see n itself.
+func (n *LoopbackNode) entryPath() (string, func(), syscall.Errno) {
+	rel, errno := n.RootData.relPath(&n.Inode)
+	if errno != 0 {
+		return "", nil, errno
+	}
+	return n.RootData.childPath(filepath.Dir(rel), filepath.Base(rel))
+}
+
+// childPath returns a path for the entry `name` in the directory n.
+func (n *LoopbackNode) childPath(name string) (string, func(), syscall.Errno) {
+	return n.RootData.childPathIn(&n.Inode, name)
+}
+
+// childPathIn returns a path for the entry `name` in the directory
+// `dir`.
+func (r *LoopbackRoot) childPathIn(dir *Inode, name string) (string, func(), syscall.Errno) {
+	rel, errno := r.relPath(dir)
+	if errno != 0 {
+		return "", nil, errno
+	}
+	if r.EncodeName != nil {
+		if name, errno = r.EncodeName(dir, name); errno != 0 {
+			return "", nil, errno
+		}
+	}
+	return r.childPath(rel, name)
+}
+
+// childPath returns a path for the entry `name` in directory `rel`,
+// relative to the root.
+func (r *LoopbackRoot) childPath(rel, name string) (string, func(), syscall.Errno) {
+	if r.rootFd < 0 {
+		return filepath.Join(r.Path, rel, name), func() {}, OK
+	}
+	return r.childPathBeneath(rel, name)
 }
 
-func (n *loopbackNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
-	p := filepath.Join(n.path(), name)
+func (n *LoopbackNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	p, done, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer done()
 
 	st := syscall.Stat_t{}
 	err := syscall.Lstat(p, &st)
@@ -111,26 +313,34 @@ func (n *loopbackNode) Lookup(ctx context.Context, name string, out *fuse.EntryO
 	}
 
 	out.Attr.FromStat(&st)
+	n.RootData.mapAttr(&out.Attr)
 	node := n.RootData.newNode()
 	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
+	n.RootData.watch(ch, p)
 	return ch, 0
 }
 
 // preserveOwner sets uid and gid of `path` according to the caller information
-// in `ctx`.
-func (n *loopbackNode) preserveOwner(ctx context.Context, path string) error {
-	if os.Getuid() != 0 {
+// in `ctx`. This is not needed if the file was created with the
+// caller's credentials.
+func (n *LoopbackNode) preserveOwner(ctx context.Context, path string) error {
+	if n.RootData.creds != nil {
 		return nil
 	}
-	caller, ok := fuse.FromContext(ctx)
-	if !ok {
-		return nil
-	}
-	return syscall.Lchown(path, int(caller.Uid), int(caller.Gid))
+	r := n.RootData
+	return passthrough.PreserveMappedOwner(ctx, path, func(caller *fuse.Caller) (uint32, uint32) {
+		return MapCaller(r.uidMap, r.gidMap, caller)
+	})
 }
 
-func (n *loopbackNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
-	p := filepath.Join(n.path(), name)
+func (n *LoopbackNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	p, done, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer done()
+	end := n.RootData.changing(&n.Inode, nil)
+	defer end()
 	err := syscall.Mknod(p, mode, int(rdev))
 	if err != nil {
 		return nil, ToErrno(err)
@@ -143,6 +353,7 @@ func (n *loopbackNode) Mknod(ctx context.Context, name string, mode, rdev uint32
 	}
 
 	out.Attr.FromStat(&st)
+	n.RootData.mapAttr(&out.Attr)
 
 	node := n.RootData.newNode()
 	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
@@ -150,8 +361,14 @@ func (n *loopbackNode) Mknod(ctx context.Context, name string, mode, rdev uint32
 	return ch, 0
 }
 
-func (n *loopbackNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
-	p := filepath.Join(n.path(), name)
+func (n *LoopbackNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	p, done, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer done()
+	end := n.RootData.changing(&n.Inode, nil)
+	defer end()
 	err := os.Mkdir(p, os.FileMode(mode))
 	if err != nil {
 		return nil, ToErrno(err)
@@ -164,42 +381,76 @@ func (n *loopbackNode) Mkdir(ctx context.Context, name string, mode uint32, out
 	}
 
 	out.Attr.FromStat(&st)
+	n.RootData.mapAttr(&out.Attr)
 
 	node := n.RootData.newNode()
 	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
+	n.RootData.watch(ch, p)
 
 	return ch, 0
 }
 
-func (n *loopbackNode) Rmdir(ctx context.Context, name string) syscall.Errno {
-	p := filepath.Join(n.path(), name)
+func (n *LoopbackNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	p, done, errno := n.childPath(name)
+	if errno != 0 {
+		return errno
+	}
+	defer done()
+	end := n.RootData.changing(&n.Inode, nil)
+	defer end()
 	err := syscall.Rmdir(p)
 	return ToErrno(err)
 }
 
-func (n *loopbackNode) Unlink(ctx context.Context, name string) syscall.Errno {
-	p := filepath.Join(n.path(), name)
+func (n *LoopbackNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	p, done, errno := n.childPath(name)
+	if errno != 0 {
+		return errno
+	}
+	defer done()
+	end := n.RootData.changing(&n.Inode, nil)
+	defer end()
 	err := syscall.Unlink(p)
 	return ToErrno(err)
 }
 
-func (n *loopbackNode) Rename(ctx context.Context, name string, newParent InodeEmbedder, newName string, flags uint32) syscall.Errno {
+func (n *LoopbackNode) Rename(ctx context.Context, name string, newParent InodeEmbedder, newName string, flags uint32) syscall.Errno {
 	if flags&RENAME_EXCHANGE != 0 {
 		return n.renameExchange(name, newParent, newName)
 	}
 
-	p1 := filepath.Join(n.path(), name)
-	p2 := filepath.Join(n.RootData.Path, newParent.EmbeddedInode().Path(nil), newName)
+	p1, done1, errno := n.childPath(name)
+	if errno != 0 {
+		return errno
+	}
+	defer done1()
+	p2, done2, errno := n.RootData.childPathIn(newParent.EmbeddedInode(), newName)
+	if errno != 0 {
+		return errno
+	}
+	defer done2()
+	end := n.RootData.changing(&n.Inode, newParent.EmbeddedInode())
+	defer end()
 
 	err := syscall.Rename(p1, p2)
 	return ToErrno(err)
 }
 
-var _ = (NodeCreater)((*loopbackNode)(nil))
+var _ = (NodeCreater)((*LoopbackNode)(nil))
+
+func (n *LoopbackNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	p, done, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	defer done()
+	end := n.RootData.changing(&n.Inode, nil)
+	defer end()
 
-func (n *loopbackNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	p := filepath.Join(n.path(), name)
 	flags = flags &^ syscall.O_APPEND
+	if n.RootData.rootFd >= 0 {
+		flags |= syscall.O_NOFOLLOW
+	}
 	fd, err := syscall.Open(p, int(flags)|os.O_CREATE, mode)
 	if err != nil {
 		return nil, nil, 0, ToErrno(err)
@@ -213,14 +464,21 @@ func (n *loopbackNode) Create(ctx context.Context, name string, flags uint32, mo
 
 	node := n.RootData.newNode()
 	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
-	lf := NewLoopbackFile(fd)
+	lf := n.RootData.newFile(ch, fd)
 
 	out.FromStat(&st)
+	n.RootData.mapAttr(&out.Attr)
 	return ch, lf, 0, 0
 }
 
-func (n *loopbackNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
-	p := filepath.Join(n.path(), name)
+func (n *LoopbackNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	p, done, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer done()
+	end := n.RootData.changing(&n.Inode, nil)
+	defer end()
 	err := syscall.Symlink(target, p)
 	if err != nil {
 		return nil, ToErrno(err)
@@ -235,13 +493,25 @@ func (n *loopbackNode) Symlink(ctx context.Context, target, name string, out *fu
 	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
 
 	out.Attr.FromStat(&st)
+	n.RootData.mapAttr(&out.Attr)
 	return ch, 0
 }
 
-func (n *loopbackNode) Link(ctx context.Context, target InodeEmbedder, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+func (n *LoopbackNode) Link(ctx context.Context, target InodeEmbedder, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	p, done, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer done()
+	tp, tdone, errno := toLoopbackNode(target).entryPath()
+	if errno != 0 {
+		return nil, errno
+	}
+	defer tdone()
+	end := n.RootData.changing(&n.Inode, target.EmbeddedInode())
+	defer end()
 
-	p := filepath.Join(n.path(), name)
-	err := syscall.Link(filepath.Join(n.RootData.Path, target.EmbeddedInode().Path(nil)), p)
+	err := syscall.Link(tp, p)
 	if err != nil {
 		return nil, ToErrno(err)
 	}
@@ -254,11 +524,16 @@ func (n *loopbackNode) Link(ctx context.Context, target InodeEmbedder, name stri
 	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
 
 	out.Attr.FromStat(&st)
+	n.RootData.mapAttr(&out.Attr)
 	return ch, 0
 }
 
-func (n *loopbackNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
-	p := n.path()
+func (n *LoopbackNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	p, done, errno := n.entryPath()
+	if errno != 0 {
+		return nil, errno
+	}
+	defer done()
 
 	for l := 256; ; l *= 2 {
 		buf := make([]byte, l)
@@ -273,19 +548,30 @@ func (n *loopbackNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
 	}
 }
 
-func (n *loopbackNode) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+func (n *LoopbackNode) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	p, done, errno := n.nodePath()
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	defer done()
+
 	flags = flags &^ syscall.O_APPEND
-	p := n.path()
 	f, err := syscall.Open(p, int(flags), 0)
 	if err != nil {
 		return nil, 0, ToErrno(err)
 	}
-	lf := NewLoopbackFile(f)
+	lf := n.RootData.newFile(&n.Inode, f)
 	return lf, 0, 0
 }
 
-func (n *loopbackNode) Opendir(ctx context.Context) syscall.Errno {
-	fd, err := syscall.Open(n.path(), syscall.O_DIRECTORY, 0755)
+func (n *LoopbackNode) Opendir(ctx context.Context) syscall.Errno {
+	p, done, errno := n.nodePath()
+	if errno != 0 {
+		return errno
+	}
+	defer done()
+
+	fd, err := syscall.Open(p, syscall.O_DIRECTORY, 0755)
 	if err != nil {
 		return ToErrno(err)
 	}
@@ -293,16 +579,30 @@ func (n *loopbackNode) Opendir(ctx context.Context) syscall.Errno {
 	return OK
 }
 
-func (n *loopbackNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
-	return NewLoopbackDirStream(n.path())
+func (n *LoopbackNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	p, done, errno := n.nodePath()
+	if errno != 0 {
+		return nil, errno
+	}
+	defer done()
+
+	return NewLoopbackDirStream(p)
 }
 
-func (n *loopbackNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+func (n *LoopbackNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
 	if f != nil {
-		return f.(FileGetattrer).Getattr(ctx, out)
+		if errno := f.(FileGetattrer).Getattr(ctx, out); errno != 0 {
+			return errno
+		}
+		n.RootData.mapAttr(&out.Attr)
+		return OK
 	}
 
-	p := n.path()
+	p, done, errno := n.entryPath()
+	if errno != 0 {
+		return errno
+	}
+	defer done()
 
 	var err error
 	st := syscall.Stat_t{}
@@ -316,17 +616,31 @@ func (n *loopbackNode) Getattr(ctx context.Context, f FileHandle, out *fuse.Attr
 		return ToErrno(err)
 	}
 	out.FromStat(&st)
+	n.RootData.mapAttr(&out.Attr)
 	return OK
 }
 
-var _ = (NodeSetattrer)((*loopbackNode)(nil))
+var _ = (NodeSetattrer)((*LoopbackNode)(nil))
+
+func (n *LoopbackNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	in, errno := MapSetAttrIn(n.RootData.uidMap, n.RootData.gidMap, in)
+	if errno != 0 {
+		return errno
+	}
+
+	end := n.RootData.changing(&n.Inode, nil)
+	defer end()
 
-func (n *loopbackNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
-	p := n.path()
 	fsa, ok := f.(FileSetattrer)
 	if ok && fsa != nil {
 		fsa.Setattr(ctx, in, out)
 	} else {
+		p, done, errno := n.nodePath()
+		if errno != 0 {
+			return errno
+		}
+		defer done()
+
 		if m, ok := in.GetMode(); ok {
 			if err := syscall.Chmod(p, m); err != nil {
 				return ToErrno(err)
@@ -381,13 +695,9 @@ func (n *loopbackNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAt
 	fga, ok := f.(FileGetattrer)
 	if ok && fga != nil {
 		fga.Getattr(ctx, out)
+		n.RootData.mapAttr(&out.Attr)
 	} else {
-		st := syscall.Stat_t{}
-		err := syscall.Lstat(p, &st)
-		if err != nil {
-			return ToErrno(err)
-		}
-		out.FromStat(&st)
+		return n.Getattr(ctx, nil, out)
 	}
 	return OK
 }
@@ -396,15 +706,48 @@ func (n *loopbackNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAt
 // root is at the given root. This node implements all NodeXxxxer
 // operations available.
 func NewLoopbackRoot(rootPath string) (InodeEmbedder, error) {
+	return NewLoopbackRootWithOptions(rootPath, nil)
+}
+
+// NewLoopbackRootWithOptions is like NewLoopbackRoot, but takes
+// options. opts may be nil.
+func NewLoopbackRootWithOptions(rootPath string, opts *LoopbackOptions) (InodeEmbedder, error) {
+	if opts == nil {
+		opts = &LoopbackOptions{}
+	}
 	var st syscall.Stat_t
 	err := syscall.Stat(rootPath, &st)
 	if err != nil {
 		return nil, err
 	}
 
-	root := &loopbackRoot{
-		Path: rootPath,
-		Dev:  uint64(st.Dev),
+	root := &LoopbackRoot{
+		Path:   rootPath,
+		Dev:    uint64(st.Dev),
+		rootFd: -1,
+		uidMap: opts.UIDMap,
+		gidMap: opts.GIDMap,
+
+		NewNode:    opts.NewNode,
+		EncodeName: opts.EncodeName,
+	}
+	if opts.CallerCredentials {
+		if root.creds, err = daemonCreds(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Confine {
+		if root.rootFd, err = openRootFd(rootPath); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Watch {
+		if root.watcher, err = newLoopbackWatcher(root); err != nil {
+			if root.rootFd >= 0 {
+				syscall.Close(root.rootFd)
+			}
+			return nil, err
+		}
 	}
 
 	return root.newNode(), nil
@@ -0,0 +1,180 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// loopbackCreds are the file system credentials of the daemon, which
+// are restored after running an operation as the caller.
+type loopbackCreds struct {
+	uid, gid int
+	groups   []int
+}
+
+// asCaller runs op with the file system credentials of the caller,
+// if the file system runs operations with the caller's credentials.
+// It returns the result of op, or an error if the credentials could
+// not be switched.
+func (r *LoopbackRoot) asCaller(ctx context.Context, op func() syscall.Errno) syscall.Errno {
+	caller, ok := fuse.FromContext(ctx)
+	if r.creds == nil || !ok {
+		return op()
+	}
+	return r.runAsCaller(caller, op)
+}
+
+// loopbackCallerNode is the LoopbackNode of a file system that runs
+// operations with the credentials of the caller. It wraps each
+// operation in asCaller.
+type loopbackCallerNode struct {
+	LoopbackNode
+}
+
+func (n *loopbackCallerNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return n.RootData.asCaller(ctx, func() syscall.Errno {
+		return n.LoopbackNode.Statfs(ctx, out)
+	})
+}
+
+func (n *loopbackCallerNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (ch *Inode, errno syscall.Errno) {
+	errno = n.RootData.asCaller(ctx, func() syscall.Errno {
+		ch, errno = n.LoopbackNode.Lookup(ctx, name, out)
+		return errno
+	})
+	return ch, errno
+}
+
+func (n *loopbackCallerNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (ch *Inode, errno syscall.Errno) {
+	errno = n.RootData.asCaller(ctx, func() syscall.Errno {
+		ch, errno = n.LoopbackNode.Mknod(ctx, name, mode, rdev, out)
+		return errno
+	})
+	return ch, errno
+}
+
+func (n *loopbackCallerNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (ch *Inode, errno syscall.Errno) {
+	errno = n.RootData.asCaller(ctx, func() syscall.Errno {
+		ch, errno = n.LoopbackNode.Mkdir(ctx, name, mode, out)
+		return errno
+	})
+	return ch, errno
+}
+
+func (n *loopbackCallerNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return n.RootData.asCaller(ctx, func() syscall.Errno {
+		return n.LoopbackNode.Rmdir(ctx, name)
+	})
+}
+
+func (n *loopbackCallerNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	return n.RootData.asCaller(ctx, func() syscall.Errno {
+		return n.LoopbackNode.Unlink(ctx, name)
+	})
+}
+
+func (n *loopbackCallerNode) Rename(ctx context.Context, name string, newParent InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	return n.RootData.asCaller(ctx, func() syscall.Errno {
+		return n.LoopbackNode.Rename(ctx, name, newParent, newName, flags)
+	})
+}
+
+func (n *loopbackCallerNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	errno = n.RootData.asCaller(ctx, func() syscall.Errno {
+		inode, fh, fuseFlags, errno = n.LoopbackNode.Create(ctx, name, flags, mode, out)
+		return errno
+	})
+	return inode, fh, fuseFlags, errno
+}
+
+func (n *loopbackCallerNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (ch *Inode, errno syscall.Errno) {
+	errno = n.RootData.asCaller(ctx, func() syscall.Errno {
+		ch, errno = n.LoopbackNode.Symlink(ctx, target, name, out)
+		return errno
+	})
+	return ch, errno
+}
+
+func (n *loopbackCallerNode) Link(ctx context.Context, target InodeEmbedder, name string, out *fuse.EntryOut) (ch *Inode, errno syscall.Errno) {
+	errno = n.RootData.asCaller(ctx, func() syscall.Errno {
+		ch, errno = n.LoopbackNode.Link(ctx, target, name, out)
+		return errno
+	})
+	return ch, errno
+}
+
+func (n *loopbackCallerNode) Readlink(ctx context.Context) (target []byte, errno syscall.Errno) {
+	errno = n.RootData.asCaller(ctx, func() syscall.Errno {
+		target, errno = n.LoopbackNode.Readlink(ctx)
+		return errno
+	})
+	return target, errno
+}
+
+func (n *loopbackCallerNode) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	errno = n.RootData.asCaller(ctx, func() syscall.Errno {
+		fh, fuseFlags, errno = n.LoopbackNode.Open(ctx, flags)
+		return errno
+	})
+	return fh, fuseFlags, errno
+}
+
+func (n *loopbackCallerNode) Opendir(ctx context.Context) syscall.Errno {
+	return n.RootData.asCaller(ctx, func() syscall.Errno {
+		return n.LoopbackNode.Opendir(ctx)
+	})
+}
+
+func (n *loopbackCallerNode) Readdir(ctx context.Context) (ds DirStream, errno syscall.Errno) {
+	errno = n.RootData.asCaller(ctx, func() syscall.Errno {
+		ds, errno = n.LoopbackNode.Readdir(ctx)
+		return errno
+	})
+	return ds, errno
+}
+
+func (n *loopbackCallerNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	return n.RootData.asCaller(ctx, func() syscall.Errno {
+		return n.LoopbackNode.Getattr(ctx, f, out)
+	})
+}
+
+func (n *loopbackCallerNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return n.RootData.asCaller(ctx, func() syscall.Errno {
+		return n.LoopbackNode.Setattr(ctx, f, in, out)
+	})
+}
+
+func (n *loopbackCallerNode) Getxattr(ctx context.Context, attr string, dest []byte) (sz uint32, errno syscall.Errno) {
+	errno = n.RootData.asCaller(ctx, func() syscall.Errno {
+		sz, errno = n.LoopbackNode.Getxattr(ctx, attr, dest)
+		return errno
+	})
+	return sz, errno
+}
+
+func (n *loopbackCallerNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return n.RootData.asCaller(ctx, func() syscall.Errno {
+		return n.LoopbackNode.Setxattr(ctx, attr, data, flags)
+	})
+}
+
+func (n *loopbackCallerNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return n.RootData.asCaller(ctx, func() syscall.Errno {
+		return n.LoopbackNode.Removexattr(ctx, attr)
+	})
+}
+
+func (n *loopbackCallerNode) Listxattr(ctx context.Context, dest []byte) (sz uint32, errno syscall.Errno) {
+	errno = n.RootData.asCaller(ctx, func() syscall.Errno {
+		sz, errno = n.LoopbackNode.Listxattr(ctx, dest)
+		return errno
+	})
+	return sz, errno
+}
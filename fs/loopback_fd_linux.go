@@ -0,0 +1,690 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"container/list"
+	"context"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/beneath"
+	"golang.org/x/sys/unix"
+)
+
+// LoopbackFdOptions configures NewLoopbackFdRoot.
+type LoopbackFdOptions struct {
+	// MaxFds is the maximum number of O_PATH file descriptors
+	// kept open for nodes that are not in use. Nodes whose
+	// descriptor was closed reopen it from their parent. If
+	// zero, 1024 is used.
+	MaxFds int
+
+	// UseFileHandles stores a file handle (see
+	// name_to_handle_at(2)) for each node, so a node can be
+	// reopened even if its ancestors were moved on the underlying
+	// file system. Reopening a handle requires
+	// CAP_DAC_READ_SEARCH; without it, nodes are reopened from
+	// their parent.
+	UseFileHandles bool
+}
+
+// loopbackFdRoot is the shared state of a file descriptor based
+// loopback file system.
+type loopbackFdRoot struct {
+	LoopbackRoot
+
+	opts LoopbackFdOptions
+
+	// mu protects the fd, users, forgotten, elem and handle
+	// fields of all nodes, and lru.
+	mu sync.Mutex
+
+	// lru has the nodes with an open descriptor, most recently
+	// used first. The root is not in here, as its descriptor,
+	// LoopbackRoot.rootFd, is only closed on unmount.
+	lru list.List
+}
+
+// loopbackFdNode is a loopback node that refers to the underlying
+// file through an O_PATH file descriptor rather than a path, so it
+// is not confused by renames on the underlying file system.
+type loopbackFdNode struct {
+	Inode
+
+	root *loopbackFdRoot
+
+	// fd is the O_PATH descriptor, or -1 if it is closed.
+	fd int
+
+	// users is the number of operations using fd.
+	users int
+
+	// forgotten is set once the node was dropped from the tree.
+	// Its descriptor is then closed as soon as it is unused.
+	forgotten bool
+
+	// elem is the entry for this node in root.lru.
+	elem *list.Element
+
+	// handle is the file handle, if UseFileHandles is set.
+	handle []byte
+}
+
+var _ = (NodeStatfser)((*loopbackFdNode)(nil))
+var _ = (NodeGetattrer)((*loopbackFdNode)(nil))
+var _ = (NodeSetattrer)((*loopbackFdNode)(nil))
+var _ = (NodeGetxattrer)((*loopbackFdNode)(nil))
+var _ = (NodeSetxattrer)((*loopbackFdNode)(nil))
+var _ = (NodeRemovexattrer)((*loopbackFdNode)(nil))
+var _ = (NodeListxattrer)((*loopbackFdNode)(nil))
+var _ = (NodeReadlinker)((*loopbackFdNode)(nil))
+var _ = (NodeOpener)((*loopbackFdNode)(nil))
+var _ = (NodeCopyFileRanger)((*loopbackFdNode)(nil))
+var _ = (NodeLookuper)((*loopbackFdNode)(nil))
+var _ = (NodeOpendirer)((*loopbackFdNode)(nil))
+var _ = (NodeReaddirer)((*loopbackFdNode)(nil))
+var _ = (NodeMkdirer)((*loopbackFdNode)(nil))
+var _ = (NodeMknoder)((*loopbackFdNode)(nil))
+var _ = (NodeLinker)((*loopbackFdNode)(nil))
+var _ = (NodeSymlinker)((*loopbackFdNode)(nil))
+var _ = (NodeCreater)((*loopbackFdNode)(nil))
+var _ = (NodeUnlinker)((*loopbackFdNode)(nil))
+var _ = (NodeRmdirer)((*loopbackFdNode)(nil))
+var _ = (NodeRenamer)((*loopbackFdNode)(nil))
+var _ = (NodeOnForgetter)((*loopbackFdNode)(nil))
+
+// NewLoopbackFdRoot returns a root node for a loopback file system
+// whose root is at the given path. Unlike NewLoopbackRoot, nodes do
+// not reconstruct their path for each operation; they hold an O_PATH
+// file descriptor and use the *at family of system calls, so renames
+// of the root or of directories on the underlying file system do not
+// break the mount. opts may be nil.
+func NewLoopbackFdRoot(rootPath string, opts *LoopbackFdOptions) (InodeEmbedder, error) {
+	fd, err := syscall.Open(rootPath, unix.O_PATH|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	r := &loopbackFdRoot{
+		LoopbackRoot: LoopbackRoot{
+			Path:   rootPath,
+			Dev:    uint64(st.Dev),
+			rootFd: fd,
+		},
+	}
+	if opts != nil {
+		r.opts = *opts
+	}
+	if r.opts.MaxFds <= 0 {
+		r.opts.MaxFds = 1024
+	}
+
+	root := r.newNode()
+	root.fd = fd
+	return root, nil
+}
+
+func (r *loopbackFdRoot) newNode() *loopbackFdNode {
+	return &loopbackFdNode{
+		root: r,
+		fd:   -1,
+	}
+}
+
+// evict closes unused descriptors until at most MaxFds remain. It
+// must be called with r.mu held.
+func (r *loopbackFdRoot) evict() {
+	for e := r.lru.Back(); e != nil && r.lru.Len() > r.opts.MaxFds; {
+		prev := e.Prev()
+		n := e.Value.(*loopbackFdNode)
+		if n.users == 0 {
+			n.closeFd()
+		}
+		e = prev
+	}
+}
+
+// closeFd closes the descriptor of the node. It must be called with
+// root.mu held.
+func (n *loopbackFdNode) closeFd() {
+	if n.fd < 0 {
+		return
+	}
+	syscall.Close(n.fd)
+	n.fd = -1
+	if n.elem != nil {
+		n.root.lru.Remove(n.elem)
+		n.elem = nil
+	}
+}
+
+// OnForget closes the descriptor, so files that were unlinked on the
+// underlying file system are released. For the root, which is
+// forgotten on unmount, this closes rootFd. A descriptor that is in
+// use is closed by its last user.
+func (n *loopbackFdNode) OnForget() {
+	r := n.root
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n.forgotten = true
+	if n.users == 0 {
+		n.closeFd()
+	}
+}
+
+// acquire returns the O_PATH descriptor of the node, opening it if
+// necessary. Callers must call release when they are done with it.
+func (n *loopbackFdNode) acquire() (int, syscall.Errno) {
+	r := n.root
+	r.mu.Lock()
+	if n.fd >= 0 {
+		n.users++
+		if n.elem != nil {
+			r.lru.MoveToFront(n.elem)
+		}
+		fd := n.fd
+		r.mu.Unlock()
+		return fd, OK
+	}
+	handle := n.handle
+	r.mu.Unlock()
+
+	fd, errno := n.reopen(handle)
+	if errno != 0 {
+		return -1, errno
+	}
+
+	if handle == nil && r.opts.UseFileHandles {
+		handle, _ = nameToHandleAt(fd, "", _AT_EMPTY_PATH)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n.fd >= 0 {
+		// Someone else reopened it concurrently.
+		syscall.Close(fd)
+	} else {
+		n.fd = fd
+		n.elem = r.lru.PushFront(n)
+	}
+	if n.handle == nil {
+		n.handle = handle
+	}
+	n.users++
+	r.evict()
+	return n.fd, OK
+}
+
+func (n *loopbackFdNode) release() {
+	n.root.mu.Lock()
+	n.users--
+	if n.users == 0 && n.forgotten {
+		n.closeFd()
+	}
+	n.root.mu.Unlock()
+}
+
+// reopen opens a new descriptor for a node whose descriptor was
+// closed, either from its file handle, or by looking up its name in
+// the parent. Returns ESTALE if the node no longer exists.
+func (n *loopbackFdNode) reopen(handle []byte) (int, syscall.Errno) {
+	r := n.root
+	if handle != nil {
+		// The root descriptor stays open until unmount, so it
+		// can identify the mount.
+		fd, err := openByHandleAt(r.rootFd, handle, unix.O_PATH|syscall.O_CLOEXEC)
+		if err == nil {
+			return fd, OK
+		}
+	}
+
+	name, parent := n.Parent()
+	if parent == nil {
+		return -1, syscall.ESTALE
+	}
+	p, ok := parent.Operations().(*loopbackFdNode)
+	if !ok {
+		return -1, syscall.ESTALE
+	}
+	pfd, errno := p.acquire()
+	if errno != 0 {
+		return -1, errno
+	}
+	defer p.release()
+
+	fd, err := syscall.Openat(pfd, name, unix.O_PATH|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err == syscall.ENOENT {
+		return -1, syscall.ESTALE
+	} else if err != nil {
+		return -1, ToErrno(err)
+	}
+
+	// Double check that the name still refers to the same file.
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return -1, ToErrno(err)
+	}
+	if r.idFromStat(&st).Ino != n.StableAttr().Ino {
+		syscall.Close(fd)
+		return -1, syscall.ESTALE
+	}
+	return fd, OK
+}
+
+// newChild stats name in the directory dirfd, and returns an Inode
+// for it.
+func (n *loopbackFdNode) newChild(ctx context.Context, dirfd int, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	st := syscall.Stat_t{}
+	if err := fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, ToErrno(err)
+	}
+	out.Attr.FromStat(&st)
+	return n.NewInode(ctx, n.root.newNode(), n.root.idFromStat(&st)), OK
+}
+
+// preserveOwner sets uid and gid of `name` in `dirfd` according to
+// the caller information in `ctx`.
+func (n *loopbackFdNode) preserveOwner(ctx context.Context, dirfd int, name string) error {
+	if os.Getuid() != 0 {
+		return nil
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return unix.Fchownat(dirfd, name, int(caller.Uid), int(caller.Gid), unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func (n *loopbackFdNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return errno
+	}
+	defer n.release()
+
+	s := syscall.Statfs_t{}
+	if err := syscall.Fstatfs(fd, &s); err != nil {
+		return ToErrno(err)
+	}
+	out.FromStatfsT(&s)
+	return OK
+}
+
+func (n *loopbackFdNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return nil, errno
+	}
+	defer n.release()
+
+	return n.newChild(ctx, fd, name, out)
+}
+
+func (n *loopbackFdNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return nil, errno
+	}
+	defer n.release()
+
+	if err := unix.Mknodat(fd, name, mode, int(rdev)); err != nil {
+		return nil, ToErrno(err)
+	}
+	n.preserveOwner(ctx, fd, name)
+	ch, errno := n.newChild(ctx, fd, name, out)
+	if errno != 0 {
+		unix.Unlinkat(fd, name, 0)
+	}
+	return ch, errno
+}
+
+func (n *loopbackFdNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return nil, errno
+	}
+	defer n.release()
+
+	if err := syscall.Mkdirat(fd, name, mode); err != nil {
+		return nil, ToErrno(err)
+	}
+	n.preserveOwner(ctx, fd, name)
+	ch, errno := n.newChild(ctx, fd, name, out)
+	if errno != 0 {
+		unix.Unlinkat(fd, name, unix.AT_REMOVEDIR)
+	}
+	return ch, errno
+}
+
+func (n *loopbackFdNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return errno
+	}
+	defer n.release()
+
+	return ToErrno(unix.Unlinkat(fd, name, unix.AT_REMOVEDIR))
+}
+
+func (n *loopbackFdNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return errno
+	}
+	defer n.release()
+
+	return ToErrno(unix.Unlinkat(fd, name, 0))
+}
+
+func (n *loopbackFdNode) Rename(ctx context.Context, name string, newParent InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	p2, ok := newParent.(*loopbackFdNode)
+	if !ok {
+		return syscall.EXDEV
+	}
+
+	fd1, errno := n.acquire()
+	if errno != 0 {
+		return errno
+	}
+	defer n.release()
+
+	fd2, errno := p2.acquire()
+	if errno != 0 {
+		return errno
+	}
+	defer p2.release()
+
+	return ToErrno(unix.Renameat2(fd1, name, fd2, newName, uint(flags)))
+}
+
+func (n *loopbackFdNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	dirfd, errno := n.acquire()
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	defer n.release()
+
+	flags = flags &^ syscall.O_APPEND
+	fd, err := syscall.Openat(dirfd, name, int(flags)|os.O_CREATE, mode)
+	if err != nil {
+		return nil, nil, 0, ToErrno(err)
+	}
+	n.preserveOwner(ctx, dirfd, name)
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return nil, nil, 0, ToErrno(err)
+	}
+
+	ch := n.NewInode(ctx, n.root.newNode(), n.root.idFromStat(&st))
+	out.FromStat(&st)
+	return ch, NewLoopbackFile(fd), 0, OK
+}
+
+func (n *loopbackFdNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return nil, errno
+	}
+	defer n.release()
+
+	if err := unix.Symlinkat(target, fd, name); err != nil {
+		return nil, ToErrno(err)
+	}
+	n.preserveOwner(ctx, fd, name)
+	ch, errno := n.newChild(ctx, fd, name, out)
+	if errno != 0 {
+		unix.Unlinkat(fd, name, 0)
+	}
+	return ch, errno
+}
+
+func (n *loopbackFdNode) Link(ctx context.Context, target InodeEmbedder, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	t, ok := target.(*loopbackFdNode)
+	if !ok {
+		return nil, syscall.EXDEV
+	}
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return nil, errno
+	}
+	defer n.release()
+
+	tfd, errno := t.acquire()
+	if errno != 0 {
+		return nil, errno
+	}
+	defer t.release()
+
+	// linkat(AT_EMPTY_PATH) requires CAP_DAC_READ_SEARCH, so go
+	// through /proc instead.
+	if err := unix.Linkat(unix.AT_FDCWD, beneath.ProcPath(tfd), fd, name, unix.AT_SYMLINK_FOLLOW); err != nil {
+		return nil, ToErrno(err)
+	}
+	ch, errno := n.newChild(ctx, fd, name, out)
+	if errno != 0 {
+		unix.Unlinkat(fd, name, 0)
+	}
+	return ch, errno
+}
+
+func (n *loopbackFdNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return nil, errno
+	}
+	defer n.release()
+
+	for l := 256; ; l *= 2 {
+		buf := make([]byte, l)
+		sz, err := unix.Readlinkat(fd, "", buf)
+		if err != nil {
+			return nil, ToErrno(err)
+		}
+
+		if sz < len(buf) {
+			return buf[:sz], 0
+		}
+	}
+}
+
+func (n *loopbackFdNode) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	defer n.release()
+
+	flags = flags &^ syscall.O_APPEND
+	f, err := syscall.Open(beneath.ProcPath(fd), int(flags), 0)
+	if err != nil {
+		return nil, 0, ToErrno(err)
+	}
+	return NewLoopbackFile(f), 0, OK
+}
+
+func (n *loopbackFdNode) Opendir(ctx context.Context) syscall.Errno {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return errno
+	}
+	defer n.release()
+
+	dfd, err := syscall.Openat(fd, ".", syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return ToErrno(err)
+	}
+	syscall.Close(dfd)
+	return OK
+}
+
+func (n *loopbackFdNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return nil, errno
+	}
+	defer n.release()
+
+	return NewLoopbackDirStream(beneath.ProcPath(fd))
+}
+
+func (n *loopbackFdNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if f != nil {
+		return f.(FileGetattrer).Getattr(ctx, out)
+	}
+
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return errno
+	}
+	defer n.release()
+
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return ToErrno(err)
+	}
+	out.FromStat(&st)
+	return OK
+}
+
+func (n *loopbackFdNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if fsa, ok := f.(FileSetattrer); ok && fsa != nil {
+		return fsa.Setattr(ctx, in, out)
+	}
+
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return errno
+	}
+	defer n.release()
+
+	p := beneath.ProcPath(fd)
+	if m, ok := in.GetMode(); ok {
+		if err := syscall.Chmod(p, m); err != nil {
+			return ToErrno(err)
+		}
+	}
+
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok || gok {
+		suid := -1
+		sgid := -1
+		if uok {
+			suid = int(uid)
+		}
+		if gok {
+			sgid = int(gid)
+		}
+		if err := unix.Fchownat(fd, "", suid, sgid, _AT_EMPTY_PATH|unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return ToErrno(err)
+		}
+	}
+
+	mtime, mok := in.GetMTime()
+	atime, aok := in.GetATime()
+	if mok || aok {
+		ap := &atime
+		mp := &mtime
+		if !aok {
+			ap = nil
+		}
+		if !mok {
+			mp = nil
+		}
+		var ts [2]syscall.Timespec
+		ts[0] = fuse.UtimeToTimespec(ap)
+		ts[1] = fuse.UtimeToTimespec(mp)
+
+		if err := syscall.UtimesNano(p, ts[:]); err != nil {
+			return ToErrno(err)
+		}
+	}
+
+	if sz, ok := in.GetSize(); ok {
+		if err := syscall.Truncate(p, int64(sz)); err != nil {
+			return ToErrno(err)
+		}
+	}
+
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return ToErrno(err)
+	}
+	out.FromStat(&st)
+	return OK
+}
+
+// The xattr system calls do not accept O_PATH descriptors, so we go
+// through /proc.
+
+func (n *loopbackFdNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return 0, errno
+	}
+	defer n.release()
+
+	sz, err := unix.Getxattr(beneath.ProcPath(fd), attr, dest)
+	return uint32(sz), ToErrno(err)
+}
+
+func (n *loopbackFdNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return errno
+	}
+	defer n.release()
+
+	return ToErrno(unix.Setxattr(beneath.ProcPath(fd), attr, data, int(flags)))
+}
+
+func (n *loopbackFdNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return errno
+	}
+	defer n.release()
+
+	return ToErrno(unix.Removexattr(beneath.ProcPath(fd), attr))
+}
+
+func (n *loopbackFdNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	fd, errno := n.acquire()
+	if errno != 0 {
+		return 0, errno
+	}
+	defer n.release()
+
+	sz, err := unix.Listxattr(beneath.ProcPath(fd), dest)
+	return uint32(sz), ToErrno(err)
+}
+
+func (n *loopbackFdNode) CopyFileRange(ctx context.Context, fhIn FileHandle,
+	offIn uint64, out *Inode, fhOut FileHandle, offOut uint64,
+	len uint64, flags uint64) (uint32, syscall.Errno) {
+	lfIn, ok := fhIn.(*loopbackFile)
+	if !ok {
+		return 0, syscall.ENOTSUP
+	}
+	lfOut, ok := fhOut.(*loopbackFile)
+	if !ok {
+		return 0, syscall.ENOTSUP
+	}
+
+	signedOffIn := int64(offIn)
+	signedOffOut := int64(offOut)
+	count, err := unix.CopyFileRange(lfIn.fd, &signedOffIn, lfOut.fd, &signedOffOut, int(len), int(flags))
+	return uint32(count), ToErrno(err)
+}
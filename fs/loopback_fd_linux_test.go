@@ -0,0 +1,133 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"github.com/hanwen/go-fuse/v2/posixtest"
+)
+
+func newLoopbackFdTest(t *testing.T, opts *LoopbackFdOptions) (origDir, mntDir string, clean func()) {
+	dir := testutil.TempDir()
+	origDir = filepath.Join(dir, "orig")
+	if err := os.Mkdir(origDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewLoopbackFdRoot(origDir, opts)
+	if err != nil {
+		t.Fatalf("NewLoopbackFdRoot: %v", err)
+	}
+	mntDir, _, cleanMount := testMount(t, root, nil)
+	return origDir, mntDir, func() {
+		cleanMount()
+		os.RemoveAll(dir)
+	}
+}
+
+// openFdsBelow returns the open file descriptors that refer to files
+// below `dir`.
+func openFdsBelow(t *testing.T, dir string) []string {
+	names, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []string
+	for _, n := range names {
+		target, _ := os.Readlink("/proc/self/fd/" + n.Name())
+		if strings.HasPrefix(target, dir) {
+			result = append(result, target)
+		}
+	}
+	return result
+}
+
+func TestLoopbackFdUnmountCloses(t *testing.T) {
+	origDir, mntDir, clean := newLoopbackFdTest(t, nil)
+	if err := os.MkdirAll(origDir+"/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(origDir+"/a/b/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadFile(mntDir + "/a/b/file"); err != nil {
+		t.Fatal(err)
+	}
+	if len(openFdsBelow(t, origDir)) == 0 {
+		t.Fatalf("no descriptors open for the mount")
+	}
+	clean()
+
+	if fds := openFdsBelow(t, origDir); len(fds) > 0 {
+		t.Errorf("descriptors left open after unmount: %v", fds)
+	}
+}
+
+func TestLoopbackFdPosix(t *testing.T) {
+	for nm, fn := range posixtest.All {
+		t.Run(nm, func(t *testing.T) {
+			// Use a tiny descriptor cache, so nodes are reopened
+			// all the time.
+			_, mntDir, clean := newLoopbackFdTest(t, &LoopbackFdOptions{MaxFds: 2})
+			defer clean()
+
+			fn(t, mntDir)
+		})
+	}
+}
+
+func TestLoopbackFdRenameUnderlying(t *testing.T) {
+	for _, handles := range []bool{false, true} {
+		origDir, mntDir, clean := newLoopbackFdTest(t, &LoopbackFdOptions{
+			MaxFds:         1,
+			UseFileHandles: handles,
+		})
+		defer clean()
+
+		if err := os.MkdirAll(origDir+"/a/b", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(origDir+"/a/b/file", []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Open the directory, so the kernel holds on to the
+		// nodes for a/ and a/b/.
+		dir, err := os.Open(mntDir + "/a/b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dir.Close()
+
+		// Rename the root of the loopback, and a directory
+		// inside it.
+		newOrig := origDir + ".moved"
+		if err := os.Rename(origDir, newOrig); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Rename(newOrig, origDir)
+		if err := os.Rename(newOrig+"/a", newOrig+"/c"); err != nil {
+			t.Fatal(err)
+		}
+
+		// The open directory now lives at c/b, and still works
+		// if its descriptor is still open, or if it can be
+		// reopened from its handle.
+		names, err := dir.Readdirnames(-1)
+		if err != nil || len(names) != 1 || names[0] != "file" {
+			t.Errorf("handles=%v: Readdirnames: %v, %v", handles, names, err)
+		}
+
+		content, err := ioutil.ReadFile(mntDir + "/c/b/file")
+		if err != nil || string(content) != "hello" {
+			t.Errorf("handles=%v: ReadFile: %q, %v", handles, content, err)
+		}
+	}
+}
@@ -8,39 +8,189 @@ package fs
 
 import (
 	"context"
-	"path/filepath"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/beneath"
 	"golang.org/x/sys/unix"
 )
 
-func (n *loopbackNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
-	sz, err := unix.Lgetxattr(n.path(), attr, dest)
+func daemonCreds() (*loopbackCreds, error) {
+	if os.Geteuid() != 0 {
+		return nil, syscall.EPERM
+	}
+	groups, err := unix.Getgroups()
+	if err != nil {
+		return nil, err
+	}
+	return &loopbackCreds{
+		uid:    os.Geteuid(),
+		gid:    os.Getegid(),
+		groups: groups,
+	}, nil
+}
+
+// callerGroups returns the supplementary groups of the process
+// `pid`. If they cannot be determined, the caller gets no
+// supplementary groups.
+func callerGroups(pid uint32) []int {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil
+	}
+	for _, l := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(l, "Groups:") {
+			continue
+		}
+		var groups []int
+		for _, f := range strings.Fields(l[len("Groups:"):]) {
+			g, err := strconv.Atoi(f)
+			if err != nil {
+				return nil
+			}
+			groups = append(groups, g)
+		}
+		return groups
+	}
+	return nil
+}
+
+// runAsCaller runs op with the file system uid, gid and
+// supplementary groups of the caller. The credentials are per thread,
+// so op runs on a new goroutine locked to its thread. If the daemon's
+// credentials cannot be restored afterwards, the goroutine exits
+// without unlocking the thread, so the runtime terminates the thread
+// rather than running other goroutines with the caller's credentials.
+func (r *LoopbackRoot) runAsCaller(caller *fuse.Caller, op func() syscall.Errno) syscall.Errno {
+	result := make(chan syscall.Errno, 1)
+	go func() {
+		runtime.LockOSThread()
+		uid, gid := MapCaller(r.uidMap, r.gidMap, caller)
+		errno := setCreds(int(uid), int(gid), callerGroups(caller.Pid))
+		if errno == 0 {
+			errno = op()
+		}
+		if err := setCreds(r.creds.uid, r.creds.gid, r.creds.groups); err != 0 {
+			log.Printf("restoring credentials: %v", err)
+			result <- syscall.EPERM
+			return
+		}
+		runtime.UnlockOSThread()
+		result <- errno
+	}()
+	return <-result
+}
+
+// setCreds sets the supplementary groups and the file system gid and
+// uid of the current thread.
+func setCreds(uid, gid int, groups []int) syscall.Errno {
+	if err := unix.Setgroups(groups); err != nil {
+		log.Printf("setgroups: %v", err)
+		return syscall.EPERM
+	}
+	if errno := setfsgid(gid); errno != 0 {
+		return errno
+	}
+	return setfsuid(uid)
+}
+
+func openRootFd(rootPath string) (int, error) {
+	return syscall.Open(rootPath, unix.O_PATH|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+}
+
+// nodePathBeneath opens rel beneath the root, and returns a path
+// for the descriptor.
+func (r *LoopbackRoot) nodePathBeneath(rel string) (string, func(), syscall.Errno) {
+	fd, err := beneath.Open(r.rootFd, rel, unix.O_PATH|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", nil, ToErrno(err)
+	}
+	return beneath.ProcPath(fd), func() { syscall.Close(fd) }, OK
+}
+
+// childPathBeneath opens the directory rel beneath the root, and
+// returns a path for `name` inside it.
+func (r *LoopbackRoot) childPathBeneath(rel, name string) (string, func(), syscall.Errno) {
+	fd, err := beneath.Open(r.rootFd, rel, unix.O_PATH|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", nil, ToErrno(err)
+	}
+	return beneath.ProcPath(fd) + "/" + name, func() { syscall.Close(fd) }, OK
+}
+
+func (n *LoopbackNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	p, done, errno := n.entryPath()
+	if errno != 0 {
+		return 0, errno
+	}
+	defer done()
+
+	sz, err := unix.Lgetxattr(p, attr, dest)
 	return uint32(sz), ToErrno(err)
 }
 
-func (n *loopbackNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
-	err := unix.Lsetxattr(n.path(), attr, data, int(flags))
+func (n *LoopbackNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	p, done, errno := n.entryPath()
+	if errno != 0 {
+		return errno
+	}
+	defer done()
+	end := n.RootData.changing(&n.Inode, nil)
+	defer end()
+
+	err := unix.Lsetxattr(p, attr, data, int(flags))
 	return ToErrno(err)
 }
 
-func (n *loopbackNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
-	err := unix.Lremovexattr(n.path(), attr)
+func (n *LoopbackNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	p, done, errno := n.entryPath()
+	if errno != 0 {
+		return errno
+	}
+	defer done()
+	end := n.RootData.changing(&n.Inode, nil)
+	defer end()
+
+	err := unix.Lremovexattr(p, attr)
 	return ToErrno(err)
 }
 
-func (n *loopbackNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
-	sz, err := unix.Llistxattr(n.path(), dest)
+func (n *LoopbackNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	p, done, errno := n.entryPath()
+	if errno != 0 {
+		return 0, errno
+	}
+	defer done()
+
+	sz, err := unix.Llistxattr(p, dest)
 	return uint32(sz), ToErrno(err)
 }
 
-func (n *loopbackNode) renameExchange(name string, newparent InodeEmbedder, newName string) syscall.Errno {
-	fd1, err := syscall.Open(n.path(), syscall.O_DIRECTORY, 0)
+func (n *LoopbackNode) renameExchange(name string, newparent InodeEmbedder, newName string) syscall.Errno {
+	p1, done1, errno := n.nodePath()
+	if errno != 0 {
+		return errno
+	}
+	defer done1()
+	fd1, err := syscall.Open(p1, syscall.O_DIRECTORY, 0)
 	if err != nil {
 		return ToErrno(err)
 	}
 	defer syscall.Close(fd1)
-	p2 := filepath.Join(n.RootData.Path, newparent.EmbeddedInode().Path(nil))
+	p2, done2, errno := toLoopbackNode(newparent).nodePath()
+	if errno != 0 {
+		return errno
+	}
+	defer done2()
+	end := n.RootData.changing(&n.Inode, newparent.EmbeddedInode())
+	defer end()
 	fd2, err := syscall.Open(p2, syscall.O_DIRECTORY, 0)
 	defer syscall.Close(fd2)
 	if err != nil {
@@ -69,17 +219,19 @@ func (n *loopbackNode) renameExchange(name string, newparent InodeEmbedder, newN
 	return ToErrno(unix.Renameat2(fd1, name, fd2, newName, unix.RENAME_EXCHANGE))
 }
 
-func (n *loopbackNode) CopyFileRange(ctx context.Context, fhIn FileHandle,
+func (n *LoopbackNode) CopyFileRange(ctx context.Context, fhIn FileHandle,
 	offIn uint64, out *Inode, fhOut FileHandle, offOut uint64,
 	len uint64, flags uint64) (uint32, syscall.Errno) {
-	lfIn, ok := fhIn.(*loopbackFile)
+	lfIn, ok := toLoopbackFile(fhIn)
 	if !ok {
 		return 0, syscall.ENOTSUP
 	}
-	lfOut, ok := fhOut.(*loopbackFile)
+	lfOut, ok := toLoopbackFile(fhOut)
 	if !ok {
 		return 0, syscall.ENOTSUP
 	}
+	end := n.RootData.changing(out, nil)
+	defer end()
 
 	signedOffIn := int64(offIn)
 	signedOffOut := int64(offOut)
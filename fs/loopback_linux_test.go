@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
+	"runtime"
 	"sync"
 	"syscall"
 	"testing"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"github.com/hanwen/go-fuse/v2/posixtest"
 	"github.com/kylelemons/godebug/pretty"
 	"golang.org/x/sys/unix"
 )
@@ -359,7 +361,7 @@ func TestParallelDiropsHang(t *testing.T) {
 		}
 	}()
 
-	loopbackRoot, err := NewLoopbackRoot(orig)
+	LoopbackRoot, err := NewLoopbackRoot(orig)
 	if err != nil {
 		t.Fatalf("NewLoopbackRoot(%s): %v\n", orig, err)
 	}
@@ -370,7 +372,7 @@ func TestParallelDiropsHang(t *testing.T) {
 	}
 	opts.Debug = testutil.VerboseTest()
 
-	rawFS := NewNodeFS(loopbackRoot, opts)
+	rawFS := NewNodeFS(LoopbackRoot, opts)
 	server, err := fuse.NewServer(rawFS, mnt, &opts.MountOptions)
 	if err != nil {
 		t.Fatal(err)
@@ -385,3 +387,291 @@ func TestRoMount(t *testing.T) {
 	tc := newTestCase(t, &testOptions{ro: true})
 	defer tc.Clean()
 }
+
+func TestPosixConfined(t *testing.T) {
+	for nm, fn := range posixtest.All {
+		t.Run(nm, func(t *testing.T) {
+			tc := newTestCase(t, &testOptions{
+				suppressDebug: true,
+				loopbackOpts:  &LoopbackOptions{Confine: true},
+			})
+			defer tc.Clean()
+
+			fn(t, tc.mntDir)
+		})
+	}
+}
+
+func TestLoopbackConfinedRace(t *testing.T) {
+	tc := newTestCase(t, &testOptions{
+		suppressDebug: true,
+		loopbackOpts:  &LoopbackOptions{Confine: true},
+	})
+	defer tc.Clean()
+
+	testutil.TestLoopbackConfinedRace(t, tc.origDir, tc.mntDir, tc.dir+"/outside")
+}
+
+func TestPosixCallerCredentials(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("need root")
+	}
+	for nm, fn := range posixtest.All {
+		t.Run(nm, func(t *testing.T) {
+			tc := newTestCase(t, &testOptions{
+				suppressDebug: true,
+				loopbackOpts:  &LoopbackOptions{CallerCredentials: true},
+			})
+			defer tc.Clean()
+
+			fn(t, tc.mntDir)
+		})
+	}
+}
+
+// asUser runs fn with the file system uid and gid of the current
+// thread set to uid and gid.
+func asUser(uid, gid int, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Exit the thread afterwards, rather than restoring
+		// its credentials.
+		runtime.LockOSThread()
+		unix.Setgroups(nil)
+		unix.Setfsgid(gid)
+		unix.Setfsuid(uid)
+		fn()
+	}()
+	<-done
+}
+
+func TestLoopbackCallerCredentials(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("need root")
+	}
+	tc := newTestCase(t, &testOptions{
+		loopbackOpts: &LoopbackOptions{CallerCredentials: true},
+	})
+	defer tc.Clean()
+
+	for _, d := range []string{tc.dir, tc.origDir, tc.mntDir} {
+		if err := os.Chmod(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(tc.origDir+"/secret", []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(tc.origDir+"/sgid", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(tc.origDir+"/sgid", 0, 4321); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(tc.origDir+"/sgid", 0777|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+
+	var readErr, createErr error
+	asUser(1234, 1234, func() {
+		_, readErr = ioutil.ReadFile(tc.mntDir + "/secret")
+		createErr = ioutil.WriteFile(tc.mntDir+"/sgid/file", []byte("hello"), 0644)
+	})
+
+	if readErr == nil || !os.IsPermission(readErr) {
+		t.Errorf("ReadFile: got %v, want EACCES", readErr)
+	}
+	if createErr != nil {
+		t.Fatalf("WriteFile: %v", createErr)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(tc.origDir+"/sgid/file", &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Uid != 1234 || st.Gid != 4321 {
+		t.Errorf("got owner %d:%d, want 1234:4321", st.Uid, st.Gid)
+	}
+}
+
+func TestLoopbackIDMap(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("need root")
+	}
+	idMap := IDMap{{Inside: 0, Outside: 100000, Count: 65536}}
+	tc := newTestCase(t, &testOptions{
+		loopbackOpts: &LoopbackOptions{UIDMap: idMap, GIDMap: idMap},
+	})
+	defer tc.Clean()
+
+	tc.writeOrig("file", "hello", 0644)
+	tc.writeOrig("unmapped", "hello", 0644)
+	if err := os.Lchown(tc.origDir+"/file", 100005, 100006); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Lchown(tc.origDir+"/unmapped", 5, 6); err != nil {
+		t.Fatal(err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(tc.mntDir+"/file", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Uid != 5 || st.Gid != 6 {
+		t.Errorf("got owner %d:%d, want 5:6", st.Uid, st.Gid)
+	}
+	if err := syscall.Lstat(tc.mntDir+"/unmapped", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Uid != OverflowID || st.Gid != OverflowID {
+		t.Errorf("got owner %d:%d, want overflow", st.Uid, st.Gid)
+	}
+
+	if err := os.Lchown(tc.mntDir+"/file", 7, 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Lstat(tc.origDir+"/file", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Uid != 100007 || st.Gid != 100008 {
+		t.Errorf("got backing owner %d:%d, want 100007:100008", st.Uid, st.Gid)
+	}
+	if err := syscall.Lchown(tc.mntDir+"/file", 70000, -1); err != syscall.EINVAL {
+		t.Errorf("chown to unmapped ID: got %v, want EINVAL", err)
+	}
+
+	if err := os.Mkdir(tc.mntDir+"/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Lstat(tc.origDir+"/dir", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Uid != 100000 || st.Gid != 100000 {
+		t.Errorf("got backing owner %d:%d, want 100000:100000", st.Uid, st.Gid)
+	}
+}
+
+func TestPosixWatch(t *testing.T) {
+	for nm, fn := range posixtest.All {
+		t.Run(nm, func(t *testing.T) {
+			tc := newTestCase(t, &testOptions{
+				entryCache:   true,
+				attrCache:    true,
+				loopbackOpts: &LoopbackOptions{Watch: true},
+			})
+			defer tc.Clean()
+
+			fn(t, tc.mntDir)
+		})
+	}
+}
+
+// waitFor polls `cond` until it returns true, or fails the test.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestLoopbackWatch(t *testing.T) {
+	orig := testutil.TempDir()
+	defer os.RemoveAll(orig)
+	if err := os.Mkdir(orig+"/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := NewLoopbackRootWithOptions(orig, &LoopbackOptions{Watch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hour := time.Hour
+	mnt, _, clean := testMount(t, root, &Options{
+		EntryTimeout:    &hour,
+		AttrTimeout:     &hour,
+		NegativeTimeout: &hour,
+	})
+	defer clean()
+
+	// Cache a negative entry, then create the file behind the
+	// kernel's back.
+	if _, err := os.Lstat(mnt + "/dir/file"); !os.IsNotExist(err) {
+		t.Fatalf("Lstat: got %v, want ENOENT", err)
+	}
+	if err := ioutil.WriteFile(orig+"/dir/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "file creation", func() bool {
+		_, err := os.Lstat(mnt + "/dir/file")
+		return err == nil
+	})
+
+	// Cache the content, then change it.
+	if got, err := ioutil.ReadFile(mnt + "/dir/file"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "hello" {
+		t.Fatalf("got %q, want %q", got, "hello")
+	}
+	if err := ioutil.WriteFile(orig+"/dir/file", []byte("world!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "content change", func() bool {
+		got, _ := ioutil.ReadFile(mnt + "/dir/file")
+		return string(got) == "world!"
+	})
+
+	// Attribute changes.
+	if err := os.Chmod(orig+"/dir/file", 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "mode change", func() bool {
+		fi, err := os.Lstat(mnt + "/dir/file")
+		return err == nil && fi.Mode().Perm() == 0600
+	})
+
+	// Deletion.
+	if err := os.Remove(orig + "/dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "file deletion", func() bool {
+		_, err := os.Lstat(mnt + "/dir/file")
+		return os.IsNotExist(err)
+	})
+}
+
+// inotifyCount returns the number of inotify descriptors of the process.
+func inotifyCount(t *testing.T) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, fd := range fds {
+		if l, _ := os.Readlink("/proc/self/fd/" + fd.Name()); l == "anon_inode:inotify" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLoopbackWatchRelease(t *testing.T) {
+	orig := testutil.TempDir()
+	defer os.RemoveAll(orig)
+
+	before := inotifyCount(t)
+	root, err := NewLoopbackRootWithOptions(orig, &LoopbackOptions{Watch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt, _, clean := testMount(t, root, nil)
+	if _, err := os.Lstat(mnt); err != nil {
+		t.Fatal(err)
+	}
+	clean()
+
+	waitFor(t, "watcher release", func() bool {
+		return inotifyCount(t) == before
+	})
+}
@@ -0,0 +1,362 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/internal/beneath"
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM |
+	unix.IN_MOVED_TO | unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_ATTRIB |
+	unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW
+
+// loopbackWatcher watches the backing directories of a loopback file
+// system with inotify, and invalidates the kernel cache for the
+// Inodes that correspond to changed entries. Watches are placed on
+// directories, as these report events for the entries they contain.
+//
+// Changes made through the mount keep the kernel cache up to date
+// themselves, so their events are ignored: while an Inode is being
+// changed through the mount, and until the events queued so far have
+// been read, events that would invalidate it are dropped. Changes
+// made outside the mount at the same time as changes to the same
+// file through the mount may therefore go unnoticed.
+type loopbackWatcher struct {
+	// fd is the inotify descriptor, owned by file. Calling
+	// file.Fd() would make it blocking.
+	fd   int
+	file *os.File
+
+	// rootPath is watched when the first directory is watched, as
+	// the root Inode is only initialized when mounting.
+	rootPath string
+	start    sync.Once
+
+	mu     sync.Mutex
+	root   *Inode
+	rootWd int
+	// Directories other than the root are identified by their
+	// StableAttr, as a looked-up Inode may be dropped in favor
+	// of an existing one for the same directory.
+	wds   map[int]StableAttr
+	attrs map[StableAttr]int
+
+	// busy counts the changes in progress through the mount for
+	// each Inode. self has the Inodes changed through the mount
+	// whose events may not all have been read yet.
+	busy map[StableAttr]int
+	self map[StableAttr]bool
+}
+
+func newLoopbackWatcher(r *LoopbackRoot) (*loopbackWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &loopbackWatcher{
+		// With a non-blocking descriptor, reads go through
+		// the runtime poller, so closing the file stops the loop.
+		fd:       fd,
+		file:     os.NewFile(uintptr(fd), "inotify"),
+		rootPath: r.Path,
+		rootWd:   -1,
+		wds:      map[int]StableAttr{},
+		attrs:    map[StableAttr]int{},
+		busy:     map[StableAttr]int{},
+		self:     map[StableAttr]bool{},
+	}
+	if r.rootFd >= 0 {
+		w.rootPath = beneath.ProcPath(r.rootFd)
+	}
+	return w, nil
+}
+
+// watch watches the directory `n`, found at `path`.
+func (w *loopbackWatcher) watch(n *Inode, path string) {
+	w.start.Do(func() {
+		root := n.Root()
+		wd, err := unix.InotifyAddWatch(w.fd, w.rootPath, watchMask)
+		w.mu.Lock()
+		w.root = root
+		if err == nil {
+			w.rootWd = wd
+		}
+		w.mu.Unlock()
+		go w.loop()
+	})
+
+	wd, err := unix.InotifyAddWatch(w.fd, path, watchMask)
+	if err != nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.wds[wd] = n.StableAttr()
+	w.attrs[n.StableAttr()] = wd
+}
+
+// unwatch stops watching the directory `n`.
+func (w *loopbackWatcher) unwatch(n *Inode) {
+	w.mu.Lock()
+	wd, ok := w.attrs[n.StableAttr()]
+	if ok {
+		delete(w.attrs, n.StableAttr())
+		delete(w.wds, wd)
+	}
+	w.mu.Unlock()
+	if ok {
+		unix.InotifyRmWatch(w.fd, uint32(wd))
+	}
+}
+
+// close stops the watcher.
+func (w *loopbackWatcher) close() error {
+	return w.file.Close()
+}
+
+// begin marks the start of a change to `n` through the mount.
+func (w *loopbackWatcher) begin(n *Inode) {
+	if n == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	attr := n.StableAttr()
+	w.busy[attr]++
+	w.self[attr] = true
+}
+
+// end marks the end of a change started with begin.
+func (w *loopbackWatcher) end(n *Inode) {
+	if n == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	attr := n.StableAttr()
+	if w.busy[attr]--; w.busy[attr] <= 0 {
+		delete(w.busy, attr)
+	}
+}
+
+// isSelf reports whether an event for `n` may have been caused by a
+// change through the mount.
+func (w *loopbackWatcher) isSelf(n *Inode) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.self[n.StableAttr()]
+}
+
+// drained is called when all queued events have been read. Events
+// are queued before the system call that causes them returns, so the
+// events for changes that have ended have all been seen.
+func (w *loopbackWatcher) drained() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for attr := range w.self {
+		if w.busy[attr] == 0 {
+			delete(w.self, attr)
+		}
+	}
+}
+
+// dir returns the live Inode for the watch `wd`.
+func (w *loopbackWatcher) dir(wd int) *Inode {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if wd == w.rootWd {
+		return w.root
+	}
+	attr, ok := w.wds[wd]
+	if !ok {
+		return nil
+	}
+	b := w.root.bridge
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stableAttrs[attr]
+}
+
+func (w *loopbackWatcher) forgetWd(wd int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if attr, ok := w.wds[wd]; ok {
+		delete(w.wds, wd)
+		delete(w.attrs, attr)
+	}
+}
+
+func (w *loopbackWatcher) loop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+
+			// The name is padded with NUL bytes.
+			name := string(nameBytes)
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			w.handle(int(ev.Wd), ev.Mask, name)
+		}
+		if queued, err := unix.IoctlGetInt(w.fd, unix.TIOCINQ); err == nil && queued == 0 {
+			w.drained()
+		}
+	}
+}
+
+// handle invalidates the kernel cache for an event on entry `name`
+// in the directory watched by `wd`.
+func (w *loopbackWatcher) handle(wd int, mask uint32, name string) {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		log.Printf("loopback: inotify queue overflow, kernel cache may be stale")
+		return
+	}
+	if mask&unix.IN_IGNORED != 0 {
+		w.forgetWd(wd)
+		return
+	}
+	dir := w.dir(wd)
+	if dir == nil {
+		return
+	}
+	if name == "" {
+		// Event for the directory itself.
+		if !w.isSelf(dir) {
+			dir.NotifyContent(-1, 0)
+		}
+		return
+	}
+
+	switch {
+	case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM|unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		if w.isSelf(dir) {
+			// The bridge updates the tree for changes made
+			// through the mount.
+			return
+		}
+		if mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) == 0 {
+			// This also drops negative entries.
+			dir.NotifyEntry(name)
+		} else if ch := dir.GetChild(name); ch != nil {
+			dir.NotifyDelete(name, ch)
+			// Drop the entry, so the path of ch does not
+			// use the stale name.
+			dir.RmChild(name)
+		} else {
+			dir.NotifyEntry(name)
+		}
+		dir.NotifyContent(-1, 0)
+	case mask&(unix.IN_MODIFY|unix.IN_CLOSE_WRITE) != 0:
+		if ch := dir.GetChild(name); ch != nil && !w.isSelf(ch) {
+			ch.NotifyContent(0, 0)
+		}
+	case mask&unix.IN_ATTRIB != 0:
+		if ch := dir.GetChild(name); ch != nil && !w.isSelf(ch) {
+			ch.NotifyContent(-1, 0)
+		}
+	}
+}
+
+// watch watches the directory `n` at `path`, if the file system
+// watches the backing directories.
+func (r *LoopbackRoot) watch(n *Inode, path string) {
+	if r.watcher != nil && n.IsDir() {
+		r.watcher.watch(n, path)
+	}
+}
+
+// changing marks `a` and `b`, either of which may be nil, as being
+// changed through the mount, so the watcher ignores the events this
+// causes. Call the returned function when the change is done.
+func (r *LoopbackRoot) changing(a, b *Inode) func() {
+	w := r.watcher
+	if w == nil {
+		return noChange
+	}
+	w.begin(a)
+	w.begin(b)
+	return func() {
+		w.end(a)
+		w.end(b)
+	}
+}
+
+func noChange() {}
+
+// unwatch stops watching the directory `n`, if it is watched.
+func (r *LoopbackRoot) unwatch(n *Inode) {
+	if r.watcher != nil && n.IsDir() {
+		r.watcher.unwatch(n)
+	}
+}
+
+// newFile returns the file handle for a descriptor opened for `n`.
+// If the file system watches the backing directories, writes through
+// it are marked as changes through the mount.
+func (r *LoopbackRoot) newFile(n *Inode, fd int) FileHandle {
+	if r.watcher == nil {
+		return NewLoopbackFile(fd)
+	}
+	return &watchedFile{
+		loopbackFile: loopbackFile{fd: fd},
+		root:         r,
+		node:         n,
+	}
+}
+
+// watchedFile is a loopbackFile of a file system that watches the
+// backing directories.
+type watchedFile struct {
+	loopbackFile
+	root *LoopbackRoot
+	node *Inode
+}
+
+func (f *watchedFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	done := f.root.changing(f.node, nil)
+	defer done()
+	return f.loopbackFile.Write(ctx, data, off)
+}
+
+func (f *watchedFile) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
+	done := f.root.changing(f.node, nil)
+	defer done()
+	return f.loopbackFile.Allocate(ctx, off, sz, mode)
+}
+
+func (f *watchedFile) Release(ctx context.Context) syscall.Errno {
+	// Closing a file that was opened for writing causes
+	// IN_CLOSE_WRITE.
+	done := f.root.changing(f.node, nil)
+	defer done()
+	return f.loopbackFile.Release(ctx)
+}
+
+// toLoopbackFile returns the loopbackFile behind a file handle of a
+// loopback file system.
+func toLoopbackFile(fh FileHandle) (*loopbackFile, bool) {
+	switch f := fh.(type) {
+	case *loopbackFile:
+		return f, true
+	case *watchedFile:
+		return &f.loopbackFile, true
+	}
+	return nil, false
+}
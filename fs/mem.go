@@ -12,14 +12,22 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
-// MemRegularFile is a filesystem node that holds a read-only data
-// slice in memory.
+// MemRegularFile is a filesystem node that holds file content in
+// memory. The content is kept in Data until the file gets a hole,
+// by writing or truncating far beyond its end, or through Allocate.
+// From then on, the content is stored sparsely, so the holes take no
+// memory, and Data is nil.
 type MemRegularFile struct {
 	Inode
 
 	mu   sync.Mutex
 	Data []byte
 	Attr fuse.Attr
+
+	// sparse is set once the content has moved from Data to
+	// `content`.
+	sparse  bool
+	content sparseData
 }
 
 var _ = (NodeOpener)((*MemRegularFile)(nil))
@@ -27,6 +35,24 @@ var _ = (NodeReader)((*MemRegularFile)(nil))
 var _ = (NodeWriter)((*MemRegularFile)(nil))
 var _ = (NodeSetattrer)((*MemRegularFile)(nil))
 var _ = (NodeFlusher)((*MemRegularFile)(nil))
+var _ = (NodeLseeker)((*MemRegularFile)(nil))
+var _ = (NodeAllocater)((*MemRegularFile)(nil))
+
+// leavesHole returns whether extending Data to `end` would leave a
+// hole of a chunk or more. Must hold f.mu.
+func (f *MemRegularFile) leavesHole(end int64) bool {
+	return !f.sparse && end > int64(len(f.Data))+sparseChunkSize
+}
+
+// makeSparse moves Data into sparse storage. Must hold f.mu.
+func (f *MemRegularFile) makeSparse() {
+	if f.sparse {
+		return
+	}
+	f.content.writeAt(f.Data, 0)
+	f.Data = nil
+	f.sparse = true
+}
 
 func (f *MemRegularFile) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	return nil, fuse.FOPEN_KEEP_CACHE, OK
@@ -35,6 +61,14 @@ func (f *MemRegularFile) Open(ctx context.Context, flags uint32) (fh FileHandle,
 func (f *MemRegularFile) Write(ctx context.Context, fh FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if f.leavesHole(off) {
+		f.makeSparse()
+	}
+	if f.sparse {
+		f.content.writeAt(data, off)
+		return uint32(len(data)), 0
+	}
+
 	end := int64(len(data)) + off
 	if int64(len(f.Data)) < end {
 		n := make([]byte, end)
@@ -52,19 +86,40 @@ var _ = (NodeGetattrer)((*MemRegularFile)(nil))
 func (f *MemRegularFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	out.Attr = f.Attr
-	out.Attr.Size = uint64(len(f.Data))
+	f.getattr(&out.Attr)
 	return OK
 }
 
+// getattr fills `out`. Must hold f.mu.
+func (f *MemRegularFile) getattr(out *fuse.Attr) {
+	*out = f.Attr
+	if f.sparse {
+		out.Size = uint64(f.content.size)
+		out.Blocks = f.content.blocks()
+	} else {
+		out.Size = uint64(len(f.Data))
+		out.Blocks = (out.Size + sparseChunkSize - 1) / sparseChunkSize * (sparseChunkSize / 512)
+	}
+	setBlksize(out, sparseChunkSize)
+}
+
 func (f *MemRegularFile) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	if sz, ok := in.GetSize(); ok {
-		f.Data = f.Data[:sz]
+		if f.leavesHole(int64(sz)) {
+			f.makeSparse()
+		}
+		switch {
+		case f.sparse:
+			f.content.truncate(int64(sz))
+		case sz <= uint64(len(f.Data)):
+			f.Data = f.Data[:sz]
+		default:
+			f.Data = append(f.Data, make([]byte, sz-uint64(len(f.Data)))...)
+		}
 	}
-	out.Attr = f.Attr
-	out.Size = uint64(len(f.Data))
+	f.getattr(&out.Attr)
 	return OK
 }
 
@@ -75,6 +130,13 @@ func (f *MemRegularFile) Flush(ctx context.Context, fh FileHandle) syscall.Errno
 func (f *MemRegularFile) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if f.sparse {
+		n := f.content.readAt(dest, off)
+		return fuse.ReadResultData(dest[:n]), OK
+	}
+	if off >= int64(len(f.Data)) {
+		return fuse.ReadResultData(nil), OK
+	}
 	end := int(off) + len(dest)
 	if end > len(f.Data) {
 		end = len(f.Data)
@@ -82,6 +144,37 @@ func (f *MemRegularFile) Read(ctx context.Context, fh FileHandle, dest []byte, o
 	return fuse.ReadResultData(f.Data[off:end]), OK
 }
 
+// Lseek implements SEEK_DATA and SEEK_HOLE.
+func (f *MemRegularFile) Lseek(ctx context.Context, fh FileHandle, off uint64, whence uint32) (uint64, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sparse {
+		pos, errno := f.content.seek(int64(off), whence)
+		return uint64(pos), errno
+	}
+
+	// Content in Data has no holes.
+	switch {
+	case whence != _SEEK_DATA && whence != _SEEK_HOLE:
+		return 0, syscall.EINVAL
+	case off >= uint64(len(f.Data)):
+		return 0, syscall.ENXIO
+	case whence == _SEEK_HOLE:
+		return uint64(len(f.Data)), OK
+	}
+	return off, OK
+}
+
+// Allocate supports preallocation, FALLOC_FL_PUNCH_HOLE and
+// FALLOC_FL_ZERO_RANGE.
+func (f *MemRegularFile) Allocate(ctx context.Context, fh FileHandle, off uint64, size uint64, mode uint32) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Any mode may create holes, so always use sparse storage.
+	f.makeSparse()
+	return f.content.fallocate(int64(off), int64(size), mode, nil)
+}
+
 // MemSymlink is an inode holding a symlink in memory.
 type MemSymlink struct {
 	Inode
@@ -0,0 +1,91 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+)
+
+func TestDataFileSparse(t *testing.T) {
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		FirstAutomaticIno: 1,
+		OnAdd: func(ctx context.Context) {
+			n := root.EmbeddedInode()
+			ch := n.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{})
+			n.AddChild("file", ch, false)
+		},
+	})
+	defer clean()
+
+	fd, err := syscall.Open(mntDir+"/file", syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	const off = 1 << 40
+	if _, err := syscall.Pwrite(fd, []byte("hello"), off); err != nil {
+		t.Fatalf("Pwrite: %v", err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		t.Fatalf("Fstat: %v", err)
+	}
+	if st.Size != off+5 || st.Blocks != 8 {
+		t.Errorf("got size %d, %d blocks, want %d, 8 blocks", st.Size, st.Blocks, off+5)
+	}
+
+	if pos, err := syscall.Seek(fd, 0, _SEEK_DATA); err != nil || pos != off {
+		t.Errorf("SEEK_DATA: got %d, %v, want %d", pos, err, int64(off))
+	}
+	if pos, err := syscall.Seek(fd, off, _SEEK_HOLE); err != nil || pos != off+5 {
+		t.Errorf("SEEK_HOLE: got %d, %v, want %d", pos, err, int64(off+5))
+	}
+
+	if err := syscall.Fallocate(fd, _FALLOC_FL_PUNCH_HOLE|_FALLOC_FL_KEEP_SIZE, off, 5); err != nil {
+		t.Fatalf("Fallocate: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := syscall.Pread(fd, buf, off); err != nil {
+		t.Fatalf("Pread: %v", err)
+	} else if !bytes.Equal(buf, make([]byte, 5)) {
+		t.Errorf("punched data: got %q", buf)
+	}
+}
+
+func TestDataFileKeepsData(t *testing.T) {
+	root := &Inode{}
+	f := &MemRegularFile{Data: []byte("hello")}
+	mntDir, _, clean := testMount(t, root, &Options{
+		FirstAutomaticIno: 1,
+		OnAdd: func(ctx context.Context) {
+			n := root.EmbeddedInode()
+			ch := n.NewPersistentInode(ctx, f, StableAttr{})
+			n.AddChild("file", ch, false)
+		},
+	})
+	defer clean()
+
+	fd, err := syscall.Open(mntDir+"/file", syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+	if _, err := syscall.Pwrite(fd, []byte("world"), 3); err != nil {
+		t.Fatalf("Pwrite: %v", err)
+	}
+
+	f.mu.Lock()
+	got := string(f.Data)
+	f.mu.Unlock()
+	if want := "helworld"; got != want {
+		t.Errorf("Data: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,841 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// MemFSOptions holds the parameters for NewMemFS.
+type MemFSOptions struct {
+	// MaxBytes limits the total size of file contents. If zero,
+	// the size is unlimited.
+	MaxBytes uint64
+
+	// MaxInodes limits the number of files, directories and
+	// other objects. If zero, the number is unlimited.
+	MaxInodes uint64
+}
+
+const (
+	memFSBlockSize = 4096
+	memFSNameLen   = 255
+)
+
+// memFS holds data shared by all nodes in an in-memory file system.
+type memFS struct {
+	opts MemFSOptions
+
+	// mu serializes changes to the directory tree.
+	mu sync.Mutex
+
+	// usedBytes and usedInodes are updated atomically.
+	usedBytes  uint64
+	usedInodes uint64
+
+	// store holds the content of files for NewDedupFS. It is nil
+	// for NewMemFS.
+	store BlobStore
+
+	// blobMu protects blobs, which holds the blobs in use by
+	// digest.
+	blobMu sync.Mutex
+	blobs  map[string]*dedupBlob
+}
+
+// allocBytes reserves space for n bytes of content. It returns false
+// if the file system is full.
+func (fs *memFS) allocBytes(n uint64) bool {
+	for {
+		old := atomic.LoadUint64(&fs.usedBytes)
+		if fs.opts.MaxBytes > 0 && old+n > fs.opts.MaxBytes {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&fs.usedBytes, old, old+n) {
+			return true
+		}
+	}
+}
+
+func (fs *memFS) freeBytes(n uint64) {
+	atomic.AddUint64(&fs.usedBytes, ^(n - 1))
+}
+
+// allocInode reserves an inode. It returns false if the file system
+// has run out of inodes.
+func (fs *memFS) allocInode() bool {
+	for {
+		old := atomic.LoadUint64(&fs.usedInodes)
+		if fs.opts.MaxInodes > 0 && old+1 > fs.opts.MaxInodes {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&fs.usedInodes, old, old+1) {
+			return true
+		}
+	}
+}
+
+func (fs *memFS) freeInode() {
+	atomic.AddUint64(&fs.usedInodes, ^uint64(0))
+}
+
+// memNode is a node in an in-memory file system. The same type is
+// used for directories, regular files, symlinks and special files.
+// The directory structure is kept in the Inode tree, so all memNodes
+// are persistent until they are unlinked.
+type memNode struct {
+	Inode
+
+	fs *memFS
+
+	// mu protects the fields below.
+	mu   sync.Mutex
+	attr fuse.Attr
+
+	// content holds the data of regular files.
+	content sparseData
+
+	// blob holds the data of regular files in a dedup file
+	// system that are not open for writing. Then, content is
+	// empty.
+	blob *dedupBlob
+
+	// opens and writers are the number of handles, and of
+	// writable handles, in a dedup file system.
+	opens   int
+	writers int
+
+	// target holds the target of a symlink.
+	target []byte
+	xattrs map[string][]byte
+}
+
+var _ = (NodeStatfser)((*memNode)(nil))
+var _ = (NodeGetattrer)((*memNode)(nil))
+var _ = (NodeSetattrer)((*memNode)(nil))
+var _ = (NodeGetxattrer)((*memNode)(nil))
+var _ = (NodeSetxattrer)((*memNode)(nil))
+var _ = (NodeRemovexattrer)((*memNode)(nil))
+var _ = (NodeListxattrer)((*memNode)(nil))
+var _ = (NodeReadlinker)((*memNode)(nil))
+var _ = (NodeOpener)((*memNode)(nil))
+var _ = (NodeReleaser)((*memNode)(nil))
+var _ = (NodeReader)((*memNode)(nil))
+var _ = (NodeWriter)((*memNode)(nil))
+var _ = (NodeFlusher)((*memNode)(nil))
+var _ = (NodeFsyncer)((*memNode)(nil))
+var _ = (NodeAllocater)((*memNode)(nil))
+var _ = (NodeLseeker)((*memNode)(nil))
+var _ = (NodeReaddirer)((*memNode)(nil))
+var _ = (NodeMkdirer)((*memNode)(nil))
+var _ = (NodeMknoder)((*memNode)(nil))
+var _ = (NodeCreater)((*memNode)(nil))
+var _ = (NodeSymlinker)((*memNode)(nil))
+var _ = (NodeLinker)((*memNode)(nil))
+var _ = (NodeUnlinker)((*memNode)(nil))
+var _ = (NodeRmdirer)((*memNode)(nil))
+var _ = (NodeRenamer)((*memNode)(nil))
+
+// NewMemFS returns the root of a writable file system that keeps all
+// of its data in memory, similar to tmpfs. Size and inode limits in
+// `opts` are enforced with ENOSPC, and reported through Statfs. The
+// opts argument may be nil.
+func NewMemFS(opts *MemFSOptions) InodeEmbedder {
+	fs := &memFS{}
+	if opts != nil {
+		fs.opts = *opts
+	}
+	return fs.newRoot()
+}
+
+// newRoot returns the root directory of fs.
+func (fs *memFS) newRoot() *memNode {
+	fs.usedInodes = 1
+
+	root := &memNode{fs: fs}
+	root.attr.Mode = syscall.S_IFDIR | 0755
+	root.attr.Nlink = 2
+	now := time.Now()
+	root.attr.SetTimes(&now, &now, &now)
+	return root
+}
+
+func (n *memNode) isDir() bool {
+	return n.Mode() == syscall.S_IFDIR
+}
+
+// getattr fills `out`. Must hold n.mu.
+func (n *memNode) getattr(out *fuse.Attr) {
+	*out = n.attr
+	switch n.Mode() {
+	case syscall.S_IFREG:
+		out.Size = uint64(n.content.size)
+		out.Blocks = n.content.blocks()
+		if n.blob != nil {
+			out.Size = uint64(n.blob.size)
+			out.Blocks = (out.Size + 511) / 512
+		}
+		setBlksize(out, sparseChunkSize)
+	case syscall.S_IFLNK:
+		out.Size = uint64(len(n.target))
+	}
+}
+
+// touch updates the modification and change times of n.
+func (n *memNode) touch() {
+	now := time.Now()
+	n.mu.Lock()
+	n.attr.SetTimes(nil, &now, &now)
+	n.mu.Unlock()
+}
+
+func (n *memNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	out.Bsize = memFSBlockSize
+	out.Frsize = memFSBlockSize
+	out.NameLen = memFSNameLen
+
+	if max := n.fs.opts.MaxBytes; max > 0 {
+		used := (atomic.LoadUint64(&n.fs.usedBytes) + memFSBlockSize - 1) / memFSBlockSize
+		out.Blocks = max / memFSBlockSize
+		if used < out.Blocks {
+			out.Bfree = out.Blocks - used
+		}
+		out.Bavail = out.Bfree
+	}
+	if max := n.fs.opts.MaxInodes; max > 0 {
+		out.Files = max
+		if used := atomic.LoadUint64(&n.fs.usedInodes); used < max {
+			out.Ffree = max - used
+		}
+	}
+	return OK
+}
+
+func (n *memNode) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.getattr(&out.Attr)
+	return OK
+}
+
+func (n *memNode) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	if sz, ok := in.GetSize(); ok {
+		if n.isDir() {
+			return syscall.EISDIR
+		}
+		if errno := n.unshare(); errno != 0 {
+			return errno
+		}
+		if errno := n.truncate(sz); errno != 0 {
+			return errno
+		}
+		n.attr.SetTimes(nil, &now, nil)
+		n.settle()
+	}
+	if m, ok := in.GetMode(); ok {
+		n.attr.Mode = (n.attr.Mode &^ 07777) | m
+	}
+	if uid, ok := in.GetUID(); ok {
+		n.attr.Uid = uid
+	}
+	if gid, ok := in.GetGID(); ok {
+		n.attr.Gid = gid
+	}
+	if atime, ok := in.GetATime(); ok {
+		n.attr.SetTimes(&atime, nil, nil)
+	}
+	if mtime, ok := in.GetMTime(); ok {
+		n.attr.SetTimes(nil, &mtime, nil)
+	}
+	n.attr.SetTimes(nil, nil, &now)
+
+	n.getattr(&out.Attr)
+	return OK
+}
+
+// truncate resizes the file content. Must hold n.mu.
+func (n *memNode) truncate(sz uint64) syscall.Errno {
+	before := n.content.allocated()
+	n.content.truncate(int64(sz))
+	n.release(before)
+	return OK
+}
+
+// reserve accounts for `sz` bytes of newly allocated content. Space
+// used by unlinked files is not accounted. Must hold n.mu.
+func (n *memNode) reserve(sz int64) syscall.Errno {
+	if n.attr.Nlink > 0 && !n.fs.allocBytes(uint64(sz)) {
+		return syscall.ENOSPC
+	}
+	return OK
+}
+
+// release returns space freed since the content had `before` bytes
+// allocated. Must hold n.mu.
+func (n *memNode) release(before int64) {
+	if after := n.content.allocated(); n.attr.Nlink > 0 && after < before {
+		n.fs.freeBytes(uint64(before - after))
+	}
+}
+
+func (n *memNode) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if n.fs.store != nil {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		fh, errno = n.openDedup(flags)
+	}
+	return fh, fuse.FOPEN_KEEP_CACHE, errno
+}
+
+// Release stores the content of a dedup file system in a blob, once
+// the last writable handle is released.
+func (n *memNode) Release(ctx context.Context, fh FileHandle) syscall.Errno {
+	if h, ok := fh.(*dedupHandle); ok {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return n.releaseDedup(h)
+	}
+	return OK
+}
+
+func (n *memNode) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.blob != nil {
+		sz, errno := n.readBlob(dest, off)
+		return fuse.ReadResultData(dest[:sz]), errno
+	}
+	sz := n.content.readAt(dest, off)
+	return fuse.ReadResultData(dest[:sz]), OK
+}
+
+func (n *memNode) Write(ctx context.Context, fh FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if errno := n.unshare(); errno != 0 {
+		return 0, errno
+	}
+	if errno := n.reserve(n.content.unallocated(off, int64(len(data)))); errno != 0 {
+		return 0, errno
+	}
+	n.content.writeAt(data, off)
+
+	now := time.Now()
+	n.attr.SetTimes(nil, &now, &now)
+	n.settle()
+	return uint32(len(data)), OK
+}
+
+func (n *memNode) Flush(ctx context.Context, fh FileHandle) syscall.Errno {
+	return OK
+}
+
+func (n *memNode) Fsync(ctx context.Context, fh FileHandle, flags uint32) syscall.Errno {
+	return OK
+}
+
+func (n *memNode) Allocate(ctx context.Context, fh FileHandle, off uint64, size uint64, mode uint32) syscall.Errno {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if errno := n.unshare(); errno != 0 {
+		return errno
+	}
+
+	before := n.content.allocated()
+	if errno := n.content.fallocate(int64(off), int64(size), mode, n.reserve); errno != 0 {
+		return errno
+	}
+	n.release(before)
+
+	now := time.Now()
+	n.attr.SetTimes(nil, &now, &now)
+	n.settle()
+	return OK
+}
+
+func (n *memNode) Lseek(ctx context.Context, fh FileHandle, off uint64, whence uint32) (uint64, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.blob != nil {
+		// Blobs have no holes.
+		if int64(off) >= n.blob.size {
+			return 0, syscall.ENXIO
+		}
+		if whence == _SEEK_HOLE {
+			return uint64(n.blob.size), OK
+		}
+		return off, OK
+	}
+	pos, errno := n.content.seek(int64(off), whence)
+	return uint64(pos), errno
+}
+
+func (n *memNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if n.Mode() != syscall.S_IFLNK {
+		return nil, syscall.EINVAL
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]byte{}, n.target...), OK
+}
+
+func (n *memNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	val, ok := n.xattrs[attr]
+	if attr == DedupDigestXattr && n.hasDigest() {
+		val, ok = []byte(n.digest()), true
+	}
+	if !ok {
+		return 0, ENOATTR
+	}
+	if len(dest) == 0 {
+		return uint32(len(val)), OK
+	}
+	if len(dest) < len(val) {
+		return uint32(len(val)), syscall.ERANGE
+	}
+	return uint32(copy(dest, val)), OK
+}
+
+func (n *memNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if attr == DedupDigestXattr && n.hasDigest() {
+		return syscall.EPERM
+	}
+	_, ok := n.xattrs[attr]
+	if ok && flags&_XATTR_CREATE != 0 {
+		return syscall.EEXIST
+	}
+	if !ok && flags&_XATTR_REPLACE != 0 {
+		return ENOATTR
+	}
+	if n.xattrs == nil {
+		n.xattrs = map[string][]byte{}
+	}
+	n.xattrs[attr] = append([]byte{}, data...)
+
+	now := time.Now()
+	n.attr.SetTimes(nil, nil, &now)
+	return OK
+}
+
+func (n *memNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if attr == DedupDigestXattr && n.hasDigest() {
+		return syscall.EPERM
+	}
+	if _, ok := n.xattrs[attr]; !ok {
+		return ENOATTR
+	}
+	delete(n.xattrs, attr)
+
+	now := time.Now()
+	n.attr.SetTimes(nil, nil, &now)
+	return OK
+}
+
+func (n *memNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var names []string
+	for k := range n.xattrs {
+		names = append(names, k)
+	}
+	if n.hasDigest() {
+		names = append(names, DedupDigestXattr)
+	}
+	sort.Strings(names)
+
+	var buf []byte
+	for _, k := range names {
+		buf = append(buf, k...)
+		buf = append(buf, 0)
+	}
+	if len(dest) == 0 {
+		return uint32(len(buf)), OK
+	}
+	if len(dest) < len(buf) {
+		return uint32(len(buf)), syscall.ERANGE
+	}
+	return uint32(copy(dest, buf)), OK
+}
+
+// Readdir lists the children sorted by name, so the listing is stable
+// when seeking in the directory.
+func (n *memNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	children := n.Children()
+	names := make([]string, 0, len(children))
+	for k := range children {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	r := make([]fuse.DirEntry, 0, len(names))
+	for _, k := range names {
+		ch := children[k]
+		r = append(r, fuse.DirEntry{
+			Mode: ch.Mode(),
+			Name: k,
+			Ino:  ch.StableAttr().Ino,
+		})
+	}
+	return NewListDirStream(r), OK
+}
+
+// newChild creates and links a new node under `name`. Must hold
+// fs.mu.
+func (n *memNode) newChild(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*memNode, syscall.Errno) {
+	if len(name) > memFSNameLen {
+		return nil, syscall.ENAMETOOLONG
+	}
+	if n.GetChild(name) != nil {
+		return nil, syscall.EEXIST
+	}
+	if !n.fs.allocInode() {
+		return nil, syscall.ENOSPC
+	}
+
+	ch := &memNode{fs: n.fs}
+	ch.attr.Mode = mode
+	ch.attr.Nlink = 1
+	if caller, ok := fuse.FromContext(ctx); ok {
+		ch.attr.Uid = caller.Uid
+		ch.attr.Gid = caller.Gid
+	}
+	now := time.Now()
+	ch.attr.SetTimes(&now, &now, &now)
+
+	isDir := mode&syscall.S_IFMT == syscall.S_IFDIR
+	n.mu.Lock()
+	if n.attr.Mode&syscall.S_ISGID != 0 {
+		// Inherit the group of setgid directories.
+		ch.attr.Gid = n.attr.Gid
+		if isDir {
+			ch.attr.Mode |= syscall.S_ISGID
+		}
+	}
+	if isDir {
+		ch.attr.Nlink = 2
+		n.attr.Nlink++
+	}
+	n.attr.SetTimes(nil, &now, &now)
+	n.mu.Unlock()
+
+	ch.getattr(&out.Attr)
+	n.NewPersistentInode(ctx, ch, StableAttr{Mode: mode & syscall.S_IFMT})
+	return ch, OK
+}
+
+// dropLink decreases the link count of `ch`, which is removed from
+// directory n. If it was the last link, the space for ch is released,
+// and the node is dropped from the tree once the kernel forgets
+// it. Must hold fs.mu.
+func (n *memNode) dropLink(ch *memNode) {
+	now := time.Now()
+	ch.mu.Lock()
+	if ch.isDir() {
+		ch.attr.Nlink = 0
+	} else if ch.attr.Nlink > 0 {
+		ch.attr.Nlink--
+	}
+	ch.attr.SetTimes(nil, nil, &now)
+	gone := ch.attr.Nlink == 0
+	if gone {
+		n.fs.freeBytes(uint64(ch.content.allocated() + int64(len(ch.target))))
+		n.fs.freeInode()
+		if ch.blob != nil && ch.opens == 0 {
+			n.fs.dropBlob(ch.blob)
+			ch.blob = nil
+		}
+	}
+	ch.mu.Unlock()
+
+	n.mu.Lock()
+	if ch.isDir() {
+		n.attr.Nlink--
+	}
+	n.attr.SetTimes(nil, &now, &now)
+	n.mu.Unlock()
+
+	if gone {
+		ch.ForgetPersistent()
+	}
+}
+
+func (n *memNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	ch, errno := n.newChild(ctx, name, syscall.S_IFDIR|(mode&07777), out)
+	if errno != 0 {
+		return nil, errno
+	}
+	return &ch.Inode, OK
+}
+
+func (n *memNode) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if mode&syscall.S_IFMT == 0 {
+		mode |= syscall.S_IFREG
+	}
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	ch, errno := n.newChild(ctx, name, mode, out)
+	if errno != 0 {
+		return nil, errno
+	}
+	ch.attr.Rdev = dev
+	out.Attr.Rdev = dev
+	return &ch.Inode, OK
+}
+
+func (n *memNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+
+	if existing := n.GetChild(name); existing != nil {
+		if flags&syscall.O_EXCL != 0 {
+			return nil, nil, 0, syscall.EEXIST
+		}
+		ch, ok := existing.Operations().(*memNode)
+		if !ok || ch.isDir() {
+			return nil, nil, 0, syscall.EISDIR
+		}
+		ch.mu.Lock()
+		defer ch.mu.Unlock()
+		var fh FileHandle
+		if n.fs.store != nil {
+			var errno syscall.Errno
+			if fh, errno = ch.openDedup(flags); errno != 0 {
+				return nil, nil, 0, errno
+			}
+		}
+		if flags&syscall.O_TRUNC != 0 {
+			if errno := ch.truncate(0); errno != 0 {
+				return nil, nil, 0, errno
+			}
+		}
+		ch.getattr(&out.Attr)
+		return existing, fh, fuse.FOPEN_KEEP_CACHE, OK
+	}
+
+	ch, errno := n.newChild(ctx, name, syscall.S_IFREG|(mode&07777), out)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	var fh FileHandle
+	if n.fs.store != nil {
+		ch.mu.Lock()
+		fh, _ = ch.openDedup(flags)
+		ch.mu.Unlock()
+	}
+	return &ch.Inode, fh, fuse.FOPEN_KEEP_CACHE, OK
+}
+
+func (n *memNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	if !n.fs.allocBytes(uint64(len(target))) {
+		return nil, syscall.ENOSPC
+	}
+	ch, errno := n.newChild(ctx, name, syscall.S_IFLNK|0777, out)
+	if errno != 0 {
+		n.fs.freeBytes(uint64(len(target)))
+		return nil, errno
+	}
+	ch.target = []byte(target)
+	out.Attr.Size = uint64(len(target))
+	return &ch.Inode, OK
+}
+
+func (n *memNode) Link(ctx context.Context, target InodeEmbedder, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	ch, ok := target.(*memNode)
+	if !ok || ch.fs != n.fs {
+		return nil, syscall.EXDEV
+	}
+	if ch.isDir() {
+		return nil, syscall.EPERM
+	}
+	if len(name) > memFSNameLen {
+		return nil, syscall.ENAMETOOLONG
+	}
+
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	if n.GetChild(name) != nil {
+		return nil, syscall.EEXIST
+	}
+
+	now := time.Now()
+	ch.mu.Lock()
+	if ch.attr.Nlink == 0 {
+		ch.mu.Unlock()
+		return nil, syscall.ENOENT
+	}
+	ch.attr.Nlink++
+	ch.attr.SetTimes(nil, nil, &now)
+	ch.getattr(&out.Attr)
+	ch.mu.Unlock()
+
+	n.touch()
+	return &ch.Inode, OK
+}
+
+// child returns the memNode for `name`.
+func (n *memNode) child(name string) *memNode {
+	ch := n.GetChild(name)
+	if ch == nil {
+		return nil
+	}
+	return ch.Operations().(*memNode)
+}
+
+func (n *memNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	ch := n.child(name)
+	if ch == nil {
+		return syscall.ENOENT
+	}
+	if ch.isDir() {
+		return syscall.EISDIR
+	}
+	n.dropLink(ch)
+	return OK
+}
+
+func (n *memNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	ch := n.child(name)
+	if ch == nil {
+		return syscall.ENOENT
+	}
+	if !ch.isDir() {
+		return syscall.ENOTDIR
+	}
+	if len(ch.Children()) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	n.dropLink(ch)
+	return OK
+}
+
+// isAncestor returns whether n is an ancestor of, or the same as, `other`.
+func (n *memNode) isAncestor(other *Inode) bool {
+	for p := other; p != nil; {
+		if p == &n.Inode {
+			return true
+		}
+		if p.IsRoot() {
+			break
+		}
+		_, p = p.Parent()
+	}
+	return false
+}
+
+func (n *memNode) Rename(ctx context.Context, name string, newParent InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags&^(RENAME_NOREPLACE|RENAME_EXCHANGE) != 0 ||
+		flags == RENAME_NOREPLACE|RENAME_EXCHANGE {
+		return syscall.EINVAL
+	}
+	p2, ok := newParent.(*memNode)
+	if !ok || p2.fs != n.fs {
+		return syscall.EXDEV
+	}
+	if len(newName) > memFSNameLen {
+		return syscall.ENAMETOOLONG
+	}
+
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+
+	src := n.child(name)
+	if src == nil {
+		return syscall.ENOENT
+	}
+	dst := p2.child(newName)
+	if src.isDir() && src.isAncestor(&p2.Inode) {
+		return syscall.EINVAL
+	}
+
+	if flags&RENAME_EXCHANGE != 0 {
+		if dst == nil {
+			return syscall.ENOENT
+		}
+		if dst.isDir() && dst.isAncestor(&n.Inode) {
+			return syscall.EINVAL
+		}
+		if src.isDir() != dst.isDir() && n != p2 {
+			dir, other := n, p2
+			if dst.isDir() {
+				dir, other = p2, n
+			}
+			dir.mu.Lock()
+			dir.attr.Nlink--
+			dir.mu.Unlock()
+			other.mu.Lock()
+			other.attr.Nlink++
+			other.mu.Unlock()
+		}
+		src.touchCtime()
+		dst.touchCtime()
+		n.touch()
+		p2.touch()
+		return OK
+	}
+
+	if dst != nil {
+		if flags&RENAME_NOREPLACE != 0 {
+			return syscall.EEXIST
+		}
+		if src.isDir() {
+			if !dst.isDir() {
+				return syscall.ENOTDIR
+			}
+			if len(dst.Children()) > 0 {
+				return syscall.ENOTEMPTY
+			}
+		} else if dst.isDir() {
+			return syscall.EISDIR
+		}
+		p2.dropLink(dst)
+	}
+
+	if src.isDir() && n != p2 {
+		n.mu.Lock()
+		n.attr.Nlink--
+		n.mu.Unlock()
+		p2.mu.Lock()
+		p2.attr.Nlink++
+		p2.mu.Unlock()
+	}
+	src.touchCtime()
+	n.touch()
+	p2.touch()
+	return OK
+}
+
+// touchCtime updates the change time of n.
+func (n *memNode) touchCtime() {
+	now := time.Now()
+	n.mu.Lock()
+	n.attr.SetTimes(nil, nil, &now)
+	n.mu.Unlock()
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMemFSRenameFlags(t *testing.T) {
+	mntDir, _, clean := testMount(t, NewMemFS(nil), nil)
+	defer clean()
+
+	if err := ioutil.WriteFile(mntDir+"/a", []byte("a"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Mkdir(mntDir+"/b", 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	if err := unix.Renameat2(unix.AT_FDCWD, mntDir+"/a", unix.AT_FDCWD, mntDir+"/b", unix.RENAME_NOREPLACE); err != syscall.EEXIST {
+		t.Errorf("RENAME_NOREPLACE: got %v, want EEXIST", err)
+	}
+
+	if err := unix.Renameat2(unix.AT_FDCWD, mntDir+"/a", unix.AT_FDCWD, mntDir+"/b", unix.RENAME_EXCHANGE); err != nil {
+		t.Fatalf("RENAME_EXCHANGE: %v", err)
+	}
+	if fi, err := os.Lstat(mntDir + "/a"); err != nil || !fi.IsDir() {
+		t.Errorf("a: got %v, %v, want directory", fi, err)
+	}
+	if content, err := ioutil.ReadFile(mntDir + "/b"); err != nil || string(content) != "a" {
+		t.Errorf("b: got %q, %v, want %q", content, err, "a")
+	}
+}
+
+func TestMemFSXAttr(t *testing.T) {
+	mntDir, _, clean := testMount(t, NewMemFS(nil), nil)
+	defer clean()
+
+	fn := mntDir + "/file"
+	if err := ioutil.WriteFile(fn, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := unix.Setxattr(fn, "user.attr", []byte("value"), unix.XATTR_CREATE); err != nil {
+		t.Fatalf("Setxattr: %v", err)
+	}
+	if err := unix.Setxattr(fn, "user.attr", []byte("value"), unix.XATTR_CREATE); err != syscall.EEXIST {
+		t.Errorf("Setxattr XATTR_CREATE: got %v, want EEXIST", err)
+	}
+
+	buf := make([]byte, 100)
+	if sz, err := unix.Getxattr(fn, "user.attr", buf); err != nil {
+		t.Fatalf("Getxattr: %v", err)
+	} else if got := string(buf[:sz]); got != "value" {
+		t.Errorf("Getxattr: got %q, want %q", got, "value")
+	}
+
+	if sz, err := unix.Listxattr(fn, buf); err != nil {
+		t.Fatalf("Listxattr: %v", err)
+	} else if got := string(buf[:sz]); got != "user.attr\x00" {
+		t.Errorf("Listxattr: got %q", got)
+	}
+
+	if err := unix.Removexattr(fn, "user.attr"); err != nil {
+		t.Fatalf("Removexattr: %v", err)
+	}
+	if _, err := unix.Getxattr(fn, "user.attr", buf); err != ENOATTR {
+		t.Errorf("Getxattr after remove: got %v, want ENOATTR", err)
+	}
+}
+
+func TestMemFSMknod(t *testing.T) {
+	mntDir, _, clean := testMount(t, NewMemFS(nil), nil)
+	defer clean()
+
+	fn := mntDir + "/fifo"
+	if err := syscall.Mknod(fn, syscall.S_IFIFO|0644, 0); err != nil {
+		t.Fatalf("Mknod: %v", err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(fn, &st); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if st.Mode != syscall.S_IFIFO|0644 {
+		t.Errorf("got mode %o, want %o", st.Mode, syscall.S_IFIFO|0644)
+	}
+}
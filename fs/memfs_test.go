@@ -0,0 +1,65 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/posixtest"
+)
+
+func TestMemFSPosix(t *testing.T) {
+	for nm, fn := range posixtest.All {
+		t.Run(nm, func(t *testing.T) {
+			mntDir, _, clean := testMount(t, NewMemFS(nil), nil)
+			defer clean()
+
+			fn(t, mntDir)
+		})
+	}
+}
+
+func TestMemFSLimits(t *testing.T) {
+	mntDir, _, clean := testMount(t, NewMemFS(&MemFSOptions{
+		MaxBytes:  4 * memFSBlockSize,
+		MaxInodes: 3,
+	}), nil)
+	defer clean()
+
+	if err := ioutil.WriteFile(mntDir+"/file", make([]byte, memFSBlockSize), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(mntDir, &st); err != nil {
+		t.Fatalf("Statfs: %v", err)
+	}
+	if st.Blocks != 4 || st.Bfree != 3 || st.Files != 3 || st.Ffree != 1 {
+		t.Errorf("got Statfs %#v, want 4 blocks, 3 free, 3 files, 1 free", st)
+	}
+
+	if err := ioutil.WriteFile(mntDir+"/big", make([]byte, 4*memFSBlockSize), 0644); err == nil {
+		t.Errorf("WriteFile beyond MaxBytes succeeded")
+	}
+	if err := os.Mkdir(mntDir+"/dir", 0755); err == nil {
+		t.Errorf("Mkdir beyond MaxInodes succeeded")
+	}
+
+	if err := os.Remove(mntDir + "/big"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := os.Remove(mntDir + "/file"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := syscall.Statfs(mntDir, &st); err != nil {
+		t.Fatalf("Statfs: %v", err)
+	}
+	if st.Bfree != 4 || st.Ffree != 2 {
+		t.Errorf("after remove: got Statfs %#v, want 4 blocks free, 2 files free", st)
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// ReadAheadOptions holds the parameters for NewReadAhead.
+type ReadAheadOptions struct {
+	// BlockSize is the size of the reads issued ahead. If zero,
+	// 128 kb is used.
+	BlockSize int
+
+	// Blocks is the number of blocks to read ahead of a
+	// sequential reader. If zero, 8 is used.
+	Blocks int
+
+	// Threshold is the number of consecutive sequential reads
+	// after which reading ahead starts. If zero, 2 is used.
+	Threshold int
+
+	// MaxBytes limits the memory used for blocks read ahead, for
+	// all files together. If zero, 64 Mb is used.
+	MaxBytes int64
+
+	// WriteCache, if set, stores blocks in the kernel page cache
+	// with Inode.WriteCache as soon as they have been read, so
+	// later reads may not have to go through FUSE at all.
+	WriteCache bool
+}
+
+// ReadAhead reads ahead of sequential readers. Each file handle is
+// tracked separately, and once it is read sequentially, the
+// following blocks are read concurrently into memory, from where
+// later reads are served. This helps backends with a high latency
+// per read, which otherwise only see reads of the size the kernel
+// issues.
+//
+// Use it by mounting a file system with Intercept as an interceptor:
+//
+//	ra := NewReadAhead(nil)
+//	server, err := Mount(dir, root, &Options{
+//		Interceptors: []Interceptor{ra.Intercept},
+//	})
+//
+// Blocks read ahead are dropped when the file is written, truncated
+// or allocated through the same mount. The file handles must be
+// comparable, which is the case for pointers; other handles are not
+// read ahead.
+type ReadAhead struct {
+	opts ReadAheadOptions
+
+	mu      sync.Mutex
+	streams map[raKey]*raStream
+	used    int64
+}
+
+// NewReadAhead returns a ReadAhead. The opts argument may be nil.
+func NewReadAhead(opts *ReadAheadOptions) *ReadAhead {
+	ra := &ReadAhead{streams: map[raKey]*raStream{}}
+	if opts != nil {
+		ra.opts = *opts
+	}
+	if ra.opts.BlockSize <= 0 {
+		ra.opts.BlockSize = 128 << 10
+	}
+	if ra.opts.Blocks <= 0 {
+		ra.opts.Blocks = 8
+	}
+	if ra.opts.Threshold <= 0 {
+		ra.opts.Threshold = 2
+	}
+	if ra.opts.MaxBytes <= 0 {
+		ra.opts.MaxBytes = 64 << 20
+	}
+	return ra
+}
+
+type raKey struct {
+	node *Inode
+	fh   FileHandle
+}
+
+// raStream is the read ahead state of a file handle.
+type raStream struct {
+	ra      *ReadAhead
+	key     raKey
+	handler NodeReader
+
+	// wg tracks the reads in flight.
+	wg sync.WaitGroup
+
+	mu sync.Mutex
+
+	// next is the offset of a sequential read.
+	next int64
+
+	// ahead is the end of the range read ahead.
+	ahead int64
+
+	// seq is the number of consecutive sequential reads.
+	seq int
+
+	// eof is set once a read ahead has hit the end of the file.
+	eof bool
+
+	// gen is incremented when the file changes.
+	gen    uint64
+	blocks map[int64]*raBlock
+	closed bool
+}
+
+// raBlock is a block that is read ahead.
+type raBlock struct {
+	gen uint64
+
+	// done is closed once data and errno are set.
+	done  chan struct{}
+	data  []byte
+	errno syscall.Errno
+}
+
+// raBypassKey marks the context of reads issued by ReadAhead.
+type raBypassKey struct{}
+
+// Intercept is the Interceptor that reads ahead.
+func (ra *ReadAhead) Intercept(ctx context.Context, op *InterceptedOp, next func(ctx context.Context) syscall.Errno) syscall.Errno {
+	if ctx.Value(raBypassKey{}) != nil {
+		return next(ctx)
+	}
+	switch op.Name {
+	case "Read":
+		return ra.read(ctx, op, next)
+	case "Release":
+		fh, _ := op.Args[0].(FileHandle)
+		ra.release(raKey{op.Node, fh})
+	case "Write", "Allocate":
+		defer ra.invalidate(op.Node)
+	case "Setattr":
+		if _, ok := op.Args[1].(*fuse.SetAttrIn).GetSize(); ok {
+			defer ra.invalidate(op.Node)
+		}
+	case "CopyFileRange":
+		defer ra.invalidate(op.Args[2].(*Inode))
+	}
+	return next(ctx)
+}
+
+func (ra *ReadAhead) read(ctx context.Context, op *InterceptedOp, next func(ctx context.Context) syscall.Errno) syscall.Errno {
+	fh, _ := op.Args[0].(FileHandle)
+	dest := op.Args[1].([]byte)
+	off := op.Args[2].(int64)
+	if fh != nil && !reflect.TypeOf(fh).Comparable() {
+		return next(ctx)
+	}
+	handler, ok := op.Handler.(NodeReader)
+	if !ok {
+		return next(ctx)
+	}
+
+	key := raKey{op.Node, fh}
+	ra.mu.Lock()
+	s := ra.streams[key]
+	if s == nil {
+		s = &raStream{
+			ra:      ra,
+			key:     key,
+			handler: handler,
+			blocks:  map[int64]*raBlock{},
+		}
+		ra.streams[key] = s
+	}
+	ra.mu.Unlock()
+
+	if data, ok := s.read(off, len(dest)); ok {
+		op.Results = []interface{}{fuse.ReadResultData(data)}
+		return OK
+	}
+	return next(ctx)
+}
+
+// read registers a read of `size` bytes at `off`, and returns the
+// data if it was read ahead.
+func (s *raStream) read(off int64, size int) ([]byte, bool) {
+	bs := int64(s.ra.opts.BlockSize)
+	end := off + int64(size)
+
+	s.mu.Lock()
+	// Reads may skip over blocks that were stored in the page
+	// cache.
+	if off == s.next || (off > s.next && off <= s.ahead) {
+		s.seq++
+	} else {
+		s.seq = 0
+		s.dropBlocks(func(int64) bool { return true })
+		s.ahead = 0
+		s.eof = false
+	}
+	s.next = end
+
+	// Blocks before the read are no longer needed.
+	s.dropBlocks(func(idx int64) bool { return (idx+1)*bs <= off })
+
+	var blocks []*raBlock
+	for idx := off / bs; idx*bs < end; idx++ {
+		b := s.blocks[idx]
+		if b == nil {
+			blocks = nil
+			break
+		}
+		blocks = append(blocks, b)
+	}
+	if s.seq >= s.ra.opts.Threshold {
+		s.schedule(end)
+	}
+	gen := s.gen
+	s.mu.Unlock()
+
+	if blocks == nil {
+		return nil, false
+	}
+	data := make([]byte, 0, size)
+	pos := off
+	for _, b := range blocks {
+		<-b.done
+		if b.errno != 0 || b.gen != gen {
+			return nil, false
+		}
+		start := pos - (pos/bs)*bs
+		if start >= int64(len(b.data)) {
+			// End of file.
+			break
+		}
+		chunk := b.data[start:]
+		if rest := end - pos; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		data = append(data, chunk...)
+		pos += int64(len(chunk))
+		if len(b.data) < int(bs) {
+			break
+		}
+	}
+	return data, true
+}
+
+// schedule starts reading ahead the blocks after `end`. Must hold
+// s.mu.
+func (s *raStream) schedule(end int64) {
+	if s.closed {
+		return
+	}
+	bs := int64(s.ra.opts.BlockSize)
+	first := end / bs
+	for idx := first; idx < first+int64(s.ra.opts.Blocks) && !s.eof; idx++ {
+		if s.blocks[idx] != nil {
+			continue
+		}
+		if !s.ra.reserve(bs) {
+			break
+		}
+		b := &raBlock{gen: s.gen, done: make(chan struct{})}
+		s.blocks[idx] = b
+		if blockEnd := (idx + 1) * bs; blockEnd > s.ahead {
+			s.ahead = blockEnd
+		}
+		s.wg.Add(1)
+		go s.fetch(b, idx*bs)
+	}
+}
+
+// fetch reads the block `b` at `off`.
+func (s *raStream) fetch(b *raBlock, off int64) {
+	defer s.wg.Done()
+	buf := make([]byte, s.ra.opts.BlockSize)
+	ctx := context.WithValue(context.Background(), raBypassKey{}, true)
+	res, errno := s.handler.Read(ctx, s.key.fh, buf, off)
+	if errno == 0 {
+		data, status := res.Bytes(buf)
+		if !status.Ok() {
+			errno = syscall.Errno(status)
+		}
+		b.data = append([]byte{}, data...)
+		res.Done()
+	}
+	b.errno = errno
+
+	s.mu.Lock()
+	current := b.gen == s.gen
+	if errno != 0 || len(b.data) < len(buf) {
+		s.eof = current
+	}
+	s.mu.Unlock()
+	close(b.done)
+
+	if current && errno == 0 && len(b.data) > 0 && s.ra.opts.WriteCache {
+		// Not tracked by wg: storing in the cache may wait for
+		// pages that the kernel is reading from us.
+		go s.key.node.WriteCache(off, b.data)
+	}
+}
+
+// dropBlocks drops the blocks for which `drop` returns true. Must
+// hold s.mu.
+func (s *raStream) dropBlocks(drop func(idx int64) bool) {
+	for idx := range s.blocks {
+		if drop(idx) {
+			delete(s.blocks, idx)
+			s.ra.unreserve(int64(s.ra.opts.BlockSize))
+		}
+	}
+}
+
+func (ra *ReadAhead) reserve(n int64) bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.used+n > ra.opts.MaxBytes {
+		return false
+	}
+	ra.used += n
+	return true
+}
+
+func (ra *ReadAhead) unreserve(n int64) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.used -= n
+}
+
+// release forgets the handle, once the reads ahead for it have
+// completed.
+func (ra *ReadAhead) release(key raKey) {
+	ra.mu.Lock()
+	s := ra.streams[key]
+	delete(ra.streams, key)
+	ra.mu.Unlock()
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.closed = true
+	s.dropBlocks(func(int64) bool { return true })
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// invalidate drops the blocks read ahead for `node`.
+func (ra *ReadAhead) invalidate(node *Inode) {
+	ra.mu.Lock()
+	var streams []*raStream
+	for k, s := range ra.streams {
+		if k.node == node {
+			streams = append(streams, s)
+		}
+	}
+	ra.mu.Unlock()
+
+	for _, s := range streams {
+		s.mu.Lock()
+		s.gen++
+		s.dropBlocks(func(int64) bool { return true })
+		s.ahead = 0
+		s.eof = false
+		s.mu.Unlock()
+	}
+}
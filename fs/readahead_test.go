@@ -0,0 +1,246 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/posixtest"
+)
+
+// directIO is an Interceptor that opens files with FOPEN_DIRECT_IO,
+// so the reads of the test reach the file system as they are issued.
+func directIO(ctx context.Context, op *InterceptedOp, next func(context.Context) syscall.Errno) syscall.Errno {
+	errno := next(ctx)
+	if errno != 0 {
+		return errno
+	}
+	switch op.Name {
+	case "Open":
+		op.Results[1] = op.Results[1].(uint32) | fuse.FOPEN_DIRECT_IO
+	case "Create":
+		op.Results[2] = op.Results[2].(uint32) | fuse.FOPEN_DIRECT_IO
+	}
+	return errno
+}
+
+// backendReads records the reads that reach the backend.
+type backendReads struct {
+	mu sync.Mutex
+
+	// ahead holds the offsets of the reads issued by ReadAhead.
+	ahead []int64
+
+	// passed holds the offsets of the reads passed on to the
+	// backend.
+	passed []int64
+}
+
+func (r *backendReads) intercept(ctx context.Context, op *InterceptedOp, next func(context.Context) syscall.Errno) syscall.Errno {
+	if op.Name == "Read" {
+		r.mu.Lock()
+		if ctx.Value(raBypassKey{}) != nil {
+			r.ahead = append(r.ahead, op.Args[2].(int64))
+		} else {
+			r.passed = append(r.passed, op.Args[2].(int64))
+		}
+		r.mu.Unlock()
+	}
+	return next(ctx)
+}
+
+// counts returns how often each offset was read ahead, and the
+// number of reads before `size` that were passed on.
+func (r *backendReads) counts(size int64) (ahead map[int64]int, passed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ahead = map[int64]int{}
+	for _, off := range r.ahead {
+		ahead[off]++
+	}
+	for _, off := range r.passed {
+		if off < size {
+			passed++
+		}
+	}
+	return ahead, passed
+}
+
+type readAheadTestCase struct {
+	*testing.T
+	mnt string
+
+	// outer sees the reads of the test, inner the reads of the
+	// backend.
+	outer opRecorder
+	inner backendReads
+}
+
+func newReadAheadTestCase(t *testing.T, opts *ReadAheadOptions) (*readAheadTestCase, func()) {
+	tc := &readAheadTestCase{T: t}
+	ra := NewReadAhead(opts)
+	mnt, _, clean := testMount(t, NewMemFS(nil), &Options{
+		Interceptors: []Interceptor{directIO, tc.outer.intercept, ra.Intercept, tc.inner.intercept},
+	})
+	tc.mnt = mnt
+	return tc, clean
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+// readAll reads `f` sequentially in pieces of `size` bytes.
+func readAll(t *testing.T, f *os.File, size int) []byte {
+	var got []byte
+	buf := make([]byte, size)
+	for {
+		n, err := f.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			return got
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadAheadSequential(t *testing.T) {
+	tc, clean := newReadAheadTestCase(t, &ReadAheadOptions{BlockSize: 64 << 10})
+	defer clean()
+
+	want := randomBytes(1<<20 + 1000)
+	if err := ioutil.WriteFile(tc.mnt+"/file", want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(tc.mnt + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got := readAll(t, f, 16<<10)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("content mismatch: got %d bytes, want %d", len(got), len(want))
+	}
+
+	// The backend sees the reads before reading ahead starts,
+	// and then a read per block. Whether blocks past the end of
+	// the file are read ahead, and so whether the read at the end
+	// of the file is passed on, depends on timing.
+	ahead, passed := tc.inner.counts(int64(len(want)))
+	if passed > 2 {
+		t.Errorf("got %d reads passed to the backend, want at most 2", passed)
+	}
+	for off, n := range ahead {
+		if off%(64<<10) != 0 || n > 1 {
+			t.Errorf("read ahead at %d %d times, want once at a block boundary", off, n)
+		}
+	}
+	for off := int64(64 << 10); off < int64(len(want)); off += 64 << 10 {
+		if ahead[off] == 0 {
+			t.Errorf("block at %d was not read ahead", off)
+		}
+	}
+	if outer := tc.outer.count("Read"); outer <= passed+len(ahead) {
+		t.Errorf("got %d reads and %d backend reads, want fewer backend reads", outer, passed+len(ahead))
+	}
+}
+
+func TestReadAheadRandom(t *testing.T) {
+	tc, clean := newReadAheadTestCase(t, &ReadAheadOptions{BlockSize: 64 << 10})
+	defer clean()
+
+	want := randomBytes(1 << 20)
+	if err := ioutil.WriteFile(tc.mnt+"/file", want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(tc.mnt + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	rnd := rand.New(rand.NewSource(1))
+	buf := make([]byte, 4096)
+	for i := 0; i < 50; i++ {
+		off := rnd.Intn(len(want) - len(buf))
+		if _, err := f.ReadAt(buf, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, want[off:off+len(buf)]) {
+			t.Fatalf("ReadAt(%d) mismatch", off)
+		}
+	}
+	if ahead, passed := tc.inner.counts(int64(len(want))); len(ahead) > 0 || passed != tc.outer.count("Read") {
+		t.Errorf("got %d reads ahead, want none", len(ahead))
+	}
+}
+
+func TestReadAheadInvalidate(t *testing.T) {
+	tc, clean := newReadAheadTestCase(t, &ReadAheadOptions{BlockSize: 64 << 10})
+	defer clean()
+
+	want := randomBytes(1 << 20)
+	if err := ioutil.WriteFile(tc.mnt+"/file", want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(tc.mnt + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 16<<10)
+	for i := 0; i < 8; i++ {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Overwrite data that has been read ahead through another
+	// handle.
+	w, err := os.OpenFile(tc.mnt+"/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := bytes.Repeat([]byte{'x'}, 100000)
+	if _, err := w.WriteAt(patch, 200000); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[200000:], patch)
+
+	got := append(make([]byte, 8*len(buf)), readAll(t, f, len(buf))...)
+	if !bytes.Equal(got[8*len(buf):], want[8*len(buf):]) {
+		t.Errorf("read stale data after write")
+	}
+}
+
+func TestReadAheadPosix(t *testing.T) {
+	for nm, fn := range posixtest.All {
+		t.Run(nm, func(t *testing.T) {
+			ra := NewReadAhead(&ReadAheadOptions{BlockSize: 4096, WriteCache: true})
+			mnt, _, clean := testMount(t, NewMemFS(nil), &Options{
+				Interceptors: []Interceptor{ra.Intercept},
+			})
+			defer clean()
+
+			fn(t, mnt)
+		})
+	}
+}
@@ -61,6 +61,7 @@ type testOptions struct {
 	suppressDebug bool
 	testDir       string
 	ro            bool
+	loopbackOpts  *LoopbackOptions
 }
 
 // newTestCase creates the directories `orig` and `mnt` inside a temporary
@@ -86,7 +87,7 @@ func newTestCase(t *testing.T, opts *testOptions) *testCase {
 	}
 
 	var err error
-	tc.loopback, err = NewLoopbackRoot(tc.origDir)
+	tc.loopback, err = NewLoopbackRootWithOptions(tc.origDir, opts.loopbackOpts)
 	if err != nil {
 		t.Fatalf("NewLoopback: %v", err)
 	}
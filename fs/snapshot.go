@@ -0,0 +1,517 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// NodeSerializer saves and restores InodeEmbedders of a specific
+// type for SaveTree and LoadTree. The tree structure, StableAttr,
+// attributes and extended attributes are saved by SaveTree itself,
+// so the serializer only has to handle the remaining state, such as
+// file content.
+type NodeSerializer interface {
+	// Save returns the state of `node`.
+	Save(ctx context.Context, node InodeEmbedder) ([]byte, error)
+
+	// Load creates a node from data returned by Save. The node
+	// will be added below `parent`. The `attr` argument holds the
+	// result of Getattr at the time of saving.
+	Load(ctx context.Context, parent *Inode, data []byte, attr *fuse.Attr) (InodeEmbedder, error)
+}
+
+var serializers = struct {
+	mu     sync.Mutex
+	byName map[string]NodeSerializer
+	byType map[reflect.Type]string
+}{
+	byName: map[string]NodeSerializer{},
+	byType: map[reflect.Type]string{},
+}
+
+// RegisterNodeSerializer registers a serializer for the type of
+// `node` under the given name. The name is stored in the snapshot, so
+// it should not change between saving and loading.
+func RegisterNodeSerializer(name string, node InodeEmbedder, s NodeSerializer) {
+	serializers.mu.Lock()
+	defer serializers.mu.Unlock()
+	serializers.byName[name] = s
+	serializers.byType[reflect.TypeOf(node)] = name
+}
+
+func serializerFor(node InodeEmbedder) (string, NodeSerializer) {
+	serializers.mu.Lock()
+	defer serializers.mu.Unlock()
+	name, ok := serializers.byType[reflect.TypeOf(node)]
+	if !ok {
+		return "", nil
+	}
+	return name, serializers.byName[name]
+}
+
+const treeMagic = "go-fuse tree snapshot"
+
+type treeHeader struct {
+	Magic   string
+	Version int
+}
+
+// treeRecord describes one directory entry of a saved tree. Records
+// are written in depth-first order, so parents precede their children.
+type treeRecord struct {
+	// Parent is the index of the record for the parent directory,
+	// or -1 for the root.
+	Parent int
+	Name   string
+
+	// Link is the index of an earlier record for the same Inode
+	// if this is a hard link, or -1. For hard links, no other
+	// fields are set.
+	Link int
+
+	Stable StableAttr
+	Attr   fuse.Attr
+	Xattrs map[string][]byte
+
+	// Type is the name of the NodeSerializer, or empty for plain
+	// Inodes.
+	Type string
+	Data []byte
+}
+
+// SaveTree writes the tree of Inodes below root to w. For each node,
+// it saves the tree structure, the StableAttr, the result of Getattr
+// and the extended attributes. Additional state is saved through a
+// NodeSerializer registered for the node's type. Nodes of plain Inode
+// type need no serializer, and serializers for MemRegularFile,
+// MemSymlink and the nodes of NewMemFS are predefined. SaveTree fails if it finds a node of
+// another type.
+//
+// SaveTree only saves the Inodes that are currently in the tree, so
+// it is meant for trees of persistent Inodes.
+func SaveTree(ctx context.Context, w io.Writer, root *Inode) error {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(&treeHeader{Magic: treeMagic, Version: 1}); err != nil {
+		return err
+	}
+
+	seen := map[*Inode]int{}
+	next := 0
+	var walk func(parent int, name string, n *Inode) error
+	walk = func(parent int, name string, n *Inode) error {
+		idx := next
+		next++
+		rec := treeRecord{Parent: parent, Name: name, Link: -1}
+		if first, ok := seen[n]; ok {
+			rec.Link = first
+			return enc.Encode(&rec)
+		}
+		seen[n] = idx
+
+		if err := saveNode(ctx, n, &rec); err != nil {
+			return fmt.Errorf("%q: %v", n.Path(root), err)
+		}
+		if err := enc.Encode(&rec); err != nil {
+			return err
+		}
+
+		children := n.Children()
+		names := make([]string, 0, len(children))
+		for k := range children {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			if err := walk(idx, k, children[k]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return walk(-1, "", root)
+}
+
+// saveNode fills in the data for n in `rec`.
+func saveNode(ctx context.Context, n *Inode, rec *treeRecord) error {
+	rec.Stable = n.StableAttr()
+	rec.Attr.Mode = rec.Stable.Mode
+	ops := n.Operations()
+	if ga, ok := ops.(NodeGetattrer); ok {
+		var out fuse.AttrOut
+		if errno := ga.Getattr(ctx, nil, &out); errno != 0 {
+			return errno
+		}
+		rec.Attr = out.Attr
+	}
+
+	xattrs, errno := saveXattrs(ctx, ops)
+	if errno != 0 {
+		return errno
+	}
+	rec.Xattrs = xattrs
+
+	switch node := ops.(type) {
+	case *Inode, *staticNode:
+		return nil
+	default:
+		name, s := serializerFor(node)
+		if s == nil {
+			return fmt.Errorf("no NodeSerializer for type %T", node)
+		}
+		data, err := s.Save(ctx, node)
+		if err != nil {
+			return err
+		}
+		rec.Type = name
+		rec.Data = data
+	}
+	return nil
+}
+
+// getBuffer calls `get` with increasingly large buffers until the
+// result fits.
+func getBuffer(get func(dest []byte) (uint32, syscall.Errno)) ([]byte, syscall.Errno) {
+	for sz := 1024; ; sz *= 2 {
+		buf := make([]byte, sz)
+		n, errno := get(buf)
+		if errno == syscall.ERANGE && sz < 1<<20 {
+			continue
+		}
+		if errno != 0 {
+			return nil, errno
+		}
+		return buf[:n], OK
+	}
+}
+
+func saveXattrs(ctx context.Context, ops InodeEmbedder) (map[string][]byte, syscall.Errno) {
+	lx, ok := ops.(NodeListxattrer)
+	if !ok {
+		return nil, OK
+	}
+	gx, ok := ops.(NodeGetxattrer)
+	if !ok {
+		return nil, OK
+	}
+	list, errno := getBuffer(func(dest []byte) (uint32, syscall.Errno) {
+		return lx.Listxattr(ctx, dest)
+	})
+	if errno != 0 {
+		return nil, errno
+	}
+
+	var result map[string][]byte
+	for _, attr := range bytes.Split(list, []byte{0}) {
+		if len(attr) == 0 {
+			continue
+		}
+		val, errno := getBuffer(func(dest []byte) (uint32, syscall.Errno) {
+			return gx.Getxattr(ctx, string(attr), dest)
+		})
+		if errno == ENOATTR {
+			continue
+		} else if errno != 0 {
+			return nil, errno
+		}
+		if result == nil {
+			result = map[string][]byte{}
+		}
+		result[string(attr)] = val
+	}
+	return result, OK
+}
+
+// LoadTree reads a tree written by SaveTree, and adds the saved
+// children of the root below `parent`. The parent must already be
+// part of a tree, so LoadTree is typically called from the OnAdd
+// method of the root. All nodes are added as persistent Inodes, with
+// the saved StableAttr. If `parent` implements NodeSetattrer, the
+// mode, owner and times of the saved root are restored on it, and
+// likewise its extended attributes if it implements NodeSetxattrer.
+//
+// Plain Inodes are restored as read-only nodes that return the saved
+// attributes and extended attributes. Other types are restored
+// through their NodeSerializer; their extended attributes are
+// restored if the node implements NodeSetxattrer.
+func LoadTree(ctx context.Context, r io.Reader, parent *Inode) error {
+	dec := gob.NewDecoder(r)
+	var hdr treeHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return err
+	}
+	if hdr.Magic != treeMagic || hdr.Version != 1 {
+		return fmt.Errorf("LoadTree: unknown format %q version %d", hdr.Magic, hdr.Version)
+	}
+
+	var nodes []*Inode
+	for {
+		var rec treeRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		idx := len(nodes)
+		if rec.Parent < 0 {
+			if idx != 0 {
+				return fmt.Errorf("LoadTree: record %d has no parent", idx)
+			}
+			if err := loadRoot(ctx, parent, &rec); err != nil {
+				return fmt.Errorf("LoadTree: root: %v", err)
+			}
+			nodes = append(nodes, parent)
+			continue
+		}
+		if rec.Parent >= idx || rec.Link >= idx {
+			return fmt.Errorf("LoadTree: record %d refers to a later record", idx)
+		}
+		dir := nodes[rec.Parent]
+
+		var ch *Inode
+		if rec.Link >= 0 {
+			ch = nodes[rec.Link]
+		} else {
+			var err error
+			ch, err = loadNode(ctx, dir, &rec)
+			if err != nil {
+				return fmt.Errorf("LoadTree %q: %v", rec.Name, err)
+			}
+		}
+		dir.AddChild(rec.Name, ch, true)
+		nodes = append(nodes, ch)
+	}
+	return nil
+}
+
+// loadRoot restores the attributes of the saved root on `root`.
+func loadRoot(ctx context.Context, root *Inode, rec *treeRecord) error {
+	ops := root.Operations()
+	if sa, ok := ops.(NodeSetattrer); ok {
+		in := fuse.SetAttrIn{
+			SetAttrInCommon: fuse.SetAttrInCommon{
+				Valid: fuse.FATTR_MODE | fuse.FATTR_UID | fuse.FATTR_GID |
+					fuse.FATTR_ATIME | fuse.FATTR_MTIME,
+				Mode:      rec.Attr.Mode & 07777,
+				Owner:     rec.Attr.Owner,
+				Atime:     rec.Attr.Atime,
+				Atimensec: rec.Attr.Atimensec,
+				Mtime:     rec.Attr.Mtime,
+				Mtimensec: rec.Attr.Mtimensec,
+			},
+		}
+		var out fuse.AttrOut
+		if errno := sa.Setattr(ctx, nil, &in, &out); errno != 0 {
+			return errno
+		}
+	}
+	return loadXattrs(ctx, ops, rec.Xattrs)
+}
+
+// loadXattrs sets the extended attributes `xattrs` on `ops`, if it
+// implements NodeSetxattrer.
+func loadXattrs(ctx context.Context, ops InodeEmbedder, xattrs map[string][]byte) error {
+	sx, ok := ops.(NodeSetxattrer)
+	if !ok {
+		return nil
+	}
+	for k, v := range xattrs {
+		if errno := sx.Setxattr(ctx, k, v, 0); errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
+
+func loadNode(ctx context.Context, dir *Inode, rec *treeRecord) (*Inode, error) {
+	var node InodeEmbedder
+	if rec.Type == "" {
+		node = &staticNode{attr: rec.Attr, xattrs: rec.Xattrs}
+	} else {
+		serializers.mu.Lock()
+		s := serializers.byName[rec.Type]
+		serializers.mu.Unlock()
+		if s == nil {
+			return nil, fmt.Errorf("no NodeSerializer registered for %q", rec.Type)
+		}
+
+		var err error
+		node, err = s.Load(ctx, dir, rec.Data, &rec.Attr)
+		if err != nil {
+			return nil, err
+		}
+		if err := loadXattrs(ctx, node, rec.Xattrs); err != nil {
+			return nil, err
+		}
+	}
+
+	dir.bridge.reserveIno(rec.Stable.Ino)
+	return dir.NewPersistentInode(ctx, node, rec.Stable), nil
+}
+
+// staticNode is a read-only node with fixed attributes. LoadTree uses
+// it for restoring plain Inodes.
+type staticNode struct {
+	Inode
+	attr   fuse.Attr
+	xattrs map[string][]byte
+}
+
+var _ = (NodeGetattrer)((*staticNode)(nil))
+var _ = (NodeGetxattrer)((*staticNode)(nil))
+var _ = (NodeListxattrer)((*staticNode)(nil))
+
+func (n *staticNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Attr = n.attr
+	return OK
+}
+
+func (n *staticNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	val, ok := n.xattrs[attr]
+	if !ok {
+		return 0, ENOATTR
+	}
+	if len(dest) < len(val) {
+		return uint32(len(val)), syscall.ERANGE
+	}
+	return uint32(copy(dest, val)), OK
+}
+
+func (n *staticNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	var names []string
+	for k := range n.xattrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var buf []byte
+	for _, k := range names {
+		buf = append(buf, k...)
+		buf = append(buf, 0)
+	}
+	if len(dest) < len(buf) {
+		return uint32(len(buf)), syscall.ERANGE
+	}
+	return uint32(copy(dest, buf)), OK
+}
+
+// sparseState is the serialized form of sparseData.
+type sparseState struct {
+	Size   int64
+	Chunks map[int64][]byte
+}
+
+func encodeState(st interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(st)
+	return buf.Bytes(), err
+}
+
+func decodeState(data []byte, st interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(st)
+}
+
+// memRegularFileState is the serialized form of a MemRegularFile.
+type memRegularFileState struct {
+	// Data is the content, unless Sparse is set.
+	Data    []byte
+	Sparse  bool
+	Content sparseState
+}
+
+type memRegularFileSerializer struct{}
+
+func (memRegularFileSerializer) Save(ctx context.Context, node InodeEmbedder) ([]byte, error) {
+	f := node.(*MemRegularFile)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return encodeState(&memRegularFileState{
+		Data:    f.Data,
+		Sparse:  f.sparse,
+		Content: sparseState{Size: f.content.size, Chunks: f.content.chunks},
+	})
+}
+
+func (memRegularFileSerializer) Load(ctx context.Context, parent *Inode, data []byte, attr *fuse.Attr) (InodeEmbedder, error) {
+	var st memRegularFileState
+	if err := decodeState(data, &st); err != nil {
+		return nil, err
+	}
+	f := &MemRegularFile{Attr: *attr, Data: st.Data, sparse: st.Sparse}
+	f.content.size = st.Content.Size
+	f.content.chunks = st.Content.Chunks
+	return f, nil
+}
+
+type memSymlinkSerializer struct{}
+
+func (memSymlinkSerializer) Save(ctx context.Context, node InodeEmbedder) ([]byte, error) {
+	return node.(*MemSymlink).Data, nil
+}
+
+func (memSymlinkSerializer) Load(ctx context.Context, parent *Inode, data []byte, attr *fuse.Attr) (InodeEmbedder, error) {
+	return &MemSymlink{Data: data, Attr: *attr}, nil
+}
+
+// memNodeState is the serialized form of a node of NewMemFS.
+type memNodeState struct {
+	Content sparseState
+	Target  []byte
+}
+
+type memNodeSerializer struct{}
+
+func (memNodeSerializer) Save(ctx context.Context, node InodeEmbedder) ([]byte, error) {
+	n := node.(*memNode)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return encodeState(&memNodeState{
+		Content: sparseState{Size: n.content.size, Chunks: n.content.chunks},
+		Target:  n.target,
+	})
+}
+
+// Load restores a node of NewMemFS. It must be loaded below another
+// node of the same file system, whose usage limits it counts against.
+func (memNodeSerializer) Load(ctx context.Context, parent *Inode, data []byte, attr *fuse.Attr) (InodeEmbedder, error) {
+	dir, ok := parent.Operations().(*memNode)
+	if !ok {
+		return nil, fmt.Errorf("parent %T is not part of a memory file system", parent.Operations())
+	}
+	var st memNodeState
+	if err := decodeState(data, &st); err != nil {
+		return nil, err
+	}
+
+	n := &memNode{fs: dir.fs, attr: *attr, target: st.Target}
+	n.content.size = st.Content.Size
+	n.content.chunks = st.Content.Chunks
+	if !n.fs.allocInode() {
+		return nil, syscall.ENOSPC
+	}
+	if errno := n.reserve(n.content.allocated()); errno != 0 {
+		n.fs.freeInode()
+		return nil, errno
+	}
+	return n, nil
+}
+
+func init() {
+	RegisterNodeSerializer("MemRegularFile", &MemRegularFile{}, memRegularFileSerializer{})
+	RegisterNodeSerializer("MemSymlink", &MemSymlink{}, memSymlinkSerializer{})
+	RegisterNodeSerializer("memNode", &memNode{}, memNodeSerializer{})
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestSaveLoadTree(t *testing.T) {
+	ctx := context.Background()
+	root := &Inode{}
+	var file *Inode
+	NewNodeFS(root, &Options{
+		FirstAutomaticIno: 1,
+		OnAdd: func(ctx context.Context) {
+			dir := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+			root.AddChild("dir", dir, false)
+
+			f := &MemRegularFile{Attr: fuse.Attr{Mode: 0640}}
+			file = dir.NewPersistentInode(ctx, f, StableAttr{Ino: 42})
+			dir.AddChild("file", file, false)
+			f.Write(ctx, nil, []byte("hello"), 1<<30)
+
+			root.AddChild("link", file, false)
+			root.AddChild("symlink", root.NewPersistentInode(ctx,
+				&MemSymlink{Data: []byte("dir/file")}, StableAttr{Mode: syscall.S_IFLNK}), false)
+		},
+	})
+
+	var buf bytes.Buffer
+	if err := SaveTree(ctx, &buf, root); err != nil {
+		t.Fatalf("SaveTree: %v", err)
+	}
+
+	loaded := &Inode{}
+	var loadErr error
+	NewNodeFS(loaded, &Options{
+		FirstAutomaticIno: 1,
+		OnAdd: func(ctx context.Context) {
+			loadErr = LoadTree(ctx, &buf, loaded)
+		},
+	})
+	if loadErr != nil {
+		t.Fatalf("LoadTree: %v", loadErr)
+	}
+
+	dir := loaded.GetChild("dir")
+	if dir == nil || dir.Mode() != syscall.S_IFDIR {
+		t.Fatalf("dir: got %v", dir)
+	}
+	ch := dir.GetChild("file")
+	if ch == nil {
+		t.Fatalf("dir/file missing")
+	}
+	if ch.StableAttr() != file.StableAttr() {
+		t.Errorf("got StableAttr %v, want %v", ch.StableAttr(), file.StableAttr())
+	}
+	if link := loaded.GetChild("link"); link != ch {
+		t.Errorf("hard link not preserved")
+	}
+
+	f := ch.Operations().(*MemRegularFile)
+	var out fuse.AttrOut
+	f.Getattr(ctx, nil, &out)
+	if out.Size != 1<<30+5 || out.Mode != 0640 {
+		t.Errorf("got attr %v", &out.Attr)
+	}
+	dest := make([]byte, 5)
+	res, _ := f.Read(ctx, nil, dest, 1<<30)
+	if got, _ := res.Bytes(nil); string(got) != "hello" {
+		t.Errorf("got content %q", got)
+	}
+
+	sl := loaded.GetChild("symlink").Operations().(*MemSymlink)
+	if string(sl.Data) != "dir/file" {
+		t.Errorf("got symlink %q", sl.Data)
+	}
+
+	// New automatic inode numbers should not collide with loaded ones.
+	if n := loaded.NewPersistentInode(ctx, &Inode{}, StableAttr{}); n.StableAttr().Ino <= 42 {
+		t.Errorf("got automatic ino %d, want > 42", n.StableAttr().Ino)
+	}
+}
+
+type unserializableNode struct {
+	Inode
+}
+
+func TestSaveTreeUnknownType(t *testing.T) {
+	root := &Inode{}
+	NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("x", root.NewPersistentInode(ctx, &unserializableNode{}, StableAttr{}), false)
+		},
+	})
+
+	var buf bytes.Buffer
+	if err := SaveTree(context.Background(), &buf, root); err == nil {
+		t.Errorf("SaveTree succeeded for unknown type")
+	}
+}
+
+func TestSaveLoadMemFS(t *testing.T) {
+	ctx := context.Background()
+	src := NewMemFS(nil)
+	mntDir, _, clean := testMount(t, src, nil)
+	if err := os.Mkdir(mntDir+"/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mntDir+"/dir/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", mntDir+"/symlink"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(mntDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err := SaveTree(ctx, &buf, src.EmbeddedInode())
+	clean()
+	if err != nil {
+		t.Fatalf("SaveTree: %v", err)
+	}
+
+	dst := NewMemFS(nil)
+	var loadErr error
+	mntDir, _, clean = testMount(t, dst, &Options{
+		FirstAutomaticIno: 1,
+		OnAdd: func(ctx context.Context) {
+			loadErr = LoadTree(ctx, &buf, dst.EmbeddedInode())
+		},
+	})
+	defer clean()
+	if loadErr != nil {
+		t.Fatalf("LoadTree: %v", loadErr)
+	}
+
+	if fi, err := os.Stat(mntDir); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("root: got %v, %v, want mode 0700", fi, err)
+	}
+	if got, err := ioutil.ReadFile(mntDir + "/dir/file"); err != nil || string(got) != "hello" {
+		t.Errorf("dir/file: got %q, %v", got, err)
+	}
+	if got, err := os.Readlink(mntDir + "/symlink"); err != nil || got != "dir/file" {
+		t.Errorf("symlink: got %q, %v", got, err)
+	}
+
+	// The loaded tree is writable.
+	if err := ioutil.WriteFile(mntDir+"/dir/new", []byte("new"), 0644); err != nil {
+		t.Errorf("WriteFile: %v", err)
+	}
+}
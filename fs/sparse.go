@@ -0,0 +1,241 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"syscall"
+)
+
+// sparseChunkSize is the allocation unit for sparseData. It matches
+// the block size reported to the kernel.
+const sparseChunkSize = 4096
+
+// sparseData holds file content as a set of fixed-size chunks. Chunks
+// that were never written, or that were punched out, take no memory
+// and read back as zeroes.
+type sparseData struct {
+	size   int64
+	chunks map[int64][]byte
+}
+
+// allocated returns the number of bytes used for storing chunks.
+func (d *sparseData) allocated() int64 {
+	return int64(len(d.chunks)) * sparseChunkSize
+}
+
+// blocks returns the allocated size in 512-byte blocks, as reported
+// in fuse.Attr.Blocks.
+func (d *sparseData) blocks() uint64 {
+	return uint64(d.allocated() / 512)
+}
+
+// unallocated returns how many bytes must be allocated to store
+// data in [off, off+sz).
+func (d *sparseData) unallocated(off, sz int64) int64 {
+	if sz <= 0 {
+		return 0
+	}
+	var n int64
+	for i := off / sparseChunkSize; i <= (off+sz-1)/sparseChunkSize; i++ {
+		if d.chunks[i] == nil {
+			n += sparseChunkSize
+		}
+	}
+	return n
+}
+
+// chunk returns chunk i, allocating it if necessary.
+func (d *sparseData) chunk(i int64) []byte {
+	c := d.chunks[i]
+	if c == nil {
+		if d.chunks == nil {
+			d.chunks = map[int64][]byte{}
+		}
+		c = make([]byte, sparseChunkSize)
+		d.chunks[i] = c
+	}
+	return c
+}
+
+// readAt copies data starting at `off` into dest, and returns the
+// number of bytes copied. Reads stop at the end of the file.
+func (d *sparseData) readAt(dest []byte, off int64) int {
+	if off >= d.size {
+		return 0
+	}
+	if max := d.size - off; int64(len(dest)) > max {
+		dest = dest[:max]
+	}
+	for n := 0; n < len(dest); {
+		pos := off + int64(n)
+		i, o := pos/sparseChunkSize, pos%sparseChunkSize
+		m := len(dest) - n
+		if rem := int(sparseChunkSize - o); m > rem {
+			m = rem
+		}
+		if c := d.chunks[i]; c != nil {
+			copy(dest[n:n+m], c[o:])
+		} else {
+			zero := dest[n : n+m]
+			for j := range zero {
+				zero[j] = 0
+			}
+		}
+		n += m
+	}
+	return len(dest)
+}
+
+// writeAt stores data at `off`, extending the file if necessary.
+func (d *sparseData) writeAt(data []byte, off int64) {
+	for n := 0; n < len(data); {
+		pos := off + int64(n)
+		n += copy(d.chunk(pos / sparseChunkSize)[pos%sparseChunkSize:], data[n:])
+	}
+	if end := off + int64(len(data)); end > d.size {
+		d.size = end
+	}
+}
+
+// allocate makes sure [off, off+sz) is backed by memory. If keepSize
+// is not set, the file is extended to cover the range.
+func (d *sparseData) allocate(off, sz int64, keepSize bool) {
+	end := off + sz
+	if !keepSize && end > d.size {
+		d.size = end
+	}
+	if end > d.size {
+		end = d.size
+	}
+	for i := off / sparseChunkSize; i*sparseChunkSize < end; i++ {
+		d.chunk(i)
+	}
+}
+
+// truncate changes the size of the file.
+func (d *sparseData) truncate(sz int64) {
+	if sz < d.size {
+		end := (d.size + sparseChunkSize - 1) / sparseChunkSize * sparseChunkSize
+		d.punch(sz, end-sz)
+	}
+	d.size = sz
+}
+
+// punch zeroes [off, off+sz), and releases the chunks that are
+// entirely covered by the range. It does not change the size.
+func (d *sparseData) punch(off, sz int64) {
+	if sz <= 0 || len(d.chunks) == 0 {
+		return
+	}
+	end := off + sz
+	first, last := off/sparseChunkSize, (end-1)/sparseChunkSize
+
+	zeroChunk := func(i int64) {
+		start := i * sparseChunkSize
+		from, to := int64(0), int64(sparseChunkSize)
+		if off > start {
+			from = off - start
+		}
+		if end < start+sparseChunkSize {
+			to = end - start
+		}
+		if from == 0 && to == sparseChunkSize {
+			delete(d.chunks, i)
+			return
+		}
+		zero := d.chunks[i][from:to]
+		for j := range zero {
+			zero[j] = 0
+		}
+	}
+
+	if last-first+1 > int64(len(d.chunks)) {
+		for i := range d.chunks {
+			if i >= first && i <= last {
+				zeroChunk(i)
+			}
+		}
+	} else {
+		for i := first; i <= last; i++ {
+			if d.chunks[i] != nil {
+				zeroChunk(i)
+			}
+		}
+	}
+}
+
+// seek implements SEEK_DATA and SEEK_HOLE for lseek(2).
+func (d *sparseData) seek(off int64, whence uint32) (int64, syscall.Errno) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off >= d.size {
+		return 0, syscall.ENXIO
+	}
+
+	i := off / sparseChunkSize
+	switch whence {
+	case _SEEK_DATA:
+		if d.chunks[i] != nil {
+			return off, OK
+		}
+		next := int64(-1)
+		for k := range d.chunks {
+			if k > i && (next < 0 || k < next) {
+				next = k
+			}
+		}
+		if next < 0 || next*sparseChunkSize >= d.size {
+			return 0, syscall.ENXIO
+		}
+		return next * sparseChunkSize, OK
+	case _SEEK_HOLE:
+		for d.chunks[i] != nil {
+			i++
+		}
+		pos := i * sparseChunkSize
+		if pos < off {
+			pos = off
+		}
+		if pos > d.size {
+			pos = d.size
+		}
+		return pos, OK
+	}
+	return 0, syscall.EINVAL
+}
+
+// fallocate implements the modes of fallocate(2) that make sense
+// for memory storage. If `reserve` is given, it is called with the
+// number of bytes about to be allocated, and may veto the operation.
+func (d *sparseData) fallocate(off, sz int64, mode uint32, reserve func(int64) syscall.Errno) syscall.Errno {
+	keepSize := mode&_FALLOC_FL_KEEP_SIZE != 0
+	switch mode &^ _FALLOC_FL_KEEP_SIZE {
+	case 0:
+		end := off + sz
+		if keepSize && end > d.size {
+			end = d.size
+		}
+		if reserve != nil {
+			if errno := reserve(d.unallocated(off, end-off)); errno != 0 {
+				return errno
+			}
+		}
+		d.allocate(off, sz, keepSize)
+	case _FALLOC_FL_PUNCH_HOLE:
+		if !keepSize {
+			return syscall.EOPNOTSUPP
+		}
+		d.punch(off, sz)
+	case _FALLOC_FL_ZERO_RANGE:
+		d.punch(off, sz)
+		if end := off + sz; !keepSize && end > d.size {
+			d.size = end
+		}
+	default:
+		return syscall.EOPNOTSUPP
+	}
+	return OK
+}
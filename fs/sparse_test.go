@@ -0,0 +1,112 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+)
+
+func TestSparseDataReadWrite(t *testing.T) {
+	var d sparseData
+	d.writeAt([]byte("hello"), 3*sparseChunkSize-2)
+
+	if d.size != 3*sparseChunkSize+3 {
+		t.Errorf("got size %d", d.size)
+	}
+	if got := len(d.chunks); got != 2 {
+		t.Errorf("got %d chunks, want 2", got)
+	}
+
+	buf := make([]byte, 10)
+	n := d.readAt(buf, 3*sparseChunkSize-5)
+	if want := []byte("\x00\x00\x00hello"); !bytes.Equal(buf[:n], want) {
+		t.Errorf("readAt: got %q, want %q", buf[:n], want)
+	}
+
+	if n := d.readAt(buf, d.size); n != 0 {
+		t.Errorf("readAt EOF: got %d bytes", n)
+	}
+}
+
+func TestSparseDataPunchTruncate(t *testing.T) {
+	var d sparseData
+	d.writeAt(bytes.Repeat([]byte{'x'}, 4*sparseChunkSize), 0)
+
+	d.punch(sparseChunkSize/2, 2*sparseChunkSize)
+	if got := len(d.chunks); got != 3 {
+		t.Errorf("after punch: got %d chunks, want 3", got)
+	}
+	buf := make([]byte, 4*sparseChunkSize)
+	d.readAt(buf, 0)
+	if want := bytes.Repeat([]byte{0}, 2*sparseChunkSize); !bytes.Equal(buf[sparseChunkSize/2:5*sparseChunkSize/2], want) {
+		t.Errorf("punched range not zero")
+	}
+	if buf[sparseChunkSize/2-1] != 'x' || buf[5*sparseChunkSize/2] != 'x' {
+		t.Errorf("punch cleared too much")
+	}
+
+	d.truncate(sparseChunkSize + 1)
+	if got := len(d.chunks); got != 1 {
+		t.Errorf("after truncate: got %d chunks, want 1", got)
+	}
+	d.truncate(2 * sparseChunkSize)
+	if n := d.readAt(buf, sparseChunkSize); n != sparseChunkSize || buf[0] != 0 {
+		t.Errorf("truncate did not zero the tail: %d %q", n, buf[:1])
+	}
+}
+
+func TestSparseDataSeek(t *testing.T) {
+	var d sparseData
+	d.writeAt([]byte("data"), 10*sparseChunkSize)
+	d.truncate(20 * sparseChunkSize)
+
+	for _, tc := range []struct {
+		off    int64
+		whence uint32
+		want   int64
+		errno  syscall.Errno
+	}{
+		{0, _SEEK_DATA, 10 * sparseChunkSize, 0},
+		{0, _SEEK_HOLE, 0, 0},
+		{10*sparseChunkSize + 1, _SEEK_DATA, 10*sparseChunkSize + 1, 0},
+		{10 * sparseChunkSize, _SEEK_HOLE, 11 * sparseChunkSize, 0},
+		{11 * sparseChunkSize, _SEEK_DATA, 0, syscall.ENXIO},
+		{20 * sparseChunkSize, _SEEK_HOLE, 0, syscall.ENXIO},
+	} {
+		got, errno := d.seek(tc.off, tc.whence)
+		if errno != tc.errno || got != tc.want {
+			t.Errorf("seek(%d, %d): got %d, %v, want %d, %v", tc.off, tc.whence, got, errno, tc.want, tc.errno)
+		}
+	}
+}
+
+func TestSparseDataFallocate(t *testing.T) {
+	var d sparseData
+	if errno := d.fallocate(0, 2*sparseChunkSize, 0, nil); errno != 0 {
+		t.Fatalf("fallocate: %v", errno)
+	}
+	if d.size != 2*sparseChunkSize || len(d.chunks) != 2 {
+		t.Errorf("fallocate: got size %d, %d chunks", d.size, len(d.chunks))
+	}
+
+	if errno := d.fallocate(0, sparseChunkSize, _FALLOC_FL_PUNCH_HOLE, nil); errno != syscall.EOPNOTSUPP {
+		t.Errorf("punch without KEEP_SIZE: got %v, want EOPNOTSUPP", errno)
+	}
+	if errno := d.fallocate(0, sparseChunkSize, _FALLOC_FL_PUNCH_HOLE|_FALLOC_FL_KEEP_SIZE, nil); errno != 0 {
+		t.Fatalf("punch: %v", errno)
+	}
+	if d.size != 2*sparseChunkSize || len(d.chunks) != 1 {
+		t.Errorf("punch: got size %d, %d chunks", d.size, len(d.chunks))
+	}
+
+	if errno := d.fallocate(sparseChunkSize, 2*sparseChunkSize, _FALLOC_FL_ZERO_RANGE, nil); errno != 0 {
+		t.Fatalf("zero range: %v", errno)
+	}
+	if d.size != 3*sparseChunkSize || len(d.chunks) != 0 {
+		t.Errorf("zero range: got size %d, %d chunks", d.size, len(d.chunks))
+	}
+}
@@ -7,6 +7,8 @@ package fs
 import (
 	"syscall"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 // futimens - futimens(3) calls utimensat(2) with "pathname" set to null and
@@ -18,3 +20,60 @@ func futimens(fd int, times *[2]syscall.Timespec) (err error) {
 	}
 	return
 }
+
+// fstatat is unix.Fstatat, but filling in a syscall.Stat_t, which has
+// the same layout.
+func fstatat(dirfd int, path string, st *syscall.Stat_t, flags int) error {
+	return unix.Fstatat(dirfd, path, (*unix.Stat_t)(unsafe.Pointer(st)), flags)
+}
+
+// nameToHandleAt returns the struct file_handle for the given file,
+// encoded as the raw bytes that openByHandleAt expects.
+func nameToHandleAt(dirfd int, path string, flags int) ([]byte, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8+_MAX_HANDLE_SZ)
+	*(*uint32)(unsafe.Pointer(&buf[0])) = _MAX_HANDLE_SZ
+
+	var mountID int32
+	_, _, e1 := syscall.Syscall6(unix.SYS_NAME_TO_HANDLE_AT, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&mountID)), uintptr(flags), 0)
+	if e1 != 0 {
+		return nil, syscall.Errno(e1)
+	}
+	sz := *(*uint32)(unsafe.Pointer(&buf[0]))
+	return buf[:8+sz], nil
+}
+
+// openByHandleAt opens a handle returned by nameToHandleAt. It
+// requires CAP_DAC_READ_SEARCH.
+func openByHandleAt(mountFd int, handle []byte, flags int) (int, error) {
+	r, _, e1 := syscall.Syscall(unix.SYS_OPEN_BY_HANDLE_AT, uintptr(mountFd),
+		uintptr(unsafe.Pointer(&handle[0])), uintptr(flags))
+	if e1 != 0 {
+		return -1, syscall.Errno(e1)
+	}
+	return int(r), nil
+}
+
+// setfsuid sets the file system uid of the current thread.
+// setfsuid(2) does not report errors, but returns the previous uid,
+// so we check that the change took effect by setting it again.
+func setfsuid(uid int) syscall.Errno {
+	syscall.RawSyscall(sysSetfsuid, uintptr(uid), 0, 0)
+	if prev, _, _ := syscall.RawSyscall(sysSetfsuid, uintptr(uid), 0, 0); int(prev) != uid {
+		return syscall.EPERM
+	}
+	return 0
+}
+
+// setfsgid is like setfsuid, but for the file system gid.
+func setfsgid(gid int) syscall.Errno {
+	syscall.RawSyscall(sysSetfsgid, uintptr(gid), 0, 0)
+	if prev, _, _ := syscall.RawSyscall(sysSetfsgid, uintptr(gid), 0, 0); int(prev) != gid {
+		return syscall.EPERM
+	}
+	return 0
+}
@@ -0,0 +1,15 @@
+//go:build !386 && !arm
+// +build !386,!arm
+
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import "golang.org/x/sys/unix"
+
+const (
+	sysSetfsuid = unix.SYS_SETFSUID
+	sysSetfsgid = unix.SYS_SETFSGID
+)
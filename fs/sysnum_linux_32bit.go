@@ -0,0 +1,16 @@
+//go:build (linux && 386) || (linux && arm)
+// +build linux,386 linux,arm
+
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import "golang.org/x/sys/unix"
+
+// On these architectures, the plain system calls take 16-bit IDs.
+const (
+	sysSetfsuid = unix.SYS_SETFSUID32
+	sysSetfsgid = unix.SYS_SETFSGID32
+)
@@ -280,4 +280,8 @@ type RawFileSystem interface {
 	// filesystem implementation can use the server argument to
 	// talk back to the kernel (through notify methods).
 	Init(*Server)
+
+	// OnUnmount is called after the file system was unmounted,
+	// and all requests have been served.
+	OnUnmount()
 }
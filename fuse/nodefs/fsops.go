@@ -61,6 +61,10 @@ func (c *rawBridge) Init(s *fuse.Server) {
 	c.rootNode.Node().OnMount((*FileSystemConnector)(c))
 }
 
+func (c *rawBridge) OnUnmount() {
+	c.rootNode.Node().OnUnmount()
+}
+
 func (c *FileSystemConnector) lookupMountUpdate(out *fuse.Attr, mount *fileSystemMount) (node *Inode, code fuse.Status) {
 	code = mount.mountInode.Node().GetAttr(out, nil, nil)
 	if !code.Ok() {
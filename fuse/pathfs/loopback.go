@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -20,6 +21,23 @@ type loopbackFileSystem struct {
 	// TODO - this should need default fill in.
 	FileSystem
 	Root string
+
+	// rootFd is an O_PATH descriptor for Root, or -1. If set, all
+	// paths are resolved beneath it. It is closed on unmount.
+	rootFd    int
+	closeRoot sync.Once
+}
+
+// LoopbackOptions holds options for NewLoopbackFileSystemWithOptions.
+type LoopbackOptions struct {
+	// Confine makes the file system resolve all paths relative
+	// to a descriptor for the root with
+	// openat2(RESOLVE_BENEATH|RESOLVE_NO_MAGICLINKS), so symlinks
+	// swapped into the backing tree by other users cannot
+	// redirect operations to files outside the root. On kernels
+	// without openat2, paths are walked one component at a time,
+	// without following symlinks. Only supported on Linux.
+	Confine bool
 }
 
 // A FUSE filesystem that shunts all request to an underlying file
@@ -35,12 +53,39 @@ func NewLoopbackFileSystem(root string) FileSystem {
 	return &loopbackFileSystem{
 		FileSystem: NewDefaultFileSystem(),
 		Root:       root,
+		rootFd:     -1,
+	}
+}
+
+// NewLoopbackFileSystemWithOptions is like NewLoopbackFileSystem, but
+// takes options. opts may be nil.
+func NewLoopbackFileSystemWithOptions(root string, opts *LoopbackOptions) (FileSystem, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	fs := &loopbackFileSystem{
+		FileSystem: NewDefaultFileSystem(),
+		Root:       root,
+		rootFd:     -1,
+	}
+	if opts != nil && opts.Confine {
+		if fs.rootFd, err = openRootFd(root); err != nil {
+			return nil, err
+		}
 	}
+	return fs, nil
 }
 
 func (fs *loopbackFileSystem) StatFs(name string) *fuse.StatfsOut {
+	p, done, err := fs.nodePath(name)
+	if err != nil {
+		return nil
+	}
+	defer done()
+
 	s := syscall.Statfs_t{}
-	err := syscall.Statfs(fs.GetPath(name), &s)
+	err = syscall.Statfs(p, &s)
 	if err == nil {
 		out := &fuse.StatfsOut{}
 		out.FromStatfsT(&s)
@@ -52,15 +97,48 @@ func (fs *loopbackFileSystem) StatFs(name string) *fuse.StatfsOut {
 func (fs *loopbackFileSystem) OnMount(nodeFs *PathNodeFs) {
 }
 
-func (fs *loopbackFileSystem) OnUnmount() {}
+// OnUnmount closes the root descriptor of a confined file system.
+func (fs *loopbackFileSystem) OnUnmount() {
+	if fs.rootFd < 0 {
+		return
+	}
+	fs.closeRoot.Do(func() {
+		syscall.Close(fs.rootFd)
+	})
+}
 
 func (fs *loopbackFileSystem) GetPath(relPath string) string {
 	return filepath.Join(fs.Root, relPath)
 }
 
+// nodePath returns a path for operating on relPath, and a function to
+// call when done with it. If the file system is confined, the path
+// refers to a descriptor opened beneath the root, so system calls
+// that follow symlinks cannot be redirected outside it.
+func (fs *loopbackFileSystem) nodePath(relPath string) (string, func(), error) {
+	if fs.rootFd < 0 {
+		return fs.GetPath(relPath), func() {}, nil
+	}
+	return fs.nodePathBeneath(relPath)
+}
+
+// entryPath is like nodePath, but the path names relPath in its
+// parent directory, so system calls that do not follow symlinks,
+// such as lstat and readlink, see the entry itself.
+func (fs *loopbackFileSystem) entryPath(relPath string) (string, func(), error) {
+	if fs.rootFd < 0 {
+		return fs.GetPath(relPath), func() {}, nil
+	}
+	return fs.entryPathBeneath(relPath)
+}
+
 func (fs *loopbackFileSystem) GetAttr(name string, context *fuse.Context) (a *fuse.Attr, code fuse.Status) {
-	fullPath := fs.GetPath(name)
-	var err error = nil
+	fullPath, done, err := fs.entryPath(name)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer done()
+
 	st := syscall.Stat_t{}
 	if name == "" {
 		// When GetAttr is called for the toplevel directory, we always want
@@ -78,9 +156,15 @@ func (fs *loopbackFileSystem) GetAttr(name string, context *fuse.Context) (a *fu
 }
 
 func (fs *loopbackFileSystem) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, status fuse.Status) {
+	p, done, err := fs.nodePath(name)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer done()
+
 	// What other ways beyond O_RDONLY are there to open
 	// directories?
-	f, err := os.Open(fs.GetPath(name))
+	f, err := os.Open(p)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
@@ -122,7 +206,13 @@ func (fs *loopbackFileSystem) Open(name string, flags uint32, context *fuse.Cont
 	// filter out append. The kernel layer will translate the
 	// offsets for us appropriately.
 	flags = flags &^ syscall.O_APPEND
-	f, err := os.OpenFile(fs.GetPath(name), int(flags), 0)
+	p, done, err := fs.nodePath(name)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer done()
+
+	f, err := os.OpenFile(p, int(flags), 0)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
@@ -130,53 +220,127 @@ func (fs *loopbackFileSystem) Open(name string, flags uint32, context *fuse.Cont
 }
 
 func (fs *loopbackFileSystem) Chmod(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	err := os.Chmod(fs.GetPath(path), os.FileMode(mode))
+	p, done, err := fs.nodePath(path)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done()
+
+	err = os.Chmod(p, os.FileMode(mode))
 	return fuse.ToStatus(err)
 }
 
 func (fs *loopbackFileSystem) Chown(path string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(os.Chown(fs.GetPath(path), int(uid), int(gid)))
+	p, done, err := fs.nodePath(path)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done()
+
+	return fuse.ToStatus(os.Chown(p, int(uid), int(gid)))
 }
 
 func (fs *loopbackFileSystem) Truncate(path string, offset uint64, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(os.Truncate(fs.GetPath(path), int64(offset)))
+	p, done, err := fs.nodePath(path)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done()
+
+	return fuse.ToStatus(os.Truncate(p, int64(offset)))
 }
 
 func (fs *loopbackFileSystem) Readlink(name string, context *fuse.Context) (out string, code fuse.Status) {
-	f, err := os.Readlink(fs.GetPath(name))
+	p, done, err := fs.entryPath(name)
+	if err != nil {
+		return "", fuse.ToStatus(err)
+	}
+	defer done()
+
+	f, err := os.Readlink(p)
 	return f, fuse.ToStatus(err)
 }
 
 func (fs *loopbackFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(syscall.Mknod(fs.GetPath(name), mode, int(dev)))
+	p, done, err := fs.entryPath(name)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done()
+
+	return fuse.ToStatus(syscall.Mknod(p, mode, int(dev)))
 }
 
 func (fs *loopbackFileSystem) Mkdir(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(os.Mkdir(fs.GetPath(path), os.FileMode(mode)))
+	p, done, err := fs.entryPath(path)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done()
+
+	return fuse.ToStatus(os.Mkdir(p, os.FileMode(mode)))
 }
 
 // Don't use os.Remove, it removes twice (unlink followed by rmdir).
 func (fs *loopbackFileSystem) Unlink(name string, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(syscall.Unlink(fs.GetPath(name)))
+	p, done, err := fs.entryPath(name)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done()
+
+	return fuse.ToStatus(syscall.Unlink(p))
 }
 
 func (fs *loopbackFileSystem) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(syscall.Rmdir(fs.GetPath(name)))
+	p, done, err := fs.entryPath(name)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done()
+
+	return fuse.ToStatus(syscall.Rmdir(p))
 }
 
 func (fs *loopbackFileSystem) Symlink(pointedTo string, linkName string, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(os.Symlink(pointedTo, fs.GetPath(linkName)))
+	p, done, err := fs.entryPath(linkName)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done()
+
+	return fuse.ToStatus(os.Symlink(pointedTo, p))
 }
 
 func (fs *loopbackFileSystem) Rename(oldPath string, newPath string, context *fuse.Context) (codee fuse.Status) {
-	oldPath = fs.GetPath(oldPath)
-	newPath = fs.GetPath(newPath)
-	err := os.Rename(oldPath, newPath)
+	oldPath, done1, err := fs.entryPath(oldPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done1()
+	newPath, done2, err := fs.entryPath(newPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done2()
+
+	err = os.Rename(oldPath, newPath)
 	return fuse.ToStatus(err)
 }
 
 func (fs *loopbackFileSystem) Link(orig string, newName string, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(os.Link(fs.GetPath(orig), fs.GetPath(newName)))
+	p1, done1, err := fs.entryPath(orig)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done1()
+	p2, done2, err := fs.entryPath(newName)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done2()
+
+	return fuse.ToStatus(os.Link(p1, p2))
 }
 
 func (fs *loopbackFileSystem) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
@@ -193,7 +357,16 @@ func (fs *loopbackFileSystem) Access(name string, mode uint32, context *fuse.Con
 }
 
 func (fs *loopbackFileSystem) Create(path string, flags uint32, mode uint32, context *fuse.Context) (fuseFile nodefs.File, code fuse.Status) {
+	p, done, err := fs.entryPath(path)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer done()
+
 	flags = flags &^ syscall.O_APPEND
-	f, err := os.OpenFile(fs.GetPath(path), int(flags)|os.O_CREATE, os.FileMode(mode))
+	if fs.rootFd >= 0 {
+		flags |= syscall.O_NOFOLLOW
+	}
+	f, err := os.OpenFile(p, int(flags)|os.O_CREATE, os.FileMode(mode))
 	return nodefs.NewLoopbackFile(f), fuse.ToStatus(err)
 }
@@ -12,6 +12,18 @@ import (
 	"github.com/hanwen/go-fuse/v2/internal/utimens"
 )
 
+func openRootFd(root string) (int, error) {
+	return -1, syscall.ENOTSUP
+}
+
+func (fs *loopbackFileSystem) nodePathBeneath(relPath string) (string, func(), error) {
+	return "", nil, syscall.ENOTSUP
+}
+
+func (fs *loopbackFileSystem) entryPathBeneath(relPath string) (string, func(), error) {
+	return "", nil, syscall.ENOTSUP
+}
+
 func (fs *loopbackFileSystem) Utimens(path string, a *time.Time, m *time.Time, context *fuse.Context) fuse.Status {
 	// MacOS before High Sierra lacks utimensat() and UTIME_OMIT.
 	// We emulate using utimes() and extra GetAttr() calls.
@@ -6,19 +6,58 @@ package pathfs
 
 import (
 	"fmt"
+	"path/filepath"
 	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/beneath"
+	"golang.org/x/sys/unix"
 )
 
+func openRootFd(root string) (int, error) {
+	return syscall.Open(root, unix.O_PATH|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+}
+
+// nodePathBeneath opens relPath beneath the root, and returns a path
+// for the descriptor.
+func (fs *loopbackFileSystem) nodePathBeneath(relPath string) (string, func(), error) {
+	fd, err := beneath.Open(fs.rootFd, relPath, unix.O_PATH|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	return beneath.ProcPath(fd), func() { syscall.Close(fd) }, nil
+}
+
+// entryPathBeneath opens the directory containing relPath beneath
+// the root, and returns a path for the entry inside it.
+func (fs *loopbackFileSystem) entryPathBeneath(relPath string) (string, func(), error) {
+	fd, err := beneath.Open(fs.rootFd, filepath.Dir(relPath), unix.O_PATH|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	return beneath.ProcPath(fd) + "/" + filepath.Base(relPath), func() { syscall.Close(fd) }, nil
+}
+
 func (fs *loopbackFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
-	attrs, err := listXAttr(fs.GetPath(name))
+	p, done, err := fs.nodePath(name)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer done()
+
+	attrs, err := listXAttr(p)
 	return attrs, fuse.ToStatus(err)
 }
 
 func (fs *loopbackFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
-	err := syscall.Removexattr(fs.GetPath(name), attr)
+	p, done, err := fs.nodePath(name)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done()
+
+	err = syscall.Removexattr(p, attr)
 	return fuse.ToStatus(err)
 }
 
@@ -27,11 +66,16 @@ func (fs *loopbackFileSystem) String() string {
 }
 
 func (fs *loopbackFileSystem) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	p, done, err := fs.nodePath(name)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer done()
 
 	bufsz := 1024
 	for {
 		data := make([]byte, bufsz)
-		sz, err := syscall.Getxattr(fs.GetPath(name), attr, data)
+		sz, err := syscall.Getxattr(p, attr, data)
 		if err == nil {
 			return data[:sz], fuse.OK
 		}
@@ -46,7 +90,13 @@ func (fs *loopbackFileSystem) GetXAttr(name string, attr string, context *fuse.C
 }
 
 func (fs *loopbackFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
-	err := syscall.Setxattr(fs.GetPath(name), attr, data, flags)
+	p, done, err := fs.nodePath(name)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done()
+
+	err = syscall.Setxattr(p, attr, data, flags)
 	return fuse.ToStatus(err)
 }
 
@@ -55,6 +105,12 @@ func (fs *loopbackFileSystem) Utimens(path string, a *time.Time, m *time.Time, c
 	var ts [2]syscall.Timespec
 	ts[0] = fuse.UtimeToTimespec(a)
 	ts[1] = fuse.UtimeToTimespec(m)
-	err := sysUtimensat(0, fs.GetPath(path), &ts, _AT_SYMLINK_NOFOLLOW)
+	p, done, err := fs.entryPath(path)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer done()
+
+	err = sysUtimensat(0, p, &ts, _AT_SYMLINK_NOFOLLOW)
 	return fuse.ToStatus(err)
 }
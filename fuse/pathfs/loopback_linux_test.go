@@ -0,0 +1,72 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"github.com/hanwen/go-fuse/v2/posixtest"
+)
+
+func setupConfinedLoopback(t *testing.T) (dir string, cleanup func()) {
+	dir = testutil.TempDir()
+	for _, d := range []string{"orig", "mnt"} {
+		if err := os.Mkdir(dir+"/"+d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs, err := NewLoopbackFileSystemWithOptions(dir+"/orig", &LoopbackOptions{Confine: true})
+	if err != nil {
+		t.Fatalf("NewLoopbackFileSystemWithOptions: %v", err)
+	}
+	nfs := NewPathNodeFs(fs, nil)
+	state, _, err := nodefs.MountRoot(dir+"/mnt", nfs.Root(), &nodefs.Options{
+		Debug: testutil.VerboseTest(),
+	})
+	if err != nil {
+		t.Fatalf("MountRoot: %v", err)
+	}
+	go state.Serve()
+	if err := state.WaitMount(); err != nil {
+		t.Fatalf("WaitMount: %v", err)
+	}
+	return dir, func() {
+		state.Unmount()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLoopbackConfinedPosix(t *testing.T) {
+	for _, k := range []string{
+		"SymlinkReadlink",
+		"MkdirRmdir",
+		"RenameOverwriteDestNoExist",
+		"RenameOverwriteDestExist",
+		"ReadDir",
+		"AppendWrite",
+		"TruncateFile",
+	} {
+		f := posixtest.All[k]
+		if f == nil {
+			t.Fatalf("test %s missing", k)
+		}
+		t.Run(k, func(t *testing.T) {
+			dir, cleanup := setupConfinedLoopback(t)
+			defer cleanup()
+
+			f(t, dir+"/mnt")
+		})
+	}
+}
+
+func TestLoopbackConfinedRace(t *testing.T) {
+	dir, cleanup := setupConfinedLoopback(t)
+	defer cleanup()
+
+	testutil.TestLoopbackConfinedRace(t, dir+"/orig", dir+"/mnt", dir+"/outside")
+}
@@ -232,6 +232,7 @@ func (n *pathInode) OnMount(conn *nodefs.FileSystemConnector) {
 }
 
 func (n *pathInode) OnUnmount() {
+	n.pathFs.fs.OnUnmount()
 }
 
 // Drop all known client inodes. Must have the treeLock.
@@ -62,6 +62,9 @@ type Server struct {
 	canSplice    bool
 	loops        sync.WaitGroup
 
+	// served is done when Serve has returned.
+	served sync.WaitGroup
+
 	ready chan error
 
 	// for implementing single threaded processing.
@@ -124,6 +127,7 @@ func (ms *Server) Unmount() (err error) {
 	}
 	// Wait for event loops to exit.
 	ms.loops.Wait()
+	ms.served.Wait()
 	ms.mountPoint = ""
 	return err
 }
@@ -206,6 +210,7 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 	// This prepares for Serve being called somewhere, either
 	// synchronously or asynchronously.
 	ms.loops.Add(1)
+	ms.served.Add(1)
 	return ms, nil
 }
 
@@ -364,6 +369,7 @@ func (ms *Server) recordStats(req *request) {
 //
 // Each filesystem operation executes in a separate goroutine.
 func (ms *Server) Serve() {
+	defer ms.served.Done()
 	ms.loop(false)
 	ms.loops.Wait()
 
@@ -387,6 +393,8 @@ func (ms *Server) Serve() {
 		reading.st = ENODEV
 		close(reading.ready)
 	}
+
+	ms.fileSystem.OnUnmount()
 }
 
 // Wait waits for the serve loop to exit. This should only be called
@@ -3,7 +3,9 @@ module github.com/hanwen/go-fuse/v2
 require (
 	github.com/hanwen/go-fuse v1.0.0
 	github.com/kylelemons/godebug v0.0.0-20170820004349-d65d576e9348
-	golang.org/x/sys v0.0.0-20180830151530-49385e6e1522
+	golang.org/x/crypto v0.8.0
+	golang.org/x/sync v0.1.0
+	golang.org/x/sys v0.7.0
 )
 
 go 1.13
@@ -0,0 +1,7 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package beneath
+
+// placeholder file so this package exists on all platforms.
@@ -0,0 +1,144 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package beneath opens files relative to a directory, without ever
+// leaving that directory, even if the tree is modified concurrently.
+package beneath
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// openat2 is the same number on all architectures.
+const _SYS_OPENAT2 = 437
+
+// flags for struct open_how.resolve
+const (
+	_RESOLVE_NO_MAGICLINKS = 0x02
+	_RESOLVE_BENEATH       = 0x08
+)
+
+// struct open_how from <linux/openat2.h>
+type openHow struct {
+	Flags   uint64
+	Mode    uint64
+	Resolve uint64
+}
+
+// noOpenat2 is set when the kernel turns out not to support
+// openat2(2). Tests set it to exercise the fallback.
+var noOpenat2 int32
+
+func openat2(dirfd int, path string, how *openHow) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	r, _, e1 := syscall.Syscall6(_SYS_OPENAT2, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(how)), unsafe.Sizeof(*how), 0, 0)
+	if e1 != 0 {
+		return -1, syscall.Errno(e1)
+	}
+	return int(r), nil
+}
+
+// Open opens path, which is relative to the directory dirfd. The
+// path is resolved with RESOLVE_BENEATH and RESOLVE_NO_MAGICLINKS, so
+// symlinks are only followed if they stay beneath dirfd, and an
+// attempt to escape returns EXDEV.
+//
+// On kernels without openat2(2), the path is walked one component at
+// a time, and symlinks are not followed at all, as if O_NOFOLLOW were
+// given for every component.
+func Open(dirfd int, path string, flags int, mode uint32) (int, error) {
+	if atomic.LoadInt32(&noOpenat2) == 0 {
+		how := openHow{
+			Flags:   uint64(flags | syscall.O_CLOEXEC),
+			Mode:    uint64(mode),
+			Resolve: _RESOLVE_BENEATH | _RESOLVE_NO_MAGICLINKS,
+		}
+		if path == "" {
+			path = "."
+		}
+		for {
+			fd, err := openat2(dirfd, path, &how)
+			if err == syscall.EAGAIN {
+				// A concurrent rename or mount
+				// happened; the kernel asks us to retry.
+				continue
+			}
+			if err != syscall.ENOSYS {
+				return fd, err
+			}
+			atomic.StoreInt32(&noOpenat2, 1)
+			break
+		}
+	}
+	return walk(dirfd, path, flags, mode)
+}
+
+// walk opens path one component at a time, refusing symlinks and
+// "..".
+func walk(dirfd int, path string, flags int, mode uint32) (int, error) {
+	var comps []string
+	for _, c := range strings.Split(path, "/") {
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			return -1, syscall.EXDEV
+		}
+		comps = append(comps, c)
+	}
+	if len(comps) == 0 {
+		comps = []string{"."}
+	}
+
+	cur := dirfd
+	defer func() {
+		if cur != dirfd {
+			syscall.Close(cur)
+		}
+	}()
+	for _, c := range comps[:len(comps)-1] {
+		next, err := syscall.Openat(cur, c, unix.O_PATH|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return -1, err
+		}
+		if cur != dirfd {
+			syscall.Close(cur)
+		}
+		cur = next
+	}
+	return syscall.Openat(cur, comps[len(comps)-1], flags|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, mode)
+}
+
+// OpenParent opens the directory containing path as an O_PATH
+// descriptor, and returns it with the last component of path. If
+// path is empty, it returns a descriptor for dirfd itself and ".".
+func OpenParent(dirfd int, path string) (fd int, name string, err error) {
+	path = strings.Trim(path, "/")
+	dir, name := "", path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		dir, name = path[:i], path[i+1:]
+	}
+	if name == "" {
+		name = "."
+	}
+	fd, err = Open(dirfd, dir, unix.O_PATH|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	return fd, name, err
+}
+
+// ProcPath returns a path that refers to the file opened as fd. It can
+// be passed to system calls that do not accept O_PATH descriptors.
+// If fd refers to a symlink, the path refers to the symlink itself.
+func ProcPath(fd int) string {
+	return fmt.Sprintf("/proc/self/fd/%d", fd)
+}
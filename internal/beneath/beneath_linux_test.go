@@ -0,0 +1,133 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package beneath
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+func withFallback(t *testing.T, f func(t *testing.T)) {
+	t.Run("openat2", f)
+	t.Run("walk", func(t *testing.T) {
+		atomic.StoreInt32(&noOpenat2, 1)
+		defer atomic.StoreInt32(&noOpenat2, 0)
+		f(t)
+	})
+}
+
+func openRoot(t *testing.T, dir string) int {
+	fd, err := syscall.Open(dir, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestOpenEscape(t *testing.T) {
+	withFallback(t, func(t *testing.T) {
+		dir := testutil.TempDir()
+		defer os.RemoveAll(dir)
+		if err := os.Mkdir(dir+"/root", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dir+"/secret", []byte("secret"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for name, target := range map[string]string{
+			"abs": dir + "/secret",
+			"rel": "../secret",
+		} {
+			if err := os.Symlink(target, dir+"/root/"+name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		root := openRoot(t, dir+"/root")
+		defer syscall.Close(root)
+
+		for _, p := range []string{"abs", "rel", "../secret", "abs/.", "/proc/self/root" + dir + "/secret"} {
+			if fd, err := Open(root, p, syscall.O_RDONLY, 0); err == nil {
+				syscall.Close(fd)
+				t.Errorf("Open(%q) escaped the root", p)
+			}
+		}
+
+		fd, name, err := OpenParent(root, "abs")
+		if err != nil {
+			t.Fatalf("OpenParent: %v", err)
+		}
+		defer syscall.Close(fd)
+		if name != "abs" {
+			t.Errorf("got name %q, want abs", name)
+		}
+	})
+}
+
+// TestOpenRace swaps a directory for a symlink pointing outside the
+// root, while opening a file inside that directory.
+func TestOpenRace(t *testing.T) {
+	withFallback(t, func(t *testing.T) {
+		dir := testutil.TempDir()
+		defer os.RemoveAll(dir)
+		for _, d := range []string{"root/dir", "outside"} {
+			if err := os.MkdirAll(dir+"/"+d, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(dir+"/root/dir/file", []byte("inside"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dir+"/outside/file", []byte("secret"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(dir+"/outside", dir+"/root/link"); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(dir+"/root/tmp", 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		root := openRoot(t, dir+"/root")
+		defer syscall.Close(root)
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Swap dir and link back and forth.
+				os.Rename(dir+"/root/dir", dir+"/root/tmp/dir")
+				os.Rename(dir+"/root/link", dir+"/root/dir")
+				os.Rename(dir+"/root/dir", dir+"/root/link")
+				os.Rename(dir+"/root/tmp/dir", dir+"/root/dir")
+			}
+		}()
+
+		buf := make([]byte, 64)
+		for i := 0; i < 10000; i++ {
+			fd, err := Open(root, "dir/file", syscall.O_RDONLY, 0)
+			if err != nil {
+				continue
+			}
+			n, _ := syscall.Read(fd, buf)
+			syscall.Close(fd)
+			if string(buf[:n]) == "secret" {
+				t.Fatalf("iteration %d: read file outside the root", i)
+			}
+		}
+		close(stop)
+		<-done
+	})
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package copyfile copies files with their metadata, for the copy-up
+// of union file systems.
+package copyfile
+
+import (
+	"os"
+	"syscall"
+)
+
+// Copy copies `src` to `dst`, which must not exist. Regular files,
+// symlinks, devices, FIFOs and sockets are copied; directories are
+// created without their entries. The mode, the extended attributes,
+// the access and modification times and, if we have the privileges,
+// the owner are preserved. Extended attributes for which `skipXattr`
+// returns true are not copied; `skipXattr` may be nil.
+func Copy(src, dst string, skipXattr func(name string) bool) error {
+	return copyEntry(src, dst, skipXattr, true)
+}
+
+// CopyMetadata is like Copy, but creates a regular file with the size
+// of `src` and without its data, which is left as a hole. The data
+// can be copied later with CopyData.
+func CopyMetadata(src, dst string, skipXattr func(name string) bool) error {
+	return copyEntry(src, dst, skipXattr, false)
+}
+
+// CopyData copies the data of the regular file `src` to `dst`, which
+// was created by CopyMetadata.
+func CopyData(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = copyData(out, in, fi.Size())
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func copyEntry(src, dst string, skipXattr func(name string) bool, data bool) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	mode := uint32(st.Mode)
+
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		err = syscall.Mkdir(dst, 0700)
+	case syscall.S_IFREG:
+		if data {
+			err = copyRegular(src, dst, fi.Size())
+		} else {
+			err = createSized(dst, fi.Size())
+		}
+	case syscall.S_IFLNK:
+		var target string
+		if target, err = os.Readlink(src); err == nil {
+			err = syscall.Symlink(target, dst)
+		}
+	default:
+		err = syscall.Mknod(dst, mode, int(st.Rdev))
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := copyXattrs(src, dst, skipXattr); err != nil {
+		return err
+	}
+	// Changing the owner clears the set-user-ID bit, so it goes
+	// before the mode.
+	if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil && !os.IsPermission(err) {
+		return err
+	}
+	if mode&syscall.S_IFMT != syscall.S_IFLNK {
+		if err := syscall.Chmod(dst, mode&07777); err != nil {
+			return err
+		}
+	}
+	return setTimes(dst, st)
+}
+
+func copyRegular(src, dst string, size int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = copyData(out, in, size)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// createSized creates `dst` as a file of `size` bytes holding no data.
+func createSized(dst string, size int64) error {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = out.Truncate(size)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,224 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package copyfile
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/splice"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	_FICLONE   = 0x40049409
+	_SEEK_DATA = 3
+	_SEEK_HOLE = 4
+)
+
+// copier copies `n` bytes at `off` from `src` to the same offset in
+// `dst`.
+type copier func(dst, src *os.File, off, n int64) error
+
+// copiers are tried in order. A copier returns an unsupported error
+// if it cannot copy between the files, before having written
+// anything.
+var copiers = []copier{copyFileRange, spliceRange, readWriteRange}
+
+type unsupported struct{ error }
+
+// copyData copies the `size` bytes of `src` to the empty file `dst`.
+// The file is cloned if the file system supports it, and otherwise
+// only the data of `src` is copied, so holes stay holes.
+func copyData(dst, src *os.File, size int64) error {
+	if err := unix.IoctlSetInt(int(dst.Fd()), _FICLONE, int(src.Fd())); err == nil {
+		return nil
+	}
+
+	copiers := copiers
+	for off := int64(0); off < size; {
+		start, end, err := nextData(src, off, size)
+		if err != nil {
+			return err
+		}
+		if start >= size {
+			break
+		}
+		for {
+			err = copiers[0](dst, src, start, end-start)
+			if _, ok := err.(unsupported); !ok {
+				break
+			}
+			copiers = copiers[1:]
+		}
+		if err != nil {
+			return err
+		}
+		off = end
+	}
+	return dst.Truncate(size)
+}
+
+// nextData returns the range of data in `f` at or after `off`. If
+// the file system does not know about holes, the rest of the file is
+// returned.
+func nextData(f *os.File, off, size int64) (start, end int64, err error) {
+	fd := int(f.Fd())
+	start, err = unix.Seek(fd, off, _SEEK_DATA)
+	if err == syscall.ENXIO {
+		// Only a hole is left.
+		return size, size, nil
+	} else if err != nil {
+		return off, size, nil
+	}
+	end, err = unix.Seek(fd, start, _SEEK_HOLE)
+	if err != nil || end > size {
+		end = size
+	}
+	return start, end, nil
+}
+
+func isUnsupported(err error) bool {
+	switch err {
+	case syscall.ENOSYS, syscall.EXDEV, syscall.EINVAL, syscall.EOPNOTSUPP:
+		return true
+	}
+	return false
+}
+
+func copyFileRange(dst, src *os.File, off, n int64) error {
+	roff, woff := off, off
+	for first := true; n > 0; first = false {
+		m, err := unix.CopyFileRange(int(src.Fd()), &roff, int(dst.Fd()), &woff, int(n), 0)
+		if err != nil {
+			if first && isUnsupported(err) {
+				return unsupported{err}
+			}
+			return err
+		}
+		if m == 0 {
+			// The file shrank.
+			return nil
+		}
+		n -= int64(m)
+	}
+	return nil
+}
+
+func spliceRange(dst, src *os.File, off, n int64) error {
+	p, err := splice.Get()
+	if err != nil {
+		return unsupported{err}
+	}
+	defer splice.Done(p)
+	p.Grow(256 << 10)
+
+	if _, err := dst.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	for first := true; n > 0; first = false {
+		sz := p.Cap()
+		if int64(sz) > n {
+			sz = int(n)
+		}
+		k, err := p.LoadFromAt(src.Fd(), sz, off)
+		if err != nil {
+			if first && isUnsupported(err) {
+				return unsupported{err}
+			}
+			return err
+		}
+		if k == 0 {
+			return nil
+		}
+		for left := k; left > 0; {
+			m, err := p.WriteTo(dst.Fd(), left)
+			if err != nil {
+				return err
+			}
+			left -= m
+		}
+		off += int64(k)
+		n -= int64(k)
+	}
+	return nil
+}
+
+func readWriteRange(dst, src *os.File, off, n int64) error {
+	buf := make([]byte, 128<<10)
+	for n > 0 {
+		if int64(len(buf)) > n {
+			buf = buf[:n]
+		}
+		k, err := src.ReadAt(buf, off)
+		if k > 0 {
+			if _, err := dst.WriteAt(buf[:k], off); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		off += int64(k)
+		n -= int64(k)
+	}
+	return nil
+}
+
+func copyXattrs(src, dst string, skip func(string) bool) error {
+	buf := make([]byte, 4096)
+	for {
+		sz, err := unix.Llistxattr(src, buf)
+		if err == syscall.ERANGE {
+			buf = make([]byte, 2*len(buf))
+			continue
+		}
+		if err == syscall.ENOTSUP {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		buf = buf[:sz]
+		break
+	}
+
+	val := make([]byte, 4096)
+	for _, attr := range bytes.Split(buf, []byte{0}) {
+		if len(attr) == 0 {
+			continue
+		}
+		name := string(attr)
+		if skip != nil && skip(name) {
+			continue
+		}
+		sz, err := unix.Lgetxattr(src, name, val)
+		for err == syscall.ERANGE {
+			val = make([]byte, 2*len(val))
+			sz, err = unix.Lgetxattr(src, name, val)
+		}
+		if err == nil {
+			err = unix.Lsetxattr(dst, name, val[:sz], 0)
+		}
+		// Attributes that we may not read or write, such as
+		// those in the trusted namespace for unprivileged
+		// users, are skipped.
+		if err != nil && err != syscall.EPERM && err != syscall.ENOTSUP && err != syscall.ENODATA {
+			return err
+		}
+	}
+	return nil
+}
+
+func setTimes(dst string, st *syscall.Stat_t) error {
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(syscall.TimespecToNsec(st.Atim)),
+		unix.NsecToTimespec(syscall.TimespecToNsec(st.Mtim)),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, dst, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
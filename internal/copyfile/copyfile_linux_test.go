@@ -0,0 +1,221 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package copyfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"golang.org/x/sys/unix"
+)
+
+// writeSparse writes a file of 4 Mb with data at its start and in
+// its middle.
+func writeSparse(t *testing.T, name string) []byte {
+	want := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(want[:100000])
+	rand.New(rand.NewSource(2)).Read(want[2<<20 : 2<<20+5000])
+
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(want[:100000], 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(want[2<<20:2<<20+5000], 2<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(int64(len(want))); err != nil {
+		t.Fatal(err)
+	}
+	return want
+}
+
+func TestCopy(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	want := writeSparse(t, dir+"/src")
+	if err := os.Chmod(dir+"/src", 0751); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(dir+"/src", "user.a", []byte("1"), 0); err != nil && err != syscall.ENOTSUP {
+		t.Fatal(err)
+	}
+	xattr := unix.Lsetxattr(dir+"/src", "user.skip", []byte("2"), 0) == nil
+	ts := []syscall.Timespec{{Sec: 1000, Nsec: 123456789}, {Sec: 2000, Nsec: 987654321}}
+	if err := syscall.UtimesNano(dir+"/src", ts); err != nil {
+		t.Fatal(err)
+	}
+
+	skip := func(name string) bool { return name == "user.skip" }
+	if err := Copy(dir+"/src", dir+"/dst", skip); err != nil {
+		t.Fatal(err)
+	}
+
+	var src, dst syscall.Stat_t
+	if err := syscall.Lstat(dir+"/src", &src); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Lstat(dir+"/dst", &dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Mode != src.Mode {
+		t.Errorf("got mode %o, want %o", dst.Mode, src.Mode)
+	}
+	if dst.Uid != src.Uid || dst.Gid != src.Gid {
+		t.Errorf("got owner %d:%d, want %d:%d", dst.Uid, dst.Gid, src.Uid, src.Gid)
+	}
+	if dst.Mtim != ts[1] || dst.Atim != ts[0] {
+		t.Errorf("got times %v %v, want %v", dst.Atim, dst.Mtim, ts)
+	}
+	if dst.Blocks > src.Blocks {
+		t.Errorf("got %d blocks, want at most %d", dst.Blocks, src.Blocks)
+	}
+
+	// Reading updates the access time, so it goes last.
+	got, err := ioutil.ReadFile(dir + "/dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("content mismatch")
+	}
+
+	if xattr {
+		buf := make([]byte, 10)
+		if sz, err := unix.Lgetxattr(dir+"/dst", "user.a", buf); err != nil {
+			t.Errorf("Getxattr: %v", err)
+		} else if string(buf[:sz]) != "1" {
+			t.Errorf("got xattr %q, want %q", buf[:sz], "1")
+		}
+		if _, err := unix.Lgetxattr(dir+"/dst", "user.skip", buf); err != syscall.ENODATA {
+			t.Errorf("Getxattr user.skip: got %v, want ENODATA", err)
+		}
+	}
+}
+
+func TestCopySpecial(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	if err := os.Symlink("target", dir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(dir+"/fifo", 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir+"/dir", 0705); err != nil {
+		t.Fatal(err)
+	}
+	for _, nm := range []string{"link", "fifo", "dir"} {
+		if err := Copy(dir+"/"+nm, dir+"/"+nm+".copy", nil); err != nil {
+			t.Fatalf("%s: %v", nm, err)
+		}
+		var src, dst syscall.Stat_t
+		if err := syscall.Lstat(dir+"/"+nm, &src); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Lstat(dir+"/"+nm+".copy", &dst); err != nil {
+			t.Fatal(err)
+		}
+		if dst.Mode != src.Mode {
+			t.Errorf("%s: got mode %o, want %o", nm, dst.Mode, src.Mode)
+		}
+		if dst.Mtim != src.Mtim {
+			t.Errorf("%s: got mtime %v, want %v", nm, dst.Mtim, src.Mtim)
+		}
+	}
+	if got, err := os.Readlink(dir + "/link.copy"); err != nil {
+		t.Fatal(err)
+	} else if got != "target" {
+		t.Errorf("got link %q, want %q", got, "target")
+	}
+}
+
+// TestCopiers checks each way of copying data, as the one that is
+// used depends on the file system.
+func TestCopiers(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	want := writeSparse(t, dir+"/src")
+	src, err := os.Open(dir + "/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	for nm, c := range map[string]copier{
+		"copy_file_range": copyFileRange,
+		"splice":          spliceRange,
+		"readwrite":       readWriteRange,
+	} {
+		dst, err := os.Create(dir + "/" + nm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Copy the ranges out of order.
+		err = c(dst, src, 2<<20, 5000)
+		if err == nil {
+			err = c(dst, src, 0, 100000)
+		}
+		if err == nil {
+			err = dst.Truncate(int64(len(want)))
+		}
+		dst.Close()
+		if _, ok := err.(unsupported); ok {
+			t.Logf("%s: %v", nm, err)
+			continue
+		} else if err != nil {
+			t.Fatalf("%s: %v", nm, err)
+		}
+		if got, err := ioutil.ReadFile(dir + "/" + nm); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s: content mismatch", nm)
+		}
+	}
+}
+
+func TestCopyMetadata(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	want := writeSparse(t, dir+"/src")
+	if err := os.Chmod(dir+"/src", 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyMetadata(dir+"/src", dir+"/dst", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(dir+"/dst", &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode != syscall.S_IFREG|0640 {
+		t.Errorf("got mode %o, want %o", st.Mode, syscall.S_IFREG|0640)
+	}
+	if st.Size != int64(len(want)) || st.Blocks != 0 {
+		t.Errorf("got size %d in %d blocks, want %d in 0 blocks", st.Size, st.Blocks, len(want))
+	}
+
+	if err := CopyData(dir+"/src", dir+"/dst"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(dir + "/dst"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("content mismatch")
+	}
+}
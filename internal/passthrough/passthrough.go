@@ -0,0 +1,54 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package passthrough has helpers for file systems that store their
+// files in a backing directory, like the loopback file system.
+package passthrough
+
+import (
+	"context"
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Ino returns the inode number for the backing file with attributes
+// `st`, in a tree whose root is on device `rootDev`.
+func Ino(st *syscall.Stat_t, rootDev uint64) uint64 {
+	// We compose an inode number by the underlying inode, and
+	// mixing in the device number. In traditional filesystems,
+	// the inode numbers are small. The device numbers are also
+	// small (typically 16 bit). Finally, we mask out the root
+	// device number of the root, so a tree that does not
+	// encompass multiple mounts will reflect the inode numbers of
+	// the underlying filesystem
+	swapped := (uint64(st.Dev) << 32) | (uint64(st.Dev) >> 32)
+	swappedRootDev := (rootDev << 32) | (rootDev >> 32)
+	return (swapped ^ swappedRootDev) ^ st.Ino
+}
+
+// PreserveOwner makes the caller in `ctx` the owner of the newly
+// created `path`, if we have the privileges to do so.
+func PreserveOwner(ctx context.Context, path string) error {
+	return PreserveMappedOwner(ctx, path, nil)
+}
+
+// PreserveMappedOwner is like PreserveOwner, but the owner is what
+// `mapCaller` returns for the caller, if it is not nil. This is for
+// file systems that map IDs to the backing file system.
+func PreserveMappedOwner(ctx context.Context, path string, mapCaller func(*fuse.Caller) (uid, gid uint32)) error {
+	if os.Getuid() != 0 {
+		return nil
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	uid, gid := caller.Uid, caller.Gid
+	if mapCaller != nil {
+		uid, gid = mapCaller(caller)
+	}
+	return syscall.Lchown(path, int(uid), int(gid))
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testutil
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Check that a confined loopback does not serve files outside its
+// root. Called by the confined loopback tests of fs and pathfs.
+//
+// The test swaps a directory in the backing tree with a symlink
+// pointing outside the root, while reading a file in that directory
+// through the mount.
+//
+// Parameters:
+//
+//	orig ....... backing directory of the loopback
+//	mnt ........ mount point of the loopback
+//	outside .... scratch directory outside orig
+func TestLoopbackConfinedRace(t *testing.T, orig, mnt, outside string) {
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(outside+"/file", []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(orig+"/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(orig+"/dir/file", []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, orig+"/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	var mntSt syscall.Stat_t
+	if err := syscall.Stat(mnt, &mntSt); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			unix.Renameat2(unix.AT_FDCWD, orig+"/dir", unix.AT_FDCWD, orig+"/link", unix.RENAME_EXCHANGE)
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	buf := make([]byte, 64)
+	for i := 0; i < 10000; i++ {
+		fd, err := syscall.Open(mnt+"/dir/file", syscall.O_RDONLY, 0)
+		if err != nil {
+			continue
+		}
+		var st syscall.Stat_t
+		syscall.Fstat(fd, &st)
+		n, _ := syscall.Read(fd, buf)
+		syscall.Close(fd)
+
+		// If the kernel saw a symlink and followed it, we end
+		// up outside the mount, which is fine.
+		if st.Dev == mntSt.Dev && string(buf[:n]) == "secret" {
+			t.Fatalf("iteration %d: loopback served a file outside its root", i)
+		}
+	}
+}
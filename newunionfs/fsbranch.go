@@ -0,0 +1,401 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package unionfs
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// fsBranch is a read-only branch that is a tree of nodes, such as
+// an archive of the zipfs package, rather than a directory. It has
+// no whiteouts.
+type fsBranch struct {
+	root *fs.Inode
+
+	// id holds the bits above inoShift of the inode numbers of
+	// the branch in the union.
+	id uint64
+
+	// mu protects added.
+	mu sync.Mutex
+	// added counts the users of the nodes that lookup added to
+	// the tree. They are removed once they are no longer used,
+	// so the tree does not grow with every name looked up.
+	added map[*fs.Inode]int
+}
+
+// newFSBranch returns the branch for the tree `root`, whose inode
+// numbers in the union have the bits `id` above inoShift.
+func newFSBranch(root fs.InodeEmbedder, id uint64) *fsBranch {
+	// The file system is never served, but this sets up the tree
+	// and calls OnAdd, as mounting it would.
+	fs.NewNodeFS(root, &fs.Options{FirstAutomaticIno: id})
+	return &fsBranch{
+		root:  root.EmbeddedInode(),
+		id:    id,
+		added: map[*fs.Inode]int{},
+	}
+}
+
+// lookup returns the node for `name`. Nodes returned by Lookup
+// methods are added to the tree, so they are found again, until
+// `release` is called.
+func (b *fsBranch) lookup(ctx context.Context, name string) (n *fs.Inode, release func(), errno syscall.Errno) {
+	var used []*fs.Inode
+	release = func() { b.release(used) }
+	n = b.root
+	if name == "" || name == "." {
+		return n, release, 0
+	}
+	for _, c := range strings.Split(name, "/") {
+		if n, errno = b.child(ctx, n, c); errno != 0 {
+			release()
+			return nil, nil, errno
+		}
+		used = append(used, n)
+	}
+	return n, release, 0
+}
+
+// child returns the child `name` of `parent`, which must be
+// released.
+func (b *fsBranch) child(ctx context.Context, parent *fs.Inode, name string) (*fs.Inode, syscall.Errno) {
+	b.mu.Lock()
+	ch := parent.GetChild(name)
+	if ch != nil {
+		b.acquire(ch)
+		b.mu.Unlock()
+		return ch, 0
+	}
+	b.mu.Unlock()
+
+	lu, ok := parent.Operations().(fs.NodeLookuper)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	var out fuse.EntryOut
+	ch, errno := lu.Lookup(ctx, name, &out)
+	if errno != 0 {
+		return nil, errno
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if parent.AddChild(name, ch, false) {
+		b.added[ch] = 1
+	} else {
+		ch = parent.GetChild(name)
+		b.acquire(ch)
+	}
+	return ch, 0
+}
+
+// acquire counts a user of `n`, if lookup added it.
+func (b *fsBranch) acquire(n *fs.Inode) {
+	if _, ok := b.added[n]; ok {
+		b.added[n]++
+	}
+}
+
+// release ends the use of the nodes `used`, which lookup returned
+// for the components of a path.
+func (b *fsBranch) release(used []*fs.Inode) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := len(used) - 1; i >= 0; i-- {
+		n := used[i]
+		cnt, ok := b.added[n]
+		if !ok {
+			continue
+		}
+		if cnt > 1 {
+			b.added[n] = cnt - 1
+			continue
+		}
+		delete(b.added, n)
+		// The node is not persistent, so this removes it
+		// from its parent.
+		n.ForgetPersistent()
+	}
+}
+
+// lstat fills `st` with the attributes of `name`, with the defaults
+// that the fs package uses for nodes without Getattr.
+func (b *fsBranch) lstat(ctx context.Context, name string, st *syscall.Stat_t) syscall.Errno {
+	n, release, errno := b.lookup(ctx, name)
+	if errno != 0 {
+		return errno
+	}
+	defer release()
+	var out fuse.AttrOut
+	if ga, ok := n.Operations().(fs.NodeGetattrer); ok {
+		if errno := ga.Getattr(ctx, nil, &out); errno != 0 {
+			return errno
+		}
+	}
+	mode := out.Mode&07777 | n.Mode()
+	if mode&07777 == 0 {
+		mode |= 0644
+		if mode&syscall.S_IFDIR != 0 {
+			mode |= 0111
+		}
+	}
+
+	*st = syscall.Stat_t{}
+	st.Ino = n.StableAttr().Ino
+	st.Mode = mode
+	st.Nlink = 1
+	st.Uid = out.Uid
+	st.Gid = out.Gid
+	st.Rdev = uint64(out.Rdev)
+	st.Size = int64(out.Size)
+	st.Blocks = int64(out.Blocks)
+	st.Atim = syscall.NsecToTimespec(int64(out.Atime)*1e9 + int64(out.Atimensec))
+	st.Mtim = syscall.NsecToTimespec(int64(out.Mtime)*1e9 + int64(out.Mtimensec))
+	st.Ctim = syscall.NsecToTimespec(int64(out.Ctime)*1e9 + int64(out.Ctimensec))
+	return 0
+}
+
+// readDir adds the entries of `dir` to `result`.
+func (b *fsBranch) readDir(ctx context.Context, dir string, result map[string]uint32) {
+	n, release, errno := b.lookup(ctx, dir)
+	if errno != 0 {
+		return
+	}
+	defer release()
+	if !n.IsDir() {
+		return
+	}
+	rd, ok := n.Operations().(fs.NodeReaddirer)
+	if !ok {
+		for nm, ch := range n.Children() {
+			result[nm] = ch.Mode()
+		}
+		return
+	}
+	ds, errno := rd.Readdir(ctx)
+	if errno != 0 {
+		return
+	}
+	defer ds.Close()
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			return
+		}
+		result[e.Name] = e.Mode
+	}
+}
+
+// open opens `name` for reading.
+func (b *fsBranch) open(ctx context.Context, name string) (*fsFile, uint32, syscall.Errno) {
+	n, release, errno := b.lookup(ctx, name)
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	f := &fsFile{node: n, release: release}
+	var flags uint32
+	if op, ok := n.Operations().(fs.NodeOpener); ok {
+		f.fh, flags, errno = op.Open(ctx, syscall.O_RDONLY)
+		if errno != 0 {
+			release()
+			return nil, 0, errno
+		}
+	}
+	// Other flags, such as FOPEN_KEEP_CACHE, no longer hold once
+	// the file is copied up.
+	return f, flags & fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (b *fsBranch) readlink(ctx context.Context, name string) ([]byte, syscall.Errno) {
+	n, release, errno := b.lookup(ctx, name)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer release()
+	rl, ok := n.Operations().(fs.NodeReadlinker)
+	if !ok {
+		return nil, syscall.EINVAL
+	}
+	return rl.Readlink(ctx)
+}
+
+func (b *fsBranch) getxattr(ctx context.Context, name, attr string, dest []byte) (uint32, syscall.Errno) {
+	n, release, errno := b.lookup(ctx, name)
+	if errno != 0 {
+		return 0, errno
+	}
+	defer release()
+	gx, ok := n.Operations().(fs.NodeGetxattrer)
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	return gx.Getxattr(ctx, attr, dest)
+}
+
+func (b *fsBranch) listxattr(ctx context.Context, name string, dest []byte) (uint32, syscall.Errno) {
+	n, release, errno := b.lookup(ctx, name)
+	if errno != 0 {
+		return 0, errno
+	}
+	defer release()
+	lx, ok := n.Operations().(fs.NodeListxattrer)
+	if !ok {
+		return 0, 0
+	}
+	return lx.Listxattr(ctx, dest)
+}
+
+// copyUp copies `name` to the path `dst`, like copyfile.Copy does
+// for directories.
+func (b *fsBranch) copyUp(ctx context.Context, name, dst string) error {
+	var st syscall.Stat_t
+	if errno := b.lstat(ctx, name, &st); errno != 0 {
+		return errno
+	}
+
+	var err error
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		err = syscall.Mkdir(dst, 0700)
+	case syscall.S_IFREG:
+		err = b.copyData(ctx, name, dst)
+	case syscall.S_IFLNK:
+		var target []byte
+		if target, err = b.readlink(ctx, name); err == nil {
+			err = syscall.Symlink(string(target), dst)
+		}
+	default:
+		err = syscall.Mknod(dst, st.Mode, int(st.Rdev))
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := b.copyXattrs(ctx, name, dst); err != nil {
+		return err
+	}
+	if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil && !os.IsPermission(err) {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		if err := syscall.Chmod(dst, st.Mode&07777); err != nil {
+			return err
+		}
+	}
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(syscall.TimespecToNsec(st.Atim)),
+		unix.NsecToTimespec(syscall.TimespecToNsec(st.Mtim)),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, dst, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// copyData writes the data of the regular file `name` to the new
+// file `dst`.
+func (b *fsBranch) copyData(ctx context.Context, name, dst string) error {
+	f, _, errno := b.open(ctx, name)
+	if errno != 0 {
+		return errno
+	}
+	defer f.Release(ctx)
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 128<<10)
+	var off int64
+	for {
+		res, errno := f.Read(ctx, buf, off)
+		if errno != 0 {
+			out.Close()
+			return errno
+		}
+		data, status := res.Bytes(buf)
+		res.Done()
+		if !status.Ok() {
+			out.Close()
+			return syscall.Errno(status)
+		}
+		if len(data) == 0 {
+			break
+		}
+		if _, err := out.Write(data); err != nil {
+			out.Close()
+			return err
+		}
+		off += int64(len(data))
+	}
+	return out.Close()
+}
+
+// copyXattrs copies the xattrs of `name` to `dst`. Like
+// copyfile.Copy, it skips attributes that may not be written.
+func (b *fsBranch) copyXattrs(ctx context.Context, name, dst string) error {
+	sz, errno := b.listxattr(ctx, name, nil)
+	if errno != 0 || sz == 0 {
+		return nil
+	}
+	buf := make([]byte, sz)
+	if sz, errno = b.listxattr(ctx, name, buf); errno != 0 {
+		return nil
+	}
+	for _, attr := range strings.Split(string(buf[:sz]), "\x00") {
+		if attr == "" || isInternalXattr(attr) {
+			continue
+		}
+		val := make([]byte, 64<<10)
+		n, errno := b.getxattr(ctx, name, attr, val)
+		if errno != 0 {
+			continue
+		}
+		err := unix.Lsetxattr(dst, attr, val[:n], 0)
+		if err != nil && err != syscall.EPERM && err != syscall.ENOTSUP {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsFile is a file opened in a fsBranch. Like the fs package, it
+// reads through the node if it implements NodeReader.
+type fsFile struct {
+	node    *fs.Inode
+	release func()
+	fh      fs.FileHandle
+}
+
+var _ = (fs.FileReader)((*fsFile)(nil))
+
+func (f *fsFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if nr, ok := f.node.Operations().(fs.NodeReader); ok {
+		return nr.Read(ctx, f.fh, dest, off)
+	}
+	if fr, ok := f.fh.(fs.FileReader); ok {
+		return fr.Read(ctx, dest, off)
+	}
+	return nil, syscall.ENOTSUP
+}
+
+var _ = (fs.FileReleaser)((*fsFile)(nil))
+
+func (f *fsFile) Release(ctx context.Context) syscall.Errno {
+	defer f.release()
+	if nr, ok := f.node.Operations().(fs.NodeReleaser); ok {
+		return nr.Release(ctx, f.fh)
+	}
+	if fr, ok := f.fh.(fs.FileReleaser); ok {
+		return fr.Release(ctx)
+	}
+	return 0
+}
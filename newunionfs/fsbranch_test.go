@@ -0,0 +1,164 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package unionfs
+
+import (
+	"archive/zip"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"github.com/hanwen/go-fuse/v2/zipfs"
+)
+
+func writeZip(t *testing.T, name string, files map[string]string) {
+	t.Helper()
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for nm, c := range files {
+		w, err := zw.Create(nm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFSBranch(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"rw", "ro", "mnt", "ro/dir"} {
+		if err := os.Mkdir(dir+"/"+d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(dir+"/ro/dir/ro-file", []byte("ro"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeZip(t, dir+"/lower.zip", map[string]string{
+		"dir/zip-file": "zip",
+		"dir/ro-file":  "hidden",
+		"sub/file":     "sub",
+		"top":          "top",
+	})
+	zipRoot, err := zipfs.NewArchiveFileSystem(dir + "/lower.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &fs.Options{}
+	opts.Debug = testutil.VerboseTest()
+	root := New([]string{dir + "/rw", dir + "/ro"}, &Options{Lowers: []fs.InodeEmbedder{zipRoot}})
+	server, err := fs.Mount(dir+"/mnt", root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+	mnt := dir + "/mnt"
+
+	if got, want := readDirNames(t, mnt), []string{"dir", "sub", "top"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := readDirNames(t, mnt+"/dir"), []string{"ro-file", "zip-file"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for f, want := range map[string]string{"dir/ro-file": "ro", "dir/zip-file": "zip", "sub/file": "sub"} {
+		if got, err := ioutil.ReadFile(mnt + "/" + f); err != nil {
+			t.Fatal(err)
+		} else if string(got) != want {
+			t.Errorf("%s: got %q, want %q", f, got, want)
+		}
+	}
+	if fi, err := os.Lstat(mnt + "/sub"); err != nil {
+		t.Fatal(err)
+	} else if !fi.IsDir() {
+		t.Errorf("sub: got mode %v, want directory", fi.Mode())
+	}
+
+	// Changing a file copies it up from the archive.
+	f, err := os.OpenFile(mnt+"/sub/file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("+")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if got, err := ioutil.ReadFile(dir + "/rw/sub/file"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "sub+" {
+		t.Errorf("got %q, want %q", got, "sub+")
+	}
+
+	if err := os.Remove(mnt + "/top"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(mnt + "/top"); !os.IsNotExist(err) {
+		t.Errorf("Lstat after remove: got %v, want ENOENT", err)
+	}
+	if err := syscall.Rmdir(mnt + "/sub"); err != syscall.ENOTEMPTY {
+		t.Errorf("Rmdir: got %v, want ENOTEMPTY", err)
+	}
+}
+
+func TestFSBranchForget(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(dir+"/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/a/b/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lower, err := fs.NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newFSBranch(lower, 1<<63)
+	ctx := context.Background()
+
+	var st syscall.Stat_t
+	if errno := b.lstat(ctx, "a/b/file", &st); errno != 0 {
+		t.Fatalf("lstat: %v", errno)
+	}
+	if st.Size != 4 {
+		t.Errorf("got size %d, want 4", st.Size)
+	}
+	if ch := b.root.Children(); len(ch) != 0 {
+		t.Errorf("lstat left nodes %v in the tree", ch)
+	}
+
+	f, _, errno := b.open(ctx, "a/b/file")
+	if errno != 0 {
+		t.Fatalf("open: %v", errno)
+	}
+	if errno := b.lstat(ctx, "a/b", &st); errno != 0 {
+		t.Fatalf("lstat: %v", errno)
+	}
+	if b.root.GetChild("a") == nil {
+		t.Errorf("node of an open file was forgotten")
+	}
+	f.Release(ctx)
+	if ch := b.root.Children(); len(ch) != 0 {
+		t.Errorf("Release left nodes %v in the tree", ch)
+	}
+	if len(b.added) != 0 {
+		t.Errorf("%d nodes still counted", len(b.added))
+	}
+}
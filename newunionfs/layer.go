@@ -0,0 +1,431 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package unionfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/internal/copyfile"
+	"golang.org/x/sys/unix"
+)
+
+// ExportLayer writes the changes in roots[0] to `w` as a tar stream
+// in the format of an OCI image layer. Deletions recorded in the
+// format `wh` become ".wh." files, and opaque directories get a
+// ".wh..wh..opq" entry. The other roots are the read-only branches,
+// which hold the data of metacopies and the attributes of
+// directories that only exist in roots[0] to hold whiteouts. The
+// union must not be changed while it is exported.
+func ExportLayer(roots []string, wh Whiteouts, w io.Writer) error {
+	r := &unionFSRoot{roots: roots, whiteouts: wh, metacopy: true}
+	return r.exportLayer(w)
+}
+
+// CommitLayer moves the changes in roots[0] to the new directory
+// `dst`, which can then be inserted as a read-only branch between
+// roots[0] and roots[1], and leaves roots[0] empty. Whiteouts are
+// moved along in the format `wh`, and the data of metacopies is
+// copied up first. `dst` should be on the file system of roots[0];
+// otherwise entries are copied, and hard links are lost. The union
+// must not be changed while it is committed.
+func CommitLayer(roots []string, wh Whiteouts, dst string) error {
+	r := &unionFSRoot{roots: roots, whiteouts: wh, metacopy: true}
+	return r.commit(dst)
+}
+
+// Commit runs CommitLayer for the mounted union `root`, which was
+// returned by New, and adds `dst` as its first read-only branch. The
+// contents of the union do not change. The union should not be
+// used while it is committed: entries that are being moved may be
+// missing from lookups that run meanwhile.
+func Commit(root fs.InodeEmbedder, dst string) error {
+	r, ok := root.(*unionFSRoot)
+	if !ok {
+		return fmt.Errorf("unionfs: %T is not a union", root)
+	}
+	if err := r.commit(dst); err != nil {
+		return err
+	}
+	r.addRootDev(dst)
+	r.branchMu.Lock()
+	defer r.branchMu.Unlock()
+	r.roots = append([]string{r.roots[0], dst}, r.roots[1:]...)
+	return nil
+}
+
+// layerWriter writes the tar stream of ExportLayer.
+type layerWriter struct {
+	*unionFSRoot
+	tw *tar.Writer
+
+	// deleted holds the deleted names by directory.
+	deleted map[string][]string
+	opaque  map[string]bool
+	// parents holds the directories that contain whiteouts
+	// below them.
+	parents map[string]bool
+	// links holds the first name of files with several links.
+	links map[[2]uint64]string
+}
+
+func (r *unionFSRoot) exportLayer(w io.Writer) error {
+	deleted, opaque, err := r.whiteouts.List(r.upper())
+	if err != nil {
+		return err
+	}
+	lw := &layerWriter{
+		unionFSRoot: r,
+		tw:          tar.NewWriter(w),
+		deleted:     map[string][]string{},
+		opaque:      map[string]bool{},
+		parents:     map[string]bool{},
+		links:       map[[2]uint64]string{},
+	}
+
+	sort.Strings(deleted)
+	done := map[string]bool{}
+	for _, name := range deleted {
+		if hasDeletedParent(name, done) || lowerStat(r.lowerBranches(), name) == nil || !lw.canHold(name) {
+			continue
+		}
+		done[name] = true
+		dir := filepath.Dir(name)
+		lw.deleted[dir] = append(lw.deleted[dir], filepath.Base(name))
+		lw.addParents(dir)
+	}
+	for _, dir := range opaque {
+		lw.opaque[dir] = true
+		lw.addParents(dir)
+	}
+
+	if err := lw.writeDir("."); err != nil {
+		return err
+	}
+	return lw.tw.Close()
+}
+
+// canHold reports whether a whiteout for `name` belongs in the
+// layer: `name` is not in roots[0], and its parents are directories
+// there, or do not exist.
+func (lw *layerWriter) canHold(name string) bool {
+	var st syscall.Stat_t
+	if syscall.Lstat(filepath.Join(lw.rootDir(0), name), &st) == nil && !lw.whiteouts.IsDeleted(lw.upper(), name) {
+		return false
+	}
+	for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+		if syscall.Lstat(filepath.Join(lw.rootDir(0), dir), &st) == nil && st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			return false
+		}
+	}
+	return true
+}
+
+func (lw *layerWriter) addParents(dir string) {
+	for ; dir != "."; dir = filepath.Dir(dir) {
+		lw.parents[dir] = true
+	}
+}
+
+// writeDir writes the directory `dir` and the entries below it. In
+// each directory, whiteouts go before the other entries.
+func (lw *layerWriter) writeDir(dir string) error {
+	upper := filepath.Join(lw.rootDir(0), dir)
+	var st syscall.Stat_t
+	inUpper := syscall.Lstat(upper, &st) == nil
+	if dir != "." {
+		if !inUpper {
+			for _, root := range lw.branches()[1:] {
+				if syscall.Lstat(filepath.Join(root, dir), &st) == nil {
+					break
+				}
+			}
+		}
+		if err := lw.writeEntry(dir, &st, inUpper); err != nil {
+			return err
+		}
+	}
+
+	if lw.opaque[dir] {
+		if err := lw.writeWhiteout(filepath.Join(dir, whOpaque)); err != nil {
+			return err
+		}
+	}
+	names := lw.deleted[dir]
+	sort.Strings(names)
+	for _, nm := range names {
+		if err := lw.writeWhiteout(filepath.Join(dir, whPrefix+nm)); err != nil {
+			return err
+		}
+	}
+
+	children := map[string]bool{}
+	if inUpper {
+		infos, err := ioutil.ReadDir(upper)
+		if err != nil {
+			return err
+		}
+		for _, fi := range infos {
+			name := filepath.Join(dir, fi.Name())
+			if lw.whiteouts.IsInternal(lw.upper(), name) || lw.whiteouts.IsDeleted(lw.upper(), name) {
+				continue
+			}
+			children[name] = true
+		}
+	}
+	for p := range lw.parents {
+		if filepath.Dir(p) == dir {
+			children[p] = true
+		}
+	}
+	var sorted []string
+	for nm := range children {
+		sorted = append(sorted, nm)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		if err := syscall.Lstat(filepath.Join(lw.rootDir(0), name), &st); err != nil && !os.IsNotExist(err) {
+			return err
+		} else if err != nil || st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			if err := lw.writeDir(name); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := lw.writeEntry(name, &st, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeWhiteout writes the empty file `name`.
+func (lw *layerWriter) writeWhiteout(name string) error {
+	return lw.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(name),
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	})
+}
+
+// writeEntry writes `name`, whose attributes are `st`. If `inUpper`
+// is set, `name` is in roots[0], and its xattrs and data are
+// written; otherwise it is a directory of a read-only branch.
+func (lw *layerWriter) writeEntry(name string, st *syscall.Stat_t, inUpper bool) error {
+	if st.Mode&syscall.S_IFMT == syscall.S_IFSOCK {
+		// Sockets cannot be stored in tar files.
+		return nil
+	}
+
+	h := &tar.Header{
+		Name:    filepath.ToSlash(name),
+		Mode:    int64(st.Mode & 07777),
+		Uid:     int(st.Uid),
+		Gid:     int(st.Gid),
+		ModTime: time.Unix(st.Mtim.Unix()),
+		Format:  tar.FormatPAX,
+	}
+	p := filepath.Join(lw.rootDir(0), name)
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		h.Typeflag = tar.TypeDir
+		h.Name += "/"
+	case syscall.S_IFREG:
+		h.Typeflag = tar.TypeReg
+		h.Size = st.Size
+	case syscall.S_IFLNK:
+		h.Typeflag = tar.TypeSymlink
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		h.Linkname = target
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		h.Typeflag = tar.TypeChar
+		if st.Mode&syscall.S_IFMT == syscall.S_IFBLK {
+			h.Typeflag = tar.TypeBlock
+		}
+		h.Devmajor = int64(unix.Major(uint64(st.Rdev)))
+		h.Devminor = int64(unix.Minor(uint64(st.Rdev)))
+	case syscall.S_IFIFO:
+		h.Typeflag = tar.TypeFifo
+	}
+	if !inUpper {
+		return lw.tw.WriteHeader(h)
+	}
+
+	if st.Nlink > 1 && h.Typeflag != tar.TypeDir {
+		key := [2]uint64{uint64(st.Dev), st.Ino}
+		if first, ok := lw.links[key]; ok {
+			h.Typeflag = tar.TypeLink
+			h.Linkname = first
+			h.Size = 0
+			return lw.tw.WriteHeader(h)
+		}
+		lw.links[key] = h.Name
+	}
+
+	xattrs, err := listXattrs(p)
+	if err != nil {
+		return err
+	}
+	for k, v := range xattrs {
+		if h.PAXRecords == nil {
+			h.PAXRecords = map[string]string{}
+		}
+		h.PAXRecords["SCHILY.xattr."+k] = v
+	}
+	if err := lw.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	if h.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	data, errno := lw.metacopyData(name)
+	if errno != 0 {
+		return errno
+	}
+	if data == "" {
+		data = p
+	}
+	f, err := os.Open(data)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(lw.tw, f, h.Size)
+	return err
+}
+
+// listXattrs returns the xattrs of `p`, except for those of the
+// union's bookkeeping.
+func listXattrs(p string) (map[string]string, error) {
+	buf := make([]byte, 4096)
+	for {
+		sz, err := unix.Llistxattr(p, buf)
+		if err == syscall.ERANGE {
+			buf = make([]byte, 2*len(buf))
+			continue
+		}
+		if err == syscall.ENOTSUP {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		buf = buf[:sz]
+		break
+	}
+
+	result := map[string]string{}
+	val := make([]byte, 4096)
+	for _, attr := range bytes.Split(buf, []byte{0}) {
+		name := string(attr)
+		if name == "" || isInternalXattr(name) {
+			continue
+		}
+		sz, err := unix.Lgetxattr(p, name, val)
+		for err == syscall.ERANGE {
+			val = make([]byte, 2*len(val))
+			sz, err = unix.Lgetxattr(p, name, val)
+		}
+		if err == syscall.ENODATA {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		result[name] = string(val[:sz])
+	}
+	return result, nil
+}
+
+// commit moves the entries of roots[0] to `dst`.
+func (r *unionFSRoot) commit(dst string) error {
+	upper := r.rootDir(0)
+	err := filepath.Walk(upper, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(upper, p)
+		if err != nil {
+			return err
+		}
+		if errno := r.fetchData(name); errno != 0 {
+			return errno
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(upper, &st); err != nil {
+		return err
+	}
+	if err := copyfile.Copy(upper, dst, nil); err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(upper)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		src := filepath.Join(upper, fi.Name())
+		err := os.Rename(src, filepath.Join(dst, fi.Name()))
+		if le, ok := err.(*os.LinkError); ok && le.Err == syscall.EXDEV {
+			err = copyTree(src, filepath.Join(dst, fi.Name()))
+			if err == nil {
+				err = os.RemoveAll(src)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Moving the entries changed the times of both roots.
+	ts := []syscall.Timespec{st.Atim, st.Mtim}
+	if err := syscall.UtimesNano(dst, ts); err != nil {
+		return err
+	}
+	return syscall.UtimesNano(upper, ts)
+}
+
+// copyTree copies `src` and the entries below it to `dst`.
+func copyTree(src, dst string) error {
+	if err := copyfile.Copy(src, dst, nil); err != nil {
+		return err
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(src, &st); err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		if err := copyTree(filepath.Join(src, fi.Name()), filepath.Join(dst, fi.Name())); err != nil {
+			return err
+		}
+	}
+	ts := []syscall.Timespec{st.Atim, st.Mtim}
+	return syscall.UtimesNano(dst, ts)
+}
@@ -0,0 +1,195 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package unionfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// changeTree populates the read-only branch of `tc`, and changes
+// the union.
+func changeTree(t *testing.T, tc *testCase) {
+	t.Helper()
+	if err := os.Mkdir(tc.ro+"/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"dir/sub/file", "other"} {
+		if err := ioutil.WriteFile(tc.ro+"/"+f, []byte("ro"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Remove(tc.mnt + "/other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(tc.mnt + "/dir/ro-file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(tc.mnt + "/dir/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(tc.mnt+"/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tc.mnt+"/dir/new", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(tc.mnt+"/dir/new", tc.mnt+"/link"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportLayer(t *testing.T) {
+	for format, newWhiteouts := range whiteoutFormats {
+		t.Run(format, func(t *testing.T) {
+			w := newWhiteouts()
+			tc := newTestCaseWithOptions(t, true, &Options{Whiteouts: w})
+			defer tc.Clean()
+			changeTree(t, tc)
+			if err := unix.Lsetxattr(tc.rw+"/dir/new", "user.test", []byte("val"), 0); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			if err := ExportLayer([]string{tc.rw, tc.ro}, w, &buf); err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			headers := map[string]*tar.Header{}
+			data := map[string]string{}
+			tr := tar.NewReader(&buf)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, h.Name)
+				headers[h.Name] = h
+				c, err := ioutil.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data[h.Name] = string(c)
+			}
+
+			opaque := "dir/sub/.wh..wh..opq"
+			if format == "deletions" {
+				opaque = "dir/sub/.wh.file"
+			}
+			want := []string{".wh.other", "dir/", "dir/.wh.ro-file", "dir/new", "dir/sub/", opaque, "link"}
+			if !reflect.DeepEqual(names, want) {
+				t.Fatalf("got %v, want %v", names, want)
+			}
+			if got := data["dir/new"]; got != "new" {
+				t.Errorf("got data %q, want %q", got, "new")
+			}
+			if got := headers["dir/new"].PAXRecords["SCHILY.xattr.user.test"]; got != "val" {
+				t.Errorf("got xattr %q, want %q", got, "val")
+			}
+			if h := headers["link"]; h.Typeflag != tar.TypeLink || h.Linkname != "dir/new" {
+				t.Errorf("got %c %q for link, want hard link to dir/new", h.Typeflag, h.Linkname)
+			}
+		})
+	}
+}
+
+func TestExportLayerMetacopy(t *testing.T) {
+	tc := newTestCaseWithOptions(t, true, &Options{Metacopy: true})
+	defer tc.Clean()
+
+	if err := os.Chmod(tc.mnt+"/dir/ro-file", 0600); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ExportLayer([]string{tc.rw, tc.ro}, NewDeletionsWhiteouts(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Name != "dir/ro-file" {
+			continue
+		}
+		if _, ok := h.PAXRecords["SCHILY.xattr."+metacopyXattr]; ok {
+			t.Errorf("metacopy xattr exported")
+		}
+		if c, err := ioutil.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		} else if string(c) != "bla" {
+			t.Errorf("got %q, want %q", c, "bla")
+		}
+		break
+	}
+}
+
+func TestCommit(t *testing.T) {
+	tc := newTestCaseWithOptions(t, true, &Options{Metacopy: true})
+	defer tc.Clean()
+	if err := ioutil.WriteFile(tc.ro+"/dir/ro-file2", []byte("bla"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changeTree(t, tc)
+	if err := os.Chmod(tc.mnt+"/dir/ro-file2", 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	before := map[string][]string{}
+	for _, d := range []string{"", "/dir", "/dir/sub"} {
+		before[d] = readDirNames(t, tc.mnt+d)
+	}
+
+	layer := tc.dir + "/layer"
+	if err := Commit(tc.root, layer); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDirNames(t, tc.rw); len(got) != 0 {
+		t.Errorf("got entries %v in writable branch", got)
+	}
+	if got, err := ioutil.ReadFile(layer + "/dir/ro-file2"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "bla" {
+		t.Errorf("got %q in layer, want the data of the metacopy", got)
+	}
+
+	for d, want := range before {
+		if got := readDirNames(t, tc.mnt+d); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %v, want %v", d, got, want)
+		}
+	}
+	if got, err := ioutil.ReadFile(tc.mnt + "/link"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+
+	// New changes go to the emptied writable branch.
+	if err := ioutil.WriteFile(tc.mnt+"/dir/ro-file2", []byte("newer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(tc.rw + "/dir/ro-file2"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "newer" {
+		t.Errorf("got %q, want %q", got, "newer")
+	}
+	if got, err := ioutil.ReadFile(layer + "/dir/ro-file2"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "bla" {
+		t.Errorf("got %q in layer, want %q", got, "bla")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package unionfs
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// LinkIndex finds the names of files with several links in a
+// read-only branch, so a union can copy such a file up once and link
+// its other names to the copy. Directories are only read when a
+// search reaches them, and then only once, as read-only branches do
+// not change. The union file system of the unionfs package uses it
+// too.
+type LinkIndex struct {
+	b Branch
+
+	mu   sync.Mutex
+	dirs map[string]*linkDir
+}
+
+// linkDir holds what a LinkIndex has read of a directory.
+type linkDir struct {
+	// links are the entries with several links, by name.
+	links map[string]*fuse.Attr
+	// subdirs are the names of the directories in it.
+	subdirs []string
+}
+
+// NewLinkIndex returns the LinkIndex of the read-only branch `b`.
+func NewLinkIndex(b Branch) *LinkIndex {
+	return &LinkIndex{
+		b:    b,
+		dirs: map[string]*linkDir{},
+	}
+}
+
+// Links returns the other names of `name`, whose attributes are `a`.
+// The search starts in the directory of `name`, where links usually
+// are, and widens to its parents until all links are found. Links
+// outside the branch are never found, so they make it read the whole
+// branch. Entries that cannot be read are left out.
+func (x *LinkIndex) Links(name string, a *fuse.Attr) []string {
+	if a.IsDir() || a.Nlink <= 1 {
+		return nil
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	var search func(dir string) bool
+	search = func(dir string) bool {
+		if seen[dir] {
+			return false
+		}
+		seen[dir] = true
+		d := x.dir(dir)
+		for nm, b := range d.links {
+			if nm != name && sameInode(a, b) {
+				names = append(names, nm)
+			}
+		}
+		if len(names)+1 >= int(a.Nlink) {
+			return true
+		}
+		for _, sub := range d.subdirs {
+			if search(sub) {
+				return true
+			}
+		}
+		return false
+	}
+	dir := filepath.Dir(name)
+	for !search(dir) && dir != "." {
+		dir = filepath.Dir(dir)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dir returns the entries of `dir`, reading it outside the lock the
+// first time.
+func (x *LinkIndex) dir(dir string) *linkDir {
+	x.mu.Lock()
+	d := x.dirs[dir]
+	x.mu.Unlock()
+	if d != nil {
+		return d
+	}
+
+	d = &linkDir{links: map[string]*fuse.Attr{}}
+	entries, _ := x.b.ReadDir(dir)
+	for nm, mode := range entries {
+		p := filepath.Join(dir, nm)
+		if mode&syscall.S_IFMT == syscall.S_IFDIR {
+			d.subdirs = append(d.subdirs, p)
+			continue
+		}
+		if a, err := x.b.Lstat(p); err == nil && a.Nlink > 1 {
+			d.links[p] = a
+		}
+	}
+	sort.Strings(d.subdirs)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.dirs[dir] = d
+	return d
+}
+
+// sameInode reports whether `a` and `b` are the attributes of the
+// same inode. Attributes carry no device, and a branch may span file
+// systems, so the inode numbers alone do not tell.
+func sameInode(a, b *fuse.Attr) bool {
+	return a.Ino == b.Ino && a.Mode == b.Mode && a.Nlink == b.Nlink && a.Size == b.Size &&
+		a.Mtime == b.Mtime && a.Mtimensec == b.Mtimensec &&
+		a.Ctime == b.Ctime && a.Ctimensec == b.Ctimensec
+}
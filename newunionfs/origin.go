@@ -0,0 +1,100 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package unionfs
+
+import (
+	"crypto/md5"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// originXattr holds the inode number in the union of a regular file
+// or directory that was copied up, so it keeps its number. Other
+// entries, such as symlinks, cannot have user xattrs, so their
+// number is kept on their parent directory, in an xattr named
+// originXattr, a dot and a hash of their name. The union file system
+// of the unionfs package uses the same layout.
+const originXattr = "user.unionfs.origin"
+
+// originOf returns the entry that holds the number of `name`, whose
+// attributes are `a`, and the xattr it is in.
+func originOf(name string, a *fuse.Attr) (string, string) {
+	if a.IsRegular() || a.IsDir() {
+		return name, originXattr
+	}
+	h := md5.Sum([]byte(filepath.Base(name)))
+	return filepath.Dir(name), fmt.Sprintf("%s.%x", originXattr, h[:8])
+}
+
+// GetOrigin returns the inode number in the union that `name` in the
+// branch `b`, whose attributes are `a`, had before it was copied up,
+// or 0 if it was not copied up.
+func GetOrigin(b Branch, name string, a *fuse.Attr) (uint64, error) {
+	holder, attr := originOf(name, a)
+	data, err := b.GetXAttr(holder, attr)
+	if err == syscall.ENODATA || err == syscall.ENOTSUP || err == syscall.ENOSYS {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(data), 10, 64)
+}
+
+// SetOrigin records that `name` in the branch `b`, whose attributes
+// are `a`, was copied up from an entry whose number in the union was
+// `ino`. If the branch cannot store user xattrs, the number is lost,
+// and SetOrigin returns nil.
+func SetOrigin(b Branch, name string, a *fuse.Attr, ino uint64) error {
+	holder, attr := originOf(name, a)
+	err := b.SetXAttr(holder, attr, []byte(strconv.FormatUint(ino, 10)))
+	if err == syscall.ENOTSUP || err == syscall.EPERM || err == syscall.ENOSYS {
+		return nil
+	}
+	return err
+}
+
+// RemoveOrigin removes the number of `name`, whose attributes are
+// `a`, if it is kept on its parent directory. It is called when
+// `name` is removed or replaced in `b`, so a new entry does not take
+// the number.
+func RemoveOrigin(b Branch, name string, a *fuse.Attr) error {
+	holder, attr := originOf(name, a)
+	if holder == name {
+		return nil
+	}
+	err := b.RemoveXAttr(holder, attr)
+	if err == syscall.ENODATA || err == syscall.ENOTSUP || err == syscall.ENOSYS {
+		return nil
+	}
+	return err
+}
+
+// RenameOrigin moves the number of the entry `from`, whose attributes
+// are `a`, along with it to `to`, and removes that of the entry `to`
+// replaced, whose attributes are `old`, or nil if there was none. It
+// is called after the entry is renamed in `b`.
+func RenameOrigin(b Branch, from, to string, a, old *fuse.Attr) error {
+	if old != nil {
+		if err := RemoveOrigin(b, to, old); err != nil {
+			return err
+		}
+	}
+	holder, _ := originOf(from, a)
+	if holder == from {
+		return nil
+	}
+	ino, err := GetOrigin(b, from, a)
+	if err != nil || ino == 0 {
+		return err
+	}
+	if err := RemoveOrigin(b, from, a); err != nil {
+		return err
+	}
+	return SetOrigin(b, to, a, ino)
+}
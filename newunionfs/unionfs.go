@@ -2,19 +2,40 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// Package unionfs implements a union file system on top of the fs
+// package. Changes are written to the first directory, while the
+// other directories are only read. Files from the read-only
+// directories are copied up to the writable one when they are
+// modified. Deletions of entries that exist in a read-only directory
+// are recorded as whiteouts in the writable directory. By default,
+// these are marker files, named after a hash of the path, in the
+// DELETIONS directory at the top of the writable directory, which
+// the union does not show; Options.Whiteouts selects other formats,
+// such as those of overlayfs and AUFS.
+//
+// Renaming a directory that has entries in a read-only directory
+// copies up the whole tree below it first.
 package unionfs
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
+	"encoding/binary"
 	"fmt"
-	"io/ioutil"
+	"hash/fnv"
 	"log"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/copyfile"
+	"github.com/hanwen/go-fuse/v2/internal/passthrough"
+	"golang.org/x/sys/unix"
 )
 
 func filePathHash(path string) string {
@@ -28,187 +49,423 @@ func filePathHash(path string) string {
 type unionFSRoot struct {
 	unionFSNode
 
-	roots []string
+	// branchMu protects roots, which Commit replaces rather than
+	// changes.
+	branchMu sync.RWMutex
+	roots    []string
+	// lowers are the branches of Options.Lowers, which come after
+	// roots.
+	lowers []*fsBranch
+
+	uidMap, gidMap fs.IDMap
+	whiteouts      Whiteouts
+	metacopy       bool
+
+	// opaqueMu protects opaque and opaqueGen.
+	opaqueMu sync.Mutex
+	// opaque caches whether directories are opaque, by branch
+	// directory and name. The writable branch only changes
+	// through the union, which drops the cache when it changes
+	// directories there, and increments opaqueGen.
+	opaque    map[[2]string]bool
+	opaqueGen uint64
+
+	// linksMu protects links.
+	linksMu sync.Mutex
+	// links holds the LinkIndex of the read-only branches, by
+	// branch directory.
+	links map[string]*LinkIndex
+
+	// devMu protects devs and rootDevs.
+	devMu sync.Mutex
+	// devs numbers the devices of the branch directories, for ino.
+	devs map[uint64]uint64
+	// rootDevs holds the device of each branch directory.
+	rootDevs map[string]uint64
+}
+
+// Options holds optional parameters for New.
+type Options struct {
+	// UIDMap and GIDMap translate user and group IDs between the
+	// union and the branches, like an idmapped mount. IDs without
+	// mapping are reported as fs.OverflowID.
+	UIDMap fs.IDMap
+	GIDMap fs.IDMap
+
+	// Whiteouts is the format in which deletions are recorded. If
+	// nil, NewDeletionsWhiteouts is used.
+	Whiteouts Whiteouts
+
+	// Metacopy makes changes to the metadata of a file from a
+	// read-only branch, such as chmod, chown or utimes, copy up
+	// only the metadata. The copy refers to the data in the
+	// read-only branch, which is copied up when the file is first
+	// opened for writing or truncated. Metacopies are only
+	// recognized with Metacopy set, so a writable branch that has
+	// them must always be mounted with it.
+	Metacopy bool
+
+	// Lowers are read-only branches below `roots` that are trees
+	// of nodes rather than directories, such as the archives of
+	// the zipfs package. They are not mounted themselves. Entries
+	// are copied up from them in full, and whiteouts in them are
+	// not recognized.
+	Lowers []fs.InodeEmbedder
+}
+
+// New returns the root of a union file system over the directories
+// `roots`. Changes are written to roots[0]; the other roots are only
+// read. `opts` may be nil.
+func New(roots []string, opts *Options) fs.InodeEmbedder {
+	if opts == nil {
+		opts = &Options{}
+	}
+	r := &unionFSRoot{
+		roots:     roots,
+		uidMap:    opts.UIDMap,
+		gidMap:    opts.GIDMap,
+		whiteouts: opts.Whiteouts,
+		metacopy:  opts.Metacopy,
+	}
+	if r.whiteouts == nil {
+		r.whiteouts = NewDeletionsWhiteouts()
+	}
+	r.devs = map[uint64]uint64{}
+	r.rootDevs = map[string]uint64{}
+	for _, root := range roots {
+		r.addRootDev(root)
+	}
+	for i, l := range opts.Lowers {
+		r.lowers = append(r.lowers, newFSBranch(l, fsBranchID|uint64(i)<<inoShift))
+	}
+	return r
 }
 
 type unionFSNode struct {
 	fs.Inode
+
+	// dataMu serializes copying up the data of the file, if it is
+	// a metacopy.
+	dataMu sync.Mutex
+
+	// entryMu protects entry.
+	entryMu sync.Mutex
+	// entry holds the device and the inode number in its branch of
+	// the entry the node was last found at, so its number need not
+	// be computed again when it is found there again.
+	entry [2]uint64
 }
 
 const delDir = "DELETIONS"
 
-var delDirHash = filePathHash(delDir)
+// upper returns the writable branch.
+func (r *unionFSRoot) upper() Branch {
+	return dirBranch(r.rootDir(0))
+}
 
-func (r *unionFSRoot) allMarkers(result map[string]struct{}) syscall.Errno {
-	dir := filepath.Join(r.roots[0], delDir)
+// branches returns the roots.
+func (r *unionFSRoot) branches() []string {
+	r.branchMu.RLock()
+	defer r.branchMu.RUnlock()
+	return r.roots
+}
 
-	ds, errno := fs.NewLoopbackDirStream(dir)
-	if errno != 0 {
-		return errno
+// rootDir returns the directory of the branch `idx`.
+func (r *unionFSRoot) rootDir(idx int) string {
+	return r.branches()[idx]
+}
+
+// lowerBranches returns the read-only branches.
+func (r *unionFSRoot) lowerBranches() []Branch {
+	var bs []Branch
+	for _, root := range r.branches()[1:] {
+		bs = append(bs, dirBranch(root))
 	}
+	return bs
+}
 
-	defer ds.Close()
-	for ds.HasNext() {
-		e, errno := ds.Next()
-		if errno != 0 {
-			return errno
-		}
-		if e.Mode != syscall.S_IFREG {
-			continue
-		}
-		result[e.Name] = struct{}{}
+// metacopyXattr marks a file in the writable branch whose data is
+// still in a read-only branch. Its value is the path of the data
+// relative to the branch root.
+const metacopyXattr = "user.unionfs.metacopy"
+
+// inoShift is the number of bits of the inode numbers of the
+// branches in the inode numbers of the union. The bits above hold
+// the number of the device, like with the xino option of overlayfs.
+const inoShift = 48
+
+// fsBranchID is set in the inode numbers of the branches of
+// Options.Lowers, which have the index of the branch in the bits
+// below it. Other inode numbers have the number of their device
+// there.
+const fsBranchID = 1 << 63
+
+// nestedDevID is set in the numbers of the devices that are mounted
+// inside a branch directory.
+const nestedDevID = 1 << 14
+
+// addRootDev numbers the device of the branch directory `root`.
+// Devices are numbered in the order of the branches, so the numbers
+// do not change when the union is mounted again.
+func (r *unionFSRoot) addRootDev(root string) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(root, &st); err != nil {
+		return
+	}
+	r.devMu.Lock()
+	defer r.devMu.Unlock()
+	dev := uint64(st.Dev)
+	r.rootDevs[root] = dev
+	if _, ok := r.devs[dev]; !ok {
+		r.devs[dev] = uint64(len(r.devs))
 	}
+}
 
-	return 0
+// devID returns the number of the device `dev` of an entry in the
+// branch directory `root`. Devices mounted inside a branch are
+// numbered by a hash of the device and of the number of the branch
+// device, so the numbers do not depend on the order in which they
+// are found. Two such devices may get the same number, and then
+// inode numbers may collide.
+func (r *unionFSRoot) devID(root string, dev uint64) uint64 {
+	r.devMu.Lock()
+	defer r.devMu.Unlock()
+	if id, ok := r.devs[dev]; ok {
+		return id
+	}
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:], r.devs[r.rootDevs[root]])
+	binary.LittleEndian.PutUint64(buf[8:], dev)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return nestedDevID | h.Sum64()%nestedDevID
 }
 
-func (r *unionFSRoot) rmMarker(name string) syscall.Errno {
-	err := syscall.Unlink(r.markerPath(name))
+// ino returns the inode number in the union of `name` in branch
+// `idx`, whose attributes are `st`. Inode numbers are unique across
+// branches, and do not change when an entry is copied up.
+func (r *unionFSRoot) ino(idx int, name string, st *syscall.Stat_t) uint64 {
+	if b := r.lower(idx); b != nil {
+		return b.id | st.Ino&(1<<inoShift-1)
+	}
+	var a fuse.Attr
+	a.FromStat(st)
+	ino, err := GetOrigin(dirBranch(r.rootDir(idx)), name, &a)
 	if err != nil {
-		return err.(syscall.Errno)
+		log.Printf("reading origin of %q: %v", name, err)
 	}
-	return 0
+	if ino != 0 {
+		return ino
+	}
+	return r.branchIno(idx, st)
 }
 
-func (r *unionFSRoot) writeMarker(name string) syscall.Errno {
-	dir := filepath.Join(r.roots[0], delDir)
-	var st syscall.Stat_t
-	if err := syscall.Stat(dir, &st); err == syscall.ENOENT {
-		if err := syscall.Mkdir(dir, 0755); err != nil {
-			log.Printf("Mkdir %q: %v", dir, err)
-			return syscall.EIO
+// branchIno returns the inode number in the union of the entry `st`
+// in branch `idx`, if it was not copied up.
+func (r *unionFSRoot) branchIno(idx int, st *syscall.Stat_t) uint64 {
+	if st.Ino>>inoShift != 0 {
+		// Does not fit; the number may collide.
+		return st.Ino
+	}
+	return r.devID(r.rootDir(idx), uint64(st.Dev))<<inoShift | st.Ino
+}
+
+// newChild returns the node for the child of `n` that has the inode
+// number `ino` in the union, and is the entry `st` in its branch.
+func (n *unionFSNode) newChild(ctx context.Context, ino uint64, st *syscall.Stat_t) *fs.Inode {
+	ch := n.NewInode(ctx, &unionFSNode{}, fs.StableAttr{Mode: st.Mode, Ino: ino})
+	if c, ok := ch.Operations().(*unionFSNode); ok {
+		c.entryMu.Lock()
+		c.entry = [2]uint64{uint64(st.Dev), st.Ino}
+		c.entryMu.Unlock()
+	}
+	return ch
+}
+
+// childIno returns the inode number in the union of the child
+// `name` of `n`, which is `p` in branch `idx` with the attributes
+// `st`. If the child has a node for that entry, it has the number
+// already, so the origin of an entry is only read when it is first
+// looked up.
+func (n *unionFSNode) childIno(name string, idx int, p string, st *syscall.Stat_t) uint64 {
+	if ch := n.GetChild(name); ch != nil {
+		if c, ok := ch.Operations().(*unionFSNode); ok {
+			c.entryMu.Lock()
+			found := c.entry == [2]uint64{uint64(st.Dev), st.Ino}
+			c.entryMu.Unlock()
+			if found {
+				return ch.StableAttr().Ino
+			}
 		}
-	} else if err != nil {
-		return err.(syscall.Errno)
 	}
+	return n.root().ino(idx, p, st)
+}
 
-	dest := r.markerPath(name)
+// isInternal reports whether `name` holds bookkeeping of the
+// whiteout format in the writable branch.
+func (r *unionFSRoot) isInternal(name string) bool {
+	return r.whiteouts.IsInternal(r.upper(), name)
+}
 
-	err := ioutil.WriteFile(dest, []byte(name), 0644)
-	return fs.ToErrno(err)
+// whiteout records that `name` is deleted.
+func (r *unionFSRoot) whiteout(ctx context.Context, name string) syscall.Errno {
+	if errno := r.promote(ctx, filepath.Dir(name)); errno != 0 {
+		return errno
+	}
+	return fs.ToErrno(r.whiteouts.Delete(r.upper(), name))
 }
 
-func (r *unionFSRoot) markerPath(name string) string {
-	return filepath.Join(r.roots[0], delDir, filePathHash(name))
+// undelete removes the whiteout for `name`, and reports whether
+// there was one.
+func (r *unionFSRoot) undelete(name string) (bool, syscall.Errno) {
+	b := r.upper()
+	if !r.whiteouts.IsDeleted(b, name) {
+		return false, 0
+	}
+	return true, fs.ToErrno(r.whiteouts.Undelete(b, name))
 }
 
-func (r *unionFSRoot) isDeleted(name string) bool {
-	var st syscall.Stat_t
-	err := syscall.Stat(r.markerPath(name), &st)
-	return err == nil
+// lower returns the branch `idx` if it is one of Options.Lowers, or
+// nil if it is a directory.
+func (r *unionFSRoot) lower(idx int) *fsBranch {
+	roots := r.branches()
+	if idx < len(roots) {
+		return nil
+	}
+	return r.lowers[idx-len(roots)]
 }
 
 func (n *unionFSNode) root() *unionFSRoot {
 	return n.Root().Operations().(*unionFSRoot)
 }
 
+// mapAttr translates the owner in `out` from the branches.
+func (r *unionFSRoot) mapAttr(out *fuse.Attr) {
+	fs.MapAttrOwner(r.uidMap, r.gidMap, out)
+}
+
+// preserveOwner makes the caller the owner of the newly created
+// `path`, if we have the privileges to do so.
+func (r *unionFSRoot) preserveOwner(ctx context.Context, path string) error {
+	return passthrough.PreserveMappedOwner(ctx, path, func(caller *fuse.Caller) (uint32, uint32) {
+		return fs.MapCaller(r.uidMap, r.gidMap, caller)
+	})
+}
+
 var _ = (fs.NodeSetattrer)((*unionFSNode)(nil))
 
 func (n *unionFSNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
-	if errno := n.promote(); errno != 0 {
+	r := n.root()
+	in, errno := fs.MapSetAttrIn(r.uidMap, r.gidMap, in)
+	if errno != 0 {
 		return errno
 	}
-
-	if fh != nil {
-		return fh.(fs.FileSetattrer).Setattr(ctx, in, out)
+	if errno := n.promote(ctx); errno != 0 {
+		return errno
+	}
+	if _, ok := in.GetSize(); ok {
+		if errno := n.copyUpData(n.Path(nil)); errno != 0 {
+			return errno
+		}
 	}
 
-	p := filepath.Join(n.root().roots[0], n.Path(nil))
-	fsa, ok := fh.(fs.FileSetattrer)
-	if ok && fsa != nil {
-		fsa.Setattr(ctx, in, out)
-	} else {
-		if m, ok := in.GetMode(); ok {
-			if err := syscall.Chmod(p, m); err != nil {
-				return fs.ToErrno(err)
-			}
+	// A lowerFile is not the copy we just made, so it is changed
+	// by path.
+	if fsa, ok := fh.(fs.FileSetattrer); ok {
+		if errno := fsa.Setattr(ctx, in, out); errno != 0 {
+			return errno
 		}
+		r.mapAttr(&out.Attr)
+		return 0
+	}
 
-		uid, uok := in.GetUID()
-		gid, gok := in.GetGID()
-		if uok || gok {
-			suid := -1
-			sgid := -1
-			if uok {
-				suid = int(uid)
-			}
-			if gok {
-				sgid = int(gid)
-			}
-			if err := syscall.Chown(p, suid, sgid); err != nil {
-				return fs.ToErrno(err)
-			}
+	p := filepath.Join(n.root().rootDir(0), n.Path(nil))
+	if m, ok := in.GetMode(); ok {
+		if err := syscall.Chmod(p, m); err != nil {
+			return fs.ToErrno(err)
 		}
+	}
 
-		mtime, mok := in.GetMTime()
-		atime, aok := in.GetATime()
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok || gok {
+		suid := -1
+		sgid := -1
+		if uok {
+			suid = int(uid)
+		}
+		if gok {
+			sgid = int(gid)
+		}
+		if err := syscall.Chown(p, suid, sgid); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
 
-		if mok || aok {
+	mtime, mok := in.GetMTime()
+	atime, aok := in.GetATime()
 
-			ap := &atime
-			mp := &mtime
-			if !aok {
-				ap = nil
-			}
-			if !mok {
-				mp = nil
-			}
-			var ts [2]syscall.Timespec
-			ts[0] = fuse.UtimeToTimespec(ap)
-			ts[1] = fuse.UtimeToTimespec(mp)
+	if mok || aok {
 
-			if err := syscall.UtimesNano(p, ts[:]); err != nil {
-				return fs.ToErrno(err)
-			}
+		ap := &atime
+		mp := &mtime
+		if !aok {
+			ap = nil
+		}
+		if !mok {
+			mp = nil
 		}
+		var ts [2]syscall.Timespec
+		ts[0] = fuse.UtimeToTimespec(ap)
+		ts[1] = fuse.UtimeToTimespec(mp)
 
-		if sz, ok := in.GetSize(); ok {
-			if err := syscall.Truncate(p, int64(sz)); err != nil {
-				return fs.ToErrno(err)
-			}
+		if err := syscall.UtimesNano(p, ts[:]); err != nil {
+			return fs.ToErrno(err)
 		}
 	}
 
-	fga, ok := fh.(fs.FileGetattrer)
-	if ok && fga != nil {
-		fga.Getattr(ctx, out)
-	} else {
-		st := syscall.Stat_t{}
-		err := syscall.Lstat(p, &st)
-		if err != nil {
+	if sz, ok := in.GetSize(); ok {
+		if err := syscall.Truncate(p, int64(sz)); err != nil {
 			return fs.ToErrno(err)
 		}
-		out.FromStat(&st)
 	}
+
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(p, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	out.FromStat(&st)
+	r.mapAttr(&out.Attr)
 	return 0
 }
 
 var _ = (fs.NodeCreater)((*unionFSNode)(nil))
 
 func (n *unionFSNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
-	if n.IsRoot() && name == delDir {
+	r := n.root()
+	if r.isInternal(filepath.Join(n.Path(nil), name)) {
 		return nil, nil, 0, syscall.EPERM
 	}
 
 	var st syscall.Stat_t
-	dirName, idx := n.getBranch(&st)
+	dirName, idx := n.getBranch(ctx, &st)
 	if idx > 0 {
-		if errno := n.promote(); errno != 0 {
+		if errno := n.promote(ctx); errno != 0 {
 			return nil, nil, 0, errno
 		}
 		idx = 0
 	}
 	fullPath := filepath.Join(dirName, name)
-	r := n.root()
-	if errno := r.rmMarker(fullPath); errno != 0 && errno != syscall.ENOENT {
+	if _, errno := r.undelete(fullPath); errno != 0 {
 		return nil, nil, 0, errno
 	}
 
-	abs := filepath.Join(n.root().roots[0], fullPath)
-	fd, err := syscall.Creat(abs, mode)
+	abs := filepath.Join(n.root().rootDir(0), fullPath)
+	fd, err := syscall.Open(abs, int(flags)|os.O_CREATE, mode)
 	if err != nil {
 		return nil, nil, 0, err.(syscall.Errno)
 	}
+	r.preserveOwner(ctx, abs)
 
 	if err := syscall.Fstat(fd, &st); err != nil {
 		// now what?
@@ -217,8 +474,10 @@ func (n *unionFSNode) Create(ctx context.Context, name string, flags uint32, mod
 		return nil, nil, 0, err.(syscall.Errno)
 	}
 
-	ch := n.NewInode(ctx, &unionFSNode{}, fs.StableAttr{Mode: st.Mode, Ino: st.Ino})
+	ch := n.newChild(ctx, r.ino(0, fullPath, &st), &st)
 	out.FromStat(&st)
+	out.Ino = ch.StableAttr().Ino
+	r.mapAttr(&out.Attr)
 
 	return ch, fs.NewLoopbackFile(fd), 0, 0
 }
@@ -228,52 +487,94 @@ var _ = (fs.NodeOpener)((*unionFSNode)(nil))
 func (n *unionFSNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
 	isWR := (flags&syscall.O_RDWR != 0) || (flags&syscall.O_WRONLY != 0)
 
+	r := n.root()
 	var st syscall.Stat_t
-	nm, idx := n.getBranch(&st)
-	if isWR && idx > 0 {
-		if errno := n.promote(); errno != 0 {
+	nm, idx := n.getBranch(ctx, &st)
+	if idx < 0 {
+		return nil, 0, syscall.ENOENT
+	}
+	if isWR {
+		if idx > 0 {
+			if errno := n.promote(ctx); errno != 0 {
+				return nil, 0, errno
+			}
+			idx = 0
+		}
+		if errno := n.copyUpData(nm); errno != 0 {
 			return nil, 0, errno
 		}
-		idx = 0
 	}
 
-	fd, err := syscall.Open(filepath.Join(n.root().roots[idx], nm), int(flags), 0)
+	if b := r.lower(idx); b != nil {
+		return b.open(ctx, nm)
+	}
+
+	p := filepath.Join(r.rootDir(idx), nm)
+	lower := idx > 0
+	if idx == 0 && !isWR {
+		data, errno := r.metacopyData(nm)
+		if errno != 0 {
+			return nil, 0, errno
+		}
+		if data != "" {
+			p, lower = data, true
+		}
+	}
+
+	fd, err := syscall.Open(p, int(flags), 0)
 	if err != nil {
 		return nil, 0, err.(syscall.Errno)
 	}
 
+	if lower {
+		return &lowerFile{fs.NewLoopbackFile(fd)}, 0, 0
+	}
 	return fs.NewLoopbackFile(fd), 0, 0
 }
 
 var _ = (fs.NodeGetattrer)((*unionFSNode)(nil))
 
 func (n *unionFSNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if _, ok := fh.(*lowerFile); ok && n.root().getBranch(ctx, n.Path(nil), nil) == 0 {
+		// The file was copied up after it was opened.
+		fh = nil
+	}
+	if fga, ok := fh.(fs.FileGetattrer); ok {
+		// The file may have been removed or replaced.
+		if errno := fga.Getattr(ctx, out); errno != 0 {
+			return errno
+		}
+		out.Ino = n.StableAttr().Ino
+		n.root().mapAttr(&out.Attr)
+		return 0
+	}
+
 	var st syscall.Stat_t
-	_, idx := n.getBranch(&st)
+	_, idx := n.getBranch(ctx, &st)
 	if idx < 0 {
 		return syscall.ENOENT
 	}
 
 	out.FromStat(&st)
+	// The node may stand for several names, or have been copied
+	// up, so the inode number is that of the node.
+	out.Ino = n.StableAttr().Ino
+	n.root().mapAttr(&out.Attr)
 	return 0
 }
 
 var _ = (fs.NodeLookuper)((*unionFSNode)(nil))
 
 func (n *unionFSNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	if n.IsRoot() && name == delDir {
-		return nil, syscall.ENOENT
-	}
-
 	var st syscall.Stat_t
 
 	p := filepath.Join(n.Path(nil), name)
-	idx := n.root().getBranch(p, &st)
+	idx := n.root().getBranch(ctx, p, &st)
 	if idx >= 0 {
-		// XXX use idx in Ino?
-		ch := n.NewInode(ctx, &unionFSNode{}, fs.StableAttr{Mode: st.Mode, Ino: st.Ino})
+		ch := n.newChild(ctx, n.childIno(name, idx, p, &st), &st)
 		out.FromStat(&st)
-		out.Mode |= 0111
+		out.Ino = ch.StableAttr().Ino
+		n.root().mapAttr(&out.Attr)
 		return ch, 0
 	}
 	return nil, syscall.ENOENT
@@ -282,47 +583,359 @@ func (n *unionFSNode) Lookup(ctx context.Context, name string, out *fuse.EntryOu
 var _ = (fs.NodeUnlinker)((*unionFSNode)(nil))
 
 func (n *unionFSNode) Unlink(ctx context.Context, name string) syscall.Errno {
-	return n.root().delPath(filepath.Join(n.Path(nil), name))
+	return n.root().delPath(ctx, filepath.Join(n.Path(nil), name))
 }
 
 var _ = (fs.NodeRmdirer)((*unionFSNode)(nil))
 
 func (n *unionFSNode) Rmdir(ctx context.Context, name string) syscall.Errno {
-	return n.root().delPath(filepath.Join(n.Path(nil), name))
+	r := n.root()
+	p := filepath.Join(n.Path(nil), name)
+
+	var st syscall.Stat_t
+	idx := r.getBranch(ctx, p, &st)
+	if idx < 0 {
+		return syscall.ENOENT
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return syscall.ENOTDIR
+	}
+	if len(r.readDir(ctx, p)) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	if idx == 0 {
+		// The directory may still hold whiteouts.
+		names := map[string]uint32{}
+		readRoot(r.rootDir(0), p, names)
+		for nm := range names {
+			ch := filepath.Join(p, nm)
+			if r.isInternal(ch) || r.whiteouts.IsDeleted(r.upper(), ch) {
+				if err := os.Remove(filepath.Join(r.rootDir(0), ch)); err != nil {
+					return fs.ToErrno(err)
+				}
+			}
+		}
+		if err := syscall.Rmdir(filepath.Join(r.rootDir(0), p)); err != nil {
+			return fs.ToErrno(err)
+		}
+		r.dropOpaque()
+		idx = r.getBranch(ctx, p, &st)
+	}
+	if idx > 0 {
+		return r.whiteout(ctx, p)
+	}
+	return 0
 }
 
 var _ = (fs.NodeSymlinker)((*unionFSNode)(nil))
 
 func (n *unionFSNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	n.promote()
-	path := filepath.Join(n.root().roots[0], n.Path(nil), name)
-	err := syscall.Symlink(target, path)
+	return n.mkchild(ctx, name, out, 0, func(p string) error {
+		return syscall.Symlink(target, p)
+	})
+}
 
-	if err != nil {
-		return nil, err.(syscall.Errno)
+var _ = (fs.NodeMkdirer)((*unionFSNode)(nil))
+
+func (n *unionFSNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return n.mkchild(ctx, name, out, 0, func(p string) error {
+		return syscall.Mkdir(p, mode)
+	})
+}
+
+var _ = (fs.NodeMknoder)((*unionFSNode)(nil))
+
+func (n *unionFSNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return n.mkchild(ctx, name, out, 0, func(p string) error {
+		return syscall.Mknod(p, mode, int(rdev))
+	})
+}
+
+var _ = (fs.NodeLinker)((*unionFSNode)(nil))
+
+func (n *unionFSNode) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	r := n.root()
+	orig := target.EmbeddedInode().Path(nil)
+	if errno := r.promote(ctx, orig); errno != 0 {
+		return nil, errno
 	}
+	// The link is the node of the target.
+	ino := target.EmbeddedInode().StableAttr().Ino
+	return n.mkchild(ctx, name, out, ino, func(p string) error {
+		return syscall.Link(filepath.Join(r.rootDir(0), orig), p)
+	})
+}
+
+// mkchild creates the child `name` in the writable branch by calling
+// `mk` with its path. If it is a link, `ino` is the number of the
+// target; otherwise it is 0.
+func (n *unionFSNode) mkchild(ctx context.Context, name string, out *fuse.EntryOut, ino uint64, mk func(path string) error) (*fs.Inode, syscall.Errno) {
+	r := n.root()
+	p := filepath.Join(n.Path(nil), name)
+	if r.isInternal(p) {
+		return nil, syscall.EPERM
+	}
+	if r.getBranch(ctx, p, nil) >= 0 {
+		return nil, syscall.EEXIST
+	}
+	if errno := n.promote(ctx); errno != 0 {
+		return nil, errno
+	}
+
+	deleted, errno := r.undelete(p)
+	if errno != 0 {
+		return nil, errno
+	}
+	abs := filepath.Join(r.rootDir(0), p)
+	if err := mk(abs); err != nil {
+		if deleted {
+			r.whiteout(ctx, p)
+		}
+		return nil, fs.ToErrno(err)
+	}
+	r.preserveOwner(ctx, abs)
 
 	var st syscall.Stat_t
-	if err := syscall.Lstat(path, &st); err != nil {
-		return nil, err.(syscall.Errno)
+	if err := syscall.Lstat(abs, &st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	if deleted && st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		// The directory replaces a deleted one, whose entries
+		// must stay deleted.
+		if errno := r.hideLower(ctx, p); errno != 0 {
+			return nil, errno
+		}
 	}
 
-	out.FromStat(&st)
+	var a fuse.Attr
+	a.FromStat(&st)
+	var err error
+	if ino != 0 {
+		err = SetOrigin(r.upper(), p, &a, ino)
+	} else {
+		// A new entry does not take the number of one that was
+		// removed outside the union.
+		err = RemoveOrigin(r.upper(), p, &a)
+		ino = r.branchIno(0, &st)
+	}
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
 
-	ch := n.NewInode(ctx, &unionFSNode{}, fs.StableAttr{
-		Mode: syscall.S_IFLNK,
-		Ino:  st.Ino,
-	})
+	out.FromStat(&st)
+	out.Ino = ino
+	r.mapAttr(&out.Attr)
+	ch := n.newChild(ctx, ino, &st)
 	return ch, 0
 }
 
+// hideLower makes the directory `dir` in the writable branch hide
+// the entries of the read-only branches.
+func (r *unionFSRoot) hideLower(ctx context.Context, dir string) syscall.Errno {
+	names := map[string]uint32{}
+	roots := r.branches()
+	for _, root := range roots[1:] {
+		readRoot(root, dir, names)
+	}
+	for _, b := range r.lowers {
+		b.readDir(ctx, dir, names)
+	}
+	var lower []string
+	for nm := range names {
+		if nm != "." && nm != ".." {
+			lower = append(lower, nm)
+		}
+	}
+	defer r.dropOpaque()
+	return fs.ToErrno(r.whiteouts.SetOpaque(r.upper(), dir, lower))
+}
+
+var _ = (fs.NodeRenamer)((*unionFSNode)(nil))
+
+func (n *unionFSNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags&fs.RENAME_EXCHANGE != 0 {
+		return syscall.ENOTSUP
+	}
+	r := n.root()
+	src := filepath.Join(n.Path(nil), name)
+	dst := filepath.Join(newParent.EmbeddedInode().Path(nil), newName)
+	if r.isInternal(dst) {
+		return syscall.EPERM
+	}
+
+	var srcSt, dstSt syscall.Stat_t
+	if r.getBranch(ctx, src, &srcSt) < 0 {
+		return syscall.ENOENT
+	}
+	srcDir := srcSt.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	var srcAttr fuse.Attr
+	srcAttr.FromStat(&srcSt)
+	var replaced *fuse.Attr
+	if r.getBranch(ctx, dst, &dstSt) >= 0 {
+		replaced = &fuse.Attr{}
+		replaced.FromStat(&dstSt)
+		if flags&fs.RENAME_NOREPLACE != 0 {
+			return syscall.EEXIST
+		}
+		dstDir := dstSt.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		if srcDir && !dstDir {
+			return syscall.ENOTDIR
+		}
+		if !srcDir && dstDir {
+			return syscall.EISDIR
+		}
+		if dstDir && len(r.readDir(ctx, dst)) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	// A directory is moved along with its entries, so they must
+	// all be in the writable branch.
+	promote := r.promote
+	if srcDir {
+		promote = r.promoteTree
+	}
+	if errno := promote(ctx, src); errno != 0 {
+		return errno
+	}
+	if errno := r.promote(ctx, filepath.Dir(dst)); errno != 0 {
+		return errno
+	}
+
+	deleted, errno := r.undelete(dst)
+	if errno != 0 {
+		return errno
+	}
+	if err := syscall.Rename(filepath.Join(r.rootDir(0), src), filepath.Join(r.rootDir(0), dst)); err != nil {
+		if deleted {
+			r.whiteout(ctx, dst)
+		}
+		return fs.ToErrno(err)
+	}
+	if err := RenameOrigin(r.upper(), src, dst, &srcAttr, replaced); err != nil {
+		return fs.ToErrno(err)
+	}
+	if srcDir {
+		r.dropOpaque()
+	}
+	if deleted && srcDir {
+		if errno := r.hideLower(ctx, dst); errno != 0 {
+			return errno
+		}
+	}
+	if r.getBranch(ctx, src, nil) > 0 {
+		return r.whiteout(ctx, src)
+	}
+	return 0
+}
+
+var _ = (fs.NodeGetxattrer)((*unionFSNode)(nil))
+
+func (n *unionFSNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	nm, idx := n.getBranch(ctx, nil)
+	if idx < 0 {
+		return 0, syscall.ENOENT
+	}
+	if isUnionXattr(attr) {
+		return 0, syscall.ENODATA
+	}
+	if b := n.root().lower(idx); b != nil {
+		return b.getxattr(ctx, nm, attr, dest)
+	}
+	sz, err := unix.Lgetxattr(filepath.Join(n.root().rootDir(idx), nm), attr, dest)
+	return uint32(sz), fs.ToErrno(err)
+}
+
+var _ = (fs.NodeListxattrer)((*unionFSNode)(nil))
+
+func (n *unionFSNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	nm, idx := n.getBranch(ctx, nil)
+	if idx < 0 {
+		return 0, syscall.ENOENT
+	}
+	if b := n.root().lower(idx); b != nil {
+		return b.listxattr(ctx, nm, dest)
+	}
+	p := filepath.Join(n.root().rootDir(idx), nm)
+	sz, err := unix.Llistxattr(p, nil)
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
+	buf := make([]byte, sz)
+	sz, err = unix.Llistxattr(p, buf)
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
+
+	var list []byte
+	for _, attr := range bytes.SplitAfter(buf[:sz], []byte{0}) {
+		if len(attr) > 0 && !isUnionXattr(string(attr[:len(attr)-1])) {
+			list = append(list, attr...)
+		}
+	}
+	if len(dest) == 0 {
+		return uint32(len(list)), 0
+	}
+	if len(dest) < len(list) {
+		return 0, syscall.ERANGE
+	}
+	return uint32(copy(dest, list)), 0
+}
+
+var _ = (fs.NodeSetxattrer)((*unionFSNode)(nil))
+
+func (n *unionFSNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if isUnionXattr(attr) {
+		return syscall.EPERM
+	}
+	if errno := n.promote(ctx); errno != 0 {
+		return errno
+	}
+	r := n.root()
+	defer r.dropOpaque()
+	p := filepath.Join(r.rootDir(0), n.Path(nil))
+	return fs.ToErrno(unix.Lsetxattr(p, attr, data, int(flags)))
+}
+
+var _ = (fs.NodeRemovexattrer)((*unionFSNode)(nil))
+
+func (n *unionFSNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	if isUnionXattr(attr) {
+		return syscall.EPERM
+	}
+	if errno := n.promote(ctx); errno != 0 {
+		return errno
+	}
+	r := n.root()
+	defer r.dropOpaque()
+	p := filepath.Join(r.rootDir(0), n.Path(nil))
+	return fs.ToErrno(unix.Lremovexattr(p, attr))
+}
+
+var _ = (fs.NodeStatfser)((*unionFSNode)(nil))
+
+func (n *unionFSNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	s := syscall.Statfs_t{}
+	if err := syscall.Statfs(n.root().rootDir(0), &s); err != nil {
+		return fs.ToErrno(err)
+	}
+	out.FromStatfsT(&s)
+	return 0
+}
+
 var _ = (fs.NodeReadlinker)((*unionFSNode)(nil))
 
 func (n *unionFSNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
-	nm, idx := n.getBranch(nil)
+	nm, idx := n.getBranch(ctx, nil)
+	if idx < 0 {
+		return nil, syscall.ENOENT
+	}
+	if b := n.root().lower(idx); b != nil {
+		return b.readlink(ctx, nm)
+	}
 
 	var buf [1024]byte
-	count, err := syscall.Readlink(filepath.Join(n.root().roots[idx], nm), buf[:])
+	count, err := syscall.Readlink(filepath.Join(n.root().rootDir(idx), nm), buf[:])
 	if err != nil {
 		return nil, err.(syscall.Errno)
 	}
@@ -333,32 +946,35 @@ func (n *unionFSNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
 var _ = (fs.NodeReaddirer)((*unionFSNode)(nil))
 
 func (n *unionFSNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	root := n.root()
-
-	markers := map[string]struct{}{delDirHash: struct{}{}}
-	// ignore error: assume no markers
-	root.allMarkers(markers)
-
-	dir := n.Path(nil)
+	return fs.NewListDirStream(n.root().readDir(ctx, n.Path(nil))), 0
+}
 
+// readDir returns the entries of `dir` that are not deleted, from
+// all branches.
+func (r *unionFSRoot) readDir(ctx context.Context, dir string) []fuse.DirEntry {
 	names := map[string]uint32{}
-	for i := range root.roots {
-		// deepest root first.
-		readRoot(root.roots[len(root.roots)-i-1], dir, names)
+	roots := r.branches()
+	for _, root := range roots {
+		readRoot(root, dir, names)
+	}
+	for _, b := range r.lowers {
+		b.readDir(ctx, dir, names)
 	}
 	result := make([]fuse.DirEntry, 0, len(names))
-	for nm, mode := range names {
-		marker := filePathHash(filepath.Join(dir, nm))
-		if _, ok := markers[marker]; ok {
+	for nm := range names {
+		if nm == "." || nm == ".." {
+			continue
+		}
+		var st syscall.Stat_t
+		if r.getBranch(ctx, filepath.Join(dir, nm), &st) < 0 {
 			continue
 		}
 		result = append(result, fuse.DirEntry{
 			Name: nm,
-			Mode: mode,
+			Mode: st.Mode,
 		})
 	}
-
-	return fs.NewListDirStream(result), 0
+	return result
 }
 
 func readRoot(root string, dir string, result map[string]uint32) {
@@ -378,137 +994,416 @@ func readRoot(root string, dir string, result map[string]uint32) {
 }
 
 // getBranch returns the root where we can find the given file. It
-// will check the deletion markers in roots[0].
-func (n *unionFSNode) getBranch(st *syscall.Stat_t) (string, int) {
+// will check the whiteouts in the roots above it.
+func (n *unionFSNode) getBranch(ctx context.Context, st *syscall.Stat_t) (string, int) {
 	name := n.Path(nil)
-	return name, n.root().getBranch(name, st)
+	return name, n.root().getBranch(ctx, name, st)
 }
 
-func (r *unionFSRoot) getBranch(name string, st *syscall.Stat_t) int {
-	if r.isDeleted(name) {
-		return -1
-	}
+func (r *unionFSRoot) getBranch(ctx context.Context, name string, st *syscall.Stat_t) int {
 	if st == nil {
 		st = &syscall.Stat_t{}
 	}
-	for i, root := range r.roots {
+	roots := r.branches()
+	for i, root := range roots {
+		b := dirBranch(root)
+		if r.whiteouts.IsInternal(b, name) || r.whiteouts.IsDeleted(b, name) {
+			return -1
+		}
 		p := filepath.Join(root, name)
 		err := syscall.Lstat(p, st)
 		if err == nil {
 			return i
 		}
+		if r.hidesBelow(root, name) {
+			return -1
+		}
+	}
+	for i, b := range r.lowers {
+		if b.lstat(ctx, name, st) == 0 {
+			return len(roots) + i
+		}
 	}
 	return -1
 }
 
-func (n *unionFSRoot) delPath(p string) syscall.Errno {
+// hidesBelow reports whether an opaque directory in `root` hides
+// `name` in the roots below it.
+func (r *unionFSRoot) hidesBelow(root, name string) bool {
+	for dir := filepath.Dir(name); ; dir = filepath.Dir(dir) {
+		if r.isOpaque(root, dir) {
+			return true
+		}
+		if dir == "." {
+			return false
+		}
+	}
+}
+
+// isOpaque reports whether the directory `dir` in `root` is opaque.
+func (r *unionFSRoot) isOpaque(root, dir string) bool {
+	key := [2]string{root, dir}
+	r.opaqueMu.Lock()
+	opaque, ok := r.opaque[key]
+	gen := r.opaqueGen
+	r.opaqueMu.Unlock()
+	if ok {
+		return opaque
+	}
+
+	opaque = r.whiteouts.IsOpaque(dirBranch(root), dir)
+	r.opaqueMu.Lock()
+	defer r.opaqueMu.Unlock()
+	if gen == r.opaqueGen {
+		if r.opaque == nil {
+			r.opaque = map[[2]string]bool{}
+		}
+		r.opaque[key] = opaque
+	}
+	return opaque
+}
+
+// dropOpaque forgets what is cached about the writable branch for
+// isOpaque. The read-only branches do not change.
+func (r *unionFSRoot) dropOpaque() {
+	upper := r.rootDir(0)
+	r.opaqueMu.Lock()
+	defer r.opaqueMu.Unlock()
+	r.opaqueGen++
+	for k := range r.opaque {
+		if k[0] == upper {
+			delete(r.opaque, k)
+		}
+	}
+}
+
+func (n *unionFSRoot) delPath(ctx context.Context, p string) syscall.Errno {
 	var st syscall.Stat_t
 	r := n.root()
-	idx := r.getBranch(p, &st)
+	idx := r.getBranch(ctx, p, &st)
 
 	if idx < 0 {
 		return 0
 	}
 	if idx == 0 {
-		err := syscall.Unlink(filepath.Join(r.roots[idx], p))
+		var a fuse.Attr
+		a.FromStat(&st)
+		if err := RemoveOrigin(r.upper(), p, &a); err != nil {
+			return fs.ToErrno(err)
+		}
+		err := syscall.Unlink(filepath.Join(r.rootDir(idx), p))
 		if err != nil {
 			return fs.ToErrno(err)
 		}
-		idx = r.getBranch(p, &st)
+		idx = r.getBranch(ctx, p, &st)
 	}
 	if idx > 0 {
-		return r.writeMarker(p)
+		return r.whiteout(ctx, p)
 	}
 
 	return 0
 }
 
-func (n *unionFSNode) promote() syscall.Errno {
-	p := &n.Inode
-	r := n.root()
+// promote copies the node and its parent directories to the
+// writable branch.
+func (n *unionFSNode) promote(ctx context.Context) syscall.Errno {
+	return n.root().promote(ctx, n.Path(nil))
+}
 
-	type tup struct {
-		*unionFSNode
-		name string
-		idx  int
-		st   syscall.Stat_t
+// promote copies `name` and its parent directories to the writable
+// branch.
+func (r *unionFSRoot) promote(ctx context.Context, name string) syscall.Errno {
+	if name == "" || name == "." {
+		return 0
+	}
+	var names []string
+	for p := name; p != "."; p = filepath.Dir(p) {
+		names = append(names, p)
 	}
 
-	var parents []tup
-	for p != nil && p != &r.Inode {
-		asUN := p.Operations().(*unionFSNode)
+	for i := len(names) - 1; i >= 0; i-- {
+		path := names[i]
 
-		var st syscall.Stat_t
-		name, idx := asUN.getBranch(&st)
+		idx := r.getBranch(ctx, path, nil)
 		if idx == 0 {
-			break
+			continue
 		}
 		if idx < 0 {
 			log.Println("promote called on nonexistent file")
 			return syscall.EIO
 		}
-
-		parents = append(parents, tup{asUN, name, idx, st})
-		_, p = p.Parent()
+		if errno := r.copyUp(ctx, path, idx); errno != 0 {
+			return errno
+		}
 	}
+	return 0
+}
 
-	for i := len(parents) - 1; i >= 0; i-- {
-		t := parents[i]
-
-		path := t.Path(nil)
-		if t.IsDir() {
-			if err := syscall.Mkdir(filepath.Join(r.roots[0], path), t.st.Mode); err != nil {
-				return err.(syscall.Errno)
-			}
-		} else if t.Mode()&syscall.S_IFREG != 0 {
-			if errno := r.promoteRegularFile(path, t.idx, &t.st); errno != 0 {
+// promoteTree promotes `name` and, if it is a directory, all entries
+// below it.
+func (r *unionFSRoot) promoteTree(ctx context.Context, name string) syscall.Errno {
+	if errno := r.promote(ctx, name); errno != 0 {
+		return errno
+	}
+	for _, e := range r.readDir(ctx, name) {
+		p := filepath.Join(name, e.Name)
+		if e.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			if errno := r.promote(ctx, p); errno != 0 {
 				return errno
 			}
-		} else {
-			log.Panicf("don't know how to handle mode %o", t.Mode())
+			continue
+		}
+		if errno := r.promoteTree(ctx, p); errno != 0 {
+			return errno
 		}
-		var ts [2]syscall.Timespec
-		ts[0] = t.st.Atim
-		ts[1] = t.st.Mtim
-
-		// ignore error.
-		syscall.UtimesNano(path, ts[:])
 	}
 	return 0
 }
 
-func (r *unionFSRoot) promoteRegularFile(p string, idx int, st *syscall.Stat_t) syscall.Errno {
-	dest, err := syscall.Creat(filepath.Join(r.roots[0], p), st.Mode)
-	if err != nil {
-		return err.(syscall.Errno)
+// copyUp copies `p` from branch `idx` to the writable branch, whose
+// parent directory must exist.
+func (r *unionFSRoot) copyUp(ctx context.Context, p string, idx int) syscall.Errno {
+	// Creating the entry changes the times of the parent, which
+	// is restored like it is after copying up with overlayfs.
+	parent := filepath.Join(r.rootDir(0), filepath.Dir(p))
+	var st syscall.Stat_t
+	if err := syscall.Lstat(parent, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	var src syscall.Stat_t
+	var err error
+	dst := filepath.Join(r.rootDir(0), p)
+	if b := r.lower(idx); b != nil {
+		if errno := b.lstat(ctx, p, &src); errno != 0 {
+			return errno
+		}
+		err = b.copyUp(ctx, p, dst)
+	} else {
+		if err := syscall.Lstat(filepath.Join(r.rootDir(idx), p), &src); err != nil {
+			return fs.ToErrno(err)
+		}
+		err = r.copyEntry(filepath.Join(r.rootDir(idx), p), dst, p)
 	}
-	src, err := syscall.Open(filepath.Join(r.roots[idx], p), syscall.O_RDONLY, 0)
 	if err != nil {
-		syscall.Close(dest)
-		return err.(syscall.Errno)
+		return fs.ToErrno(err)
+	}
+	var a fuse.Attr
+	a.FromStat(&src)
+	if err := SetOrigin(r.upper(), p, &a, r.ino(idx, p, &src)); err != nil {
+		os.Remove(dst)
+		return fs.ToErrno(err)
 	}
 
-	var ret syscall.Errno
-	var buf [128 >> 10]byte
-	for {
-		n, err := syscall.Read(src, buf[:])
-		if n == 0 {
-			break
+	ts := []syscall.Timespec{st.Atim, st.Mtim}
+	// ignore error: the copy is complete.
+	syscall.UtimesNano(parent, ts)
+	return r.copyUpLinks(ctx, p, idx)
+}
+
+// copyUpLinks links the other names of `p`, if it is a file with
+// several links in branch `idx`, to its copy in the writable branch,
+// so the copy is shared like the original.
+func (r *unionFSRoot) copyUpLinks(ctx context.Context, p string, idx int) syscall.Errno {
+	if r.lower(idx) != nil {
+		return 0
+	}
+	root := r.rootDir(idx)
+	a, err := dirBranch(root).Lstat(p)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	for _, nm := range r.lowerLinks(root).Links(p, a) {
+		// Other names may be hidden, or replaced in the branches
+		// above.
+		if r.getBranch(ctx, nm, nil) != idx {
+			continue
 		}
-		if err != nil {
-			ret = err.(syscall.Errno)
-			break
+		dir := filepath.Dir(nm)
+		if errno := r.promote(ctx, dir); errno != 0 {
+			return errno
 		}
+		parent := filepath.Join(r.rootDir(0), dir)
+		var st syscall.Stat_t
+		if err := syscall.Lstat(parent, &st); err != nil {
+			return fs.ToErrno(err)
+		}
+		if err := syscall.Link(filepath.Join(r.rootDir(0), p), filepath.Join(r.rootDir(0), nm)); err != nil {
+			return fs.ToErrno(err)
+		}
+		syscall.UtimesNano(parent, []syscall.Timespec{st.Atim, st.Mtim})
+	}
+	return 0
+}
+
+// lowerLinks returns the LinkIndex of the read-only branch `root`.
+func (r *unionFSRoot) lowerLinks(root string) *LinkIndex {
+	r.linksMu.Lock()
+	defer r.linksMu.Unlock()
+	if r.links == nil {
+		r.links = map[string]*LinkIndex{}
+	}
+	x := r.links[root]
+	if x == nil {
+		x = NewLinkIndex(dirBranch(root))
+		r.links[root] = x
+	}
+	return x
+}
+
+// copyEntry copies `src` to `dst` for the copy-up of `name`. In
+// metacopy mode, the data of regular files stays at `src`.
+func (r *unionFSRoot) copyEntry(src, dst, name string) error {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(src, &st); err != nil {
+		return err
+	}
+	if !r.metacopy || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return copyfile.Copy(src, dst, isInternalXattr)
+	}
+
+	if err := copyfile.CopyMetadata(src, dst, isInternalXattr); err != nil {
+		return err
+	}
+	if err := unix.Lsetxattr(dst, metacopyXattr, []byte(name), 0); err != nil {
+		// The branch cannot store the reference, so we need
+		// the data after all.
+		os.Remove(dst)
+		return copyfile.Copy(src, dst, isInternalXattr)
+	}
+	return nil
+}
 
-		if _, err := syscall.Write(dest, buf[:n]); err != nil {
-			ret = err.(syscall.Errno)
-			break
+// metacopyData returns the path of the data of `name` if it is a
+// metacopy in the writable branch, or "" otherwise.
+func (r *unionFSRoot) metacopyData(name string) (string, syscall.Errno) {
+	if !r.metacopy {
+		return "", 0
+	}
+	buf := make([]byte, syscall.PathMax)
+	sz, err := unix.Lgetxattr(filepath.Join(r.rootDir(0), name), metacopyXattr, buf)
+	if err == syscall.ENODATA || err == syscall.ENOTSUP {
+		return "", 0
+	} else if err != nil {
+		return "", fs.ToErrno(err)
+	}
+
+	// Like overlayfs redirects, the reference is found in the
+	// first read-only branch that has it.
+	redirect := string(buf[:sz])
+	roots := r.branches()
+	for _, root := range roots[1:] {
+		p := filepath.Join(root, redirect)
+		var st syscall.Stat_t
+		if syscall.Lstat(p, &st) == nil && st.Mode&syscall.S_IFMT == syscall.S_IFREG {
+			return p, 0
 		}
 	}
-	syscall.Close(src)
+	log.Printf("data %q of metacopy %q not found", redirect, name)
+	return "", syscall.EIO
+}
+
+// copyUpData copies the data of `name` to the writable branch, if it
+// is a metacopy.
+func (n *unionFSNode) copyUpData(name string) syscall.Errno {
+	n.dataMu.Lock()
+	defer n.dataMu.Unlock()
+	return n.root().fetchData(name)
+}
 
-	if err := syscall.Close(dest); err != nil && ret == 0 {
-		ret = err.(syscall.Errno)
+// fetchData does the work of copyUpData, for callers that make sure
+// that the file is not copied up concurrently.
+func (r *unionFSRoot) fetchData(name string) syscall.Errno {
+	data, errno := r.metacopyData(name)
+	if data == "" {
+		return errno
 	}
-	return ret
+
+	p := filepath.Join(r.rootDir(0), name)
+	var st syscall.Stat_t
+	if err := syscall.Lstat(p, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	if err := copyfile.CopyData(data, p); err != nil {
+		return fs.ToErrno(err)
+	}
+	// Writing the data changed the times of the copy.
+	ts := []syscall.Timespec{st.Atim, st.Mtim}
+	if err := syscall.UtimesNano(p, ts); err != nil {
+		return fs.ToErrno(err)
+	}
+	return fs.ToErrno(unix.Lremovexattr(p, metacopyXattr))
+}
+
+// isInternalXattr reports whether `name` is an attribute of whiteout
+// or union bookkeeping, which is not copied up.
+func isInternalXattr(name string) bool {
+	return strings.HasPrefix(name, "trusted.overlay.") || strings.HasPrefix(name, "user.overlay.") ||
+		isUnionXattr(name)
+}
+
+// isUnionXattr reports whether `name` is an attribute that the union
+// keeps, and hides from its users.
+func isUnionXattr(name string) bool {
+	return name == metacopyXattr || strings.HasPrefix(name, originXattr)
+}
+
+// lowerFile is a handle for reading a file in a read-only branch.
+// Once the file is copied up, its attributes are those of the copy,
+// so lowerFile does not set them.
+type lowerFile struct {
+	fh fs.FileHandle
+}
+
+var _ = (fs.FileReader)((*lowerFile)(nil))
+
+func (f *lowerFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	return f.fh.(fs.FileReader).Read(ctx, dest, off)
+}
+
+var _ = (fs.FileGetattrer)((*lowerFile)(nil))
+
+func (f *lowerFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	return f.fh.(fs.FileGetattrer).Getattr(ctx, out)
+}
+
+var _ = (fs.FileLseeker)((*lowerFile)(nil))
+
+func (f *lowerFile) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
+	return f.fh.(fs.FileLseeker).Lseek(ctx, off, whence)
+}
+
+var _ = (fs.FileGetlker)((*lowerFile)(nil))
+
+func (f *lowerFile) Getlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	return f.fh.(fs.FileGetlker).Getlk(ctx, owner, lk, flags, out)
+}
+
+var _ = (fs.FileSetlker)((*lowerFile)(nil))
+
+func (f *lowerFile) Setlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	return f.fh.(fs.FileSetlker).Setlk(ctx, owner, lk, flags)
+}
+
+var _ = (fs.FileSetlkwer)((*lowerFile)(nil))
+
+func (f *lowerFile) Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	return f.fh.(fs.FileSetlkwer).Setlkw(ctx, owner, lk, flags)
+}
+
+var _ = (fs.FileFlusher)((*lowerFile)(nil))
+
+func (f *lowerFile) Flush(ctx context.Context) syscall.Errno {
+	return f.fh.(fs.FileFlusher).Flush(ctx)
+}
+
+var _ = (fs.FileFsyncer)((*lowerFile)(nil))
+
+func (f *lowerFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return f.fh.(fs.FileFsyncer).Fsync(ctx, flags)
+}
+
+var _ = (fs.FileReleaser)((*lowerFile)(nil))
+
+func (f *lowerFile) Release(ctx context.Context) syscall.Errno {
+	return f.fh.(fs.FileReleaser).Release(ctx)
 }
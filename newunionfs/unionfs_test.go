@@ -6,6 +6,7 @@ package unionfs
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -17,6 +18,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/internal/testutil"
 	"github.com/hanwen/go-fuse/v2/posixtest"
+	"golang.org/x/sys/unix"
 )
 
 type testCase struct {
@@ -37,6 +39,11 @@ func (tc *testCase) Clean() {
 }
 
 func newTestCase(t *testing.T, populate bool) *testCase {
+	t.Helper()
+	return newTestCaseWithOptions(t, populate, nil)
+}
+
+func newTestCaseWithOptions(t *testing.T, populate bool, unionOpts *Options) *testCase {
 	t.Helper()
 	dir := testutil.TempDir()
 	dirs := []string{"ro", "rw", "mnt"}
@@ -58,9 +65,7 @@ func newTestCase(t *testing.T, populate bool) *testCase {
 		rw:  dir + "/rw",
 		ro:  dir + "/ro",
 	}
-	tc.root = &unionFSRoot{
-		roots: []string{tc.rw, tc.ro},
-	}
+	tc.root = New([]string{tc.rw, tc.ro}, unionOpts).(*unionFSRoot)
 
 	server, err := fs.Mount(tc.mnt, tc.root, &opts)
 	if err != nil {
@@ -116,15 +121,15 @@ func TestDeleteMarker(t *testing.T) {
 	defer tc.Clean()
 
 	path := "dir/ro-file"
-	tc.root.delPath(path)
+	tc.root.delPath(context.Background(), path)
 
 	var st syscall.Stat_t
 	if err := syscall.Lstat(filepath.Join(tc.mnt, path), &st); err != syscall.ENOENT {
 		t.Fatalf("Lstat before: %v", err)
 	}
 
-	if errno := tc.root.rmMarker(path); errno != 0 {
-		t.Fatalf("rmMarker: %v", errno)
+	if err := tc.root.whiteouts.Undelete(DirBranch(tc.rw), path); err != nil {
+		t.Fatalf("Undelete: %v", err)
 	}
 
 	if err := syscall.Lstat(filepath.Join(tc.mnt, path), &st); err != nil {
@@ -162,6 +167,40 @@ func TestCreate(t *testing.T) {
 	}
 }
 
+func TestCreateFlags(t *testing.T) {
+	tc := newTestCase(t, true)
+	defer tc.Clean()
+
+	path := filepath.Join(tc.mnt, "dir/new-file")
+	fd, err := syscall.Open(path, syscall.O_CREAT|syscall.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	want := []byte("hello")
+	if _, err := syscall.Pwrite(fd, want, 0); err != nil {
+		t.Fatalf("Pwrite: %v", err)
+	}
+	got := make([]byte, len(want))
+	if n, err := syscall.Pread(fd, got, 0); err != nil {
+		t.Fatalf("Pread: %v", err)
+	} else if !bytes.Equal(got[:n], want) {
+		t.Errorf("got %q, want %q", got[:n], want)
+	}
+
+	if _, err := syscall.Open(filepath.Join(tc.mnt, "dir/ro-file"), syscall.O_CREAT|syscall.O_EXCL|syscall.O_WRONLY, 0644); err != syscall.EEXIST {
+		t.Errorf("O_EXCL on existing file: got %v, want EEXIST", err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(filepath.Join(tc.mnt, "dir/ro-file"), &st); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	} else if got := st.Mode & 07777; got != 0644 {
+		t.Errorf("got mode %o, want 0644", got)
+	}
+}
+
 func TestPromote(t *testing.T) {
 	tc := newTestCase(t, true)
 	defer tc.Clean()
@@ -271,21 +310,7 @@ func TestReaddir(t *testing.T) {
 }
 
 func TestPosix(t *testing.T) {
-	cases := []string{
-		"SymlinkReadlink",
-		"FileBasic",
-		"TruncateFile",
-		"TruncateNoFile",
-		"FdLeak",
-		//		"MkdirRmdir",
-		//		"NlinkZero",
-		"ParallelFileOpen",
-		//		"Link",
-		"ReadDir",
-	}
-
-	for _, nm := range cases {
-		f := posixtest.All[nm]
+	for nm, f := range posixtest.All {
 		t.Run(nm, func(t *testing.T) {
 			tc := newTestCase(t, false)
 			defer tc.Clean()
@@ -295,6 +320,464 @@ func TestPosix(t *testing.T) {
 	}
 }
 
+func TestPromoteContent(t *testing.T) {
+	tc := newTestCase(t, true)
+	defer tc.Clean()
+
+	f, err := os.OpenFile(tc.mnt+"/dir/ro-file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("bla")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(tc.rw + "/dir/ro-file"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "blabla" {
+		t.Errorf("got %q, want %q", got, "blabla")
+	}
+}
+
+func TestPromoteMetadata(t *testing.T) {
+	tc := newTestCase(t, true)
+	defer tc.Clean()
+
+	ro := tc.ro + "/dir/ro-file"
+	if err := os.Chmod(ro, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(ro, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	ts := []syscall.Timespec{{Sec: 1000, Nsec: 123456789}, {Sec: 2000, Nsec: 987654321}}
+	for _, p := range []string{ro, tc.ro + "/dir"} {
+		if err := syscall.UtimesNano(p, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Opening for writing copies up, without changing the file.
+	f, err := os.OpenFile(tc.mnt+"/dir/ro-file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, nm := range []string{"dir/ro-file", "dir"} {
+		var src, dst syscall.Stat_t
+		if err := syscall.Lstat(tc.ro+"/"+nm, &src); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Lstat(tc.rw+"/"+nm, &dst); err != nil {
+			t.Fatal(err)
+		}
+		if dst.Mode != src.Mode {
+			t.Errorf("%s: got mode %o, want %o", nm, dst.Mode, src.Mode)
+		}
+		if dst.Mtim != ts[1] {
+			t.Errorf("%s: got mtime %v, want %v", nm, dst.Mtim, ts[1])
+		}
+		if dst.Size != src.Size && nm != "dir" {
+			t.Errorf("%s: got size %d, want %d", nm, dst.Size, src.Size)
+		}
+		if dst.Blocks > src.Blocks && nm != "dir" {
+			t.Errorf("%s: got %d blocks, want at most %d", nm, dst.Blocks, src.Blocks)
+		}
+	}
+}
+
+func TestPromoteSpecial(t *testing.T) {
+	tc := newTestCase(t, true)
+	defer tc.Clean()
+
+	if err := os.Symlink("ro-file", tc.ro+"/dir/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(tc.ro+"/dir/fifo", 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Renaming the directory copies up all of its entries.
+	if err := os.Rename(tc.mnt+"/dir", tc.mnt+"/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(tc.mnt + "/dir"); !os.IsNotExist(err) {
+		t.Errorf("Lstat old name: got %v, want ENOENT", err)
+	}
+	if got, err := os.Readlink(tc.rw + "/renamed/link"); err != nil {
+		t.Fatal(err)
+	} else if got != "ro-file" {
+		t.Errorf("got link %q, want %q", got, "ro-file")
+	}
+	if fi, err := os.Lstat(tc.rw + "/renamed/fifo"); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("got mode %v, want a FIFO", fi.Mode())
+	}
+	if got, err := ioutil.ReadFile(tc.mnt + "/renamed/ro-file"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "bla" {
+		t.Errorf("got %q, want %q", got, "bla")
+	}
+}
+
+func TestXattr(t *testing.T) {
+	tc := newTestCase(t, true)
+	defer tc.Clean()
+
+	if err := unix.Setxattr(tc.ro+"/dir/ro-file", "user.a", []byte("1"), 0); err == syscall.ENOTSUP {
+		t.Skip("no xattr support")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 100)
+	if sz, err := unix.Getxattr(tc.mnt+"/dir/ro-file", "user.a", buf); err != nil {
+		t.Fatal(err)
+	} else if got := string(buf[:sz]); got != "1" {
+		t.Errorf("got %q, want %q", got, "1")
+	}
+
+	if err := unix.Setxattr(tc.mnt+"/dir/ro-file", "user.b", []byte("2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	for attr, want := range map[string]string{"user.a": "1", "user.b": "2"} {
+		if sz, err := unix.Getxattr(tc.rw+"/dir/ro-file", attr, buf); err != nil {
+			t.Errorf("Getxattr %s: %v", attr, err)
+		} else if got := string(buf[:sz]); got != want {
+			t.Errorf("%s: got %q, want %q", attr, got, want)
+		}
+	}
+
+	if err := unix.Removexattr(tc.mnt+"/dir/ro-file", "user.a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unix.Getxattr(tc.mnt+"/dir/ro-file", "user.a", buf); err != syscall.ENODATA {
+		t.Errorf("Getxattr after remove: got %v, want ENODATA", err)
+	}
+}
+
+func TestMkdirDeleted(t *testing.T) {
+	tc := newTestCase(t, true)
+	defer tc.Clean()
+
+	if err := os.RemoveAll(tc.mnt + "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(tc.mnt+"/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	names, err := ioutil.ReadDir(tc.mnt + "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("got entries %v in new directory", names)
+	}
+	if err := os.Remove(tc.mnt + "/dir"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetacopy(t *testing.T) {
+	tc := newTestCaseWithOptions(t, true, &Options{Metacopy: true})
+	defer tc.Clean()
+
+	want := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	if err := ioutil.WriteFile(tc.ro+"/dir/file", want, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing the mode copies up only the metadata.
+	if err := os.Chmod(tc.mnt+"/dir/file", 0600); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	if _, err := unix.Lgetxattr(tc.rw+"/dir/file", metacopyXattr, buf); err == syscall.ENOTSUP {
+		t.Skip("no xattr support")
+	} else if err != nil {
+		t.Fatalf("Getxattr: %v", err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(tc.rw+"/dir/file", &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Size != int64(len(want)) || st.Blocks != 0 {
+		t.Errorf("got size %d in %d blocks, want %d in 0 blocks", st.Size, st.Blocks, len(want))
+	}
+	if err := syscall.Lstat(tc.mnt+"/dir/file", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Mode != syscall.S_IFREG|0600 {
+		t.Errorf("got mode %o, want %o", st.Mode, syscall.S_IFREG|0600)
+	}
+
+	if sz, err := unix.Llistxattr(tc.mnt+"/dir/file", buf); err != nil {
+		t.Fatalf("Listxattr: %v", err)
+	} else if bytes.Contains(buf[:sz], []byte(metacopyXattr)) {
+		t.Errorf("Listxattr shows %q", metacopyXattr)
+	}
+	if _, err := unix.Lgetxattr(tc.mnt+"/dir/file", metacopyXattr, buf); err != syscall.ENODATA {
+		t.Errorf("Getxattr %s: got %v, want ENODATA", metacopyXattr, err)
+	}
+
+	// The metacopy refers to its data, also after a rename.
+	if err := os.Rename(tc.mnt+"/dir/file", tc.mnt+"/dir/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(tc.mnt + "/dir/renamed"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("content mismatch after rename")
+	}
+
+	// Opening for writing copies up the data.
+	f, err := os.OpenFile(tc.mnt+"/dir/renamed", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("x"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want[1] = 'x'
+	if got, err := ioutil.ReadFile(tc.rw + "/dir/renamed"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("content mismatch after copy-up")
+	}
+	if _, err := unix.Lgetxattr(tc.rw+"/dir/renamed", metacopyXattr, buf); err != syscall.ENODATA {
+		t.Errorf("Getxattr %s after copy-up: got %v, want ENODATA", metacopyXattr, err)
+	}
+	if got, err := ioutil.ReadFile(tc.ro + "/dir/file"); err != nil {
+		t.Fatal(err)
+	} else if got[1] != '1' {
+		t.Errorf("read-only branch was changed")
+	}
+}
+
+func TestMetacopyFchmod(t *testing.T) {
+	tc := newTestCaseWithOptions(t, true, &Options{Metacopy: true})
+	defer tc.Clean()
+
+	f, err := os.Open(tc.mnt + "/dir/ro-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The handle reads the read-only branch, which must not be
+	// changed through it.
+	if err := f.Chmod(0600); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Lstat(tc.ro + "/dir/ro-file"); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0644 {
+		t.Errorf("read-only branch got mode %o", fi.Mode().Perm())
+	}
+	if fi, err := f.Stat(); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("got mode %o, want 0600", fi.Mode().Perm())
+	}
+	if got, err := ioutil.ReadAll(f); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "bla" {
+		t.Errorf("got %q, want %q", got, "bla")
+	}
+}
+
 func init() {
 	syscall.Umask(0)
 }
+
+func TestIDMap(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("need root")
+	}
+	idMap := fs.IDMap{{Inside: 0, Outside: 100000, Count: 65536}}
+	tc := newTestCaseWithOptions(t, true, &Options{UIDMap: idMap, GIDMap: idMap})
+	defer tc.Clean()
+
+	if err := os.Lchown(tc.ro+"/dir/ro-file", 100005, 100006); err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(tc.mnt+"/dir/ro-file", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Uid != 5 || st.Gid != 6 {
+		t.Errorf("got owner %d:%d, want 5:6", st.Uid, st.Gid)
+	}
+
+	if err := os.Lchown(tc.mnt+"/dir/ro-file", 7, 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Lstat(tc.rw+"/dir/ro-file", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Uid != 100007 || st.Gid != 100008 {
+		t.Errorf("got backing owner %d:%d, want 100007:100008", st.Uid, st.Gid)
+	}
+
+	if err := ioutil.WriteFile(tc.mnt+"/new", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Lstat(tc.rw+"/new", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Uid != 100000 || st.Gid != 100000 {
+		t.Errorf("got backing owner %d:%d, want 100000:100000", st.Uid, st.Gid)
+	}
+}
+
+func TestHardLinkCopyUp(t *testing.T) {
+	tc := newTestCase(t, true)
+	defer tc.Clean()
+
+	for _, nm := range []string{"link", "dir/deleted"} {
+		if err := os.Link(tc.ro+"/dir/ro-file", tc.ro+"/"+nm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(tc.mnt + "/dir/deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(tc.mnt+"/link", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("+")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if got, err := ioutil.ReadFile(tc.mnt + "/dir/ro-file"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "bla+" {
+		t.Errorf("got %q through other link, want %q", got, "bla+")
+	}
+	var a, b syscall.Stat_t
+	if err := syscall.Lstat(tc.rw+"/link", &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Lstat(tc.rw+"/dir/ro-file", &b); err != nil {
+		t.Fatal(err)
+	}
+	if a.Ino != b.Ino {
+		t.Errorf("links copied up as separate files")
+	}
+	if _, err := os.Lstat(tc.rw + "/dir/deleted"); !os.IsNotExist(err) {
+		t.Errorf("deleted link copied up: %v", err)
+	}
+
+	if err := syscall.Lstat(tc.mnt+"/link", &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Lstat(tc.mnt+"/dir/ro-file", &b); err != nil {
+		t.Fatal(err)
+	}
+	if a.Ino != b.Ino || a.Nlink != 2 || b.Nlink != 2 {
+		t.Errorf("got ino %d nlink %d and ino %d nlink %d, want equal inodes with 2 links", a.Ino, a.Nlink, b.Ino, b.Nlink)
+	}
+}
+
+func TestStableIno(t *testing.T) {
+	tc := newTestCase(t, true)
+	defer tc.Clean()
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(tc.ro+"/dir/ro-file", &st); err != nil {
+		t.Fatal(err)
+	}
+	roIno := st.Ino
+	if err := os.Symlink("ro-file", tc.ro+"/dir/ro-link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Lstat(tc.ro+"/dir/ro-link", &st); err != nil {
+		t.Fatal(err)
+	}
+	linkIno := st.Ino
+	if err := syscall.Lstat(tc.mnt+"/dir/ro-file", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Ino != roIno {
+		// The branches are on one device, which is numbered 0.
+		t.Errorf("got ino %d, want %d", st.Ino, roIno)
+	}
+
+	if err := os.Chmod(tc.mnt+"/dir/ro-file", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Lstat(tc.rw+"/dir/ro-file", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Ino == roIno {
+		t.Fatalf("copy has the inode of the original")
+	}
+
+	// Symlinks cannot have user xattrs, but keep their number
+	// too, also when they are renamed.
+	if err := os.Rename(tc.mnt+"/dir/ro-link", tc.mnt+"/dir/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Lstat(tc.mnt+"/dir/link", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Ino != linkIno {
+		t.Errorf("got symlink ino %d after copy-up, want %d", st.Ino, linkIno)
+	}
+
+	// The number survives a restart.
+	if err := tc.server.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	opts := &fs.Options{}
+	opts.Debug = testutil.VerboseTest()
+	server, err := fs.Mount(tc.mnt, New([]string{tc.rw, tc.ro}, nil), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.server = server
+	if err := syscall.Lstat(tc.mnt+"/dir/ro-file", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Ino != roIno {
+		t.Errorf("got ino %d after copy-up, want %d", st.Ino, roIno)
+	}
+	if err := syscall.Lstat(tc.mnt+"/dir/link", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Ino != linkIno {
+		t.Errorf("got symlink ino %d after restart, want %d", st.Ino, linkIno)
+	}
+	if sz, err := unix.Llistxattr(tc.mnt+"/dir", nil); err != nil {
+		t.Fatal(err)
+	} else if sz != 0 {
+		t.Errorf("origin of symlink listed on its directory")
+	}
+	if _, err := unix.Lgetxattr(tc.mnt+"/dir/ro-file", originXattr, make([]byte, 32)); err != unix.ENODATA {
+		t.Errorf("Getxattr origin: got %v, want ENODATA", err)
+	}
+
+	// Equal numbers on different devices are told apart.
+	a := tc.root.ino(1, "nonexistent", &syscall.Stat_t{Dev: 1000, Ino: 5})
+	b := tc.root.ino(1, "nonexistent", &syscall.Stat_t{Dev: 1001, Ino: 5})
+	if a == b {
+		t.Errorf("got ino %d for both devices", a)
+	}
+
+	// The numbers of devices found inside a branch do not depend
+	// on the order in which they are found.
+	r := New([]string{tc.rw, tc.ro}, &Options{Lowers: []fs.InodeEmbedder{&fs.Inode{}}}).(*unionFSRoot)
+	if got := r.ino(1, "nonexistent", &syscall.Stat_t{Dev: 1001, Ino: 5}); got != b {
+		t.Errorf("got ino %d after restart, want %d", got, b)
+	}
+
+	// Trees are kept apart from the directories.
+	var rwSt syscall.Stat_t
+	if err := syscall.Lstat(tc.rw, &rwSt); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := r.ino(0, "nonexistent", &syscall.Stat_t{Dev: rwSt.Dev, Ino: 5}), r.ino(2, "", &syscall.Stat_t{Ino: 5}); a == b {
+		t.Errorf("got ino %d for directory and tree", a)
+	}
+}
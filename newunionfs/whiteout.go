@@ -0,0 +1,591 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package unionfs
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// Whiteouts records in a branch which entries of the branches below
+// it are deleted. Names are paths relative to the root of the union,
+// which is ".". The union writes whiteouts only to the writable
+// branch, but honors those in all branches, so layers can be
+// stacked. The union file system of the unionfs package uses the
+// same formats.
+type Whiteouts interface {
+	// IsDeleted reports whether `name` is deleted in `b`.
+	IsDeleted(b Branch, name string) bool
+
+	// Delete records that `name` is deleted. The parent directory
+	// of `name` exists in `b`, and `name` itself does not.
+	Delete(b Branch, name string) error
+
+	// Undelete removes the record that `name` is deleted, if
+	// there is one.
+	Undelete(b Branch, name string) error
+
+	// IsOpaque reports whether the directory `dir` in `b` hides
+	// the entries of the branches below it.
+	IsOpaque(b Branch, dir string) bool
+
+	// SetOpaque makes the directory `dir` in `b` hide the entries
+	// below it, which are named `lower`.
+	SetOpaque(b Branch, dir string, lower []string) error
+
+	// ClearOpaque undoes SetOpaque.
+	ClearOpaque(b Branch, dir string) error
+
+	// IsInternal reports whether `name` in `b` holds bookkeeping
+	// of the format, and must not be shown.
+	IsInternal(b Branch, name string) bool
+
+	// List returns the deleted names and the opaque directories
+	// recorded in `b`.
+	List(b Branch) (deleted, opaque []string, err error)
+}
+
+// Branch gives a Whiteouts access to a branch of a union. Names are
+// relative to the root of the branch. Errors are syscall.Errno
+// values.
+type Branch interface {
+	Lstat(name string) (*fuse.Attr, error)
+	Mknod(name string, mode, dev uint32) error
+	Mkdir(name string, mode uint32) error
+	Chmod(name string, mode uint32) error
+	Unlink(name string) error
+	Rmdir(name string) error
+
+	// WriteFile creates the file `name` with mode 0644, or
+	// truncates it, and writes `data` to it.
+	WriteFile(name string, data []byte) error
+	ReadFile(name string) ([]byte, error)
+
+	// ReadDir returns the modes of the entries of the directory
+	// `name` by name, without "." and "..".
+	ReadDir(name string) (map[string]uint32, error)
+
+	GetXAttr(name, attr string) ([]byte, error)
+	SetXAttr(name, attr string, data []byte) error
+	RemoveXAttr(name, attr string) error
+}
+
+// DirBranch returns the Branch for the directory `dir`.
+func DirBranch(dir string) Branch {
+	return dirBranch(dir)
+}
+
+type dirBranch string
+
+func (b dirBranch) path(name string) string {
+	return filepath.Join(string(b), name)
+}
+
+func (b dirBranch) Lstat(name string) (*fuse.Attr, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(b.path(name), &st); err != nil {
+		return nil, err
+	}
+	a := &fuse.Attr{}
+	a.FromStat(&st)
+	return a, nil
+}
+
+func (b dirBranch) Mknod(name string, mode, dev uint32) error {
+	return syscall.Mknod(b.path(name), mode, int(dev))
+}
+
+func (b dirBranch) Mkdir(name string, mode uint32) error {
+	return syscall.Mkdir(b.path(name), mode)
+}
+
+func (b dirBranch) Chmod(name string, mode uint32) error {
+	return syscall.Chmod(b.path(name), mode)
+}
+
+func (b dirBranch) Unlink(name string) error {
+	return syscall.Unlink(b.path(name))
+}
+
+func (b dirBranch) Rmdir(name string) error {
+	return syscall.Rmdir(b.path(name))
+}
+
+func (b dirBranch) WriteFile(name string, data []byte) error {
+	fd, err := syscall.Open(b.path(name), syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	for len(data) > 0 {
+		n, err := syscall.Write(fd, data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (b dirBranch) ReadFile(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(b.path(name))
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return data, nil
+}
+
+func (b dirBranch) ReadDir(name string) (map[string]uint32, error) {
+	ds, errno := fs.NewLoopbackDirStream(b.path(name))
+	if errno != 0 {
+		return nil, errno
+	}
+	defer ds.Close()
+	result := map[string]uint32{}
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			return nil, errno
+		}
+		if e.Name != "." && e.Name != ".." {
+			result[e.Name] = e.Mode
+		}
+	}
+	return result, nil
+}
+
+func (b dirBranch) GetXAttr(name, attr string) ([]byte, error) {
+	buf := make([]byte, 64)
+	for {
+		sz, err := unix.Lgetxattr(b.path(name), attr, buf)
+		if err == syscall.ERANGE {
+			if sz, err = unix.Lgetxattr(b.path(name), attr, nil); err != nil {
+				return nil, err
+			}
+			buf = make([]byte, sz)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:sz], nil
+	}
+}
+
+func (b dirBranch) SetXAttr(name, attr string, data []byte) error {
+	return unix.Lsetxattr(b.path(name), attr, data, 0)
+}
+
+func (b dirBranch) RemoveXAttr(name, attr string) error {
+	return unix.Lremovexattr(b.path(name), attr)
+}
+
+// walk calls `fn` for the entries below the directory `dir` in `b`,
+// directories before their entries.
+func walk(b Branch, dir string, fn func(name string, mode uint32) error) error {
+	entries, err := b.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for nm := range entries {
+		names = append(names, nm)
+	}
+	sort.Strings(names)
+	for _, nm := range names {
+		p := filepath.Join(dir, nm)
+		mode := entries[nm]
+		if err := fn(p, mode); err != nil {
+			return err
+		}
+		if mode&syscall.S_IFMT == syscall.S_IFDIR {
+			if err := walk(b, p, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// NewDeletionsWhiteouts returns the Whiteouts that records deletions
+// as files in the DELETIONS directory at the root of the branch,
+// named by a hash of the deleted path and holding the path. This is
+// the default format of the unionfs package. Opaque directories are
+// recorded as deletions of all entries below them.
+func NewDeletionsWhiteouts() Whiteouts {
+	return NewDeletionsWhiteoutsIn(delDir)
+}
+
+// NewDeletionsWhiteoutsIn is like NewDeletionsWhiteouts, but keeps
+// the deletions in the directory `dir`, as the DeletionDirName
+// option of the unionfs package does.
+func NewDeletionsWhiteoutsIn(dir string) Whiteouts {
+	return deletionsWhiteouts{dir: dir}
+}
+
+type deletionsWhiteouts struct {
+	dir string
+}
+
+// markerPath returns the path of the file that records the deletion
+// of `name`.
+func (w deletionsWhiteouts) markerPath(name string) string {
+	return filepath.Join(w.dir, filePathHash(name))
+}
+
+func (w deletionsWhiteouts) IsDeleted(b Branch, name string) bool {
+	_, err := b.Lstat(w.markerPath(name))
+	return err == nil
+}
+
+func (w deletionsWhiteouts) Delete(b Branch, name string) error {
+	if err := b.Mkdir(w.dir, 0755); err != nil && err != syscall.EEXIST {
+		return err
+	}
+	return b.WriteFile(w.markerPath(name), []byte(name))
+}
+
+func (w deletionsWhiteouts) Undelete(b Branch, name string) error {
+	if err := b.Unlink(w.markerPath(name)); err != nil {
+		if err == syscall.ENOENT {
+			return nil
+		}
+		return err
+	}
+	// ignore error: other markers remain.
+	b.Rmdir(w.dir)
+	return nil
+}
+
+func (deletionsWhiteouts) IsOpaque(b Branch, dir string) bool {
+	return false
+}
+
+func (w deletionsWhiteouts) SetOpaque(b Branch, dir string, lower []string) error {
+	for _, nm := range lower {
+		if err := w.Delete(b, filepath.Join(dir, nm)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (deletionsWhiteouts) ClearOpaque(b Branch, dir string) error {
+	return nil
+}
+
+func (w deletionsWhiteouts) IsInternal(b Branch, name string) bool {
+	return name == w.dir
+}
+
+func (w deletionsWhiteouts) List(b Branch) (deleted, opaque []string, err error) {
+	entries, err := b.ReadDir(w.dir)
+	if err == syscall.ENOENT {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	for nm, mode := range entries {
+		if mode&syscall.S_IFMT != syscall.S_IFREG {
+			continue
+		}
+		c, err := b.ReadFile(filepath.Join(w.dir, nm))
+		if err != nil {
+			return nil, nil, err
+		}
+		deleted = append(deleted, string(c))
+	}
+	return deleted, nil, nil
+}
+
+// NewOverlayWhiteouts returns the Whiteouts of the kernel overlay
+// file system: deleted entries are character devices with device
+// number 0/0, and opaque directories have the "overlay.opaque"
+// extended attribute set to "y". The attribute is in the trusted
+// namespace, which needs CAP_SYS_ADMIN, or in the user namespace if
+// `userXattr` is set, as for the userxattr mount option of overlayfs.
+func NewOverlayWhiteouts(userXattr bool) Whiteouts {
+	w := overlayWhiteouts{opaqueXattr: "trusted.overlay.opaque"}
+	if userXattr {
+		w.opaqueXattr = "user.overlay.opaque"
+	}
+	return w
+}
+
+type overlayWhiteouts struct {
+	opaqueXattr string
+}
+
+func (overlayWhiteouts) IsDeleted(b Branch, name string) bool {
+	a, err := b.Lstat(name)
+	return err == nil && a.Mode&syscall.S_IFMT == syscall.S_IFCHR && a.Rdev == 0
+}
+
+func (overlayWhiteouts) Delete(b Branch, name string) error {
+	return b.Mknod(name, syscall.S_IFCHR, 0)
+}
+
+func (w overlayWhiteouts) Undelete(b Branch, name string) error {
+	if !w.IsDeleted(b, name) {
+		return nil
+	}
+	return b.Unlink(name)
+}
+
+func (w overlayWhiteouts) IsOpaque(b Branch, dir string) bool {
+	data, err := b.GetXAttr(dir, w.opaqueXattr)
+	return err == nil && string(data) == "y"
+}
+
+func (w overlayWhiteouts) SetOpaque(b Branch, dir string, lower []string) error {
+	return b.SetXAttr(dir, w.opaqueXattr, []byte("y"))
+}
+
+func (w overlayWhiteouts) ClearOpaque(b Branch, dir string) error {
+	err := b.RemoveXAttr(dir, w.opaqueXattr)
+	if err == syscall.ENODATA {
+		return nil
+	}
+	return err
+}
+
+func (overlayWhiteouts) IsInternal(b Branch, name string) bool {
+	return false
+}
+
+func (w overlayWhiteouts) List(b Branch) (deleted, opaque []string, err error) {
+	if w.IsOpaque(b, ".") {
+		opaque = append(opaque, ".")
+	}
+	err = walk(b, ".", func(name string, mode uint32) error {
+		switch mode & syscall.S_IFMT {
+		case syscall.S_IFCHR:
+			if w.IsDeleted(b, name) {
+				deleted = append(deleted, name)
+			}
+		case syscall.S_IFDIR:
+			if w.IsOpaque(b, name) {
+				opaque = append(opaque, name)
+			}
+		}
+		return nil
+	})
+	return deleted, opaque, err
+}
+
+// whPrefix is the prefix of AUFS whiteout names.
+const whPrefix = ".wh."
+
+// whOpaque is the name of the AUFS file marking the directory that
+// contains it as opaque.
+const whOpaque = whPrefix + whPrefix + ".opq"
+
+// NewAUFSWhiteouts returns the Whiteouts of AUFS, which is also used
+// in OCI image layers: a deleted entry "name" is recorded as an empty
+// file ".wh.name" in the same directory, and an opaque directory
+// contains the file ".wh..wh..opq". All names starting with ".wh."
+// are hidden.
+func NewAUFSWhiteouts() Whiteouts {
+	return aufsWhiteouts{}
+}
+
+type aufsWhiteouts struct{}
+
+func (aufsWhiteouts) path(name string) string {
+	dir, base := filepath.Split(name)
+	return filepath.Join(dir, whPrefix+base)
+}
+
+func (w aufsWhiteouts) IsDeleted(b Branch, name string) bool {
+	_, err := b.Lstat(w.path(name))
+	return err == nil
+}
+
+func (w aufsWhiteouts) Delete(b Branch, name string) error {
+	return b.WriteFile(w.path(name), nil)
+}
+
+func (w aufsWhiteouts) Undelete(b Branch, name string) error {
+	if err := b.Unlink(w.path(name)); err != nil && err != syscall.ENOENT {
+		return err
+	}
+	return nil
+}
+
+func (aufsWhiteouts) IsOpaque(b Branch, dir string) bool {
+	_, err := b.Lstat(filepath.Join(dir, whOpaque))
+	return err == nil
+}
+
+func (aufsWhiteouts) SetOpaque(b Branch, dir string, lower []string) error {
+	return b.WriteFile(filepath.Join(dir, whOpaque), nil)
+}
+
+func (aufsWhiteouts) ClearOpaque(b Branch, dir string) error {
+	if err := b.Unlink(filepath.Join(dir, whOpaque)); err != nil && err != syscall.ENOENT {
+		return err
+	}
+	return nil
+}
+
+func (aufsWhiteouts) IsInternal(b Branch, name string) bool {
+	return strings.HasPrefix(filepath.Base(name), whPrefix)
+}
+
+func (aufsWhiteouts) List(b Branch) (deleted, opaque []string, err error) {
+	err = walk(b, ".", func(name string, mode uint32) error {
+		dir, base := filepath.Split(name)
+		switch {
+		case base == whOpaque:
+			opaque = append(opaque, filepath.Clean(dir))
+		case strings.HasPrefix(base, whPrefix+whPrefix):
+			// Other AUFS bookkeeping.
+		case strings.HasPrefix(base, whPrefix):
+			deleted = append(deleted, filepath.Join(dir, base[len(whPrefix):]))
+		}
+		return nil
+	})
+	return deleted, opaque, err
+}
+
+// ConvertWhiteouts converts the whiteouts in roots[0] from the format
+// `from` to the format `to`. The other roots are the read-only
+// branches of the union, which are needed to create the directories
+// that hold whiteouts in some formats, and to list the entries
+// hidden by opaque directories. Deletions of entries that do not
+// exist in the read-only branches are dropped. The new whiteouts are
+// written before the old ones are removed, so an interrupted
+// conversion hides no less than before, and can be run again. The
+// union must not be mounted while its whiteouts are converted.
+func ConvertWhiteouts(roots []string, from, to Whiteouts) error {
+	branches := make([]Branch, len(roots))
+	for i, root := range roots {
+		branches[i] = DirBranch(root)
+	}
+	return ConvertBranchWhiteouts(branches, from, to)
+}
+
+// ConvertBranchWhiteouts is like ConvertWhiteouts, for branches that
+// need not be directories.
+func ConvertBranchWhiteouts(branches []Branch, from, to Whiteouts) error {
+	upper := branches[0]
+	lower := branches[1:]
+	deleted, opaque, err := from.List(upper)
+	if err != nil {
+		return err
+	}
+
+	// Parents go first, so deletions below deleted directories
+	// can be dropped.
+	sort.Strings(deleted)
+	done := map[string]bool{}
+	for _, name := range deleted {
+		if hasDeletedParent(name, done) || lowerStat(lower, name) == nil {
+			continue
+		}
+		if !to.IsDeleted(upper, name) {
+			if err := copyUpDirs(branches, filepath.Dir(name)); err != nil {
+				return err
+			}
+			if err := to.Delete(upper, name); err != nil {
+				return err
+			}
+		}
+		done[name] = true
+	}
+
+	hiddenBy := map[string][]string{}
+	for _, dir := range opaque {
+		names := map[string]bool{}
+		for _, b := range lower {
+			entries, _ := b.ReadDir(dir)
+			for nm := range entries {
+				names[nm] = true
+			}
+		}
+		var hidden []string
+		for nm := range names {
+			hidden = append(hidden, nm)
+		}
+		if err := to.SetOpaque(upper, dir, hidden); err != nil {
+			return err
+		}
+		hiddenBy[dir] = hidden
+	}
+
+	// Both formats may keep a whiteout in the same place, so it
+	// is recorded again if removing the old one removed it.
+	for _, dir := range opaque {
+		wasOpaque := to.IsOpaque(upper, dir)
+		if err := from.ClearOpaque(upper, dir); err != nil {
+			return err
+		}
+		if wasOpaque && !to.IsOpaque(upper, dir) {
+			if err := to.SetOpaque(upper, dir, hiddenBy[dir]); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range deleted {
+		if err := from.Undelete(upper, name); err != nil {
+			return err
+		}
+		if done[name] && !to.IsDeleted(upper, name) {
+			if err := to.Delete(upper, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hasDeletedParent(name string, deleted map[string]bool) bool {
+	for p := filepath.Dir(name); p != "."; p = filepath.Dir(p) {
+		if deleted[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// lowerStat returns the attributes of `name` in the first of
+// `branches` that has it, or nil.
+func lowerStat(branches []Branch, name string) *fuse.Attr {
+	for _, b := range branches {
+		if a, err := b.Lstat(name); err == nil {
+			return a
+		}
+	}
+	return nil
+}
+
+// copyUpDirs creates the directory `dir` and its parents in
+// branches[0], with the permissions they have in the other branches.
+func copyUpDirs(branches []Branch, dir string) error {
+	if dir == "." {
+		return nil
+	}
+	if err := copyUpDirs(branches, filepath.Dir(dir)); err != nil {
+		return err
+	}
+	if _, err := branches[0].Lstat(dir); err == nil {
+		return nil
+	}
+	mode := uint32(0755)
+	if a := lowerStat(branches[1:], dir); a != nil {
+		mode = a.Mode & 07777
+	}
+	if err := branches[0].Mkdir(dir, mode); err != nil {
+		return err
+	}
+	return branches[0].Chmod(dir, mode)
+}
@@ -0,0 +1,231 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package unionfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"github.com/hanwen/go-fuse/v2/posixtest"
+)
+
+var whiteoutFormats = map[string]func() Whiteouts{
+	"deletions": NewDeletionsWhiteouts,
+	"overlay":   func() Whiteouts { return NewOverlayWhiteouts(true) },
+	"aufs":      NewAUFSWhiteouts,
+}
+
+func readDirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	f, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestWhiteoutPosix(t *testing.T) {
+	for format, newWhiteouts := range whiteoutFormats {
+		for nm, fn := range posixtest.All {
+			t.Run(format+"/"+nm, func(t *testing.T) {
+				tc := newTestCaseWithOptions(t, false, &Options{Whiteouts: newWhiteouts()})
+				defer tc.Clean()
+
+				fn(t, tc.mnt)
+			})
+		}
+	}
+}
+
+func TestWhiteoutFormats(t *testing.T) {
+	for format, newWhiteouts := range whiteoutFormats {
+		t.Run(format, func(t *testing.T) {
+			w := newWhiteouts()
+			tc := newTestCaseWithOptions(t, true, &Options{Whiteouts: w})
+			defer tc.Clean()
+
+			if err := os.Mkdir(tc.ro+"/dir/sub", 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(tc.ro+"/dir/sub/file", []byte("x"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Remove(tc.mnt + "/dir/ro-file"); err != nil {
+				t.Fatal(err)
+			}
+			if !w.IsDeleted(DirBranch(tc.rw), "dir/ro-file") {
+				t.Errorf("no whiteout for dir/ro-file")
+			}
+			if got, want := readDirNames(t, tc.mnt+"/dir"), []string{"sub"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got, want := readDirNames(t, tc.mnt), []string{"dir"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got root entries %v, want %v", got, want)
+			}
+
+			// A new directory in place of a deleted one is
+			// empty.
+			if err := os.RemoveAll(tc.mnt + "/dir/sub"); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(tc.mnt+"/dir/sub", 0755); err != nil {
+				t.Fatal(err)
+			}
+			if got := readDirNames(t, tc.mnt+"/dir/sub"); len(got) != 0 {
+				t.Errorf("got entries %v in new directory", got)
+			}
+			if err := ioutil.WriteFile(tc.mnt+"/dir/sub/new", nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := readDirNames(t, tc.mnt+"/dir/sub"), []string{"new"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+
+			// A new file in place of a deleted one is shown.
+			if err := ioutil.WriteFile(tc.mnt+"/dir/ro-file", []byte("new"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := ioutil.ReadFile(tc.mnt + "/dir/ro-file"); err != nil {
+				t.Fatal(err)
+			} else if string(got) != "new" {
+				t.Errorf("got %q, want %q", got, "new")
+			}
+		})
+	}
+}
+
+func TestWhiteoutStacked(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	roots := []string{dir + "/rw", dir + "/mid", dir + "/ro"}
+	for _, d := range append(roots, dir+"/mnt", dir+"/mid/dir", dir+"/ro/dir") {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"ro/deleted", "ro/dir/hidden", "ro/shown"} {
+		if err := ioutil.WriteFile(dir+"/"+f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The middle layer deletes a file and hides a directory of
+	// the lowest one.
+	w := NewOverlayWhiteouts(true)
+	if err := w.Delete(DirBranch(dir+"/mid"), "deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetOpaque(DirBranch(dir+"/mid"), "dir", nil); err == syscall.ENOTSUP {
+		t.Skip("no xattr support")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &fs.Options{}
+	opts.Debug = testutil.VerboseTest()
+	server, err := fs.Mount(dir+"/mnt", New(roots, &Options{Whiteouts: w}), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	if got, want := readDirNames(t, dir+"/mnt"), []string{"dir", "shown"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := readDirNames(t, dir+"/mnt/dir"); len(got) != 0 {
+		t.Errorf("got entries %v in opaque directory", got)
+	}
+	if _, err := os.Lstat(dir + "/mnt/dir/hidden"); !os.IsNotExist(err) {
+		t.Errorf("Lstat hidden: got %v, want ENOENT", err)
+	}
+}
+
+func TestConvertWhiteouts(t *testing.T) {
+	tc := newTestCase(t, true)
+	defer tc.Clean()
+
+	if err := os.Mkdir(tc.ro+"/dir/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"dir/sub/file", "other"} {
+		if err := ioutil.WriteFile(tc.ro+"/"+f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"dir/sub/file", "other", "dir/ro-file"} {
+		if err := os.Remove(tc.mnt + "/" + f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tc.server.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	tc.server = nil
+
+	roots := []string{tc.rw, tc.ro}
+	// The overlay formats share their whiteouts, which must
+	// survive the conversion between them.
+	formats := map[string]func() Whiteouts{
+		"overlay-trusted": func() Whiteouts { return NewOverlayWhiteouts(false) },
+	}
+	for k, v := range whiteoutFormats {
+		formats[k] = v
+	}
+	from := NewDeletionsWhiteouts()
+	for _, format := range []string{"overlay-trusted", "overlay", "aufs", "deletions"} {
+		to := formats[format]()
+		if err := ConvertWhiteouts(roots, from, to); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		from = to
+
+		deleted, _, err := to.List(DirBranch(tc.rw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(deleted)
+		if want := []string{"dir/ro-file", "dir/sub/file", "other"}; !reflect.DeepEqual(deleted, want) {
+			t.Errorf("%s: got deleted %v, want %v", format, deleted, want)
+		}
+		if format != "deletions" {
+			if _, err := os.Lstat(filepath.Join(tc.rw, delDir)); !os.IsNotExist(err) {
+				t.Errorf("%s: DELETIONS left: %v", format, err)
+			}
+			if fi, err := os.Lstat(tc.rw + "/dir/sub"); err != nil {
+				t.Errorf("%s: %v", format, err)
+			} else if fi.Mode().Perm() != 0700 {
+				t.Errorf("%s: got mode %v for dir/sub, want 0700", format, fi.Mode())
+			}
+		}
+	}
+
+	opts := &fs.Options{}
+	opts.Debug = testutil.VerboseTest()
+	server, err := fs.Mount(tc.mnt, New(roots, nil), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.server = server
+	if got, want := readDirNames(t, tc.mnt), []string{"dir"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := readDirNames(t, tc.mnt+"/dir"), []string{"sub"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poolfs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/copyfile"
+)
+
+// Control runs a command of the control file. The commands are
+//
+//	add PATH[=MODE]
+//	remove PATH
+//	mode PATH=MODE
+//	drain PATH
+//
+// which call AddBranch, RemoveBranch, SetBranchMode and Drain. A
+// drain runs in the background, and its failure is logged.
+func (p *Pool) Control(cmd string) error {
+	fields := strings.Fields(cmd)
+	if len(fields) != 2 {
+		return fmt.Errorf("poolfs: invalid command %q", cmd)
+	}
+	arg := fields[1]
+	switch fields[0] {
+	case "add":
+		b, err := ParseBranch(arg)
+		if err != nil {
+			return err
+		}
+		return p.AddBranch(b)
+	case "remove":
+		return p.RemoveBranch(arg)
+	case "mode":
+		b, err := ParseBranch(arg)
+		if err != nil {
+			return err
+		}
+		return p.SetBranchMode(b.Path, b.Mode)
+	case "drain":
+		b, err := p.startDrain(arg)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := p.drain(b); err != nil {
+				log.Printf("poolfs: drain %s: %v", arg, err)
+			}
+		}()
+		return nil
+	}
+	return fmt.Errorf("poolfs: unknown command %q", fields[0])
+}
+
+// Drain moves the entries of the branch at `path` to the branches
+// chosen by the create policy, and then removes it from the pool. The
+// branch becomes NoCreate while it is drained, and cannot be removed
+// or have its mode changed. Entries that also exist in another branch
+// are not moved, and make Drain fail. Files that are changed while
+// they are moved are copied again. Once a file is moved, writes
+// through handles that were opened before fail with EIO, so it must
+// be opened again. Moved files keep their inode numbers, but hard
+// links are copied as separate files.
+func (p *Pool) Drain(path string) error {
+	b, err := p.startDrain(path)
+	if err != nil {
+		return err
+	}
+	return p.drain(b)
+}
+
+// startDrain marks the branch at `path` as being drained, and
+// returns it. Until the drain ends, the branch cannot be removed or
+// have its mode changed.
+func (p *Pool) startDrain(path string) (*branch, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := p.find(path)
+	if i < 0 {
+		return nil, fmt.Errorf("poolfs: branch %q not found", path)
+	}
+	b := *p.branches[i]
+	if b.Mode == ReadOnly {
+		return nil, fmt.Errorf("poolfs: branch %q is read-only", path)
+	}
+	if p.draining[b.Path] {
+		return nil, fmt.Errorf("poolfs: branch %q is being drained", path)
+	}
+	b.Mode = NoCreate
+	p.branches[i] = &b
+	p.draining[b.Path] = true
+	return &b, nil
+}
+
+// drain drains the branch `b`, which was returned by startDrain.
+func (p *Pool) drain(b *branch) error {
+	err := p.drainDir(b, ".")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.draining, b.Path)
+	if err != nil {
+		return err
+	}
+	if i := p.find(b.Path); i >= 0 {
+		p.branches = append(p.branches[:i:i], p.branches[i+1:]...)
+	}
+	return nil
+}
+
+// drainDir moves the entries of `dir` out of `b`.
+func (p *Pool) drainDir(b *branch, dir string) error {
+	entries, err := ioutil.ReadDir(filepath.Join(b.Path, dir))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := filepath.Join(dir, e.Name())
+		if !e.IsDir() {
+			if err := p.moveEntry(b, name); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := p.drainDir(b, name); err != nil {
+			return err
+		}
+		// Keep empty directories.
+		if len(p.existing(name)) == 1 {
+			t, err := p.drainTarget(name)
+			if err != nil {
+				return err
+			}
+			if err := copyfile.Copy(filepath.Join(b.Path, name), filepath.Join(t.Path, name), nil); err != nil && !os.IsExist(err) {
+				return err
+			}
+		}
+		if err := os.Remove(filepath.Join(b.Path, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drainTarget returns the branch to move `name` to. If the create
+// policy only considers branches in which the parent directory
+// exists, and there are none, the branch with the most free space is
+// used.
+func (p *Pool) drainTarget(name string) (*branch, error) {
+	t, errno := p.createBranch(name, p.create)
+	if errno == syscall.ENOENT {
+		t, errno = p.createBranch(name, mostFreeSpace)
+	}
+	if errno != 0 {
+		return nil, fmt.Errorf("no branch for %q: %v", name, errno)
+	}
+	return t, nil
+}
+
+// moveEntry moves the entry `name`, which is not a directory, from
+// `b` to another branch.
+func (p *Pool) moveEntry(b *branch, name string) error {
+	if len(p.existing(name)) > 1 {
+		return fmt.Errorf("%q also exists in another branch", name)
+	}
+	src := filepath.Join(b.Path, name)
+	for try := 0; try < 3; try++ {
+		var before syscall.Stat_t
+		if err := syscall.Lstat(src, &before); err != nil {
+			return err
+		}
+		t, err := p.drainTarget(name)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(t.Path, name)
+		tmp := filepath.Join(filepath.Dir(dst), ".poolfs-drain-"+filepath.Base(name))
+		if err := copyfile.Copy(src, tmp, nil); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		// Writes through the handles of the file wait until it is
+		// moved, and then fail.
+		id := fileID{b.id, before.Ino}
+		f := p.acquireFile(id)
+		f.mu.Lock()
+		moved, err := p.moveCopy(b, t, name, tmp, &before)
+		if moved {
+			f.moved = true
+		}
+		f.mu.Unlock()
+		p.releaseFile(id, f)
+		if moved || err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("%q keeps changing", name)
+}
+
+// moveCopy replaces `name` in `b`, which had attributes `before`,
+// by its copy `tmp` in `t`, unless the original changed. It reports
+// whether it did.
+func (p *Pool) moveCopy(b, t *branch, name, tmp string, before *syscall.Stat_t) (bool, error) {
+	defer os.Remove(tmp)
+	src := filepath.Join(b.Path, name)
+	var after syscall.Stat_t
+	if err := syscall.Lstat(src, &after); err != nil {
+		return false, err
+	}
+	if !sameTimes(&after, before) || after.Size != before.Size {
+		return false, nil
+	}
+	// Unlike rename, link does not replace an entry that was
+	// created in the meantime.
+	dst := filepath.Join(t.Path, name)
+	if err := os.Link(tmp, dst); err != nil {
+		return false, err
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(dst, &st); err != nil {
+		return false, err
+	}
+	ino := p.ino(b, before)
+	p.filesMu.Lock()
+	p.moved[fileID{t.id, st.Ino}] = ino
+	p.filesMu.Unlock()
+	return true, os.Remove(src)
+}
+
+// lookupControl returns the control file.
+func (p *Pool) lookupControl(ctx context.Context, out *fuse.EntryOut) *fs.Inode {
+	p.mu.Lock()
+	if p.control == nil {
+		p.control = p.root.NewPersistentInode(ctx, &controlNode{pool: p},
+			fs.StableAttr{Mode: syscall.S_IFREG})
+	}
+	ch := p.control
+	p.mu.Unlock()
+
+	var attr fuse.AttrOut
+	ch.Operations().(*controlNode).Getattr(ctx, nil, &attr)
+	out.Attr = attr.Attr
+	return ch
+}
+
+// status returns the content of the control file: a line per branch,
+// in the syntax of ParseBranch, followed by "draining" if it is being
+// drained.
+func (p *Pool) status() []byte {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var lines []string
+	for _, b := range p.branches {
+		l := b.String()
+		if p.draining[b.Path] {
+			l += " draining"
+		}
+		lines = append(lines, l+"\n")
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+// controlNode is the control file. Reads return the branches. Data
+// written is run as commands, one per line, when the file is flushed.
+type controlNode struct {
+	fs.Inode
+
+	pool *Pool
+}
+
+var _ = (fs.NodeOpener)((*controlNode)(nil))
+var _ = (fs.NodeGetattrer)((*controlNode)(nil))
+var _ = (fs.NodeSetattrer)((*controlNode)(nil))
+
+type controlHandle struct {
+	pool *Pool
+
+	mu   sync.Mutex
+	data []byte
+	// written is set if the handle holds commands.
+	written bool
+}
+
+var _ = (fs.FileReader)((*controlHandle)(nil))
+var _ = (fs.FileWriter)((*controlHandle)(nil))
+var _ = (fs.FileFlusher)((*controlHandle)(nil))
+
+func (n *controlNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	h := &controlHandle{pool: n.pool}
+	if flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		h.data = n.pool.status()
+	}
+	return h, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (n *controlNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0644
+	out.Size = uint64(len(n.pool.status()))
+	return 0
+}
+
+// Setattr accepts truncation, which happens when the file is opened
+// with O_TRUNC for writing commands.
+func (n *controlNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return n.Getattr(ctx, f, out)
+}
+
+func (h *controlHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if off >= int64(len(h.data)) {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(h.data)) {
+		end = int64(len(h.data))
+	}
+	return fuse.ReadResultData(h.data[off:end]), 0
+}
+
+func (h *controlHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if end := int(off) + len(data); end > len(h.data) {
+		h.data = append(h.data, make([]byte, end-len(h.data))...)
+	}
+	copy(h.data[off:], data)
+	h.written = true
+	return uint32(len(data)), 0
+}
+
+func (h *controlHandle) Flush(ctx context.Context) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.written {
+		return 0
+	}
+	h.written = false
+	cmds := string(h.data)
+	h.data = nil
+	for _, l := range strings.Split(cmds, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if err := h.pool.Control(l); err != nil {
+			log.Printf("poolfs: %v", err)
+			return syscall.EINVAL
+		}
+	}
+	return 0
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poolfs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// fileID identifies a file of a branch.
+type fileID struct {
+	branch uint64
+	ino    uint64
+}
+
+// openFile is a file of a branch that has writable handles, or that
+// is being moved by Drain.
+type openFile struct {
+	// mu is held for reading by writes through the handles, and
+	// for writing while Drain moves the file.
+	mu sync.RWMutex
+
+	// moved is set once Drain has moved the file to another
+	// branch.
+	moved bool
+
+	// refs counts the handles, and the drain moving the file. It
+	// is protected by Pool.filesMu.
+	refs int
+}
+
+// acquireFile returns the openFile for `id`, creating it if needed.
+// It must be released with releaseFile.
+func (p *Pool) acquireFile(id fileID) *openFile {
+	p.filesMu.Lock()
+	defer p.filesMu.Unlock()
+	f := p.files[id]
+	if f == nil {
+		f = &openFile{}
+		p.files[id] = f
+	}
+	f.refs++
+	return f
+}
+
+func (p *Pool) releaseFile(id fileID, f *openFile) {
+	p.filesMu.Lock()
+	defer p.filesMu.Unlock()
+	f.refs--
+	if f.refs == 0 {
+		delete(p.files, id)
+	}
+}
+
+// ino returns the inode number of an entry of `b` in the pool. The
+// ID of the branch goes in the high bits, so entries of different
+// branches do not collide. Files moved by Drain keep the number they
+// had before.
+func (p *Pool) ino(b *branch, st *syscall.Stat_t) uint64 {
+	p.filesMu.Lock()
+	defer p.filesMu.Unlock()
+	if ino, ok := p.moved[fileID{b.id, st.Ino}]; ok {
+		return ino
+	}
+	return st.Ino ^ b.id<<48
+}
+
+// newFile returns the handle for `fd`, which is open on the file
+// `st` of `b` with `flags`. Writable handles are tracked, so Drain
+// can make them fail once it moves their file. If the file was
+// removed before it could be tracked, newFile closes `fd` and returns
+// ESTALE.
+func (p *Pool) newFile(b *branch, fd int, flags uint32) (fs.FileHandle, syscall.Errno) {
+	if flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		return fs.NewLoopbackFile(fd), 0
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return nil, fs.ToErrno(err)
+	}
+	id := fileID{b.id, st.Ino}
+	f := p.acquireFile(id)
+
+	// A drain that moved the file before we acquired it has
+	// unlinked it.
+	if err := syscall.Fstat(fd, &st); err != nil || st.Nlink == 0 {
+		p.releaseFile(id, f)
+		syscall.Close(fd)
+		return nil, syscall.ESTALE
+	}
+	return &poolFile{
+		FileHandle: fs.NewLoopbackFile(fd),
+		pool:       p,
+		id:         id,
+		file:       f,
+	}, 0
+}
+
+// poolFile is a writable handle. Once Drain has moved its file to
+// another branch, changes through it fail with EIO, rather than being
+// made to the copy that was left behind.
+type poolFile struct {
+	fs.FileHandle
+
+	pool *Pool
+	id   fileID
+	file *openFile
+}
+
+var _ = (fs.FileReader)((*poolFile)(nil))
+var _ = (fs.FileWriter)((*poolFile)(nil))
+var _ = (fs.FileReleaser)((*poolFile)(nil))
+var _ = (fs.FileFlusher)((*poolFile)(nil))
+var _ = (fs.FileFsyncer)((*poolFile)(nil))
+var _ = (fs.FileGetattrer)((*poolFile)(nil))
+var _ = (fs.FileSetattrer)((*poolFile)(nil))
+var _ = (fs.FileLseeker)((*poolFile)(nil))
+var _ = (fs.FileAllocater)((*poolFile)(nil))
+var _ = (fs.FileGetlker)((*poolFile)(nil))
+var _ = (fs.FileSetlker)((*poolFile)(nil))
+var _ = (fs.FileSetlkwer)((*poolFile)(nil))
+
+// change runs `f`, which changes the file, unless it has been moved.
+func (f *poolFile) change(fn func() syscall.Errno) syscall.Errno {
+	f.file.mu.RLock()
+	defer f.file.mu.RUnlock()
+	if f.file.moved {
+		return syscall.EIO
+	}
+	return fn()
+}
+
+func (f *poolFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	return f.FileHandle.(fs.FileReader).Read(ctx, dest, off)
+}
+
+func (f *poolFile) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	errno = f.change(func() syscall.Errno {
+		written, errno = f.FileHandle.(fs.FileWriter).Write(ctx, data, off)
+		return errno
+	})
+	return written, errno
+}
+
+func (f *poolFile) Release(ctx context.Context) syscall.Errno {
+	f.pool.releaseFile(f.id, f.file)
+	return f.FileHandle.(fs.FileReleaser).Release(ctx)
+}
+
+func (f *poolFile) Flush(ctx context.Context) syscall.Errno {
+	return f.FileHandle.(fs.FileFlusher).Flush(ctx)
+}
+
+func (f *poolFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return f.FileHandle.(fs.FileFsyncer).Fsync(ctx, flags)
+}
+
+func (f *poolFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	return f.FileHandle.(fs.FileGetattrer).Getattr(ctx, out)
+}
+
+func (f *poolFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return f.change(func() syscall.Errno {
+		return f.FileHandle.(fs.FileSetattrer).Setattr(ctx, in, out)
+	})
+}
+
+func (f *poolFile) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
+	return f.FileHandle.(fs.FileLseeker).Lseek(ctx, off, whence)
+}
+
+func (f *poolFile) Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno {
+	a, ok := f.FileHandle.(fs.FileAllocater)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	return f.change(func() syscall.Errno {
+		return a.Allocate(ctx, off, size, mode)
+	})
+}
+
+func (f *poolFile) Getlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	return f.FileHandle.(fs.FileGetlker).Getlk(ctx, owner, lk, flags, out)
+}
+
+func (f *poolFile) Setlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	return f.FileHandle.(fs.FileSetlker).Setlk(ctx, owner, lk, flags)
+}
+
+func (f *poolFile) Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	return f.FileHandle.(fs.FileSetlkwer).Setlkw(ctx, owner, lk, flags)
+}
@@ -0,0 +1,472 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poolfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/passthrough"
+	"golang.org/x/sys/unix"
+)
+
+// poolNode is a file or directory in the pool. It has no state of its
+// own: every operation finds the branches holding its path.
+type poolNode struct {
+	fs.Inode
+
+	pool *Pool
+}
+
+// path returns the path of the child `name`, or of the node itself
+// if `name` is empty.
+func (n *poolNode) path(name string) string {
+	return filepath.Join(n.Path(nil), name)
+}
+
+// isControl reports whether `name` is the control file.
+func (n *poolNode) isControl(name string) bool {
+	return n.IsRoot() && n.pool.controlName != "-" && name == n.pool.controlName
+}
+
+func (n *poolNode) newChild(ctx context.Context, b *branch, st *syscall.Stat_t, out *fuse.EntryOut) *fs.Inode {
+	out.FromStat(st)
+	out.Ino = n.pool.ino(b, st)
+	return n.NewInode(ctx, &poolNode{pool: n.pool}, fs.StableAttr{Mode: uint32(st.Mode), Ino: out.Ino})
+}
+
+var _ = (fs.NodeStatfser)((*poolNode)(nil))
+
+func (n *poolNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return n.pool.statfs(out)
+}
+
+var _ = (fs.NodeLookuper)((*poolNode)(nil))
+
+func (n *poolNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if n.isControl(name) {
+		return n.pool.lookupControl(ctx, out), 0
+	}
+	var st syscall.Stat_t
+	b, errno := n.pool.searchBranch(n.path(name), &st)
+	if errno != 0 {
+		return nil, errno
+	}
+	return n.newChild(ctx, b, &st, out), 0
+}
+
+var _ = (fs.NodeGetattrer)((*poolNode)(nil))
+
+func (n *poolNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if fga, ok := fh.(fs.FileGetattrer); ok {
+		// The file may have been removed or replaced.
+		if errno := fga.Getattr(ctx, out); errno != 0 {
+			return errno
+		}
+	} else {
+		var st syscall.Stat_t
+		if _, errno := n.pool.searchBranch(n.path(""), &st); errno != 0 {
+			return errno
+		}
+		out.FromStat(&st)
+	}
+	out.Ino = n.StableAttr().Ino
+	return 0
+}
+
+var _ = (fs.NodeSetattrer)((*poolNode)(nil))
+
+func (n *poolNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	// Only writable handles, which cannot be on a ReadOnly branch,
+	// can truncate.
+	if _, ok := in.GetSize(); ok && fh != nil {
+		fsa := fh.(fs.FileSetattrer)
+		if errno := fsa.Setattr(ctx, in, out); errno != 0 {
+			return errno
+		}
+		out.Ino = n.StableAttr().Ino
+		return 0
+	}
+
+	errno := n.pool.forEach(n.path(""), func(b *branch, p string) error {
+		if m, ok := in.GetMode(); ok {
+			if err := syscall.Chmod(p, m); err != nil {
+				return err
+			}
+		}
+		uid, uok := in.GetUID()
+		gid, gok := in.GetGID()
+		if uok || gok {
+			suid, sgid := -1, -1
+			if uok {
+				suid = int(uid)
+			}
+			if gok {
+				sgid = int(gid)
+			}
+			if err := syscall.Lchown(p, suid, sgid); err != nil {
+				return err
+			}
+		}
+		mtime, mok := in.GetMTime()
+		atime, aok := in.GetATime()
+		if mok || aok {
+			ap, mp := &atime, &mtime
+			if !aok {
+				ap = nil
+			}
+			if !mok {
+				mp = nil
+			}
+			ts := []unix.Timespec{
+				unix.Timespec(fuse.UtimeToTimespec(ap)),
+				unix.Timespec(fuse.UtimeToTimespec(mp)),
+			}
+			if err := unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+				return err
+			}
+		}
+		if sz, ok := in.GetSize(); ok {
+			if err := syscall.Truncate(p, int64(sz)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errno != 0 {
+		return errno
+	}
+	return n.Getattr(ctx, nil, out)
+}
+
+var _ = (fs.NodeOpener)((*poolNode)(nil))
+
+func (n *poolNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	for {
+		b, errno := n.pool.searchBranch(n.path(""), nil)
+		if errno != 0 {
+			return nil, 0, errno
+		}
+		fh, errno := n.pool.openIn(b, n.path(""), flags)
+		if errno == syscall.ESTALE {
+			// Moved by Drain: look for the new copy.
+			continue
+		}
+		return fh, 0, errno
+	}
+}
+
+// openIn opens `name` in `b`.
+func (p *Pool) openIn(b *branch, name string, flags uint32) (fs.FileHandle, syscall.Errno) {
+	if b.Mode == ReadOnly && (flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0) {
+		return nil, syscall.EROFS
+	}
+	fd, err := syscall.Open(filepath.Join(b.Path, name), int(flags), 0)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return p.newFile(b, fd, flags)
+}
+
+var _ = (fs.NodeCreater)((*poolNode)(nil))
+
+func (n *poolNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	if n.isControl(name) {
+		return nil, nil, 0, syscall.EPERM
+	}
+	p := n.path(name)
+	var st syscall.Stat_t
+	b, errno := n.pool.searchBranch(p, &st)
+	if errno == 0 {
+		// The file was created in the meantime.
+		if flags&syscall.O_EXCL != 0 {
+			return nil, nil, 0, syscall.EEXIST
+		}
+		fh, errno := n.pool.openIn(b, p, flags&^syscall.O_CREAT)
+		if errno != 0 {
+			return nil, nil, 0, errno
+		}
+		return n.newChild(ctx, b, &st, out), fh, 0, 0
+	}
+	b, errno = n.pool.createBranch(p, n.pool.create)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	abs := filepath.Join(b.Path, p)
+	fd, err := syscall.Open(abs, int(flags)|syscall.O_CREAT, mode)
+	if err != nil {
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+	passthrough.PreserveOwner(ctx, abs)
+
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		syscall.Unlink(abs)
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+	fh, errno := n.pool.newFile(b, fd, flags)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	return n.newChild(ctx, b, &st, out), fh, 0, 0
+}
+
+var _ = (fs.NodeMkdirer)((*poolNode)(nil))
+
+func (n *poolNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return n.mkchild(ctx, name, out, func(p string) error {
+		return syscall.Mkdir(p, mode)
+	})
+}
+
+var _ = (fs.NodeMknoder)((*poolNode)(nil))
+
+func (n *poolNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return n.mkchild(ctx, name, out, func(p string) error {
+		return syscall.Mknod(p, mode, int(rdev))
+	})
+}
+
+var _ = (fs.NodeSymlinker)((*poolNode)(nil))
+
+func (n *poolNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return n.mkchild(ctx, name, out, func(p string) error {
+		return syscall.Symlink(target, p)
+	})
+}
+
+// mkchild creates the child `name` in the branch chosen by the create
+// policy, by calling `mk` with its path.
+func (n *poolNode) mkchild(ctx context.Context, name string, out *fuse.EntryOut, mk func(path string) error) (*fs.Inode, syscall.Errno) {
+	p := n.path(name)
+	if n.isControl(name) || len(n.pool.existing(p)) > 0 {
+		return nil, syscall.EEXIST
+	}
+	b, errno := n.pool.createBranch(p, n.pool.create)
+	if errno != 0 {
+		return nil, errno
+	}
+	abs := filepath.Join(b.Path, p)
+	if err := mk(abs); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	passthrough.PreserveOwner(ctx, abs)
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(abs, &st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return n.newChild(ctx, b, &st, out), 0
+}
+
+var _ = (fs.NodeLinker)((*poolNode)(nil))
+
+func (n *poolNode) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	p := n.path(name)
+	if n.isControl(name) || len(n.pool.existing(p)) > 0 {
+		return nil, syscall.EEXIST
+	}
+
+	// A hard link must be on the branch of its target.
+	orig := target.EmbeddedInode().Path(nil)
+	var b *branch
+	for _, eb := range n.pool.existing(orig) {
+		if eb.Mode != ReadOnly {
+			b = eb
+			break
+		}
+	}
+	if b == nil {
+		return nil, syscall.EROFS
+	}
+	if errno := n.pool.clonePath(b, filepath.Dir(p)); errno != 0 {
+		return nil, errno
+	}
+	abs := filepath.Join(b.Path, p)
+	if err := syscall.Link(filepath.Join(b.Path, orig), abs); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(abs, &st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return n.newChild(ctx, b, &st, out), 0
+}
+
+var _ = (fs.NodeUnlinker)((*poolNode)(nil))
+
+func (n *poolNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	return n.pool.forEach(n.path(name), func(b *branch, p string) error {
+		return syscall.Unlink(p)
+	})
+}
+
+var _ = (fs.NodeRmdirer)((*poolNode)(nil))
+
+func (n *poolNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	p := n.path(name)
+	// The directory must be empty in all branches, also those that
+	// the action policy leaves alone.
+	if len(n.pool.readDir(p)) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	return n.pool.forEach(p, func(b *branch, p string) error {
+		return syscall.Rmdir(p)
+	})
+}
+
+var _ = (fs.NodeRenamer)((*poolNode)(nil))
+
+func (n *poolNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags&fs.RENAME_EXCHANGE != 0 {
+		return syscall.ENOTSUP
+	}
+	pool := n.pool
+	np := newParent.(*poolNode)
+	if n.isControl(name) || np.isControl(newName) {
+		return syscall.EPERM
+	}
+	src := n.path(name)
+	dst := np.path(newName)
+
+	var srcSt, dstSt syscall.Stat_t
+	if _, errno := pool.searchBranch(src, &srcSt); errno != 0 {
+		return errno
+	}
+	dstBranches := pool.existing(dst)
+	if len(dstBranches) > 0 {
+		if flags&fs.RENAME_NOREPLACE != 0 {
+			return syscall.EEXIST
+		}
+		if _, errno := pool.searchBranch(dst, &dstSt); errno != 0 {
+			return errno
+		}
+		srcDir := srcSt.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		dstDir := dstSt.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		if srcDir && !dstDir {
+			return syscall.ENOTDIR
+		}
+		if !srcDir && dstDir {
+			return syscall.EISDIR
+		}
+		if dstDir && len(pool.readDir(dst)) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	// Each chosen branch renames its own copy of the entry.
+	renamed := map[string]bool{}
+	errno := pool.forEach(src, func(b *branch, p string) error {
+		if errno := pool.clonePath(b, filepath.Dir(dst)); errno != 0 {
+			return errno
+		}
+		if err := syscall.Rename(p, filepath.Join(b.Path, dst)); err != nil {
+			return err
+		}
+		renamed[b.Path] = true
+		return nil
+	})
+	if errno != 0 {
+		return errno
+	}
+
+	// The old destination in the other branches would hide the
+	// renamed entry. It is empty if it is a directory.
+	for _, b := range dstBranches {
+		if renamed[b.Path] || b.Mode == ReadOnly {
+			continue
+		}
+		os.Remove(filepath.Join(b.Path, dst))
+	}
+	return 0
+}
+
+var _ = (fs.NodeReadlinker)((*poolNode)(nil))
+
+func (n *poolNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	b, errno := n.pool.searchBranch(n.path(""), nil)
+	if errno != 0 {
+		return nil, errno
+	}
+	target, err := os.Readlink(filepath.Join(b.Path, n.path("")))
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return []byte(target), 0
+}
+
+var _ = (fs.NodeReaddirer)((*poolNode)(nil))
+
+func (n *poolNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return fs.NewListDirStream(n.pool.readDir(n.path(""))), 0
+}
+
+// readDir returns the entries of `dir` in all branches. An entry
+// that exists in several branches has the type it has in the first.
+func (p *Pool) readDir(dir string) []fuse.DirEntry {
+	seen := map[string]bool{}
+	var result []fuse.DirEntry
+	for _, b := range p.snapshot() {
+		ds, errno := fs.NewLoopbackDirStream(filepath.Join(b.Path, dir))
+		if errno != 0 {
+			continue
+		}
+		for ds.HasNext() {
+			e, errno := ds.Next()
+			if errno != 0 {
+				break
+			}
+			if e.Name == "." || e.Name == ".." || seen[e.Name] {
+				continue
+			}
+			seen[e.Name] = true
+			result = append(result, fuse.DirEntry{Name: e.Name, Mode: e.Mode})
+		}
+		ds.Close()
+	}
+	return result
+}
+
+var _ = (fs.NodeGetxattrer)((*poolNode)(nil))
+
+func (n *poolNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	b, errno := n.pool.searchBranch(n.path(""), nil)
+	if errno != 0 {
+		return 0, errno
+	}
+	sz, err := unix.Lgetxattr(filepath.Join(b.Path, n.path("")), attr, dest)
+	return uint32(sz), fs.ToErrno(err)
+}
+
+var _ = (fs.NodeListxattrer)((*poolNode)(nil))
+
+func (n *poolNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	b, errno := n.pool.searchBranch(n.path(""), nil)
+	if errno != 0 {
+		return 0, errno
+	}
+	sz, err := unix.Llistxattr(filepath.Join(b.Path, n.path("")), dest)
+	return uint32(sz), fs.ToErrno(err)
+}
+
+var _ = (fs.NodeSetxattrer)((*poolNode)(nil))
+
+func (n *poolNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return n.pool.forEach(n.path(""), func(b *branch, p string) error {
+		return unix.Lsetxattr(p, attr, data, int(flags))
+	})
+}
+
+var _ = (fs.NodeRemovexattrer)((*poolNode)(nil))
+
+func (n *poolNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return n.pool.forEach(n.path(""), func(b *branch, p string) error {
+		return unix.Lremovexattr(p, attr)
+	})
+}
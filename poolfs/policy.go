@@ -0,0 +1,131 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poolfs
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Candidate is a branch that a Policy may choose for an operation.
+type Candidate struct {
+	Branch
+
+	// Exists is set if the path of the operation exists in the
+	// branch. When creating an entry, it is the path of the
+	// parent directory.
+	Exists bool
+
+	// Avail is the number of bytes available to unprivileged
+	// users, and Used the number of bytes in use, on the file
+	// system of the branch. They are only set when creating an
+	// entry.
+	Avail, Used uint64
+}
+
+// A Policy chooses branches for an operation among `candidates`,
+// which are in the order of the branches of the pool. It returns the
+// indices of the chosen candidates, best first. Operations that need
+// a single branch use the first one.
+type Policy func(candidates []Candidate) []int
+
+// Policies are the policies by their mergerfs names. The policies
+// starting with "ep" (existing path) only choose branches in which
+// the path exists; the others clone the parent directories of a new
+// entry into the chosen branch as needed.
+var Policies = map[string]Policy{
+	"all":    all,
+	"epall":  existingPath(all),
+	"ff":     firstFound,
+	"epff":   existingPath(firstFound),
+	"mfs":    mostFreeSpace,
+	"epmfs":  existingPath(mostFreeSpace),
+	"lfs":    leastFreeSpace,
+	"eplfs":  existingPath(leastFreeSpace),
+	"lus":    leastUsedSpace,
+	"eplus":  existingPath(leastUsedSpace),
+	"rand":   random,
+	"eprand": existingPath(random),
+}
+
+// ParsePolicy returns the policy called `name` in Policies.
+func ParsePolicy(name string) (Policy, error) {
+	p, ok := Policies[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("poolfs: unknown policy %q", name)
+	}
+	return p, nil
+}
+
+// all chooses all candidates.
+func all(c []Candidate) []int {
+	idx := make([]int, len(c))
+	for i := range c {
+		idx[i] = i
+	}
+	return idx
+}
+
+// firstFound chooses the first candidate.
+func firstFound(c []Candidate) []int {
+	if len(c) == 0 {
+		return nil
+	}
+	return []int{0}
+}
+
+// best chooses the candidate for which `less` reports that it goes
+// before all others. Ties go to the first branch.
+func best(c []Candidate, less func(a, b *Candidate) bool) []int {
+	if len(c) == 0 {
+		return nil
+	}
+	idx := all(c)
+	sort.SliceStable(idx, func(i, j int) bool {
+		return less(&c[idx[i]], &c[idx[j]])
+	})
+	return idx[:1]
+}
+
+func mostFreeSpace(c []Candidate) []int {
+	return best(c, func(a, b *Candidate) bool { return a.Avail > b.Avail })
+}
+
+func leastFreeSpace(c []Candidate) []int {
+	return best(c, func(a, b *Candidate) bool { return a.Avail < b.Avail })
+}
+
+func leastUsedSpace(c []Candidate) []int {
+	return best(c, func(a, b *Candidate) bool { return a.Used < b.Used })
+}
+
+func random(c []Candidate) []int {
+	if len(c) == 0 {
+		return nil
+	}
+	return []int{rand.Intn(len(c))}
+}
+
+// existingPath returns a policy that applies `p` to the candidates in
+// which the path exists.
+func existingPath(p Policy) Policy {
+	return func(c []Candidate) []int {
+		var exist []Candidate
+		var orig []int
+		for i := range c {
+			if c[i].Exists {
+				exist = append(exist, c[i])
+				orig = append(orig, i)
+			}
+		}
+		chosen := p(exist)
+		for i := range chosen {
+			chosen[i] = orig[chosen[i]]
+		}
+		return chosen
+	}
+}
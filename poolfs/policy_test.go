@@ -0,0 +1,72 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poolfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPolicies(t *testing.T) {
+	c := []Candidate{
+		{Branch: Branch{Path: "/a"}, Avail: 10, Used: 50},
+		{Branch: Branch{Path: "/b"}, Exists: true, Avail: 30, Used: 40},
+		{Branch: Branch{Path: "/c"}, Avail: 20, Used: 10},
+		{Branch: Branch{Path: "/d"}, Exists: true, Avail: 5, Used: 60},
+	}
+	for nm, want := range map[string][]int{
+		"all":   {0, 1, 2, 3},
+		"epall": {1, 3},
+		"ff":    {0},
+		"epff":  {1},
+		"mfs":   {1},
+		"epmfs": {1},
+		"lfs":   {3},
+		"eplfs": {3},
+		"lus":   {2},
+		"eplus": {1},
+	} {
+		p, err := ParsePolicy(nm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p(c); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", nm, got, want)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if got := Policies["eprand"](c); len(got) != 1 || !c[got[0]].Exists {
+			t.Errorf("eprand: got %v", got)
+		}
+	}
+	if got := Policies["epmfs"](c[:1]); len(got) != 0 {
+		t.Errorf("epmfs without existing path: got %v", got)
+	}
+	if _, err := ParsePolicy("bogus"); err == nil {
+		t.Errorf("ParsePolicy succeeded for unknown policy")
+	}
+}
+
+func TestParseBranch(t *testing.T) {
+	for in, want := range map[string]Branch{
+		"/a":        {Path: "/a"},
+		"/a=RO":     {Path: "/a", Mode: ReadOnly},
+		"/a=b=nc":   {Path: "/a=b", Mode: NoCreate},
+		"/disk1=RW": {Path: "/disk1"},
+	} {
+		got, err := ParseBranch(in)
+		if err != nil {
+			t.Errorf("%q: %v", in, err)
+		} else if got != want {
+			t.Errorf("%q: got %v, want %v", in, got, want)
+		}
+	}
+	for _, in := range []string{"=RW", "/a=XX"} {
+		if _, err := ParseBranch(in); err == nil {
+			t.Errorf("%q: got no error", in)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package poolfs pools directories, typically on different disks,
+// into a single file system, like mergerfs. Each file lives in one
+// of the branches, and is read and written there. Which branch a new
+// entry goes to, which one is used for looking up a name, and which
+// ones are changed by operations such as chmod or unlink is decided
+// by configurable policies.
+//
+// The branches can be changed while the file system is mounted,
+// through the methods of Pool or through its control file.
+package poolfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/copyfile"
+)
+
+// BranchMode says which operations may use a branch.
+type BranchMode int
+
+const (
+	// ReadWrite branches are used for all operations.
+	ReadWrite BranchMode = iota
+
+	// NoCreate branches are not chosen for new entries, but the
+	// entries they hold can be changed and removed.
+	NoCreate
+
+	// ReadOnly branches are not changed.
+	ReadOnly
+)
+
+var branchModeNames = map[BranchMode]string{
+	ReadWrite: "RW",
+	NoCreate:  "NC",
+	ReadOnly:  "RO",
+}
+
+func (m BranchMode) String() string {
+	if s, ok := branchModeNames[m]; ok {
+		return s
+	}
+	return fmt.Sprintf("BranchMode(%d)", int(m))
+}
+
+// ParseBranchMode parses "RW", "NC" or "RO".
+func ParseBranchMode(s string) (BranchMode, error) {
+	for m, nm := range branchModeNames {
+		if strings.EqualFold(s, nm) {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("poolfs: unknown branch mode %q", s)
+}
+
+// Branch is a directory in the pool.
+type Branch struct {
+	Path string
+	Mode BranchMode
+}
+
+// ParseBranch parses a branch in the mergerfs syntax, "PATH=MODE",
+// where "=MODE" may be left out for ReadWrite.
+func ParseBranch(s string) (Branch, error) {
+	b := Branch{Path: s}
+	if i := strings.LastIndex(s, "="); i >= 0 {
+		m, err := ParseBranchMode(s[i+1:])
+		if err != nil {
+			return b, err
+		}
+		b.Path, b.Mode = s[:i], m
+	}
+	if b.Path == "" {
+		return b, fmt.Errorf("poolfs: empty branch path in %q", s)
+	}
+	return b, nil
+}
+
+func (b Branch) String() string {
+	return b.Path + "=" + b.Mode.String()
+}
+
+// Options holds optional parameters for New.
+type Options struct {
+	// Create chooses the branch for new entries. If nil, "epmfs"
+	// is used.
+	Create Policy
+
+	// Search chooses the branch for looking up, reading and
+	// opening entries. If nil, "ff" is used.
+	Search Policy
+
+	// Action chooses the branches that are changed by chmod,
+	// chown, utimes, truncate, setting extended attributes,
+	// unlink, rmdir and rename. If nil, "epall" is used.
+	Action Policy
+
+	// MinFreeSpace is the number of bytes that must be available
+	// on a branch for it to be chosen for new entries.
+	MinFreeSpace uint64
+
+	// ControlName is the name of the control file in the root
+	// directory. Reading it lists the branches, and writing
+	// commands to it changes them, see Pool.Control. If empty,
+	// ".poolfs" is used. Set it to "-" to disable the control
+	// file.
+	ControlName string
+}
+
+type branch struct {
+	Branch
+
+	// id distinguishes the inode numbers of the branches.
+	id uint64
+}
+
+// Pool is a file system pooling branches.
+type Pool struct {
+	root *poolNode
+
+	create, search, action Policy
+	minFree                uint64
+	controlName            string
+
+	mu       sync.RWMutex
+	branches []*branch
+	nextID   uint64
+	draining map[string]bool
+	control  *fs.Inode
+
+	// filesMu protects files and moved.
+	filesMu sync.Mutex
+	// files holds the files with writable handles.
+	files map[fileID]*openFile
+	// moved holds the inode numbers of the files moved by Drain.
+	moved map[fileID]uint64
+}
+
+// New returns a pool of `branches`. Mount the node returned by Root.
+func New(branches []Branch, opts *Options) (*Pool, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	p := &Pool{
+		create:      opts.Create,
+		search:      opts.Search,
+		action:      opts.Action,
+		minFree:     opts.MinFreeSpace,
+		controlName: opts.ControlName,
+		draining:    map[string]bool{},
+		files:       map[fileID]*openFile{},
+		moved:       map[fileID]uint64{},
+	}
+	if p.create == nil {
+		p.create = Policies["epmfs"]
+	}
+	if p.search == nil {
+		p.search = Policies["ff"]
+	}
+	if p.action == nil {
+		p.action = Policies["epall"]
+	}
+	if p.controlName == "" {
+		p.controlName = ".poolfs"
+	}
+	for _, b := range branches {
+		if err := p.AddBranch(b); err != nil {
+			return nil, err
+		}
+	}
+	p.root = &poolNode{pool: p}
+	return p, nil
+}
+
+// Root returns the root of the file system.
+func (p *Pool) Root() fs.InodeEmbedder {
+	return p.root
+}
+
+// Branches returns the branches, in order.
+func (p *Pool) Branches() []Branch {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var r []Branch
+	for _, b := range p.branches {
+		r = append(r, b.Branch)
+	}
+	return r
+}
+
+// AddBranch adds `b` after the other branches. Its path must be a
+// directory that is not in the pool yet.
+func (p *Pool) AddBranch(b Branch) error {
+	b.Path = filepath.Clean(b.Path)
+	if fi, err := os.Stat(b.Path); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("poolfs: branch %q is not a directory", b.Path)
+	}
+	if _, ok := branchModeNames[b.Mode]; !ok {
+		return fmt.Errorf("poolfs: branch %q has invalid mode %v", b.Path, b.Mode)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.find(b.Path) >= 0 {
+		return fmt.Errorf("poolfs: branch %q already exists", b.Path)
+	}
+	p.nextID++
+	p.branches = append(p.branches, &branch{Branch: b, id: p.nextID})
+	return nil
+}
+
+// RemoveBranch removes the branch with path `path` from the pool. The
+// entries in it are no longer visible, but they are left in place.
+func (p *Pool) RemoveBranch(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := p.find(path)
+	if i < 0 {
+		return fmt.Errorf("poolfs: branch %q not found", path)
+	}
+	if p.draining[p.branches[i].Path] {
+		return fmt.Errorf("poolfs: branch %q is being drained", path)
+	}
+	p.branches = append(p.branches[:i:i], p.branches[i+1:]...)
+	return nil
+}
+
+// SetBranchMode changes the mode of the branch with path `path`.
+func (p *Pool) SetBranchMode(path string, mode BranchMode) error {
+	if _, ok := branchModeNames[mode]; !ok {
+		return fmt.Errorf("poolfs: invalid mode %v", mode)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := p.find(path)
+	if i < 0 {
+		return fmt.Errorf("poolfs: branch %q not found", path)
+	}
+	if p.draining[p.branches[i].Path] {
+		return fmt.Errorf("poolfs: branch %q is being drained", path)
+	}
+	// Branches are copied by the operations that use them, so
+	// they are replaced rather than changed.
+	b := *p.branches[i]
+	b.Mode = mode
+	p.branches[i] = &b
+	return nil
+}
+
+// find returns the index of the branch at `path`, or -1.
+func (p *Pool) find(path string) int {
+	path = filepath.Clean(path)
+	for i, b := range p.branches {
+		if b.Path == path {
+			return i
+		}
+	}
+	return -1
+}
+
+// snapshot returns the current branches.
+func (p *Pool) snapshot() []*branch {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*branch(nil), p.branches...)
+}
+
+// existing returns the branches in which `name` exists.
+func (p *Pool) existing(name string) []*branch {
+	var r []*branch
+	for _, b := range p.snapshot() {
+		var st syscall.Stat_t
+		if syscall.Lstat(filepath.Join(b.Path, name), &st) == nil {
+			r = append(r, b)
+		}
+	}
+	return r
+}
+
+func candidates(bs []*branch, exists bool) []Candidate {
+	c := make([]Candidate, len(bs))
+	for i, b := range bs {
+		c[i] = Candidate{Branch: b.Branch, Exists: exists}
+	}
+	return c
+}
+
+// searchBranch returns the branch to read `name` from, and its
+// attributes there.
+func (p *Pool) searchBranch(name string, st *syscall.Stat_t) (*branch, syscall.Errno) {
+	if st == nil {
+		st = &syscall.Stat_t{}
+	}
+	bs := p.existing(name)
+	chosen := p.search(candidates(bs, true))
+	if len(chosen) == 0 {
+		return nil, syscall.ENOENT
+	}
+	b := bs[chosen[0]]
+	if err := syscall.Lstat(filepath.Join(b.Path, name), st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return b, 0
+}
+
+// actionBranches returns the branches to change for an operation on
+// `name`.
+func (p *Pool) actionBranches(name string) ([]*branch, syscall.Errno) {
+	bs := p.existing(name)
+	if len(bs) == 0 {
+		return nil, syscall.ENOENT
+	}
+	var writable []*branch
+	for _, b := range bs {
+		if b.Mode != ReadOnly {
+			writable = append(writable, b)
+		}
+	}
+	if len(writable) == 0 {
+		return nil, syscall.EROFS
+	}
+	var r []*branch
+	for _, i := range p.action(candidates(writable, true)) {
+		r = append(r, writable[i])
+	}
+	if len(r) == 0 {
+		return nil, syscall.ENOENT
+	}
+	return r, 0
+}
+
+// forEach runs `f` on the branches chosen by the action policy for
+// `name`. It succeeds if `f` succeeds for any of them.
+func (p *Pool) forEach(name string, f func(b *branch, path string) error) syscall.Errno {
+	bs, errno := p.actionBranches(name)
+	if errno != 0 {
+		return errno
+	}
+	var firstErr error
+	ok := false
+	for _, b := range bs {
+		if err := f(b, filepath.Join(b.Path, name)); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		ok = true
+	}
+	if ok {
+		return 0
+	}
+	return fs.ToErrno(firstErr)
+}
+
+// createBranch returns the branch chosen by `policy` for the new
+// entry `name`. Its parent directory exists in the returned branch.
+func (p *Pool) createBranch(name string, policy Policy) (*branch, syscall.Errno) {
+	parent := filepath.Dir(name)
+	var bs []*branch
+	var c []Candidate
+	errno := syscall.EROFS
+	for _, b := range p.snapshot() {
+		if b.Mode != ReadWrite {
+			continue
+		}
+		var s syscall.Statfs_t
+		if err := syscall.Statfs(b.Path, &s); err != nil {
+			continue
+		}
+		avail := s.Bavail * uint64(s.Bsize)
+		if avail < p.minFree {
+			errno = syscall.ENOSPC
+			continue
+		}
+		var st syscall.Stat_t
+		exists := syscall.Lstat(filepath.Join(b.Path, parent), &st) == nil &&
+			st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		bs = append(bs, b)
+		c = append(c, Candidate{
+			Branch: b.Branch,
+			Exists: exists,
+			Avail:  avail,
+			Used:   (s.Blocks - s.Bfree) * uint64(s.Bsize),
+		})
+	}
+	if len(c) > 0 {
+		errno = syscall.ENOENT
+	}
+	chosen := policy(c)
+	if len(chosen) == 0 {
+		return nil, errno
+	}
+	b := bs[chosen[0]]
+	if errno := p.clonePath(b, parent); errno != 0 {
+		return nil, errno
+	}
+	return b, 0
+}
+
+// clonePath creates the directory `dir` and its parents in `dst` as
+// they are in the other branches.
+func (p *Pool) clonePath(dst *branch, dir string) syscall.Errno {
+	if dir == "." {
+		return 0
+	}
+	var st syscall.Stat_t
+	if syscall.Lstat(filepath.Join(dst.Path, dir), &st) == nil {
+		return 0
+	}
+	if errno := p.clonePath(dst, filepath.Dir(dir)); errno != 0 {
+		return errno
+	}
+	for _, b := range p.existing(dir) {
+		if b.Path == dst.Path {
+			continue
+		}
+		err := copyfile.Copy(filepath.Join(b.Path, dir), filepath.Join(dst.Path, dir), nil)
+		if os.IsExist(err) {
+			// Created concurrently.
+			err = nil
+		}
+		return fs.ToErrno(err)
+	}
+	return syscall.ENOENT
+}
+
+// statfs returns the statistics of the pool. Space is counted once
+// per file system, and only the space of ReadWrite branches is
+// available.
+func (p *Pool) statfs(out *fuse.StatfsOut) syscall.Errno {
+	type fsStats struct {
+		st    syscall.Statfs_t
+		avail bool
+	}
+	var stats []*fsStats
+	seen := map[uint64]*fsStats{}
+	for _, b := range p.snapshot() {
+		var st syscall.Stat_t
+		var s syscall.Statfs_t
+		if err := syscall.Stat(b.Path, &st); err != nil {
+			continue
+		}
+		if err := syscall.Statfs(b.Path, &s); err != nil {
+			continue
+		}
+		key := uint64(st.Dev)
+		f := seen[key]
+		if f == nil {
+			f = &fsStats{st: s}
+			seen[key] = f
+			stats = append(stats, f)
+		}
+		if b.Mode == ReadWrite {
+			f.avail = true
+		}
+	}
+	if len(stats) == 0 {
+		return syscall.ENOENT
+	}
+
+	// The block counts are in the blocks of each file system, so
+	// they are summed in bytes, and reported in the smallest
+	// block size.
+	bsize := blockSize(&stats[0].st)
+	out.NameLen = nameLen(&stats[0].st)
+	for _, f := range stats {
+		if bs := blockSize(&f.st); bs < bsize {
+			bsize = bs
+		}
+		if nl := nameLen(&f.st); nl < out.NameLen {
+			out.NameLen = nl
+		}
+	}
+	var blocks, bfree, bavail uint64
+	for _, f := range stats {
+		bs := blockSize(&f.st)
+		blocks += uint64(f.st.Blocks) * bs
+		bfree += uint64(f.st.Bfree) * bs
+		out.Files += uint64(f.st.Files)
+		out.Ffree += uint64(f.st.Ffree)
+		if f.avail {
+			bavail += uint64(f.st.Bavail) * bs
+		}
+	}
+	out.Blocks = blocks / bsize
+	out.Bfree = bfree / bsize
+	out.Bavail = bavail / bsize
+	out.Bsize = uint32(bsize)
+	out.Frsize = uint32(bsize)
+	return 0
+}
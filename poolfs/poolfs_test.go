@@ -0,0 +1,410 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poolfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"github.com/hanwen/go-fuse/v2/posixtest"
+)
+
+type testCase struct {
+	dir      string
+	mnt      string
+	branches []string
+	pool     *Pool
+}
+
+func newTestCase(t *testing.T, modes []BranchMode, opts *Options) (*testCase, func()) {
+	t.Helper()
+	tc := &testCase{dir: testutil.TempDir()}
+	tc.mnt = tc.dir + "/mnt"
+	if err := os.Mkdir(tc.mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var branches []Branch
+	for i, m := range modes {
+		p := fmt.Sprintf("%s/b%d", tc.dir, i)
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		tc.branches = append(tc.branches, p)
+		branches = append(branches, Branch{Path: p, Mode: m})
+	}
+
+	var err error
+	tc.pool, err = New(branches, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountOpts := &fs.Options{}
+	mountOpts.Debug = testutil.VerboseTest()
+	server, err := fs.Mount(tc.mnt, tc.pool.Root(), mountOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tc, func() {
+		server.Unmount()
+		os.RemoveAll(tc.dir)
+	}
+}
+
+func (tc *testCase) writeBranch(t *testing.T, i int, name, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(tc.branches[i]+"/"+name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+func TestPosix(t *testing.T) {
+	for nm, fn := range posixtest.All {
+		t.Run(nm, func(t *testing.T) {
+			tc, clean := newTestCase(t, []BranchMode{ReadWrite, ReadWrite}, nil)
+			defer clean()
+			fn(t, tc.mnt)
+		})
+	}
+}
+
+func TestReadDirMerged(t *testing.T) {
+	tc, clean := newTestCase(t, []BranchMode{ReadWrite, ReadWrite, ReadOnly}, nil)
+	defer clean()
+
+	tc.writeBranch(t, 0, "a", "a")
+	tc.writeBranch(t, 1, "b", "b")
+	tc.writeBranch(t, 2, "c", "c")
+	tc.writeBranch(t, 2, "a", "shadowed")
+
+	es, err := ioutil.ReadDir(tc.mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range es {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+	for nm, want := range map[string]string{"a": "a", "b": "b", "c": "c"} {
+		if got, err := ioutil.ReadFile(tc.mnt + "/" + nm); err != nil {
+			t.Fatal(err)
+		} else if string(got) != want {
+			t.Errorf("%s: got %q, want %q", nm, got, want)
+		}
+	}
+}
+
+func TestCreateExistingPath(t *testing.T) {
+	tc, clean := newTestCase(t, []BranchMode{ReadWrite, ReadWrite}, nil)
+	defer clean()
+
+	if err := os.Mkdir(tc.branches[1]+"/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// epmfs only chooses branches holding the parent directory.
+	if err := ioutil.WriteFile(tc.mnt+"/dir/file", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(tc.branches[1]+"/dir/file") || exists(tc.branches[0]+"/dir") {
+		t.Errorf("file not created in the branch holding the directory")
+	}
+}
+
+func TestCreateClonesPath(t *testing.T) {
+	tc, clean := newTestCase(t, []BranchMode{ReadWrite, ReadWrite}, &Options{Create: Policies["ff"]})
+	defer clean()
+
+	if err := os.Mkdir(tc.branches[1]+"/dir", 0705); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tc.mnt+"/dir/file", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(tc.branches[0] + "/dir/file") {
+		t.Fatalf("file not created in first branch")
+	}
+	if fi, err := os.Lstat(tc.branches[0] + "/dir"); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0705 {
+		t.Errorf("cloned directory has mode %o, want 0705", fi.Mode().Perm())
+	}
+}
+
+func TestActionAllBranches(t *testing.T) {
+	tc, clean := newTestCase(t, []BranchMode{ReadWrite, NoCreate, ReadOnly}, nil)
+	defer clean()
+
+	for i := range tc.branches {
+		tc.writeBranch(t, i, "file", "data")
+	}
+	if err := os.Chmod(tc.mnt+"/file", 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []os.FileMode{0600, 0600, 0644} {
+		if fi, err := os.Lstat(tc.branches[i] + "/file"); err != nil {
+			t.Fatal(err)
+		} else if fi.Mode().Perm() != want {
+			t.Errorf("branch %d: got mode %o, want %o", i, fi.Mode().Perm(), want)
+		}
+	}
+
+	if err := os.Remove(tc.mnt + "/file"); err != nil {
+		t.Fatal(err)
+	}
+	if exists(tc.branches[0]+"/file") || exists(tc.branches[1]+"/file") {
+		t.Errorf("file left in writable branch")
+	}
+
+	// Only the read-only copy is left.
+	_, err := os.OpenFile(tc.mnt+"/file", os.O_WRONLY, 0)
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EROFS {
+		t.Errorf("open for writing: got %v, want EROFS", err)
+	}
+	err = os.Chmod(tc.mnt+"/file", 0600)
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EROFS {
+		t.Errorf("chmod: got %v, want EROFS", err)
+	}
+}
+
+func TestNoWritableBranch(t *testing.T) {
+	tc, clean := newTestCase(t, []BranchMode{NoCreate, ReadOnly}, nil)
+	defer clean()
+
+	err := ioutil.WriteFile(tc.mnt+"/file", []byte("x"), 0644)
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EROFS {
+		t.Errorf("create: got %v, want EROFS", err)
+	}
+}
+
+func TestRenameOtherBranch(t *testing.T) {
+	tc, clean := newTestCase(t, []BranchMode{ReadWrite, ReadWrite}, nil)
+	defer clean()
+
+	tc.writeBranch(t, 0, "dst", "old")
+	if err := os.Mkdir(tc.branches[1]+"/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	tc.writeBranch(t, 1, "dir/src", "new")
+
+	if err := os.Rename(tc.mnt+"/dir/src", tc.mnt+"/dst"); err != nil {
+		t.Fatal(err)
+	}
+	if exists(tc.branches[0] + "/dst") {
+		t.Errorf("old destination was not removed")
+	}
+	if got, err := ioutil.ReadFile(tc.mnt + "/dst"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+}
+
+func TestStatfs(t *testing.T) {
+	tc, clean := newTestCase(t, []BranchMode{ReadWrite, ReadWrite}, nil)
+	defer clean()
+
+	// Both branches are on the same file system, which is only
+	// counted once.
+	var branch, pool syscall.Statfs_t
+	if err := syscall.Statfs(tc.branches[0], &branch); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Statfs(tc.mnt, &pool); err != nil {
+		t.Fatal(err)
+	}
+	// Block counts are in units of Frsize.
+	if got, want := pool.Blocks*uint64(pool.Frsize), branch.Blocks*uint64(branch.Frsize); got != want {
+		t.Errorf("got %d bytes, want %d", got, want)
+	}
+
+	if err := tc.pool.SetBranchMode(tc.branches[0], ReadOnly); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.pool.SetBranchMode(tc.branches[1], NoCreate); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Statfs(tc.mnt, &pool); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Bavail != 0 {
+		t.Errorf("got %d blocks available without ReadWrite branches", pool.Bavail)
+	}
+}
+
+func TestControlFile(t *testing.T) {
+	tc, clean := newTestCase(t, []BranchMode{ReadWrite}, nil)
+	defer clean()
+
+	extra := tc.dir + "/extra"
+	if err := os.Mkdir(extra, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(extra+"/file", []byte("extra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctl := tc.mnt + "/.poolfs"
+	cmds := fmt.Sprintf("add %s=NC\nmode %s=RO\n", extra, tc.branches[0])
+	if err := ioutil.WriteFile(ctl, []byte(cmds), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%s=RO\n%s=NC\n", tc.branches[0], extra)
+	if got, err := ioutil.ReadFile(ctl); err != nil {
+		t.Fatal(err)
+	} else if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, err := ioutil.ReadFile(tc.mnt + "/file"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "extra" {
+		t.Errorf("got %q, want %q", got, "extra")
+	}
+
+	if err := ioutil.WriteFile(ctl, []byte("remove "+extra+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := tc.pool.Branches(); len(got) != 1 {
+		t.Errorf("got branches %v after remove", got)
+	}
+	if err := ioutil.WriteFile(ctl, []byte("bogus command\n"), 0644); err == nil {
+		t.Errorf("invalid command succeeded")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	tc, clean := newTestCase(t, []BranchMode{ReadWrite, ReadWrite}, nil)
+	defer clean()
+
+	for _, d := range []string{"/dir", "/dir/sub", "/empty"} {
+		if err := os.Mkdir(tc.branches[0]+d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tc.writeBranch(t, 0, "top", "top")
+	tc.writeBranch(t, 0, "dir/sub/file", "file")
+	if err := os.Symlink("top", tc.branches[0]+"/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tc.pool.Drain(tc.branches[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := tc.pool.Branches(); len(got) != 1 || got[0].Path != tc.branches[1] {
+		t.Errorf("got branches %v, want only %s", got, tc.branches[1])
+	}
+	if es, err := ioutil.ReadDir(tc.branches[0]); err != nil {
+		t.Fatal(err)
+	} else if len(es) != 0 {
+		t.Errorf("drained branch has %d entries", len(es))
+	}
+
+	for nm, want := range map[string]string{"top": "top", "dir/sub/file": "file"} {
+		if got, err := ioutil.ReadFile(tc.branches[1] + "/" + nm); err != nil {
+			t.Error(err)
+		} else if string(got) != want {
+			t.Errorf("%s: got %q, want %q", nm, got, want)
+		}
+	}
+	if got, err := os.Readlink(tc.branches[1] + "/link"); err != nil {
+		t.Error(err)
+	} else if got != "top" {
+		t.Errorf("got link %q, want %q", got, "top")
+	}
+	if !exists(tc.branches[1] + "/empty") {
+		t.Errorf("empty directory was not kept")
+	}
+}
+
+func TestDrainBusy(t *testing.T) {
+	tc, clean := newTestCase(t, []BranchMode{ReadWrite, ReadWrite}, nil)
+	defer clean()
+
+	tc.writeBranch(t, 0, "file", "a")
+	b, err := tc.pool.startDrain(tc.branches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.pool.RemoveBranch(tc.branches[0]); err == nil {
+		t.Errorf("RemoveBranch of a draining branch succeeded")
+	}
+	if err := tc.pool.SetBranchMode(tc.branches[0], ReadWrite); err == nil {
+		t.Errorf("SetBranchMode of a draining branch succeeded")
+	}
+	if err := tc.pool.drain(b); err != nil {
+		t.Fatal(err)
+	}
+	if got := tc.pool.Branches(); len(got) != 1 || got[0].Path != tc.branches[1] {
+		t.Errorf("got branches %v, want only %s", got, tc.branches[1])
+	}
+}
+
+func TestDrainConflict(t *testing.T) {
+	tc, clean := newTestCase(t, []BranchMode{ReadWrite, ReadWrite}, nil)
+	defer clean()
+
+	tc.writeBranch(t, 0, "file", "a")
+	tc.writeBranch(t, 1, "file", "b")
+	if err := tc.pool.Drain(tc.branches[0]); err == nil {
+		t.Fatal("Drain succeeded with a conflicting file")
+	}
+	if got := tc.pool.Branches(); len(got) != 2 || got[0].Mode != NoCreate {
+		t.Errorf("got branches %v, want the drained branch kept as NoCreate", got)
+	}
+}
+
+func TestDrainOpenFile(t *testing.T) {
+	tc, clean := newTestCase(t, []BranchMode{ReadWrite, ReadWrite}, nil)
+	defer clean()
+
+	tc.writeBranch(t, 0, "file", "a")
+	var before syscall.Stat_t
+	if err := syscall.Lstat(tc.mnt+"/file", &before); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(tc.mnt+"/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := tc.pool.Drain(tc.branches[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("b"), 0); err == nil {
+		t.Errorf("write through a handle on the drained branch succeeded")
+	}
+	if got, err := ioutil.ReadFile(tc.mnt + "/file"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "a" {
+		t.Errorf("got %q, want %q", got, "a")
+	}
+	if err := ioutil.WriteFile(tc.mnt+"/file", []byte("c"), 0644); err != nil {
+		t.Fatalf("write after reopening: %v", err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(tc.branches[1]+"/file", &st); err != nil {
+		t.Fatal(err)
+	}
+	bs := tc.pool.snapshot()
+	if got := tc.pool.ino(bs[0], &st); got != before.Ino {
+		t.Errorf("got inode %d after drain, want %d", got, before.Ino)
+	}
+}
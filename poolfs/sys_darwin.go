@@ -0,0 +1,24 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poolfs
+
+import "syscall"
+
+// blockSize returns the size of the blocks that the counts of `s`
+// are in.
+func blockSize(s *syscall.Statfs_t) uint64 {
+	return uint64(s.Bsize)
+}
+
+// Darwin does not report the name length; it is MAXNAMLEN.
+func nameLen(s *syscall.Statfs_t) uint32 {
+	return 255
+}
+
+// sameTimes reports whether `a` and `b` have the same modification
+// and change times.
+func sameTimes(a, b *syscall.Stat_t) bool {
+	return a.Mtimespec == b.Mtimespec && a.Ctimespec == b.Ctimespec
+}
@@ -0,0 +1,26 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poolfs
+
+import "syscall"
+
+// blockSize returns the size of the blocks that the counts of `s`
+// are in.
+func blockSize(s *syscall.Statfs_t) uint64 {
+	if s.Frsize > 0 {
+		return uint64(s.Frsize)
+	}
+	return uint64(s.Bsize)
+}
+
+func nameLen(s *syscall.Statfs_t) uint32 {
+	return uint32(s.Namelen)
+}
+
+// sameTimes reports whether `a` and `b` have the same modification
+// and change times.
+func sameTimes(a, b *syscall.Stat_t) bool {
+	return a.Mtim == b.Mtim && a.Ctim == b.Ctim
+}
@@ -0,0 +1,256 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package unionfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	newunionfs "github.com/hanwen/go-fuse/v2/newunionfs"
+)
+
+// AutoUnionConfig declares the unions of an autoUnionFs. In JSON, it
+// looks like
+//
+//	{"unions": [{
+//	    "name": "work",
+//	    "branches": ["/scratch/work", "/src/base"],
+//	    "branch_cache_ttl": 5,
+//	    "hidden_files": [".git"]
+//	}]}
+type AutoUnionConfig struct {
+	Unions []UnionConfig `json:"unions"`
+}
+
+// UnionConfig declares a union. Options that are not set are taken
+// from the AutoUnionFsOptions.
+type UnionConfig struct {
+	// Name is the directory of the union in the mount.
+	Name string `json:"name"`
+
+	// Branches are the directories of the union. The first one is
+	// writable. Relative paths are relative to the directory of
+	// the autoUnionFs.
+	Branches []string `json:"branches"`
+
+	// BranchCacheTTL and DeletionCacheTTL are in seconds.
+	BranchCacheTTL   *float64 `json:"branch_cache_ttl,omitempty"`
+	DeletionCacheTTL *float64 `json:"deletion_cache_ttl,omitempty"`
+
+	// Whiteouts is the format of deletions: "deletions", a
+	// directory of deletion markers named by DeletionDirName, which
+	// is the default, "overlay" or "overlay-userxattr", as by
+	// newunionfs.NewOverlayWhiteouts, or "aufs", as by
+	// newunionfs.NewAUFSWhiteouts.
+	Whiteouts       string `json:"whiteouts,omitempty"`
+	DeletionDirName string `json:"deletion_dirname,omitempty"`
+
+	// HiddenFiles are added to the hidden files of the options.
+	HiddenFiles []string `json:"hidden_files,omitempty"`
+}
+
+// whiteoutFormats are the values of UnionConfig.Whiteouts.
+var whiteoutFormats = map[string]bool{
+	"":                  true,
+	"deletions":         true,
+	"overlay":           true,
+	"overlay-userxattr": true,
+	"aufs":              true,
+}
+
+// ParseAutoUnionConfig parses and checks a configuration in JSON.
+func ParseAutoUnionConfig(data []byte) (*AutoUnionConfig, error) {
+	var c AutoUnionConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, u := range c.Unions {
+		switch {
+		case u.Name == "" || strings.Contains(u.Name, "/") || isReservedName(u.Name):
+			return nil, fmt.Errorf("invalid union name %q", u.Name)
+		case names[u.Name]:
+			return nil, fmt.Errorf("union %q declared twice", u.Name)
+		case len(u.Branches) == 0:
+			return nil, fmt.Errorf("union %q has no branches", u.Name)
+		case !whiteoutFormats[u.Whiteouts]:
+			return nil, fmt.Errorf("union %q: unsupported whiteout format %q", u.Name, u.Whiteouts)
+		}
+		names[u.Name] = true
+	}
+	return &c, nil
+}
+
+// LoadAutoUnionConfig reads the configuration in the JSON file
+// `name`.
+func LoadAutoUnionConfig(name string) (*AutoUnionConfig, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ParseAutoUnionConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return c, nil
+}
+
+// SetAutoUnionConfig makes the unions of `fs`, which was returned by
+// NewAutoUnionFs, match the configuration `c`. Unions that are no
+// longer declared, or whose declaration changed, are removed, and
+// new ones are added. Other unions, including those found through
+// READONLY symlinks, are not disturbed.
+func SetAutoUnionConfig(fs pathfs.FileSystem, c *AutoUnionConfig) error {
+	a, ok := fs.(*autoUnionFs)
+	if !ok {
+		return fmt.Errorf("unionfs: %v is not an autoUnionFs", fs)
+	}
+	return a.setConfig(c)
+}
+
+// ReloadAutoUnionConfig reads the ConfigFile of the options of `fs`,
+// which was returned by NewAutoUnionFs, and applies it with
+// SetAutoUnionConfig.
+func ReloadAutoUnionConfig(fs pathfs.FileSystem) error {
+	a, ok := fs.(*autoUnionFs)
+	if !ok {
+		return fmt.Errorf("unionfs: %v is not an autoUnionFs", fs)
+	}
+	return a.reloadConfig()
+}
+
+func (fs *autoUnionFs) reloadConfig() error {
+	c, err := LoadAutoUnionConfig(fs.options.ConfigFile)
+	if err != nil {
+		return err
+	}
+	return fs.setConfig(c)
+}
+
+func (fs *autoUnionFs) setConfig(c *AutoUnionConfig) error {
+	fs.configLock.Lock()
+	defer fs.configLock.Unlock()
+
+	want := map[string]UnionConfig{}
+	for _, u := range c.Unions {
+		want[u.Name] = u
+	}
+
+	var errs []string
+	for name, old := range fs.configured {
+		// Unions that were removed through the config/ directory
+		// are added again.
+		if u, ok := want[name]; ok && reflect.DeepEqual(u, old) && fs.getUnionFs(name) != nil {
+			continue
+		}
+		if code := fs.rmFs(name); !code.Ok() && code != fuse.ENOENT {
+			errs = append(errs, fmt.Sprintf("remove %s: %v", name, code))
+			continue
+		}
+		delete(fs.configured, name)
+	}
+	for _, u := range c.Unions {
+		if _, ok := fs.configured[u.Name]; ok {
+			continue
+		}
+		var roots []string
+		for _, b := range u.Branches {
+			if !filepath.IsAbs(b) {
+				b = filepath.Join(fs.root, b)
+			}
+			roots = append(roots, b)
+		}
+		if code := fs.createFs(u.Name, roots, fs.unionOptions(&u)); !code.Ok() {
+			errs = append(errs, fmt.Sprintf("add %s: %v", u.Name, code))
+			continue
+		}
+		fs.configured[u.Name] = u
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unionfs: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// unionOptions returns the options of `fs` with the settings of `u`.
+func (fs *autoUnionFs) unionOptions(u *UnionConfig) *UnionFsOptions {
+	opts := fs.options.UnionFsOptions
+	if u.BranchCacheTTL != nil {
+		opts.BranchCacheTTL = time.Duration(*u.BranchCacheTTL * float64(time.Second))
+	}
+	if u.DeletionCacheTTL != nil {
+		opts.DeletionCacheTTL = time.Duration(*u.DeletionCacheTTL * float64(time.Second))
+	}
+	if u.DeletionDirName != "" {
+		opts.DeletionDirName = u.DeletionDirName
+	}
+	switch u.Whiteouts {
+	case "overlay", "overlay-userxattr":
+		opts.Whiteouts = newunionfs.NewOverlayWhiteouts(u.Whiteouts == "overlay-userxattr")
+	case "aufs":
+		opts.Whiteouts = newunionfs.NewAUFSWhiteouts()
+	case "deletions":
+		opts.Whiteouts = nil
+	}
+	opts.HiddenFiles = append(append([]string{}, opts.HiddenFiles...), u.HiddenFiles...)
+	return &opts
+}
+
+// watchConfig applies the configuration file, and applies it again
+// whenever its contents change, until the file system is unmounted.
+// The file is read on every check, rather than stat'ed, as an edit
+// may keep its size and modification time.
+func (fs *autoUnionFs) watchConfig() {
+	interval := fs.options.ConfigCheckInterval
+	if interval == 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	name := fs.options.ConfigFile
+	var last []byte
+	loaded := false
+	// readErr is the last error from reading the file, so a
+	// missing file is reported once rather than on every check.
+	var readErr string
+	for {
+		data, err := ioutil.ReadFile(name)
+		switch {
+		case err != nil:
+			if err.Error() != readErr {
+				readErr = err.Error()
+				log.Printf("config: %v", err)
+			}
+		case !loaded || !bytes.Equal(data, last):
+			readErr = ""
+			loaded, last = true, data
+			c, err := ParseAutoUnionConfig(data)
+			if err == nil {
+				err = fs.setConfig(c)
+			}
+			if err != nil {
+				log.Printf("config %s: %v", name, err)
+			}
+		default:
+			readErr = ""
+		}
+
+		select {
+		case <-fs.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -42,6 +42,16 @@ type autoUnionFs struct {
 
 	nodeFs  *pathfs.PathNodeFs
 	options *AutoUnionFsOptions
+
+	// configured holds the declarations of the unions that were
+	// created from the configuration, protected by configLock.
+	configLock sync.Mutex
+	configured map[string]UnionConfig
+	// stop ends watching the configuration file. It is closed
+	// once, by stopOnce, as the file system may be unmounted
+	// more than once.
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 type AutoUnionFsOptions struct {
@@ -58,6 +68,17 @@ type AutoUnionFsOptions struct {
 
 	// Expose this version in /status/gounionfs_version
 	Version string
+
+	// ConfigFile is a JSON file in the format of AutoUnionConfig,
+	// which declares unions in addition to those found through
+	// READONLY symlinks. It is read after mounting, and again
+	// when it changes or ReloadAutoUnionConfig is called.
+	ConfigFile string
+
+	// ConfigCheckInterval is how often ConfigFile is read, to
+	// check whether its contents changed. The default is one
+	// second.
+	ConfigCheckInterval time.Duration
 }
 
 const (
@@ -78,6 +99,8 @@ func NewAutoUnionFs(directory string, options AutoUnionFsOptions) pathfs.FileSys
 		knownFileSystems: make(map[string]knownFs),
 		nameRootMap:      make(map[string]string),
 		zombies:          make(map[string]bool),
+		configured:       make(map[string]UnionConfig),
+		stop:             make(chan struct{}),
 		options:          &options,
 		FileSystem:       pathfs.NewDefaultFileSystem(),
 	}
@@ -99,6 +122,13 @@ func (fs *autoUnionFs) OnMount(nodeFs *pathfs.PathNodeFs) {
 	if fs.options.UpdateOnMount {
 		time.AfterFunc(100*time.Millisecond, func() { fs.updateKnownFses() })
 	}
+	if fs.options.ConfigFile != "" {
+		go fs.watchConfig()
+	}
+}
+
+func (fs *autoUnionFs) OnUnmount() {
+	fs.stopOnce.Do(func() { close(fs.stop) })
 }
 
 func (fs *autoUnionFs) addAutomaticFs(roots []string) {
@@ -110,7 +140,7 @@ func (fs *autoUnionFs) addAutomaticFs(roots []string) {
 	}
 }
 
-func (fs *autoUnionFs) createFs(name string, roots []string) fuse.Status {
+func (fs *autoUnionFs) createFs(name string, roots []string, options *UnionFsOptions) fuse.Status {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
@@ -133,7 +163,7 @@ func (fs *autoUnionFs) createFs(name string, roots []string) fuse.Status {
 		return fuse.EBUSY
 	}
 
-	ufs, err := NewUnionFsFromRoots(roots, &fs.options.UnionFsOptions, true)
+	ufs, err := NewUnionFsFromRoots(roots, options, true)
 	if err != nil {
 		log.Println("Could not create UnionFs:", err)
 		return fuse.EPERM
@@ -184,10 +214,14 @@ func (fs *autoUnionFs) rmFs(name string) (code fuse.Status) {
 }
 
 func (fs *autoUnionFs) addFs(name string, roots []string) (code fuse.Status) {
-	if name == _CONFIG || name == _STATUS || name == _SCAN_CONFIG {
+	if isReservedName(name) {
 		return fuse.EINVAL
 	}
-	return fs.createFs(name, roots)
+	return fs.createFs(name, roots, &fs.options.UnionFsOptions)
+}
+
+func isReservedName(name string) bool {
+	return name == _CONFIG || name == _STATUS || name == _SCAN_CONFIG
 }
 
 func (fs *autoUnionFs) getRoots(path string) []string {
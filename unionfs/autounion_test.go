@@ -275,3 +275,109 @@ func TestCreationChecks(t *testing.T) {
 		t.Error("Should return EINVAL", err)
 	}
 }
+
+func TestConfigFile(t *testing.T) {
+	wd := testutil.TempDir()
+	defer os.RemoveAll(wd)
+	for _, d := range []string{"mnt", "ro", "store", "store/rw1", "store/rw2"} {
+		if err := os.Mkdir(wd+"/"+d, 0700); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+	WriteFile(t, wd+"/ro/file1", "file1")
+	WriteFile(t, wd+"/ro/file2", "file2")
+
+	config := wd + "/config.json"
+	WriteFile(t, config, `{"unions": [{"name": "u1", "branches": ["rw1", "`+wd+`/ro"]}]}`)
+
+	opts := testAOpts
+	opts.ConfigFile = config
+	opts.ConfigCheckInterval = 10 * time.Millisecond
+	fs := NewAutoUnionFs(wd+"/store", opts)
+	nfs := pathfs.NewPathNodeFs(fs, nil)
+	state, _, err := nodefs.MountRoot(wd+"/mnt", nfs.Root(), &opts.Options)
+	if err != nil {
+		t.Fatalf("MountNodeFileSystem failed: %v", err)
+	}
+	go state.Serve()
+	state.WaitMount()
+	defer state.Unmount()
+
+	waitFor := func(name string, exist bool) {
+		t.Helper()
+		for i := 0; ; i++ {
+			_, err := os.Lstat(wd + "/mnt/" + name)
+			if (err == nil) == exist {
+				return
+			}
+			if i == 100 {
+				t.Fatalf("%s: got %v, want exist=%v", name, err, exist)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	waitFor("u1/file1", true)
+	u1 := fs.(*autoUnionFs).getUnionFs("u1")
+
+	// Adding a union leaves u1 alone.
+	WriteFile(t, config, `{"unions": [
+		{"name": "u1", "branches": ["rw1", "`+wd+`/ro"]},
+		{"name": "u2", "branches": ["rw2", "`+wd+`/ro"], "hidden_files": ["file1"]}]}`)
+	if err := ReloadAutoUnionConfig(fs); err != nil {
+		t.Fatalf("ReloadAutoUnionConfig: %v", err)
+	}
+	waitFor("u2/file2", true)
+	if _, err := os.Lstat(wd + "/mnt/u2/file1"); err == nil {
+		t.Error("u2/file1 should be hidden")
+	}
+	if fs.(*autoUnionFs).getUnionFs("u1") != u1 {
+		t.Error("u1 was recreated")
+	}
+
+	// Changing u1 recreates it, and dropping u2 removes it.
+	WriteFile(t, config, `{"unions": [{"name": "u1", "branches": ["rw1", "`+wd+`/ro"], "hidden_files": ["file2"]}]}`)
+	waitFor("u2", false)
+	waitFor("u1/file2", false)
+	if fs.(*autoUnionFs).getUnionFs("u1") == u1 {
+		t.Error("u1 was not recreated")
+	}
+
+	// An edit that keeps the size and modification time is seen.
+	fi, err := os.Stat(config)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	WriteFile(t, config, `{"unions": [{"name": "u1", "branches": ["rw1", "`+wd+`/ro"], "hidden_files": ["file1"]}]}`)
+	if err := os.Chtimes(config, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	waitFor("u1/file1", false)
+	waitFor("u1/file2", true)
+
+	// Unmounting stops the watch; doing so again is harmless.
+	fs.OnUnmount()
+}
+
+func TestParseAutoUnionConfig(t *testing.T) {
+	for _, c := range []string{
+		`{"unions": [{"name": "", "branches": ["a"]}]}`,
+		`{"unions": [{"name": "config", "branches": ["a"]}]}`,
+		`{"unions": [{"name": "a/b", "branches": ["a"]}]}`,
+		`{"unions": [{"name": "a"}]}`,
+		`{"unions": [{"name": "a", "branches": ["a"]}, {"name": "a", "branches": ["b"]}]}`,
+		`{"unions": [{"name": "a", "branches": ["a"], "whiteouts": "bogus"}]}`,
+		`{"unions": [`,
+	} {
+		if _, err := ParseAutoUnionConfig([]byte(c)); err == nil {
+			t.Errorf("%s: want error", c)
+		}
+	}
+
+	c, err := ParseAutoUnionConfig([]byte(`{"unions": [{"name": "a", "branches": ["a", "/b"], "branch_cache_ttl": 0.5, "whiteouts": "aufs"}]}`))
+	if err != nil {
+		t.Fatalf("ParseAutoUnionConfig: %v", err)
+	}
+	if u := c.Unions[0]; u.BranchCacheTTL == nil || *u.BranchCacheTTL != 0.5 || len(u.Branches) != 2 {
+		t.Errorf("got %+v", u)
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/hanwen/go-fuse/v2/internal/copyfile"
+	newunionfs "github.com/hanwen/go-fuse/v2/newunionfs"
 )
 
 func filePathHash(path string) string {
@@ -49,15 +51,18 @@ func filePathHash(path string) string {
  * It overlays arbitrary writable FileSystems with any number of
    readonly FileSystems.
 
- * Deleting a file will put a file named
- /DELETIONS/HASH-OF-FULL-FILENAME into the writable overlay,
- containing the full filename itself.
+ * Deleting a file records a whiteout in the writable overlay. By
+ default, this is a file named /DELETIONS/HASH-OF-FULL-FILENAME,
+ containing the full filename itself; see NewDeletionsWhiteouts
+ for why.
 
- This is optimized for NFS usage: we want to minimize the number of
- NFS operations, which are slow.  By putting all whiteouts in one
- place, we can cheaply fetch the list of all deleted files.  Even
- without caching on our side, the kernel's negative dentry cache can
- answer is-deleted queries quickly.
+ * A file with several links in a read-only branch is copied up once,
+ and its other names are linked to the copy.
+
+ * Inode numbers have the index of the branch in their high bits, so
+ they are unique across branches. Entries that are copied up keep
+ their number, which is recorded in the writable branch as by the
+ newunionfs package.
 
 */
 type unionFS struct {
@@ -66,8 +71,16 @@ type unionFS struct {
 	// The same, but as interfaces.
 	fileSystems []pathfs.FileSystem
 
-	// A file-existence cache.
-	deletionCache *dirCache
+	// Records the deleted files in writable, which is
+	// fileSystems[0].
+	whiteouts Whiteouts
+	writable  newunionfs.Branch
+
+	// The links of the read-only branches, by branch.
+	linkIndexes []*newunionfs.LinkIndex
+
+	// A directory -> is-opaque cache for the writable branch.
+	opaqueCache *TimedCache
 
 	// A file -> branch cache.
 	branchCache *TimedCache
@@ -84,6 +97,11 @@ type UnionFsOptions struct {
 	DeletionCacheTTL time.Duration
 	DeletionDirName  string
 	HiddenFiles      []string
+
+	// Whiteouts is the format in which deletions are recorded in
+	// the writable branch. If nil, they are recorded in
+	// DeletionDirName, as by NewDeletionsWhiteouts.
+	Whiteouts Whiteouts
 }
 
 const (
@@ -98,12 +116,23 @@ func NewUnionFs(fileSystems []pathfs.FileSystem, options UnionFsOptions) (pathfs
 	}
 
 	writable := g.fileSystems[0]
-	code := g.createDeletionStore()
-	if !code.Ok() {
-		return nil, fmt.Errorf("could not create deletion path %v: %v", options.DeletionDirName, code)
+	g.writable = NewBranch(writable)
+	g.whiteouts = options.Whiteouts
+	if g.whiteouts == nil {
+		var err error
+		g.whiteouts, err = NewDeletionsWhiteouts(writable, options.DeletionDirName, options.DeletionCacheTTL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	g.linkIndexes = make([]*newunionfs.LinkIndex, len(fileSystems))
+	for i, fs := range fileSystems[1:] {
+		g.linkIndexes[i+1] = newunionfs.NewLinkIndex(NewBranch(fs))
 	}
+	g.opaqueCache = NewTimedCache(
+		func(n string) (interface{}, bool) { return g.whiteouts.IsOpaque(g.writable, n), true },
+		options.DeletionCacheTTL)
 
-	g.deletionCache = newDirCache(writable, options.DeletionDirName, options.DeletionCacheTTL)
 	g.branchCache = NewTimedCache(
 		func(n string) (interface{}, bool) { return g.getBranchAttrNoCache(n), true },
 		options.BranchCacheTTL)
@@ -123,45 +152,6 @@ func (fs *unionFS) OnMount(nodeFs *pathfs.PathNodeFs) {
 ////////////////
 // Deal with all the caches.
 
-// The isDeleted() method tells us if a path has a marker in the deletion store.
-// It may return an error code if the store could not be accessed.
-func (fs *unionFS) isDeleted(name string) (deleted bool, code fuse.Status) {
-	marker := fs.deletionPath(name)
-	haveCache, found := fs.deletionCache.HasEntry(filepath.Base(marker))
-	if haveCache {
-		return found, fuse.OK
-	}
-
-	_, code = fs.fileSystems[0].GetAttr(marker, nil)
-
-	if code == fuse.OK {
-		return true, code
-	}
-	if code == fuse.ENOENT {
-		return false, fuse.OK
-	}
-
-	log.Printf("error accessing deletion marker %s: %v", marker, code)
-	return false, fuse.Status(syscall.EROFS)
-}
-
-func (fs *unionFS) createDeletionStore() (code fuse.Status) {
-	writable := fs.fileSystems[0]
-	fi, code := writable.GetAttr(fs.options.DeletionDirName, nil)
-	if code == fuse.ENOENT {
-		code = writable.Mkdir(fs.options.DeletionDirName, 0755, nil)
-		if code.Ok() {
-			fi, code = writable.GetAttr(fs.options.DeletionDirName, nil)
-		}
-	}
-
-	if !code.Ok() || !fi.IsDir() {
-		code = fuse.Status(syscall.EROFS)
-	}
-
-	return code
-}
-
 func (fs *unionFS) getBranch(name string) branchResult {
 	name = stripSlash(name)
 	r := fs.branchCache.Get(name)
@@ -200,19 +190,19 @@ func (fs *unionFS) getBranchAttrNoCache(name string) branchResult {
 	if base != "" {
 		parentBranch = fs.getBranch(parent).branch
 	}
-	for i, fs := range fs.fileSystems {
+	for i, branch := range fs.fileSystems {
 		if i < parentBranch {
 			continue
 		}
 
-		a, s := fs.GetAttr(name, nil)
+		a, s := branch.GetAttr(name, nil)
 		if s.Ok() {
-			if i > 0 {
-				// Needed to make hardlinks work.
-				a.Ino = 0
-			}
+			// The attributes may be cached by the branch,
+			// which needs the inode number.
+			c := *a
+			c.Ino = fs.ino(i, name, a)
 			return branchResult{
-				attr:   a,
+				attr:   &c,
 				code:   s,
 				branch: i,
 			}
@@ -225,68 +215,66 @@ func (fs *unionFS) getBranchAttrNoCache(name string) branchResult {
 	return branchResult{nil, fuse.ENOENT, -1}
 }
 
+// inoShift is the number of bits of the inode numbers of the
+// branches in the inode numbers of the union. The bits above hold
+// the index of the branch, as its device is not known.
+const inoShift = 48
+
+// ino returns the inode number in the union of `name` in branch
+// `branch`, whose attributes are `a`. It is cached with the
+// attributes in the branch cache.
+func (fs *unionFS) ino(branch int, name string, a *fuse.Attr) uint64 {
+	if branch == 0 {
+		ino, err := newunionfs.GetOrigin(fs.writable, name, a)
+		if err != nil {
+			log.Printf("reading origin of %q: %v", name, err)
+		}
+		if ino != 0 {
+			return ino
+		}
+	}
+	if a.Ino>>inoShift != 0 {
+		// Does not fit; the number may collide.
+		return a.Ino
+	}
+	return uint64(branch)<<inoShift | a.Ino
+}
+
 ////////////////
 // Deletion.
 
-func (fs *unionFS) deletionPath(name string) string {
-	return filepath.Join(fs.options.DeletionDirName, filePathHash(name))
-}
-
 func (fs *unionFS) removeDeletion(name string) {
-	marker := fs.deletionPath(name)
-
-	// os.Remove tries to be smart and issues a Remove() and
-	// Rmdir() sequentially.  We want to skip the 2nd system call,
-	// so use syscall.Unlink() directly.
-
-	code := fs.fileSystems[0].Unlink(marker, nil)
-	if !code.Ok() && code != fuse.ENOENT {
-		log.Printf("error unlinking %s: %v", marker, code)
+	if err := fs.whiteouts.Undelete(fs.writable, name); err != nil {
+		log.Printf("error removing whiteout of %s: %v", name, err)
 	}
-
-	// Update in-memory cache as last step, so we avoid caching a
-	// state from before the storage update.
-	fs.deletionCache.RemoveEntry(path.Base(marker))
 }
 
 func (fs *unionFS) putDeletion(name string) (code fuse.Status) {
-	code = fs.createDeletionStore()
-	if !code.Ok() {
-		return code
+	if dir := parentDir(name); dir != "" {
+		// The deletion of the parent hides `name` already, so
+		// its directories are not created again. Formats that
+		// keep whiteouts apart still record it.
+		if deleted, _ := fs.isDeleted(dir); deleted {
+			fs.whiteouts.Delete(fs.writable, name)
+			return fuse.OK
+		}
 	}
-
-	marker := fs.deletionPath(name)
-
-	// Is there a WriteStringToFileOrDie ?
-	writable := fs.fileSystems[0]
-	fi, code := writable.GetAttr(marker, nil)
-	if code.Ok() && fi.Size == uint64(len(name)) {
-		return fuse.OK
+	if code = fs.promoteDirsTo(name); !code.Ok() {
+		return code
 	}
+	return fuse.ToStatus(fs.whiteouts.Delete(fs.writable, name))
+}
 
-	var f nodefs.File
-	if code == fuse.ENOENT {
-		f, code = writable.Create(marker, uint32(os.O_TRUNC|os.O_WRONLY), 0644, nil)
-	} else {
-		writable.Chmod(marker, 0644, nil)
-		f, code = writable.Open(marker, uint32(os.O_TRUNC|os.O_WRONLY), nil)
-	}
-	if !code.Ok() {
-		log.Printf("could not create deletion file %v: %v", marker, code)
-		return fuse.EPERM
-	}
-	defer f.Release()
-	defer f.Flush()
-	n, code := f.Write([]byte(name), 0)
-	if int(n) != len(name) || !code.Ok() {
-		panic(fmt.Sprintf("Error for writing %v: %v, %v (exp %v) %v", name, marker, n, len(name), code))
+// undelete removes the whiteout of `name` before it is created in
+// the writable branch, as some formats keep the whiteout under the
+// name itself. If the creation fails, the returned function puts
+// the whiteout back.
+func (fs *unionFS) undelete(name string) (restore func()) {
+	if deleted, _ := fs.isDeleted(name); !deleted {
+		return func() {}
 	}
-
-	// Update the in-memory deletion cache as the last step,
-	// to ensure that the new state stays in memory
-	fs.deletionCache.AddEntry(path.Base(marker))
-
-	return fuse.OK
+	fs.removeDeletion(name)
+	return func() { fs.putDeletion(name) }
 }
 
 ////////////////
@@ -300,7 +288,7 @@ func (fs *unionFS) Promote(name string, srcResult branchResult, context *fuse.Co
 	fs.promoteDirsTo(name)
 
 	if srcResult.attr.IsRegular() {
-		code = pathfs.CopyFile(sourceFs, writable, name, name, context)
+		code = copyFile(sourceFs, writable, name, context)
 
 		if code.Ok() {
 			code = writable.Chmod(name, srcResult.attr.Mode&07777|0200, context)
@@ -310,6 +298,9 @@ func (fs *unionFS) Promote(name string, srcResult branchResult, context *fuse.Co
 			mTime := srcResult.attr.ModTime()
 			code = writable.Utimens(name, &aTime, &mTime, context)
 		}
+		if code.Ok() {
+			code = fs.promoteLinks(name, srcResult.branch, context)
+		}
 
 		files := fs.nodeFs.AllFiles(name, 0)
 		for _, fileWrapper := range files {
@@ -353,6 +344,10 @@ func (fs *unionFS) Promote(name string, srcResult branchResult, context *fuse.Co
 		return fuse.ENOSYS
 	}
 
+	if code.Ok() {
+		// The copy keeps the number of the original.
+		code = fuse.ToStatus(newunionfs.SetOrigin(fs.writable, name, srcResult.attr, srcResult.attr.Ino))
+	}
 	if !code.Ok() {
 		fs.branchCache.GetFresh(name)
 		return code
@@ -365,6 +360,46 @@ func (fs *unionFS) Promote(name string, srcResult branchResult, context *fuse.Co
 	return fuse.OK
 }
 
+// promoteLinks links the other names of the file `name`, if it has
+// several links in branch `branch`, to its copy in the writable
+// branch.
+func (fs *unionFS) promoteLinks(name string, branch int, context *fuse.Context) fuse.Status {
+	a, code := fs.fileSystems[branch].GetAttr(name, context)
+	if !code.Ok() {
+		return code
+	}
+	for _, nm := range fs.linkIndexes[branch].Links(name, a) {
+		// Other names may be deleted, or replaced in the
+		// branches above.
+		if deleted, _ := fs.isDeleted(nm); deleted || fs.getBranch(nm).branch != branch {
+			continue
+		}
+		if code := fs.promoteDirsTo(nm); !code.Ok() {
+			return code
+		}
+		if code := fs.fileSystems[0].Link(name, nm, context); !code.Ok() {
+			return code
+		}
+		fs.branchCache.DropEntry(nm)
+	}
+	return fuse.OK
+}
+
+// copyFile copies the file `name` from `src` to `dest`. Between
+// loopback file systems, the file is cloned or copied in the kernel
+// if possible, and its holes and metadata are kept.
+func copyFile(src, dest pathfs.FileSystem, name string, context *fuse.Context) fuse.Status {
+	type pather interface {
+		GetPath(relPath string) string
+	}
+	srcPather, ok := src.(pather)
+	destPather, ok2 := dest.(pather)
+	if !ok || !ok2 {
+		return pathfs.CopyFile(src, dest, name, name, context)
+	}
+	return fuse.ToStatus(copyfile.Copy(srcPather.GetPath(name), destPather.GetPath(name), nil))
+}
+
 ////////////////////////////////////////////////////////////////
 // Below: implement interface for a FileSystem.
 
@@ -389,10 +424,13 @@ func (fs *unionFS) Link(orig string, newName string, context *fuse.Context) (cod
 		code = fs.promoteDirsTo(newName)
 	}
 	if code.Ok() {
+		restore := fs.undelete(newName)
 		code = fs.fileSystems[0].Link(orig, newName, context)
+		if !code.Ok() {
+			restore()
+		}
 	}
 	if code.Ok() {
-		fs.removeDeletion(newName)
 		fs.branchCache.GetFresh(newName)
 	}
 	return code
@@ -424,6 +462,7 @@ func (fs *unionFS) Rmdir(path string, context *fuse.Context) (code fuse.Status)
 	if code != fuse.OK {
 		return code
 	}
+	fs.opaqueCache.DropAll(nil)
 
 	r = fs.branchCache.GetFresh(path).(branchResult)
 	if r.branch > 0 {
@@ -447,10 +486,13 @@ func (fs *unionFS) Mkdir(path string, mode uint32, context *fuse.Context) (code
 
 	code = fs.promoteDirsTo(path)
 	if code.Ok() {
+		restore := fs.undelete(path)
 		code = fs.fileSystems[0].Mkdir(path, mode, context)
+		if !code.Ok() {
+			restore()
+		}
 	}
 	if code.Ok() {
-		fs.removeDeletion(path)
 		attr := &fuse.Attr{
 			Mode: fuse.S_IFDIR | mode,
 		}
@@ -472,10 +514,18 @@ func (fs *unionFS) Mkdir(path string, mode uint32, context *fuse.Context) (code
 func (fs *unionFS) Symlink(pointedTo string, linkName string, context *fuse.Context) (code fuse.Status) {
 	code = fs.promoteDirsTo(linkName)
 	if code.Ok() {
+		restore := fs.undelete(linkName)
 		code = fs.fileSystems[0].Symlink(pointedTo, linkName, context)
+		if !code.Ok() {
+			restore()
+		}
+	}
+	if code.Ok() {
+		// The symlink does not take the number of one that
+		// was removed outside the union.
+		code = fuse.ToStatus(newunionfs.RemoveOrigin(fs.writable, linkName, &fuse.Attr{Mode: syscall.S_IFLNK}))
 	}
 	if code.Ok() {
-		fs.removeDeletion(linkName)
 		fs.branchCache.GetFresh(linkName)
 	}
 	return code
@@ -611,6 +661,9 @@ func (fs *unionFS) Access(name string, mode uint32, context *fuse.Context) (code
 func (fs *unionFS) Unlink(name string, context *fuse.Context) (code fuse.Status) {
 	r := fs.getBranch(name)
 	if r.branch == 0 {
+		if code = fuse.ToStatus(newunionfs.RemoveOrigin(fs.writable, name, r.attr)); !code.Ok() {
+			return code
+		}
 		code = fs.fileSystems[0].Unlink(name, context)
 		if code != fuse.OK {
 			return code
@@ -671,6 +724,9 @@ func (fs *unionFS) promoteDirsTo(filename string) fuse.Status {
 			log.Println("Error creating dir leading to path", d, code, fs.fileSystems[0])
 			return fuse.EPERM
 		}
+		if err := newunionfs.SetOrigin(fs.writable, d, r.attr, r.attr.Ino); err != nil {
+			return fuse.ToStatus(err)
+		}
 
 		aTime := r.attr.AccessTime()
 		mTime := r.attr.ModTime()
@@ -688,10 +744,13 @@ func (fs *unionFS) Create(name string, flags uint32, mode uint32, context *fuse.
 	if code != fuse.OK {
 		return nil, code
 	}
+	restore := fs.undelete(name)
 	fuseFile, code = writable.Create(name, flags, mode, context)
+	if !code.Ok() {
+		restore()
+	}
 	if code.Ok() {
 		fuseFile = fs.newUnionFsFile(fuseFile, 0)
-		fs.removeDeletion(name)
 
 		now := time.Now()
 		a := fuse.Attr{
@@ -713,7 +772,7 @@ func (fs *unionFS) GetAttr(name string, context *fuse.Context) (a *fuse.Attr, s
 			Mode: fuse.S_IFREG | 0777,
 		}, fuse.OK
 	}
-	if name == fs.options.DeletionDirName {
+	if fs.whiteouts.IsInternal(fs.writable, name) {
 		return nil, fuse.ENOENT
 	}
 	isDel, s := fs.isDeleted(name)
@@ -751,17 +810,7 @@ func (fs *unionFS) OpenDir(directory string, context *fuse.Context) (stream []fu
 		return nil, fuse.ENOENT
 	}
 
-	// We could try to use the cache, but we have a delay, so
-	// might as well get the fresh results async.
 	var wg sync.WaitGroup
-	var deletions map[string]struct{}
-
-	wg.Add(1)
-	go func() {
-		deletions = newDirnameMap(fs.fileSystems[0], fs.options.DeletionDirName)
-		wg.Done()
-	}()
-
 	entries := make([]map[string]uint32, len(fs.fileSystems))
 	for i := range fs.fileSystems {
 		entries[i] = make(map[string]uint32)
@@ -783,42 +832,33 @@ func (fs *unionFS) OpenDir(directory string, context *fuse.Context) (stream []fu
 	}
 
 	wg.Wait()
-	if deletions == nil {
-		_, code := fs.fileSystems[0].GetAttr(fs.options.DeletionDirName, context)
-		if code == fuse.ENOENT {
-			deletions = map[string]struct{}{}
-		} else {
-			return nil, fuse.Status(syscall.EROFS)
-		}
+	// The whiteouts are in the writable branch: if it cannot be
+	// read, the deleted entries cannot be told apart.
+	if a, code := fs.fileSystems[0].GetAttr("", context); !code.Ok() || !a.IsDir() {
+		return nil, fuse.Status(syscall.EROFS)
 	}
-
 	results := entries[0]
 
 	// TODO(hanwen): should we do anything with the return
 	// statuses?
+	lower := map[string]uint32{}
 	for i, m := range entries {
-		if statuses[i] != fuse.OK {
-			continue
-		}
-		if i == 0 {
-			// We don't need to further process the first
-			// branch: it has no deleted files.
+		if statuses[i] != fuse.OK || i == 0 {
 			continue
 		}
 		for k, v := range m {
-			_, ok := results[k]
-			if ok {
-				continue
-			}
-
-			_, deleted := deletions[filePathHash(filepath.Join(directory, k))]
-			if !deleted {
-				results[k] = v
+			if _, ok := lower[k]; !ok {
+				lower[k] = v
 			}
 		}
 	}
+	fs.filterWhiteouts(directory, results, lower)
+	for k, v := range lower {
+		if _, ok := results[k]; !ok {
+			results[k] = v
+		}
+	}
 	if directory == "" {
-		delete(results, fs.options.DeletionDirName)
 		for name, _ := range fs.hiddenFiles {
 			delete(results, name)
 		}
@@ -878,8 +918,12 @@ func (fs *unionFS) renameDirectory(srcResult branchResult, srcDir string, dstDir
 	}
 
 	if code.Ok() {
+		restore := fs.undelete(dstDir)
 		writable := fs.fileSystems[0]
 		code = writable.Rename(srcDir, dstDir, context)
+		if !code.Ok() {
+			restore()
+		}
 	}
 
 	if code.Ok() {
@@ -920,9 +964,16 @@ func (fs *unionFS) Rename(src string, dst string, context *fuse.Context) fuse.St
 		return code
 	}
 
+	var replaced *fuse.Attr
+	if dstResult := fs.getBranch(dst); dstResult.branch == 0 {
+		replaced = dstResult.attr
+	}
 	if code := fs.fileSystems[0].Rename(src, dst, context); !code.Ok() {
 		return code
 	}
+	if err := newunionfs.RenameOrigin(fs.writable, src, dst, srcResult.attr, replaced); err != nil {
+		return fuse.ToStatus(err)
+	}
 
 	fs.removeDeletion(dst)
 	// Rename is racy; avoid racing with unionFsFile.Release().
@@ -940,7 +991,10 @@ func (fs *unionFS) DropBranchCache(names []string) {
 }
 
 func (fs *unionFS) DropDeletionCache() {
-	fs.deletionCache.DropCache()
+	if c, ok := fs.whiteouts.(interface{ DropCache() }); ok {
+		c.DropCache()
+	}
+	fs.opaqueCache.DropAll(nil)
 }
 
 func (fs *unionFS) DropSubFsCaches() {
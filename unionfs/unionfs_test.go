@@ -65,6 +65,12 @@ func setRecursiveWritable(t *testing.T, dir string, writable bool) {
 // rw .... modifiable data
 // ro .... read-only data
 func setupUfs(t *testing.T) (wd string, cleanup func()) {
+	return setupUfsWithOptions(t, testOpts)
+}
+
+// setupUfsWithOptions is like setupUfs, but mounts the union with
+// the options `ufsOpts`.
+func setupUfsWithOptions(t *testing.T, ufsOpts UnionFsOptions) (wd string, cleanup func()) {
 	// Make sure system setting does not affect test.
 	syscall.Umask(0)
 
@@ -88,7 +94,7 @@ func setupUfs(t *testing.T) (wd string, cleanup func()) {
 		pathfs.NewLoopbackFileSystem(wd + "/rw"),
 		NewCachingFileSystem(pathfs.NewLoopbackFileSystem(wd+"/ro"), 0),
 	}
-	ufs, err := NewUnionFs(fses, testOpts)
+	ufs, err := NewUnionFs(fses, ufsOpts)
 	if err != nil {
 		t.Fatalf("NewUnionFs: %v", err)
 	}
@@ -245,6 +251,63 @@ func TestUnionFsChtimes(t *testing.T) {
 	}
 }
 
+func TestUnionFsPromoteLoopback(t *testing.T) {
+	wd := testutil.TempDir()
+	defer os.RemoveAll(wd)
+	for _, d := range []string{"mnt", "rw", "ro"} {
+		if err := os.Mkdir(wd+"/"+d, 0700); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+	}
+	ufs, err := NewUnionFsFromRoots([]string{wd + "/rw", wd + "/ro"}, &testOpts, false)
+	if err != nil {
+		t.Fatalf("NewUnionFsFromRoots: %v", err)
+	}
+	nfs := pathfs.NewPathNodeFs(ufs, nil)
+	state, _, err := nodefs.MountRoot(wd+"/mnt", nfs.Root(), &nodefs.Options{Debug: testutil.VerboseTest()})
+	if err != nil {
+		t.Fatalf("MountRoot: %v", err)
+	}
+	go state.Serve()
+	state.WaitMount()
+	defer state.Unmount()
+
+	WriteFile(t, wd+"/ro/file", "abc")
+	if err := os.Truncate(wd+"/ro/file", 1<<20); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	ts := []syscall.Timespec{{Sec: 42, Nsec: 123456789}, {Sec: 43, Nsec: 987654321}}
+	if err := syscall.UtimesNano(wd+"/ro/file", ts); err != nil {
+		t.Fatalf("UtimesNano: %v", err)
+	}
+
+	f, err := os.OpenFile(wd+"/mnt/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	f.Close()
+
+	var src, dst syscall.Stat_t
+	if err := syscall.Lstat(wd+"/ro/file", &src); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if err := syscall.Lstat(wd+"/rw/file", &dst); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if dst.Mtim != ts[1] {
+		t.Errorf("got mtime %v, want %v", dst.Mtim, ts[1])
+	}
+	if dst.Size != src.Size {
+		t.Errorf("got size %d, want %d", dst.Size, src.Size)
+	}
+	if dst.Blocks > src.Blocks {
+		t.Errorf("got %d blocks, want at most %d", dst.Blocks, src.Blocks)
+	}
+	if got := readFromFile(t, wd+"/rw/file"); got[:3] != "abc" {
+		t.Errorf("got content %q, want prefix %q", got[:3], "abc")
+	}
+}
+
 func TestUnionFsChmod(t *testing.T) {
 	wd, clean := setupUfs(t)
 	defer clean()
@@ -771,6 +834,86 @@ func TestUnionFsLink(t *testing.T) {
 	}
 }
 
+func TestUnionFsPromoteHardLink(t *testing.T) {
+	wd, clean := setupUfs(t)
+	defer clean()
+
+	WriteFile(t, wd+"/ro/file", "hello")
+	if err := os.Mkdir(wd+"/ro/dir", 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := os.Link(wd+"/ro/file", wd+"/ro/dir/other"); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	setRecursiveWritable(t, wd+"/ro", false)
+
+	f, err := os.OpenFile(wd+"/mnt/file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.Write([]byte("+")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	f.Close()
+
+	if got := readFromFile(t, wd+"/mnt/dir/other"); got != "hello+" {
+		t.Errorf("got %q through other link, want %q", got, "hello+")
+	}
+	var a, b syscall.Stat_t
+	if err := syscall.Lstat(wd+"/rw/file", &a); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if err := syscall.Lstat(wd+"/rw/dir/other", &b); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if a.Ino != b.Ino {
+		t.Errorf("links copied up as separate files")
+	}
+}
+
+func TestUnionFsStableIno(t *testing.T) {
+	wd, clean := setupUfs(t)
+	defer clean()
+
+	WriteFile(t, wd+"/ro/file", "hello")
+	WriteFile(t, wd+"/rw/file2", "hello")
+	if err := os.Symlink("file", wd+"/ro/link"); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	setRecursiveWritable(t, wd+"/ro", false)
+
+	ino := func(name string) uint64 {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(wd+"/mnt/"+name, &st); err != nil {
+			t.Fatalf("Lstat: %v", err)
+		}
+		return st.Ino
+	}
+	fileIno, linkIno := ino("file"), ino("link")
+	if fileIno == ino("file2") {
+		t.Errorf("files of different branches have number %d", fileIno)
+	}
+
+	if err := os.Chmod(wd+"/mnt/file", 0600); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if err := os.Rename(wd+"/mnt/link", wd+"/mnt/moved"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, err := os.Lstat(wd + "/rw/file"); err != nil {
+		t.Fatalf("file was not copied up: %v", err)
+	}
+	// The copies are looked up again once the cached entries
+	// expire.
+	time.Sleep(entryTTL)
+	if got := ino("file"); got != fileIno {
+		t.Errorf("got ino %d after copy-up, want %d", got, fileIno)
+	}
+	if got := ino("moved"); got != linkIno {
+		t.Errorf("got symlink ino %d after copy-up, want %d", got, linkIno)
+	}
+}
+
 func TestUnionFsTruncate(t *testing.T) {
 	wd, clean := setupUfs(t)
 	defer clean()
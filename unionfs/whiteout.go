@@ -0,0 +1,309 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package unionfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	newunionfs "github.com/hanwen/go-fuse/v2/newunionfs"
+)
+
+// Whiteouts records in the writable branch of a union which entries
+// of the read-only branches are deleted. It is the interface of the
+// newunionfs package, so the two unions share the formats, and
+// branches can be moved between them. The formats of that package,
+// such as newunionfs.NewOverlayWhiteouts and
+// newunionfs.NewAUFSWhiteouts, can be used here. Opaque directories
+// are honored, but not created: deleting a directory and creating it
+// again deletes the entries below it one by one.
+type Whiteouts = newunionfs.Whiteouts
+
+// parentDir returns the directory of `name`, with "" for the root.
+func parentDir(name string) string {
+	dir := path.Dir(name)
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return dir
+}
+
+// NewBranch returns the newunionfs.Branch through which whiteouts
+// are recorded in the branch `fs`.
+func NewBranch(fs pathfs.FileSystem) newunionfs.Branch {
+	return pathfsBranch{fs}
+}
+
+// pathfsBranch is a branch of the union, for the whiteout formats.
+// They name the root ".", which is "" in pathfs.
+type pathfsBranch struct {
+	fs pathfs.FileSystem
+}
+
+func toError(code fuse.Status) error {
+	if code.Ok() {
+		return nil
+	}
+	return syscall.Errno(code)
+}
+
+func (b pathfsBranch) name(name string) string {
+	if name == "." {
+		return ""
+	}
+	return name
+}
+
+func (b pathfsBranch) Lstat(name string) (*fuse.Attr, error) {
+	a, code := b.fs.GetAttr(b.name(name), nil)
+	if !code.Ok() {
+		return nil, toError(code)
+	}
+	return a, nil
+}
+
+func (b pathfsBranch) Mknod(name string, mode, dev uint32) error {
+	return toError(b.fs.Mknod(b.name(name), mode, dev, nil))
+}
+
+func (b pathfsBranch) Mkdir(name string, mode uint32) error {
+	return toError(b.fs.Mkdir(b.name(name), mode, nil))
+}
+
+func (b pathfsBranch) Chmod(name string, mode uint32) error {
+	return toError(b.fs.Chmod(b.name(name), mode, nil))
+}
+
+func (b pathfsBranch) Unlink(name string) error {
+	return toError(b.fs.Unlink(b.name(name), nil))
+}
+
+func (b pathfsBranch) Rmdir(name string) error {
+	return toError(b.fs.Rmdir(b.name(name), nil))
+}
+
+func (b pathfsBranch) WriteFile(name string, data []byte) error {
+	f, code := b.fs.Create(b.name(name), uint32(os.O_TRUNC|os.O_WRONLY), 0644, nil)
+	if !code.Ok() {
+		return toError(code)
+	}
+	defer f.Release()
+	if len(data) > 0 {
+		n, code := f.Write(data, 0)
+		if !code.Ok() {
+			return toError(code)
+		}
+		if int(n) != len(data) {
+			return syscall.EIO
+		}
+	}
+	return toError(f.Flush())
+}
+
+func (b pathfsBranch) ReadFile(name string) ([]byte, error) {
+	a, code := b.fs.GetAttr(b.name(name), nil)
+	if !code.Ok() {
+		return nil, toError(code)
+	}
+	f, code := b.fs.Open(b.name(name), uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		return nil, toError(code)
+	}
+	defer f.Release()
+	buf := make([]byte, a.Size)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		return nil, toError(code)
+	}
+	data, code := res.Bytes(buf)
+	return data, toError(code)
+}
+
+func (b pathfsBranch) ReadDir(name string) (map[string]uint32, error) {
+	stream, code := b.fs.OpenDir(b.name(name), nil)
+	if !code.Ok() {
+		return nil, toError(code)
+	}
+	result := map[string]uint32{}
+	for _, e := range stream {
+		if e.Name != "." && e.Name != ".." {
+			result[e.Name] = e.Mode
+		}
+	}
+	return result, nil
+}
+
+func (b pathfsBranch) GetXAttr(name, attr string) ([]byte, error) {
+	data, code := b.fs.GetXAttr(b.name(name), attr, nil)
+	return data, toError(code)
+}
+
+func (b pathfsBranch) SetXAttr(name, attr string, data []byte) error {
+	return toError(b.fs.SetXAttr(b.name(name), attr, data, 0, nil))
+}
+
+func (b pathfsBranch) RemoveXAttr(name, attr string) error {
+	return toError(b.fs.RemoveXAttr(b.name(name), attr, nil))
+}
+
+// NewDeletionsWhiteouts returns the Whiteouts that records deletions
+// as files in the directory `dir` of the writable branch, named by a
+// hash of the deleted path and holding the path, as
+// newunionfs.NewDeletionsWhiteoutsIn does. The contents of the
+// directory are cached for `ttl`.
+func NewDeletionsWhiteouts(writable pathfs.FileSystem, dir string, ttl time.Duration) (Whiteouts, error) {
+	w := &deletionsWhiteouts{
+		Whiteouts: newunionfs.NewDeletionsWhiteoutsIn(dir),
+		fs:        writable,
+		dir:       dir,
+	}
+	if code := w.createStore(); !code.Ok() {
+		return nil, fmt.Errorf("could not create deletion path %v: %v", dir, code)
+	}
+	w.cache = newDirCache(writable, dir, ttl)
+	return w, nil
+}
+
+// Deleting a file puts a file named
+// /DELETIONS/HASH-OF-FULL-FILENAME into the writable overlay,
+// containing the full filename itself.
+//
+// This is optimized for NFS usage: we want to minimize the number of
+// NFS operations, which are slow.  By putting all whiteouts in one
+// place, we can cheaply fetch the list of all deleted files.  Even
+// without caching on our side, the kernel's negative dentry cache can
+// answer is-deleted queries quickly.
+type deletionsWhiteouts struct {
+	Whiteouts
+
+	fs  pathfs.FileSystem
+	dir string
+
+	// A file-existence cache.
+	cache *dirCache
+}
+
+func (w *deletionsWhiteouts) createStore() (code fuse.Status) {
+	fi, code := w.fs.GetAttr(w.dir, nil)
+	if code == fuse.ENOENT {
+		code = w.fs.Mkdir(w.dir, 0755, nil)
+		if code.Ok() {
+			fi, code = w.fs.GetAttr(w.dir, nil)
+		}
+	}
+
+	if !code.Ok() || !fi.IsDir() {
+		code = fuse.Status(syscall.EROFS)
+	}
+
+	return code
+}
+
+func (w *deletionsWhiteouts) IsDeleted(b newunionfs.Branch, name string) bool {
+	haveCache, found := w.cache.HasEntry(filePathHash(name))
+	if haveCache {
+		return found
+	}
+	return w.Whiteouts.IsDeleted(b, name)
+}
+
+func (w *deletionsWhiteouts) Delete(b newunionfs.Branch, name string) error {
+	if err := w.Whiteouts.Delete(b, name); err != nil {
+		return err
+	}
+
+	// Update the in-memory deletion cache as the last step,
+	// to ensure that the new state stays in memory
+	w.cache.AddEntry(filePathHash(name))
+	return nil
+}
+
+func (w *deletionsWhiteouts) Undelete(b newunionfs.Branch, name string) error {
+	err := w.Whiteouts.Undelete(b, name)
+
+	// Update in-memory cache as last step, so we avoid caching a
+	// state from before the storage update.
+	w.cache.RemoveEntry(filePathHash(name))
+	return err
+}
+
+func (w *deletionsWhiteouts) DropCache() {
+	w.cache.DropCache()
+}
+
+// ConvertWhiteouts converts the whiteouts in the writable branch
+// fileSystems[0] from the format `from` to the format `to`, as
+// newunionfs.ConvertWhiteouts does. The union must not be mounted
+// while its whiteouts are converted.
+func ConvertWhiteouts(fileSystems []pathfs.FileSystem, from, to Whiteouts) error {
+	branches := make([]newunionfs.Branch, len(fileSystems))
+	for i, fs := range fileSystems {
+		branches[i] = NewBranch(fs)
+	}
+	return newunionfs.ConvertBranchWhiteouts(branches, from, to)
+}
+
+// isDeleted reports whether `name` is deleted, by a whiteout or by
+// an opaque directory above it.
+func (fs *unionFS) isDeleted(name string) (deleted bool, code fuse.Status) {
+	if fs.whiteouts.IsDeleted(fs.writable, name) {
+		return true, fuse.OK
+	}
+	if name == "" || !fs.hidesLower(parentDir(name)) {
+		return false, fuse.OK
+	}
+	_, code = fs.fileSystems[0].GetAttr(name, nil)
+	if code == fuse.ENOENT {
+		return true, fuse.OK
+	}
+	return false, fuse.OK
+}
+
+// hidesLower reports whether `dir`, or one of its parents, is
+// opaque in the writable branch.
+func (fs *unionFS) hidesLower(dir string) bool {
+	for {
+		if fs.opaqueCache.Get(dir).(bool) {
+			return true
+		}
+		if dir == "" {
+			return false
+		}
+		dir = parentDir(dir)
+	}
+}
+
+// filterWhiteouts removes the bookkeeping of the whiteouts from
+// `upper`, the entries of the directory `dir` in the writable branch,
+// and the deleted entries from `lower`, those of the read-only
+// branches.
+func (fs *unionFS) filterWhiteouts(dir string, upper, lower map[string]uint32) {
+	for k := range upper {
+		name := filepath.Join(dir, k)
+		if fs.whiteouts.IsInternal(fs.writable, name) || fs.whiteouts.IsDeleted(fs.writable, name) {
+			delete(upper, k)
+		}
+	}
+	if len(lower) > 0 && fs.hidesLower(dir) {
+		for k := range lower {
+			delete(lower, k)
+		}
+	}
+	for k := range lower {
+		if _, ok := upper[k]; ok {
+			continue
+		}
+		name := filepath.Join(dir, k)
+		if fs.whiteouts.IsInternal(fs.writable, name) || fs.whiteouts.IsDeleted(fs.writable, name) {
+			delete(lower, k)
+		}
+	}
+}
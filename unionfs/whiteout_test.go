@@ -0,0 +1,155 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package unionfs
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	newunionfs "github.com/hanwen/go-fuse/v2/newunionfs"
+	"golang.org/x/sys/unix"
+)
+
+func TestWhiteoutFormats(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		new  func() Whiteouts
+		// whiteout is the path of the whiteout of "dir/file",
+		// relative to the writable branch.
+		whiteout string
+		// opaque makes the directory `dir` opaque.
+		opaque func(dir string) error
+	}{
+		{
+			name: "overlay",
+			new: func() Whiteouts {
+				return newunionfs.NewOverlayWhiteouts(true)
+			},
+			whiteout: "dir/file",
+			opaque: func(dir string) error {
+				return unix.Lsetxattr(dir, "user.overlay.opaque", []byte("y"), 0)
+			},
+		},
+		{
+			name: "aufs",
+			new: func() Whiteouts {
+				return newunionfs.NewAUFSWhiteouts()
+			},
+			whiteout: "dir/.wh.file",
+			opaque: func(dir string) error {
+				return ioutil.WriteFile(dir+"/.wh..wh..opq", nil, 0644)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := testOpts
+			opts.Whiteouts = tc.new()
+			wd, clean := setupUfsWithOptions(t, opts)
+			defer clean()
+
+			for _, d := range []string{"/ro/dir", "/ro/opaque", "/rw/opaque"} {
+				if err := os.Mkdir(wd+d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, f := range []string{"/ro/dir/file", "/ro/dir/other", "/ro/opaque/file"} {
+				if err := ioutil.WriteFile(wd+f, []byte("ro"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tc.opaque(wd + "/rw/opaque"); err != nil {
+				t.Fatalf("opaque: %v", err)
+			}
+
+			if err := os.Remove(wd + "/mnt/dir/file"); err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+			if _, err := os.Lstat(wd + "/rw/" + tc.whiteout); err != nil {
+				t.Errorf("whiteout: %v", err)
+			}
+			if _, err := os.Lstat(wd + "/rw/DELETIONS"); err == nil {
+				t.Errorf("DELETIONS was created")
+			}
+			if _, err := os.Lstat(wd + "/mnt/dir/file"); err == nil {
+				t.Errorf("deleted file is visible")
+			}
+			checkMapEq(t, dirNames(t, wd+"/mnt/dir"), map[string]bool{"other": true})
+
+			if err := ioutil.WriteFile(wd+"/mnt/dir/file", []byte("rw"), 0644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			if got := readFromFile(t, wd+"/mnt/dir/file"); got != "rw" {
+				t.Errorf("got %q, want %q", got, "rw")
+			}
+			if tc.whiteout != "dir/file" {
+				if _, err := os.Lstat(wd + "/rw/" + tc.whiteout); err == nil {
+					t.Errorf("whiteout was kept")
+				}
+			}
+
+			var st syscall.Stat_t
+			if err := syscall.Lstat(wd+"/mnt/opaque/file", &st); err != syscall.ENOENT {
+				t.Errorf("Lstat in opaque directory: got %v, want ENOENT", err)
+			}
+			checkMapEq(t, dirNames(t, wd+"/mnt/opaque"), map[string]bool{})
+		})
+	}
+}
+
+func TestConvertWhiteouts(t *testing.T) {
+	wd := testutil.TempDir()
+	defer os.RemoveAll(wd)
+	for _, d := range []string{"/rw", "/ro", "/ro/dir"} {
+		if err := os.Mkdir(wd+d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"/ro/dir/file", "/ro/dir/other"} {
+		if err := ioutil.WriteFile(wd+f, []byte("ro"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fses := []pathfs.FileSystem{
+		pathfs.NewLoopbackFileSystem(wd + "/rw"),
+		pathfs.NewLoopbackFileSystem(wd + "/ro"),
+	}
+
+	from, err := NewDeletionsWhiteouts(fses[0], testOpts.DeletionDirName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := from.Delete(NewBranch(fses[0]), "dir/file"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	to := newunionfs.NewAUFSWhiteouts()
+	if err := ConvertWhiteouts(fses, from, to); err != nil {
+		t.Fatalf("ConvertWhiteouts: %v", err)
+	}
+	if _, err := os.Lstat(wd + "/rw/dir/.wh.file"); err != nil {
+		t.Errorf("whiteout: %v", err)
+	}
+	if _, err := os.Lstat(wd + "/rw/" + testOpts.DeletionDirName); err == nil {
+		t.Errorf("%s was kept", testOpts.DeletionDirName)
+	}
+
+	opts := testOpts
+	opts.Whiteouts = to
+	ufs, err := NewUnionFs(fses, opts)
+	if err != nil {
+		t.Fatalf("NewUnionFs: %v", err)
+	}
+	if _, code := ufs.GetAttr("dir/file", nil); code != fuse.ENOENT {
+		t.Errorf("GetAttr(dir/file): got %v, want ENOENT", code)
+	}
+	if _, code := ufs.GetAttr("dir/other", nil); !code.Ok() {
+		t.Errorf("GetAttr(dir/other): %v", code)
+	}
+}